@@ -0,0 +1,59 @@
+package gitreposerver
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLog writes a line in the Combined Log Format for each request
+// to the configured AccessLog.
+func (h *httpHandler) accessLog(next http.Handler) http.Handler {
+	w := h.cfg.AccessLog
+	if w == nil {
+		return next
+	}
+	var mu sync.Mutex
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		host := "-"
+		if ip := clientIP(r, h.cfg.TrustedProxies); ip != nil {
+			host = ip.String()
+		}
+		user := requestInfoFromContext(r.Context()).identity
+		if user == "" {
+			user = "-"
+		}
+		size := "-"
+		if rec.bytes > 0 {
+			size = strconv.FormatInt(rec.bytes, 10)
+		}
+		line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+			host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			logQuote(r.Method+" "+r.RequestURI+" "+r.Proto),
+			rec.status, size,
+			logQuote(r.Referer()), logQuote(r.UserAgent()),
+		)
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := w.Write([]byte(line)); err != nil {
+			h.logger(r.Context()).Warn("write access log", "err", err)
+		}
+	})
+}
+
+// logQuote quotes s for an access log, "-" if it's empty.
+func logQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,158 @@
+package gitreposerver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Activity records when each repository was last fetched from and pushed to,
+// for the /repos listing and info.json.
+// One Activity can be shared by the http, ssh and git daemon servers
+// so they show what happened over every transport.
+type Activity struct {
+	file   string
+	maxAge time.Duration
+
+	mu    sync.Mutex
+	repos map[string]RepoActivity
+	dirty bool
+}
+
+// RepoActivity is when a repository was last fetched from and pushed to,
+// zero if it hasn't been.
+type RepoActivity struct {
+	LastFetch time.Time `json:"last_fetch,omitempty"`
+	LastPush  time.Time `json:"last_push,omitempty"`
+}
+
+// times returns the fetch and push times to show, nil if they're zero.
+func (r RepoActivity) times() (fetch, push *time.Time) {
+	if !r.LastFetch.IsZero() {
+		fetch = &r.LastFetch
+	}
+	if !r.LastPush.IsZero() {
+		push = &r.LastPush
+	}
+	return fetch, push
+}
+
+func (r RepoActivity) last() time.Time {
+	if r.LastPush.After(r.LastFetch) {
+		return r.LastPush
+	}
+	return r.LastFetch
+}
+
+// NewActivity returns an Activity that's kept in file, if it's set,
+// starting with what the file already holds.
+// Repositories not used for maxAge are forgotten, 0 keeps them forever.
+func NewActivity(file string, maxAge time.Duration) (*Activity, error) {
+	a := &Activity{file: file, maxAge: maxAge, repos: make(map[string]RepoActivity)}
+	if file == "" {
+		return a, nil
+	}
+	b, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return a, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read activity file: %w", err)
+	}
+	if err := json.Unmarshal(b, &a.repos); err != nil {
+		return nil, fmt.Errorf("parse activity file: %w", err)
+	}
+	return a, nil
+}
+
+// record notes the fetch or push a request completed, if it succeeded.
+func (a *Activity) record(info *requestInfo) {
+	if a == nil || info.event == nil || info.failure != "" || info.repo == "" {
+		return
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := a.repos[info.repo]
+	if info.event.Service == "receive-pack" {
+		r.LastPush = now
+	} else {
+		r.LastFetch = now
+	}
+	a.repos[info.repo] = r
+	a.dirty = true
+}
+
+// get returns the activity of repo.
+func (a *Activity) get(repo string) RepoActivity {
+	if a == nil {
+		return RepoActivity{}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r := a.repos[repo]
+	if a.expired(r, time.Now()) {
+		return RepoActivity{}
+	}
+	return r
+}
+
+func (a *Activity) expired(r RepoActivity, now time.Time) bool {
+	return a.maxAge > 0 && now.Sub(r.last()) > a.maxAge
+}
+
+// Save writes the activity to its file if it changed since the last Save,
+// forgetting repositories not used for its maxAge.
+func (a *Activity) Save() error {
+	if a == nil || a.file == "" {
+		return nil
+	}
+	a.mu.Lock()
+	now := time.Now()
+	for repo, r := range a.repos {
+		if a.expired(r, now) {
+			delete(a.repos, repo)
+			a.dirty = true
+		}
+	}
+	if !a.dirty {
+		a.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(a.repos)
+	a.dirty = false
+	a.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(a.file, b)
+	}
+	if err != nil {
+		// try again on the next Save
+		a.mu.Lock()
+		a.dirty = true
+		a.mu.Unlock()
+		return fmt.Errorf("save activity: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces name with b in a single rename,
+// so a crash doesn't leave half a file.
+func writeFileAtomic(name string, b []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,44 @@
+package gitreposerver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// aliasKey normalizes a repository name for looking up its alias,
+// so old, old.git and /old/ name the same repository.
+func aliasKey(name string) string {
+	return strings.TrimSuffix(strings.Trim(name, "/"), ".git")
+}
+
+// newAliases returns aliases keyed by aliasKey.
+func newAliases(aliases map[string]string) map[string]string {
+	m := make(map[string]string, len(aliases))
+	for from, to := range aliases {
+		m[aliasKey(from)] = strings.Trim(to, "/")
+	}
+	return m
+}
+
+// checkAliases rejects aliases that aren't valid repository names,
+// so an alias can't reach outside the base directory either.
+func checkAliases(aliases map[string]string) error {
+	for from, to := range aliases {
+		if aliasKey(from) == "" || checkRepoName(strings.Trim(from, "/")) != nil {
+			return fmt.Errorf("config: invalid alias %q", from)
+		}
+		if strings.Trim(to, "/") == "" || checkRepoName(strings.Trim(to, "/")) != nil {
+			return fmt.Errorf("config: invalid alias target %q for %q", to, from)
+		}
+	}
+	return nil
+}
+
+// resolveAlias returns the new name if name is an alias, otherwise name.
+// The new name isn't looked up as an alias again.
+func (h *httpHandler) resolveAlias(name string) string {
+	if to, ok := h.aliases[aliasKey(name)]; ok {
+		return to
+	}
+	return name
+}
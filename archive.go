@@ -0,0 +1,286 @@
+package gitreposerver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// archiveFormats maps archive name suffixes to their content types.
+var archiveFormats = []struct {
+	ext         string
+	contentType string
+}{
+	{".tar.gz", "application/gzip"},
+	{".tgz", "application/gzip"},
+	{".tar", "application/x-tar"},
+	{".zip", "application/zip"},
+}
+
+// archive serves /{repo}/archive/{rev}.{tar.gz,tgz,tar,zip},
+// a snapshot of the tree at rev like git archive.
+// Entries are under a {repo}-{rev}/ directory.
+func (h *httpHandler) archive(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repo := RepoFromContext(r.Context())
+	arg := routeArgFromContext(r.Context())
+	var rev, ext, contentType string
+	for _, f := range archiveFormats {
+		if strings.HasSuffix(arg, f.ext) {
+			rev, ext, contentType = strings.TrimSuffix(arg, f.ext), f.ext, f.contentType
+			break
+		}
+	}
+	if ext == "" {
+		http.Error(rw, "unsupported archive format, use .tar.gz, .tgz, .tar or .zip", http.StatusNotFound)
+		return
+	}
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	hash, err := resolveRevision(sto, h.hiddenRefs(r.Context(), repo), rev)
+	if err != nil {
+		h.httpError(rw, r, err)
+		return
+	}
+	tree, mtime, err := archiveTree(sto, hash)
+	if err != nil {
+		h.httpError(rw, r, err)
+		return
+	}
+
+	// the archive only depends on the object, not on which ref named it
+	etag := fmt.Sprintf(`"%s%s"`, hash, ext)
+	rw.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	prefix := archivePrefix(repo, rev)
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", prefix+ext))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	switch ext {
+	case ".zip":
+		err = writeZip(rw, sto, tree, prefix+"/", mtime, hash)
+	case ".tar":
+		err = writeTar(rw, sto, tree, prefix+"/", mtime, hash)
+	default:
+		var gz *gzip.Writer
+		gz, err = gzip.NewWriterLevel(rw, h.cfg.compressionLevel())
+		if err == nil {
+			err = writeTar(gz, sto, tree, prefix+"/", mtime, hash)
+			if cerr := gz.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		// the response has started, the client sees a truncated archive
+		h.logger(r.Context()).Warn("write archive", "repo", repo, "rev", rev, "err", err)
+		requestInfoFromContext(r.Context()).err = err
+	}
+}
+
+// archiveTree returns the tree for h, a commit, tag or tree,
+// and the modification time to give its entries:
+// the commit time, or now for a bare tree like git archive.
+func archiveTree(sto storer.EncodedObjectStorer, h plumbing.Hash) (*object.Tree, time.Time, error) {
+	commit, err := peelCommit(sto, h)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if commit != nil {
+		tree, err := commit.Tree()
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("get tree of %s: %w", commit.Hash, err)
+		}
+		return tree, commit.Committer.When, nil
+	}
+	tree, err := object.GetTree(sto, h)
+	if errors.Is(err, plumbing.ErrObjectNotFound) || errors.Is(err, plumbing.ErrInvalidType) {
+		return nil, time.Time{}, errRefNotFound
+	} else if err != nil {
+		return nil, time.Time{}, fmt.Errorf("get tree %s: %w", h, err)
+	}
+	return tree, time.Now(), nil
+}
+
+// archivePrefix returns the directory archive entries are in,
+// such as project-v1.0 for the v1.0 archive of project.git.
+func archivePrefix(repo, rev string) string {
+	name := strings.TrimSuffix(repo, "/.git")
+	name = strings.TrimSuffix(path.Base(name), ".git")
+	if name == "." || name == "/" || name == "" {
+		name = "archive"
+	}
+	return name + "-" + strings.ReplaceAll(rev, "/", "-")
+}
+
+// walkArchive calls fn with each entry of tree and its path,
+// reading the blob of each file.
+// Entries whose path fails checkTreePath, which git wouldn't have let
+// into a tree, are left out so they can't escape the archive's directory
+// when it's extracted.
+func walkArchive(sto storer.EncodedObjectStorer, tree *object.Tree, fn func(name string, e object.TreeEntry, blob *object.Blob) error) error {
+	w := object.NewTreeWalker(tree, true, nil)
+	defer w.Close()
+	for {
+		name, e, err := w.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("walk tree: %w", err)
+		}
+		if checkTreePath(name) != nil {
+			continue
+		}
+		var blob *object.Blob
+		switch e.Mode {
+		case filemode.Dir, filemode.Submodule:
+		default:
+			blob, err = object.GetBlob(sto, e.Hash)
+			if err != nil {
+				return fmt.Errorf("get blob %s for %s: %w", e.Hash, name, err)
+			}
+		}
+		if err := fn(name, e, blob); err != nil {
+			return err
+		}
+	}
+}
+
+// writeTar writes tree as a tar, with h in a pax comment like git archive.
+func writeTar(w io.Writer, sto storer.EncodedObjectStorer, tree *object.Tree, prefix string, mtime time.Time, h plumbing.Hash) error {
+	tw := tar.NewWriter(w)
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"comment": h.String()},
+	})
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: prefix, Mode: 0o775, ModTime: mtime})
+	if err != nil {
+		return err
+	}
+	err = walkArchive(sto, tree, func(name string, e object.TreeEntry, blob *object.Blob) error {
+		hdr := &tar.Header{Name: prefix + name, ModTime: mtime}
+		switch e.Mode {
+		case filemode.Dir, filemode.Submodule:
+			// submodules are empty dirs, as in a fresh clone
+			hdr.Typeflag, hdr.Name, hdr.Mode = tar.TypeDir, hdr.Name+"/", 0o775
+			return tw.WriteHeader(hdr)
+		case filemode.Symlink:
+			target, err := readBlob(blob)
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag, hdr.Linkname, hdr.Mode = tar.TypeSymlink, target, 0o777
+			return tw.WriteHeader(hdr)
+		case filemode.Executable:
+			hdr.Mode = 0o775
+		default:
+			hdr.Mode = 0o664
+		}
+		hdr.Typeflag, hdr.Size = tar.TypeReg, blob.Size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		return copyBlob(tw, blob)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeZip writes tree as a zip, with h as its comment like git archive.
+func writeZip(w io.Writer, sto storer.EncodedObjectStorer, tree *object.Tree, prefix string, mtime time.Time, h plumbing.Hash) error {
+	zw := zip.NewWriter(w)
+	if err := zw.SetComment(h.String()); err != nil {
+		return err
+	}
+	dir := &zip.FileHeader{Name: prefix, Modified: mtime}
+	dir.SetMode(os.ModeDir | 0o775)
+	if _, err := zw.CreateHeader(dir); err != nil {
+		return err
+	}
+	err := walkArchive(sto, tree, func(name string, e object.TreeEntry, blob *object.Blob) error {
+		hdr := &zip.FileHeader{Name: prefix + name, Modified: mtime, Method: zip.Deflate}
+		switch e.Mode {
+		case filemode.Dir, filemode.Submodule:
+			hdr.Name, hdr.Method = hdr.Name+"/", zip.Store
+			hdr.SetMode(os.ModeDir | 0o775)
+			_, err := zw.CreateHeader(hdr)
+			return err
+		case filemode.Symlink:
+			hdr.SetMode(os.ModeSymlink | 0o777)
+		case filemode.Executable:
+			hdr.SetMode(0o775)
+		default:
+			hdr.SetMode(0o664)
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		return copyBlob(fw, blob)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func copyBlob(w io.Writer, blob *object.Blob) error {
+	r, err := blob.Reader()
+	if err != nil {
+		return fmt.Errorf("read blob %s: %w", blob.Hash, err)
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("read blob %s: %w", blob.Hash, err)
+	}
+	return nil
+}
+
+func readBlob(blob *object.Blob) (string, error) {
+	var b strings.Builder
+	if err := copyBlob(&b, blob); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
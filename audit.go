@@ -0,0 +1,119 @@
+package gitreposerver
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// auditRecord is a line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Identity  string    `json:"identity,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	Transport string    `json:"transport"`
+	Repo      string    `json:"repo,omitempty"`
+	// Operation is fetch or push,
+	// empty for failed ssh authentications, which precede the command.
+	Operation string `json:"operation,omitempty"`
+	// Refs are the refs a push changed.
+	Refs []RefUpdate `json:"refs,omitempty"`
+	// Signer is who signed the push certificate of a signed push,
+	// set only if the signature was verified.
+	Signer string `json:"signer,omitempty"`
+	// Outcome is ok, rejected for pushes that changed no refs,
+	// or the kind of failure as in RequestStats.Error.
+	Outcome string `json:"outcome"`
+}
+
+// auditLog writes JSON records of authenticated operations.
+// A nil auditLog records nothing.
+type auditLog struct {
+	w   io.Writer
+	log Logger
+}
+
+func newAuditLog(w io.Writer, log Logger) *auditLog {
+	if w == nil {
+		return nil
+	}
+	return &auditLog{w: w, log: log}
+}
+
+// record writes rec, timestamping it now.
+func (a *auditLog) record(rec auditRecord) {
+	if a == nil {
+		return
+	}
+	rec.Time = time.Now()
+	b, err := json.Marshal(rec)
+	if err != nil {
+		a.log.Error("encode audit record", "err", err)
+		return
+	}
+	if _, err := a.w.Write(append(b, '\n')); err != nil {
+		a.log.Error("write audit log", "err", err)
+	}
+}
+
+// operation records a finished fetch or push by an authenticated client,
+// failure is empty if it succeeded.
+// Successful reads that only listed refs, such as protocol v2 ls-refs
+// requests before a fetch, aren't recorded.
+func (a *auditLog) operation(info *requestInfo, transport, client string, write bool, failure string) {
+	if a == nil || info.identity == "" || (!write && info.event == nil && failure == "") {
+		return
+	}
+	rec := auditRecord{
+		Identity:  info.identity,
+		ClientIP:  client,
+		Transport: transport,
+		Repo:      info.repo,
+		Operation: auditOperation(write),
+		Signer:    info.signer,
+		Outcome:   failure,
+	}
+	if info.event != nil {
+		rec.Refs = info.event.Updates
+	}
+	switch {
+	case rec.Outcome != "":
+	case write && len(rec.Refs) == 0:
+		rec.Outcome = "rejected"
+	default:
+		rec.Outcome = "ok"
+	}
+	a.record(rec)
+}
+
+// authFailed records a rejected authentication attempt.
+func (a *auditLog) authFailed(identity, transport, client, repo, operation string) {
+	a.record(auditRecord{
+		Identity:  identity,
+		ClientIP:  client,
+		Transport: transport,
+		Repo:      repo,
+		Operation: operation,
+		Outcome:   "unauthorized",
+	})
+}
+
+func auditOperation(write bool) string {
+	if write {
+		return "push"
+	}
+	return "fetch"
+}
+
+// lockedWriter serializes writes to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
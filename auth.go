@@ -0,0 +1,334 @@
+package gitreposerver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// Authenticator checks the credentials presented for a repository.
+type Authenticator interface {
+	// Authenticate reports whether user may access repo with pass,
+	// write is set for pushes.
+	Authenticate(user, pass, repo string, write bool) (bool, error)
+}
+
+// TokenValidator checks bearer tokens presented for a repository.
+type TokenValidator interface {
+	// ValidateToken returns the identity token belongs to
+	// if it may access repo, write is set for pushes.
+	ValidateToken(token, repo string, write bool) (identity string, ok bool)
+}
+
+// Operation is an access to a repository.
+type Operation int
+
+const (
+	// OpRead is a fetch, or reading the repository through the other endpoints.
+	OpRead Operation = iota
+	// OpWrite is a push, including one creating the repository.
+	OpWrite
+)
+
+func (op Operation) String() string {
+	if op == OpWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// service returns the git service performing op.
+func (op Operation) service() string {
+	if op == OpWrite {
+		return "git-receive-pack"
+	}
+	return "git-upload-pack"
+}
+
+// Authorizer decides whether a client may access a repository,
+// once its identity is known.
+// It's called for every transport, after authentication.
+type Authorizer interface {
+	// Authorize reports whether identity may perform op on repo,
+	// identity is empty for anonymous clients.
+	Authorize(identity, repo string, op Operation) (bool, error)
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the authenticated identity for a request,
+// or an empty string for anonymous requests.
+func IdentityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// authEnabled reports whether any authentication method is configured.
+func (c Config) authEnabled() bool {
+	return c.Auth != nil || c.Tokens != nil || c.ClientCAs != nil
+}
+
+// checkAuth authenticates r by its verified client certificate
+// or against the configured Auth or Tokens,
+// returning r with the authenticated identity in its context.
+// On failure, it sends an auth challenge and returns false.
+func (h *httpHandler) checkAuth(rw http.ResponseWriter, r *http.Request, repo string, write bool) (*http.Request, bool) {
+	cfg := h.cfg
+	if cfg.ClientCAs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		identity := certIdentity(r.TLS.VerifiedChains[0][0])
+		return r.WithContext(withIdentity(r.Context(), identity)), true
+	}
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	switch {
+	case strings.EqualFold(scheme, "Bearer") && cfg.Tokens != nil:
+		token = strings.TrimSpace(token)
+		if token != "" {
+			identity, ok := cfg.Tokens.ValidateToken(token, repo, write)
+			if ok {
+				return r.WithContext(withIdentity(r.Context(), identity)), true
+			}
+		}
+		h.logger(r.Context()).Info("token authentication failed", "repo", repo)
+		h.auditAuthFailed(r, "", repo, write)
+
+	case cfg.Auth != nil:
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			break
+		}
+		ok, err := cfg.Auth.Authenticate(user, pass, repo, write)
+		if err != nil {
+			h.logger(r.Context()).Error("authenticate", "user", user, "repo", repo, "err", err)
+			h.httpError(rw, r, err)
+			return r, false
+		}
+		if ok {
+			return r.WithContext(withIdentity(r.Context(), user)), true
+		}
+		h.logger(r.Context()).Info("authentication failed", "user", user, "repo", repo)
+		h.auditAuthFailed(r, user, repo, write)
+	}
+
+	realm := cfg.AuthRealm
+	if realm == "" {
+		realm = "gitreposerver"
+	}
+	if cfg.Auth != nil {
+		rw.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	}
+	if cfg.Tokens != nil {
+		rw.Header().Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", realm))
+	}
+	http.Error(rw, "authentication required", http.StatusUnauthorized)
+	return r, false
+}
+
+// auditAuthFailed records a rejected http authentication attempt,
+// repo is empty for the repository listing.
+func (h *httpHandler) auditAuthFailed(r *http.Request, user, repo string, write bool) {
+	var client, op string
+	if ip := clientIP(r, h.cfg.TrustedProxies); ip != nil {
+		client = ip.String()
+	}
+	if repo != "" {
+		op = auditOperation(write)
+	}
+	h.audit.authFailed(user, "http", client, repo, op)
+}
+
+// authorize checks identity may perform op on repo with the Authorizer,
+// returning errRepoNotFound or transport.ErrAuthorizationFailed if not.
+func (h *httpHandler) authorize(ctx context.Context, identity, repo string, op Operation) error {
+	ok, err := h.allowed(identity, repo, op)
+	if err != nil || ok {
+		return err
+	}
+	h.logger(ctx).Info("access denied", "identity", identity, "repo", repo, "op", op)
+	if h.cfg.HideUnauthorized {
+		return errRepoNotFound
+	}
+	return transport.ErrAuthorizationFailed
+}
+
+// allowed reports whether the Authorizer lets identity perform op on repo.
+func (h *httpHandler) allowed(identity, repo string, op Operation) (bool, error) {
+	if h.cfg.Authorizer == nil {
+		return true, nil
+	}
+	ok, err := h.cfg.Authorizer.Authorize(identity, repo, op)
+	if err != nil {
+		return false, fmt.Errorf("authorize: %w", err)
+	}
+	return ok, nil
+}
+
+// userFile authenticates against bcrypt hashed passwords,
+// as produced by `htpasswd -nbB user pass`.
+// Every user has access to every repository.
+type userFile struct {
+	hashes map[string][]byte
+	// dummy is compared against for unknown users, with the cost of the file's hashes,
+	// so they take as long to refuse as a wrong password and don't reveal who exists.
+	dummy []byte
+}
+
+// readUserFile reads a file of "user:hash" lines.
+func readUserFile(name string) (userFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return userFile{}, fmt.Errorf("open user file: %w", err)
+	}
+	defer f.Close()
+
+	users := userFile{hashes: make(map[string][]byte)}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return userFile{}, fmt.Errorf("parse user file: malformed line %q", line)
+		}
+		users.hashes[user] = []byte(hash)
+	}
+	if err := sc.Err(); err != nil {
+		return userFile{}, fmt.Errorf("read user file: %w", err)
+	}
+	cost := bcrypt.DefaultCost
+	for _, hash := range users.hashes {
+		if c, err := bcrypt.Cost(hash); err == nil {
+			cost = c
+			break
+		}
+	}
+	users.dummy, err = bcrypt.GenerateFromPassword([]byte("not a password"), cost)
+	if err != nil {
+		return userFile{}, fmt.Errorf("generate dummy hash: %w", err)
+	}
+	return users, nil
+}
+
+func (u userFile) Authenticate(user, pass, repo string, write bool) (bool, error) {
+	hash, ok := u.hashes[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(u.dummy, []byte(pass))
+		return false, nil
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(pass)) == nil, nil
+}
+
+type fileToken struct {
+	identity string
+	expires  time.Time
+}
+
+// tokenFile validates bearer tokens, keyed by their sha256 digest.
+// Every token has access to every repository.
+type tokenFile map[[sha256.Size]byte]fileToken
+
+// readTokenFile reads a file of "token identity [expiry]" lines,
+// with an optional RFC 3339 expiry time.
+func readTokenFile(name string) (tokenFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open token file: %w", err)
+	}
+	defer f.Close()
+
+	tokens := make(tokenFile)
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("parse token file: malformed line %d", lineno)
+		}
+		t := fileToken{identity: fields[1]}
+		if len(fields) == 3 {
+			t.expires, err = time.Parse(time.RFC3339, fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("parse token file: expiry for %q: %w", t.identity, err)
+			}
+		}
+		tokens[sha256.Sum256([]byte(fields[0]))] = t
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read token file: %w", err)
+	}
+	return tokens, nil
+}
+
+func (t tokenFile) ValidateToken(token, repo string, write bool) (string, bool) {
+	ft, ok := t[sha256.Sum256([]byte(token))]
+	if !ok {
+		return "", false
+	}
+	if !ft.expires.IsZero() && time.Now().After(ft.expires) {
+		return "", false
+	}
+	return ft.identity, true
+}
+
+// authorizedKeys accepts ssh public keys listed in an authorized_keys file,
+// identifying clients by the key's comment or, without one, its fingerprint.
+// Every key has access to every repository.
+type authorizedKeys map[string]string
+
+// readAuthorizedKeys reads a file in the OpenSSH authorized_keys format,
+// key options are ignored.
+func readAuthorizedKeys(name string) (authorizedKeys, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read authorized keys: %w", err)
+	}
+	keys := make(authorizedKeys)
+	for len(bytes.TrimSpace(b)) > 0 {
+		key, comment, _, rest, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("parse authorized keys: %w", err)
+		}
+		if comment == "" {
+			comment = ssh.FingerprintSHA256(key)
+		}
+		keys[string(key.Marshal())] = comment
+		b = rest
+	}
+	return keys, nil
+}
+
+func (a authorizedKeys) PublicKey(user string, key ssh.PublicKey) (string, bool) {
+	identity, ok := a[string(key.Marshal())]
+	return identity, ok
+}
+
+// LoadHostKey reads a PEM encoded ssh private key.
+func LoadHostKey(name string) (ssh.Signer, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read ssh host key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh host key: %w", err)
+	}
+	return signer, nil
+}
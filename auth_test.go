@@ -0,0 +1,235 @@
+package gitreposerver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeUserFile writes a user file with the passwords of users, keyed by name,
+// hashed at bcrypt's minimum cost to keep tests fast, and loads it.
+func writeUserFile(t *testing.T, users map[string]string) userFile {
+	t.Helper()
+	var b strings.Builder
+	for user, pass := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString(user + ":" + string(hash) + "\n")
+	}
+	name := filepath.Join(t.TempDir(), "users")
+	writeTestFile(t, name, b.String())
+	u, err := readUserFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestUserFile(t *testing.T) {
+	u := writeUserFile(t, map[string]string{"alice": "secret"})
+	tests := []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"bob", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		ok, err := u.Authenticate(tt.user, tt.pass, "repo.git", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("Authenticate(%q, %q) = %v, want %v", tt.user, tt.pass, ok, tt.want)
+		}
+	}
+	// unknown users are checked against a hash as slow as the file's
+	if cost, err := bcrypt.Cost(u.dummy); err != nil || cost != bcrypt.MinCost {
+		t.Errorf("dummy hash cost %d, %v, want %d", cost, err, bcrypt.MinCost)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	users := writeUserFile(t, map[string]string{"alice": "secret"})
+	srv := newTestServer(t, dir, WithAuth(users), WithAuthRealm("test realm"))
+
+	tests := []struct {
+		name       string
+		user, pass string
+		want       int
+	}{
+		{"anonymous", "", "", http.StatusUnauthorized},
+		{"wrong password", "alice", "wrong", http.StatusUnauthorized},
+		{"unknown user", "bob", "secret", http.StatusUnauthorized},
+		{"authenticated", "alice", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/repo.git/info/refs?service=git-upload-pack", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.pass)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", res.StatusCode, tt.want)
+			}
+			if challenge := res.Header.Get("WWW-Authenticate"); tt.want == http.StatusUnauthorized && challenge != `Basic realm="test realm"` {
+				t.Errorf("WWW-Authenticate %q", challenge)
+			}
+		})
+	}
+
+	u, err := url.Parse(srv.URL + "/repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("alice", "secret")
+	runGit(t, t.TempDir(), "clone", "-q", u.String(), "out")
+	u.User = url.UserPassword("alice", "wrong")
+	if _, err := tryGit(t, t.TempDir(), "clone", "-q", u.String(), "out"); err == nil {
+		t.Error("cloned with a wrong password")
+	}
+}
+
+func TestAnonymousRead(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	users := writeUserFile(t, map[string]string{"alice": "secret"})
+	srv := newTestServer(t, dir, WithAuth(users), WithAnonymousRead(true), WithReceivePack(true))
+
+	for service, want := range map[string]int{
+		"git-upload-pack":  http.StatusOK,
+		"git-receive-pack": http.StatusUnauthorized,
+	} {
+		res, err := http.Get(srv.URL + "/repo.git/info/refs?service=" + service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("anonymous %s: status %d, want %d", service, res.StatusCode, want)
+		}
+	}
+
+	work := t.TempDir()
+	runGit(t, work, "clone", "-q", srv.URL+"/repo.git", "out")
+	work = filepath.Join(work, "out")
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "pushed")
+	if _, err := tryGit(t, work, "push", "-q", "origin", "HEAD:refs/heads/anonymous"); err == nil {
+		t.Error("anonymous push accepted")
+	}
+	u, err := url.Parse(srv.URL + "/repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("alice", "secret")
+	runGit(t, work, "push", "-q", u.String(), "HEAD:refs/heads/alice")
+}
+
+// writeTokenFile writes a token file of lines and loads it.
+func writeTokenFile(t *testing.T, lines ...string) tokenFile {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "tokens")
+	writeTestFile(t, name, strings.Join(lines, "\n")+"\n")
+	tokens, err := readTokenFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestTokenAuth(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	tokens := writeTokenFile(t,
+		"# ci tokens",
+		"ci-token ci",
+		"old-token old 2000-01-01T00:00:00Z",
+		"future-token future 2999-01-01T00:00:00Z",
+	)
+	srv := newTestServer(t, dir, WithTokens(tokens))
+
+	tests := []struct {
+		name   string
+		header string
+		repo   string
+		want   int
+	}{
+		{"missing header", "", "repo.git", http.StatusUnauthorized},
+		{"no token", "Bearer", "repo.git", http.StatusUnauthorized},
+		{"empty token", "Bearer ", "repo.git", http.StatusUnauthorized},
+		{"other scheme", "Token ci-token", "repo.git", http.StatusUnauthorized},
+		{"basic", "Basic Y2k6Y2ktdG9rZW4=", "repo.git", http.StatusUnauthorized},
+		{"unknown token", "Bearer nope", "repo.git", http.StatusUnauthorized},
+		{"expired token", "Bearer old-token", "repo.git", http.StatusUnauthorized},
+		{"valid token", "Bearer ci-token", "repo.git", http.StatusOK},
+		{"lower case scheme", "bearer ci-token", "repo.git", http.StatusOK},
+		{"unexpired token", "Bearer future-token", "repo.git", http.StatusOK},
+		// a bad token can't tell which repositories exist
+		{"missing repo", "Bearer nope", "missing.git", http.StatusUnauthorized},
+		{"valid token missing repo", "Bearer ci-token", "missing.git", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/"+tt.repo+"/info/refs?service=git-upload-pack", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Fatalf("status %d, want %d", res.StatusCode, tt.want)
+			}
+			if challenge := res.Header.Get("WWW-Authenticate"); tt.want == http.StatusUnauthorized && challenge != `Bearer realm="gitreposerver"` {
+				t.Errorf("WWW-Authenticate %q", challenge)
+			}
+		})
+	}
+}
+
+// TestTokenIdentity checks the token's identity reaches the request context.
+func TestTokenIdentity(t *testing.T) {
+	h := newTestHandler(t, t.TempDir(), WithTokens(writeTokenFile(t, "ci-token ci")))
+	req := httptest.NewRequest(http.MethodGet, "/repo.git/info/refs", nil)
+	req.Header.Set("Authorization", "Bearer ci-token")
+	rec := httptest.NewRecorder()
+	r, ok := h.checkAuth(rec, req, "repo.git", false)
+	if !ok {
+		t.Fatalf("token refused: %d %s", rec.Code, rec.Body)
+	}
+	if identity := IdentityFromContext(r.Context()); identity != "ci" {
+		t.Errorf("identity %q, want ci", identity)
+	}
+}
+
+func TestLoadTokenFileMalformed(t *testing.T) {
+	for _, line := range []string{"token-only", "token id 2000-01-01T00:00:00Z extra", "token id yesterday"} {
+		name := filepath.Join(t.TempDir(), "tokens")
+		writeTestFile(t, name, line+"\n")
+		if _, err := readTokenFile(name); err == nil {
+			t.Errorf("loaded token file with %q", line)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package gitreposerver
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// BranchRule protects the refs it matches from some pushes.
+// Unlike DenyNonFastForwards and DenyDeletes,
+// it can depend on who's pushing.
+type BranchRule struct {
+	// Pattern is a glob over full ref names, such as refs/heads/main
+	// or refs/heads/release/*, in the syntax of path.Match,
+	// so * doesn't match a /.
+	Pattern string
+	// Pushers are the identities that may update matching refs,
+	// empty for anyone who may push to the repository.
+	Pushers []string
+	// DenyForcePush rejects updates that aren't fast-forwards.
+	DenyForcePush bool
+	// DenyDelete rejects deleting matching refs.
+	DenyDelete bool
+}
+
+func (r BranchRule) matches(name string) bool {
+	ok, _ := path.Match(r.Pattern, name)
+	return ok
+}
+
+func (r BranchRule) allows(identity string) bool {
+	if len(r.Pushers) == 0 {
+		return true
+	}
+	for _, p := range r.Pushers {
+		if p == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBranchRules checks rules are valid for Config.validate.
+func checkBranchRules(rules []BranchRule) error {
+	for _, r := range rules {
+		if !strings.HasPrefix(r.Pattern, "refs/") {
+			return fmt.Errorf("config: branch rule %q is not under refs/", r.Pattern)
+		}
+		if _, err := path.Match(r.Pattern, ""); err != nil {
+			return fmt.Errorf("config: branch rule %q: %w", r.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkRules returns why the branch rules reject cmd, empty if none do.
+// It's called once the pushed objects are known to be there.
+func (req pushRequest) checkRules(cmd *packp.Command) string {
+	name := cmd.Name.String()
+	for _, rule := range req.rules {
+		if !rule.matches(name) {
+			continue
+		}
+		if !rule.allows(req.identity) {
+			who := req.identity
+			if who == "" {
+				who = "anonymous clients"
+			}
+			return fmt.Sprintf("protected by %s, %s may not push", rule.Pattern, who)
+		}
+		switch {
+		case cmd.Action() == packp.Delete && rule.DenyDelete:
+			return fmt.Sprintf("deletion prohibited by %s", rule.Pattern)
+		case cmd.Action() == packp.Update && rule.DenyForcePush:
+			ff, err := isFastForward(req.objects, cmd.Old, cmd.New)
+			if err != nil {
+				return "failed to check fast-forward"
+			}
+			if !ff {
+				return fmt.Sprintf("non-fast-forward prohibited by %s", rule.Pattern)
+			}
+		}
+	}
+	return ""
+}
+
+// LoadBranchRules reads a file of "pattern [option...]" lines,
+// the options being push=identity,... to limit who may push,
+// no-force and no-delete.
+func LoadBranchRules(name string) ([]BranchRule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open branch rules: %w", err)
+	}
+	defer f.Close()
+
+	var rules []BranchRule
+	sc := bufio.NewScanner(f)
+	for lineno := 1; sc.Scan(); lineno++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		rule := BranchRule{Pattern: fields[0]}
+		for _, opt := range fields[1:] {
+			switch {
+			case strings.HasPrefix(opt, "push="):
+				rule.Pushers = append(rule.Pushers, strings.Split(strings.TrimPrefix(opt, "push="), ",")...)
+			case opt == "no-force":
+				rule.DenyForcePush = true
+			case opt == "no-delete":
+				rule.DenyDelete = true
+			default:
+				return nil, fmt.Errorf("parse branch rules: unknown option %q on line %d", opt, lineno)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("read branch rules: %w", err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,126 @@
+package gitreposerver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// refsCache holds encoded ref advertisements per repository and service.
+type refsCache struct {
+	mu      sync.Mutex
+	entries map[string]map[string]*advertisement
+}
+
+type advertisement struct {
+	// fingerprint identifies the state of the refs the body was built from.
+	fingerprint string
+	etag        string
+	body        []byte
+}
+
+func newRefsCache() *refsCache {
+	return &refsCache{
+		entries: make(map[string]map[string]*advertisement),
+	}
+}
+
+// get returns the cached advertisement if it was built from refs
+// matching fingerprint.
+func (c *refsCache) get(repo, service, fingerprint string) (*advertisement, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	adv, ok := c.entries[repo][service]
+	if !ok || adv.fingerprint != fingerprint {
+		return nil, false
+	}
+	return adv, true
+}
+
+func (c *refsCache) put(repo, service, fingerprint string, body []byte) *advertisement {
+	sum := sha256.Sum256(body)
+	adv := &advertisement{
+		fingerprint: fingerprint,
+		etag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+		body:        body,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[repo] == nil {
+		c.entries[repo] = make(map[string]*advertisement)
+	}
+	c.entries[repo][service] = adv
+	return adv
+}
+
+// invalidate drops all advertisements for repo.
+func (c *refsCache) invalidate(repo string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, repo)
+}
+
+// refsFingerprint summarizes the size and mtime of HEAD, packed-refs
+// and every loose ref in the repository at dir in fsys,
+// also returning the newest mtime.
+// The ref directories are included, so deleting a ref moves it forward too,
+// and the config, as it can hide refs and change the default branch.
+func refsFingerprint(fsys billy.Filesystem, dir string) (string, time.Time, error) {
+	h := sha256.New()
+	if fi, err := fsys.Stat(path.Join("/", dir, "config")); err == nil {
+		fmt.Fprintf(h, "config %d %d\n", fi.Size(), fi.ModTime().UnixNano())
+	}
+	var modTime time.Time
+	err := statRefs(fsys, dir, func(name string, fi fs.FileInfo) {
+		fmt.Fprintf(h, "%s %d %d\n", name, fi.Size(), fi.ModTime().UnixNano())
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), modTime, nil
+}
+
+// statRefs calls fn with the HEAD, packed-refs and loose ref files in dir.
+func statRefs(fsys billy.Filesystem, dir string, fn func(name string, fi fs.FileInfo)) error {
+	for _, name := range []string{"HEAD", "packed-refs"} {
+		fi, err := fsys.Stat(path.Join("/", dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		fn(name, fi)
+	}
+
+	err := walkFS(fsys, path.Join("/", dir, "refs"), func(name string, fi fs.FileInfo) error {
+		fn(name, fi)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// etagMatch reports whether an If-None-Match header matches etag.
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
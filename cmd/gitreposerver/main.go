@@ -0,0 +1,417 @@
+// Command gitreposerver serves the git repositories in -git-dir
+// over http, ssh and optionally the git daemon protocol.
+package main
+
+import (
+	"context"
+	"flag"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"go.seankhliao.com/gitreposerver"
+	"golang.org/x/crypto/ssh"
+)
+
+func main() {
+	gitDir := flag.String("git-dir", "", "path to git directory (.git/ or a bare repo), or a directory of bare repos")
+	pathPrefix := flag.String("path-prefix", "", "url path to serve http under, such as /git")
+	repoRoots := flag.String("repo-roots", "", "comma separated directories that symlinked repositories in -git-dir may resolve to")
+	httpAddr := flag.String("http-addr", ":8080", "comma separated http addresses to serve on, each a host:port or unix:/path/to/socket")
+	sshAddr := flag.String("ssh-addr", ":8081", "ssh address to serve on")
+	daemonAddr := flag.String("daemon-addr", "", "git daemon protocol address to serve read only fetches on, disabled if empty")
+	sshHostKey := flag.String("ssh-host-key", "", "ssh host private key file, defaults to a key generated on each start")
+	sshAuthorizedKeys := flag.String("ssh-authorized-keys", "", "authorized_keys file of ssh public keys to accept, defaults to accepting any client for fetches only")
+	receivePack := flag.Bool("receive-pack", false, "enable git-receive-pack (push) over http, and over ssh with -ssh-authorized-keys")
+	readOnly := flag.Bool("read-only", false, "refuse all pushes and never modify repositories, overriding -receive-pack, -auto-init, -upstream fetches and -gc-interval")
+	dumbHTTP := flag.Bool("dumb-http", false, "serve the read only dumb http protocol to clients without smart http")
+	allowAnySHA1 := flag.Bool("allow-any-sha1-in-want", false, "allow protocol v0 fetches of any object, not just ref tips")
+	experimentalSHA256 := flag.Bool("experimental-sha256", false, "serve sha256 repositories, advertising their object format, though go-git can't read them yet")
+	denyNonFF := flag.String("deny-non-fast-forwards", "", "comma separated ref prefixes that pushes can only fast-forward, ! excludes")
+	denyDeletes := flag.String("deny-deletes", "", "comma separated ref prefixes that pushes can't delete, ! excludes")
+	branchRules := flag.String("branch-rules", "", "file of rules limiting who may push to refs and whether they can be force pushed or deleted")
+	aliases := flag.String("aliases", "", "comma separated old=new repository names to serve old as new")
+	redirectAliases := flag.Bool("redirect-aliases", false, "redirect http requests for -aliases instead of serving them")
+	corsOrigins := flag.String("cors-origins", "", "comma separated origins allowed to make browser requests, * allows any")
+	hiddenRefs := flag.String("hidden-refs", "", "comma separated ref prefixes to hide from fetches, ! unhides")
+	settingsFile := flag.String("settings-file", "", "git config file whose gitreposerver section sets hiderefs, quota, defaultbranch, uploadpack and receivepack for every repository, reloaded on SIGHUP")
+	defaultBranch := flag.String("default-branch", "", "branch to advertise as HEAD for repos with a detached or dangling HEAD")
+	maxAdvertisedRefs := flag.Int("max-advertised-refs", 0, "refuse protocol v0 fetches of repos with more refs, 0 is unlimited")
+	truncateRefs := flag.Bool("truncate-advertised-refs", false, "advertise only the first -max-advertised-refs refs instead of refusing the fetch")
+	minProtocol := flag.Int("min-protocol-version", 0, "refuse fetches using an older git protocol version, 2 requires protocol v2")
+	agent := flag.String("agent", gitreposerver.DefaultAgent, "agent advertised to clients")
+	disableCaps := flag.String("disable-capabilities", "", "comma separated capabilities to leave out of protocol v0 ref advertisements")
+	autoInit := flag.Bool("auto-init", false, "create bare repositories on the first push to them, requires -receive-pack")
+	fsckObjects := flag.Bool("fsck-objects", false, "check that pushed objects are well formed")
+	atomicPushes := flag.Bool("atomic-pushes", false, "update all refs of a push or none, even if the client didn't ask for an atomic push")
+	pushCertKeys := flag.String("push-cert-keys", "", "comma separated files of armored OpenPGP or authorized_keys ssh public keys trusted to sign pushes")
+	requireSignedPush := flag.Bool("require-signed-push", false, "reject pushes without a push certificate signed by one of -push-cert-keys")
+	hooksDir := flag.String("hooks-dir", "", "dir of hooks run for pushes to all repositories, defaults to each repository's hooks dir")
+	hookTimeout := flag.Duration("hook-timeout", gitreposerver.DefaultHookTimeout, "time allowed for each hook run")
+	authFile := flag.String("auth-file", "", "file of user:bcrypt-hash lines to authenticate http requests against")
+	tokenFile := flag.String("token-file", "", "file of token identity [expiry] lines to authenticate http bearer tokens against")
+	authRealm := flag.String("auth-realm", "gitreposerver", "realm for http basic auth challenges")
+	anonymousRead := flag.Bool("anonymous-read", false, "only require http authentication for pushes")
+	drainTimeout := flag.Duration("drain-timeout", gitreposerver.DefaultDrainTimeout, "time to wait for in-flight http requests on shutdown")
+	socketMode := flag.String("socket-mode", "0660", "file mode of the unix socket for a unix: -http-addr")
+	readHeaderTimeout := flag.Duration("read-header-timeout", gitreposerver.DefaultReadHeaderTimeout, "time allowed to read http request headers")
+	readTimeout := flag.Duration("read-timeout", gitreposerver.DefaultReadTimeout, "time allowed to read an http request, including a pushed pack")
+	idleTimeout := flag.Duration("idle-timeout", gitreposerver.DefaultIdleTimeout, "time to keep idle http connections open")
+	maxOperationDuration := flag.Duration("max-operation-duration", 0, "hard cap on the time of a single fetch or push over any transport, 0 for unlimited")
+	uploadTimeout := flag.Duration("upload-timeout", gitreposerver.DefaultUploadTimeout, "time allowed to serve a single fetch")
+	maxUploads := flag.Int("max-concurrent-uploads", 0, "maximum simultaneous http fetches, 0 for unlimited")
+	maxReceives := flag.Int("max-concurrent-receives", 0, "maximum simultaneous http pushes, 0 for unlimited")
+	concurrencyWait := flag.Duration("concurrency-wait", 0, "time a request over the concurrency limit waits for a slot")
+	rateLimit := flag.Float64("rate-limit", 0, "http requests per second allowed from each client ip, 0 for unlimited")
+	rateBurst := flag.Int("rate-burst", 0, "burst size for -rate-limit, defaults to the rate")
+	rateLimitExempt := flag.String("rate-limit-exempt", "", "comma separated cidrs exempt from -rate-limit")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated cidrs of proxies trusted to set X-Forwarded-For")
+	maxPackBytes := flag.Int64("max-pack-bytes", 0, "maximum size of a pushed pack, 0 for unlimited")
+	repoQuota := flag.Int64("repo-quota-bytes", 0, "maximum size of a repository's objects after a push, 0 for unlimited")
+	maxRequestBytes := flag.Int64("max-request-bytes", gitreposerver.DefaultMaxRequestBytes, "maximum size of http upload-pack requests")
+	maxHaves := flag.Int("max-haves", 0, "maximum have lines in a fetch, 0 for unlimited")
+	maxWants := flag.Int("max-wants", 0, "maximum distinct objects a fetch can want, 0 for unlimited")
+	maxHeaderBytes := flag.Int("max-header-bytes", gitreposerver.DefaultMaxHeaderBytes, "maximum size of http request headers")
+	tlsCert := flag.String("tls-cert", "", "tls certificate chain file, enables https")
+	tlsKey := flag.String("tls-key", "", "tls private key file")
+	acmeHosts := flag.String("acme-hosts", "", "comma separated hosts to get Let's Encrypt certificates for when -tls-cert isn't set, enables https")
+	acmeCacheDir := flag.String("acme-cache-dir", "", "directory to keep Let's Encrypt certificates in, required with -acme-hosts")
+	acmeHTTPAddr := flag.String("acme-http-addr", ":80", "address to serve Let's Encrypt HTTP-01 challenges on with -acme-hosts")
+	httpRedirectAddr := flag.String("http-redirect-addr", "", "address to redirect plain http requests to https from, such as :80")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum tls version")
+	tlsClientCA := flag.String("tls-client-ca", "", "file of CA certificates to verify client certificates against, enables mutual tls")
+	tlsClientCAOptional := flag.Bool("tls-client-ca-optional", false, "accept clients without a certificate with -tls-client-ca")
+	tlsDisableHTTP2 := flag.Bool("tls-disable-http2", false, "serve https over HTTP/1.1 only")
+	tlsCipherSuites := flag.String("tls-cipher-suites", "", "comma separated tls cipher suites, defaults to the crypto/tls defaults")
+	compress := flag.Bool("compress", false, "gzip http ref advertisements for clients that accept it")
+	compressionLevel := flag.Int("compression-level", 0, "gzip level for -compress, 1 (fastest) to 9 (best), -2 for huffman only, 0 for the default")
+	verboseErrors := flag.Bool("verbose-errors", false, "send server error details to http clients, for debugging")
+	accessLog := flag.String("access-log", "", "file to append a combined format access log of http requests to, - for stdout")
+	auditLog := flag.String("audit-log", "", "file to append a JSON audit log of authenticated fetches and pushes to, - for stdout")
+	webhookURL := flag.String("webhook-url", "", "url to POST a JSON event to after each successful fetch and push")
+	upstream := flag.String("upstream", "", "url prefix to mirror every repository from, such as https://github.com/, read only")
+	upstreamInterval := flag.Duration("upstream-interval", gitreposerver.DefaultUpstreamInterval, "time a mirror is served before fetching its upstream again")
+	upstreamTimeout := flag.Duration("upstream-timeout", gitreposerver.DefaultUpstreamTimeout, "time allowed for each fetch from -upstream")
+	activityFile := flag.String("activity-file", "", "file to keep when repositories were last fetched and pushed in across restarts")
+	activityMaxAge := flag.Duration("activity-max-age", 0, "time after which repositories not fetched or pushed are forgotten, 0 keeps them")
+	gcInterval := flag.Duration("gc-interval", 0, "time between git gc runs on every repository, 0 disables")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	traceWire := flag.Bool("trace-wire", false, "log the wants, haves and capabilities of each fetch")
+	flag.Parse()
+
+	level, err := gitreposerver.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger := gitreposerver.NewStdLogger(log.Default(), level)
+
+	opts := []gitreposerver.Option{
+		gitreposerver.WithLogger(logger),
+		gitreposerver.WithPathPrefix(*pathPrefix),
+		gitreposerver.WithReceivePack(*receivePack),
+		gitreposerver.WithReadOnly(*readOnly),
+		gitreposerver.WithAutoInit(*autoInit),
+		gitreposerver.WithFsckObjects(*fsckObjects),
+		gitreposerver.WithAtomicPushes(*atomicPushes),
+		gitreposerver.WithHooks(*hooksDir, *hookTimeout),
+		gitreposerver.WithDefaultBranch(*defaultBranch),
+		gitreposerver.WithAgentString(*agent),
+		gitreposerver.WithMaxAdvertisedRefs(*maxAdvertisedRefs, *truncateRefs),
+		gitreposerver.WithMinProtocolVersion(*minProtocol),
+		gitreposerver.WithTraceWire(*traceWire),
+		gitreposerver.WithAllowAnySHA1InWant(*allowAnySHA1),
+		gitreposerver.WithExperimentalSHA256(*experimentalSHA256),
+		gitreposerver.WithDumbHTTP(*dumbHTTP),
+		gitreposerver.WithAuthRealm(*authRealm),
+		gitreposerver.WithAnonymousRead(*anonymousRead),
+		gitreposerver.WithDrainTimeout(*drainTimeout),
+		gitreposerver.WithTimeouts(*readHeaderTimeout, *idleTimeout, *uploadTimeout),
+		gitreposerver.WithReadTimeout(*readTimeout),
+		gitreposerver.WithMaxOperationDuration(*maxOperationDuration),
+		gitreposerver.WithConcurrencyLimits(*maxUploads, *maxReceives, *concurrencyWait),
+		gitreposerver.WithMaxRequestBytes(*maxRequestBytes),
+		gitreposerver.WithMaxHeaderBytes(*maxHeaderBytes),
+		gitreposerver.WithMaxHaves(*maxHaves),
+		gitreposerver.WithMaxWants(*maxWants),
+		gitreposerver.WithMaxPackBytes(*maxPackBytes),
+		gitreposerver.WithRepoQuota(*repoQuota),
+		gitreposerver.WithVerboseErrors(*verboseErrors),
+	}
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		log.Fatalln("invalid -socket-mode:", err)
+	}
+	opts = append(opts, gitreposerver.WithSocketMode(fs.FileMode(mode)))
+	if *hiddenRefs != "" {
+		opts = append(opts, gitreposerver.WithHiddenRefs(strings.Split(*hiddenRefs, ",")...))
+	}
+	if *repoRoots != "" {
+		opts = append(opts, gitreposerver.WithRepoRoots(strings.Split(*repoRoots, ",")...))
+	}
+	if *aliases != "" {
+		m := make(map[string]string)
+		for _, kv := range strings.Split(*aliases, ",") {
+			from, to, ok := strings.Cut(kv, "=")
+			if !ok {
+				log.Fatalf("invalid -aliases entry %q, want old=new", kv)
+			}
+			m[from] = to
+		}
+		opts = append(opts, gitreposerver.WithAliases(m, *redirectAliases))
+	}
+	if *disableCaps != "" {
+		disabled := strings.Split(*disableCaps, ",")
+		opts = append(opts, gitreposerver.WithAdvertiseCapabilities(func(service string, caps *capability.List) {
+			for _, c := range disabled {
+				caps.Delete(capability.Capability(c))
+			}
+		}))
+	}
+	// files loaded again on SIGHUP
+	var reloads []reloadFile
+	if *pushCertKeys != "" {
+		keys, err := gitreposerver.LoadPushCertKeys(strings.Split(*pushCertKeys, ",")...)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, gitreposerver.WithSignedPushes(keys, *requireSignedPush))
+		reloads = append(reloads, reloadFile{"push-cert-keys", keys})
+	} else if *requireSignedPush {
+		log.Fatalln("-require-signed-push requires -push-cert-keys")
+	}
+	if *corsOrigins != "" {
+		opts = append(opts, gitreposerver.WithCORSOrigins(strings.Split(*corsOrigins, ",")...))
+	}
+	if *denyNonFF != "" {
+		opts = append(opts, gitreposerver.WithDenyNonFastForwards(strings.Split(*denyNonFF, ",")...))
+	}
+	if *denyDeletes != "" {
+		opts = append(opts, gitreposerver.WithDenyDeletes(strings.Split(*denyDeletes, ",")...))
+	}
+	if *branchRules != "" {
+		rules, err := gitreposerver.LoadBranchRules(*branchRules)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, gitreposerver.WithBranchRules(rules...))
+	}
+	proxies, err := gitreposerver.ParseCIDRs(*trustedProxies)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	opts = append(opts, gitreposerver.WithTrustedProxies(proxies))
+	if *rateLimit > 0 {
+		exempt, err := gitreposerver.ParseCIDRs(*rateLimitExempt)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts,
+			gitreposerver.WithRateLimit(*rateLimit, *rateBurst),
+			gitreposerver.WithRateLimitExempt(exempt),
+		)
+	}
+	if *compress {
+		// the level is checked by Validate with the rest of the config
+		opts = append(opts, gitreposerver.WithCompression(*compressionLevel))
+	}
+	if *acmeHosts != "" {
+		opts = append(opts, gitreposerver.WithACME(*acmeCacheDir, strings.Split(*acmeHosts, ",")...), gitreposerver.WithACMEHTTPAddr(*acmeHTTPAddr))
+	} else if *acmeCacheDir != "" {
+		opts = append(opts, gitreposerver.WithACME(*acmeCacheDir))
+	}
+	if *tlsCert != "" || *tlsKey != "" || *acmeHosts != "" {
+		minVersion, err := gitreposerver.ParseTLSVersion(*tlsMinVersion)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cipherSuites, err := gitreposerver.ParseCipherSuites(*tlsCipherSuites)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts,
+			gitreposerver.WithTLS(*tlsCert, *tlsKey),
+			gitreposerver.WithTLSMinVersion(minVersion),
+			gitreposerver.WithTLSCipherSuites(cipherSuites),
+			gitreposerver.WithHTTP2(!*tlsDisableHTTP2),
+		)
+	}
+	if *httpRedirectAddr != "" {
+		opts = append(opts, gitreposerver.WithHTTPRedirect(*httpRedirectAddr))
+	}
+	if *tlsClientCA != "" {
+		cas, err := gitreposerver.LoadClientCAs(*tlsClientCA)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, gitreposerver.WithClientCAs(cas, *tlsClientCAOptional))
+	}
+	switch *accessLog {
+	case "":
+	case "-":
+		opts = append(opts, gitreposerver.WithAccessLog(os.Stdout))
+	default:
+		f, err := os.OpenFile(*accessLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		opts = append(opts, gitreposerver.WithAccessLog(f))
+	}
+	switch *auditLog {
+	case "":
+	case "-":
+		opts = append(opts, gitreposerver.WithAuditLog(os.Stdout))
+	default:
+		f, err := os.OpenFile(*auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+		opts = append(opts, gitreposerver.WithAuditLog(f))
+	}
+	if *webhookURL != "" {
+		opts = append(opts, gitreposerver.WithOnEvent(gitreposerver.Webhook(*webhookURL, logger)))
+	}
+	if *gcInterval != 0 {
+		opts = append(opts, gitreposerver.WithMaintenance(*gcInterval))
+	}
+	if *upstream != "" {
+		opts = append(opts, gitreposerver.WithUpstream(gitreposerver.UpstreamPrefix(*upstream), *upstreamInterval, *upstreamTimeout))
+	}
+	if *authFile != "" {
+		users, err := gitreposerver.LoadAuthFile(*authFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, gitreposerver.WithAuth(users))
+		reloads = append(reloads, reloadFile{"auth-file", users})
+	}
+	if *settingsFile != "" {
+		settings, err := gitreposerver.LoadSettingsFile(*settingsFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, gitreposerver.WithSettingsFile(settings))
+		reloads = append(reloads, reloadFile{"settings-file", settings})
+	}
+	if *tokenFile != "" {
+		tokens, err := gitreposerver.LoadTokenFile(*tokenFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, gitreposerver.WithTokens(tokens))
+		reloads = append(reloads, reloadFile{"token-file", tokens})
+	}
+	activity, err := gitreposerver.NewActivity(*activityFile, *activityMaxAge)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	opts = append(opts, gitreposerver.WithActivity(activity))
+
+	var hostKey ssh.Signer
+	if *sshHostKey != "" {
+		hostKey, err = gitreposerver.LoadHostKey(*sshHostKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	var sshAuth gitreposerver.PublicKeyCallback
+	if *sshAuthorizedKeys != "" {
+		keys, err := gitreposerver.LoadAuthorizedKeys(*sshAuthorizedKeys)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sshAuth = keys.PublicKey
+		reloads = append(reloads, reloadFile{"ssh-authorized-keys", keys})
+	}
+
+	// fail before starting either server
+	if err := gitreposerver.Validate(append(opts, gitreposerver.WithDir(*gitDir), gitreposerver.WithAddr(*httpAddr))...); err != nil {
+		log.Fatalln(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// restore default signal handling so a second signal exits immediately
+		<-ctx.Done()
+		stop()
+	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			logger.Info("reloading files, other flags only change on restart", "files", len(reloads))
+			for _, f := range reloads {
+				if err := f.Reload(); err != nil {
+					logger.Error("reload failed, keeping the previous contents", "flag", f.flag, "err", err)
+				} else {
+					logger.Info("reloaded", "flag", f.flag)
+				}
+			}
+		}
+	}()
+
+	go func() {
+		t := time.NewTicker(activitySaveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if err := activity.Save(); err != nil {
+					logger.Error("save activity", "err", err)
+				}
+			}
+		}
+	}()
+
+	servers := 2
+	errc := make(chan error, 4)
+	if *daemonAddr != "" {
+		servers++
+		go func() {
+			errc <- gitreposerver.RunDaemonContext(ctx, *gitDir, *daemonAddr, opts...)
+		}()
+	}
+	if *gcInterval != 0 {
+		servers++
+		go func() {
+			errc <- gitreposerver.RunMaintenanceContext(ctx, *gitDir, opts...)
+		}()
+	}
+	go func() {
+		errc <- gitreposerver.RunSSHContext(ctx, *gitDir, *sshAddr, hostKey, sshAuth, opts...)
+	}()
+	go func() {
+		errc <- gitreposerver.RunHTTPMultiContext(ctx, *gitDir, strings.Split(*httpAddr, ","), opts...)
+	}()
+	for i := 0; i < servers; i++ {
+		err := <-errc
+		if err != nil {
+			logger.Error("server failed", "err", err)
+		}
+	}
+	if err := activity.Save(); err != nil {
+		logger.Error("save activity", "err", err)
+	}
+}
+
+// activitySaveInterval is how often the server saves its Activity.
+const activitySaveInterval = time.Minute
+
+// reloadFile is a file given by flag that's loaded again on SIGHUP.
+type reloadFile struct {
+	flag string
+	reloader
+}
+
+type reloader interface {
+	Reload() error
+}
@@ -0,0 +1,125 @@
+package gitreposerver
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errUnsupportedEncoding is returned for request bodies
+// in a Content-Encoding the server can't decode.
+var errUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// decodeBody returns the body of r decoded per its Content-Encoding,
+// which may be gzip, deflate or identity.
+// Errors from a corrupt or truncated compressed body are requestErrors.
+// Closing the returned reader doesn't close r.Body.
+func decodeBody(r *http.Request) (io.ReadCloser, error) {
+	enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	switch enc {
+	case "", "identity":
+		return io.NopCloser(r.Body), nil
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, decodeError(enc, err)
+		}
+		return decodedBody{gz, enc}, nil
+	case "deflate":
+		// deflate should be zlib wrapped, but some clients send raw deflate
+		br := bufio.NewReader(r.Body)
+		header, err := br.Peek(2)
+		if err != nil {
+			return nil, decodeError(enc, err)
+		}
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, decodeError(enc, err)
+			}
+			return decodedBody{zr, enc}, nil
+		}
+		return decodedBody{flate.NewReader(br), enc}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errUnsupportedEncoding, enc)
+}
+
+// decodedBody marks errors decoding a compressed body as the client's.
+type decodedBody struct {
+	io.ReadCloser
+	enc string
+}
+
+func (d decodedBody) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = decodeError(d.enc, err)
+	}
+	return n, err
+}
+
+func decodeError(enc string, err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return requestErrorf("decode %s body: %v", enc, err)
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			q, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			if err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// compressResponse reports whether the response to r should be gzipped,
+// marking the response as varying by Accept-Encoding.
+// Packs are already compressed, so only text responses should use this.
+func (h *httpHandler) compressResponse(rw http.ResponseWriter, r *http.Request) bool {
+	if !h.cfg.CompressResponses {
+		return false
+	}
+	addVary(rw.Header(), "Accept-Encoding")
+	return acceptsGzip(r.Header.Get("Accept-Encoding"))
+}
+
+// gzipWriter starts a gzipped response body,
+// the writer must be closed to complete it.
+func (h *httpHandler) gzipWriter(rw http.ResponseWriter) io.WriteCloser {
+	rw.Header().Set("Content-Encoding", "gzip")
+	rw.Header().Del("Content-Length")
+	gz, err := gzip.NewWriterLevel(rw, h.cfg.compressionLevel())
+	if err != nil {
+		// the level is validated by compressionLevel
+		gz = gzip.NewWriter(rw)
+	}
+	return gz
+}
+
+// gzipETag derives the entity tag of the gzipped representation.
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-gzip"`
+}
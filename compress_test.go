@@ -0,0 +1,220 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// compress encodes b with the Content-Encoding enc.
+func compress(t *testing.T, enc string, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch enc {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		return b
+	}
+	if _, err := w.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	want := []byte(strings.Repeat("0032want 0123456789012345678901234567890123456789\n", 10))
+	tests := []struct {
+		header string
+		enc    string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate", "raw deflate"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(compress(t, tt.enc, want)))
+		req.Header.Set("Content-Encoding", tt.header)
+		body, err := decodeBody(req)
+		if err != nil {
+			t.Errorf("%q as %q: %v", tt.enc, tt.header, err)
+			continue
+		}
+		got, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%q as %q: read %q, %v", tt.enc, tt.header, got, err)
+		}
+	}
+}
+
+func TestDecodeBodyCorrupt(t *testing.T) {
+	payload := bytes.Repeat([]byte("some request line\n"), 100)
+	truncate := func(b []byte) []byte { return b[:len(b)/2] }
+	flip := func(b []byte) []byte {
+		b = append([]byte(nil), b...)
+		b[len(b)-6] ^= 0xff
+		return b
+	}
+	tests := []struct {
+		name string
+		enc  string
+		body []byte
+	}{
+		{"truncated gzip", "gzip", truncate(compress(t, "gzip", payload))},
+		{"corrupt gzip", "gzip", flip(compress(t, "gzip", payload))},
+		{"not gzip", "gzip", payload},
+		{"empty gzip", "gzip", nil},
+		{"truncated deflate", "deflate", truncate(compress(t, "deflate", payload))},
+		{"corrupt deflate", "deflate", flip(compress(t, "deflate", payload))},
+		{"truncated raw deflate", "deflate", truncate(compress(t, "raw deflate", payload))},
+		{"empty deflate", "deflate", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Encoding", tt.enc)
+			body, err := decodeBody(req)
+			if err == nil {
+				_, err = io.ReadAll(body)
+				body.Close()
+			}
+			if err == nil {
+				t.Fatal("decoded without an error")
+			}
+			if code, _ := classifyError(err); code != http.StatusBadRequest {
+				t.Errorf("%v: status %d, want 400", err, code)
+			}
+		})
+	}
+}
+
+func TestDecodeBodyUnsupported(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("x"))
+	req.Header.Set("Content-Encoding", "br")
+	if _, err := decodeBody(req); !errors.Is(err, errUnsupportedEncoding) {
+		t.Errorf("br: %v, want %v", err, errUnsupportedEncoding)
+	}
+}
+
+// TestCompressedUploadPack fetches with a request body in each encoding.
+func TestCompressedUploadPack(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	srv := newTestServer(t, dir)
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+	request := uploadPackRequest([]string{main}, nil).Bytes()
+
+	tests := []struct {
+		header string
+		body   []byte
+		want   int
+	}{
+		{"", request, http.StatusOK},
+		{"gzip", compress(t, "gzip", request), http.StatusOK},
+		{"deflate", compress(t, "deflate", request), http.StatusOK},
+		{"deflate", compress(t, "raw deflate", request), http.StatusOK},
+		{"gzip", compress(t, "gzip", request)[:20], http.StatusBadRequest},
+		{"br", request, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/repo.git/git-upload-pack", bytes.NewReader(tt.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		if tt.header != "" {
+			req.Header.Set("Content-Encoding", tt.header)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("Content-Encoding %q: status %d, want %d", tt.header, res.StatusCode, tt.want)
+		}
+	}
+}
+
+// TestCompressedBodyBomb checks a small gzip body inflating far past
+// MaxRequestBytes is refused once the limit is reached,
+// without the server inflating or keeping the rest of it.
+func TestCompressedBodyBomb(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	srv := newTestServer(t, dir, WithMaxRequestBytes(1<<20))
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+
+	const inflated = 64 << 20
+	line := fmt.Sprintf("0032want %s\n", main)
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	for n := 0; n < inflated; n += len(line) {
+		io.WriteString(gz, line)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= 1<<20 {
+		t.Fatalf("compressed body is %d bytes, not under the limit", buf.Len())
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/repo.git/git-upload-pack", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	runtime.ReadMemStats(&after)
+	if res.StatusCode != http.StatusRequestEntityTooLarge || !strings.Contains(string(body), errBodyTooLarge.Error()) {
+		t.Errorf("status %d, %q, want 413 %q", res.StatusCode, body, errBodyTooLarge)
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > inflated/4 {
+		t.Errorf("allocated %d MiB for a body inflating to %d MiB", alloc>>20, inflated>>20)
+	}
+}
+
+func TestValidateCompressionLevel(t *testing.T) {
+	for level, ok := range map[int]bool{
+		gzip.HuffmanOnly:        true,
+		gzip.DefaultCompression: true,
+		0:                       true,
+		gzip.BestCompression:    true,
+		-3:                      false,
+		10:                      false,
+	} {
+		if err := Validate(WithDir(t.TempDir()), WithAddr("127.0.0.1:0"), WithCompression(level)); (err == nil) != ok {
+			t.Errorf("level %d: %v, want valid %v", level, err, ok)
+		}
+	}
+}
@@ -0,0 +1,976 @@
+package gitreposerver
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+)
+
+// Defaults of the settings left unset.
+const (
+	DefaultDrainTimeout    = 30 * time.Second
+	DefaultMaxRequestBytes = 64 << 20
+	DefaultMaxHeaderBytes  = 64 << 10
+
+	DefaultReadHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout       = 10 * time.Minute
+	DefaultIdleTimeout       = 2 * time.Minute
+	DefaultUploadTimeout     = time.Hour
+
+	DefaultHookTimeout = 5 * time.Minute
+
+	DefaultAgent = "gitreposerver"
+
+	DefaultUpstreamInterval = time.Minute
+	DefaultUpstreamTimeout  = 5 * time.Minute
+)
+
+// Config holds the settings shared by the git servers.
+type Config struct {
+	// Dir holds the repositories to serve.
+	Dir string
+	// RepoRoots are other directories symlinks in Dir may lead to.
+	// Repositories that resolve to outside Dir and RepoRoots aren't served.
+	RepoRoots []string
+	// Filesystem holds Dir instead of the OS filesystem,
+	// such as a memfs for tests.
+	// Pushes run hooks in the repository so they need the OS filesystem,
+	// ReceivePack can't be used with it.
+	Filesystem billy.Filesystem
+	// Addr is the http listen address,
+	// a unix socket path prefixed with "unix:" or a host:port.
+	Addr string
+
+	// PathPrefix is the path the http server is mounted at, such as /git,
+	// so repositories are served at /git/{repo}.
+	// It's stripped before repository names are resolved,
+	// requests outside it get a 404.
+	PathPrefix string
+
+	// ReceivePack enables git-receive-pack (push) over http.
+	ReceivePack bool
+	// ReadOnly refuses every write, whatever ReceivePack, AutoInit
+	// or the repositories' configs say: pushes get a 403
+	// and receive-pack isn't advertised. Mirrors are served
+	// without fetching their upstream and maintenance doesn't run,
+	// so the server never modifies the repositories.
+	ReadOnly bool
+	// EnableDumbHTTP serves the dumb http protocol to clients that can't use smart http:
+	// HEAD, info/refs requested without a service,
+	// objects/info/packs and the loose objects and packs under objects, read only.
+	// Hidden refs aren't listed, but as with git their objects can be read by id.
+	EnableDumbHTTP bool
+	// AllowAnySHA1InWant lets protocol v0 clients fetch any object by id,
+	// like uploadpack.allowAnySHA1InWant, instead of only ref tips.
+	// Protocol v2 fetches always allow any object.
+	AllowAnySHA1InWant bool
+	// ExperimentalSHA256 serves sha256 repositories instead of refusing them with a 501,
+	// advertising object-format=sha256 and refusing protocol v2 commands for another format.
+	// go-git only names objects by sha1 so far, listing refs and building packs
+	// for these repositories doesn't work yet.
+	ExperimentalSHA256 bool
+	// HiddenRefs are ref prefixes, such as refs/pull, that aren't advertised
+	// to fetches and can't be fetched by their tips, like transfer.hideRefs.
+	// A prefix starting with ! unhides refs hidden by an earlier prefix.
+	HiddenRefs []string
+	// DefaultBranch is advertised as HEAD for repositories
+	// whose HEAD is detached or points to a missing branch.
+	DefaultBranch string
+	// Settings, if loaded, sets what a repository's config can for every repository:
+	// its hiderefs add to HiddenRefs, the rest override DefaultBranch,
+	// RepoQuotaBytes and the services served. Each Reload applies
+	// to the requests that follow, without a restart.
+	Settings SettingsFile
+	// Aliases maps old repository names to the names they're served as,
+	// with or without the .git suffix, such as old-name to new-name.git.
+	Aliases map[string]string
+	// RedirectAliases answers http GET requests for an alias,
+	// including the first request of a clone, with a 301 to the new name,
+	// instead of serving the new name under the old one.
+	RedirectAliases bool
+	// MaxAdvertisedRefs limits the refs advertised to protocol v0 fetches,
+	// which list every ref, 0 is unlimited. Fetches of repositories
+	// with more refs fail, asking the client to use protocol v2,
+	// unless TruncateAdvertisedRefs is set to advertise only the first
+	// refs: HEAD's branch, then branches, then tags.
+	MaxAdvertisedRefs      int
+	TruncateAdvertisedRefs bool
+	// MinProtocolVersion set to 2 refuses protocol v0 fetches on every transport,
+	// with a message asking the client to set protocol.version=2,
+	// sparing the server their full ref advertisements.
+	// It defaults to 0, accepting every version.
+	// Pushes only have protocol v0 and are always accepted.
+	MinProtocolVersion int
+	// AgentString is advertised to clients as the server's agent,
+	// such as gitreposerver/1.2.3, defaulting to gitreposerver.
+	AgentString string
+	// AdvertiseCapabilities is called with the capabilities of each
+	// protocol v0 ref advertisement before it's sent, so they can be
+	// added or removed. service is git-upload-pack or git-receive-pack.
+	AdvertiseCapabilities func(service string, caps *capability.List)
+	// AutoInit creates a bare repository when a push targets
+	// a repository that doesn't exist.
+	AutoInit bool
+	// DenyNonFastForwards are ref prefixes, such as refs/heads/main,
+	// that pushes can only fast-forward, like receive.denyNonFastForwards.
+	// Clients don't tell the server a push is forced,
+	// so this applies to every push.
+	DenyNonFastForwards []string
+	// DenyDeletes are ref prefixes that pushes can't delete.
+	DenyDeletes []string
+	// BranchRules limit who may push to the refs they match,
+	// and whether those refs can be force pushed or deleted.
+	// Every rule matching a ref applies.
+	BranchRules []BranchRule
+	// FsckObjects checks that pushed objects are well formed,
+	// like transfer.fsckObjects.
+	FsckObjects bool
+	// AtomicPushes applies every push all or nothing,
+	// as if the client asked for an atomic push with git push --atomic.
+	AtomicPushes bool
+	// PushCertKeys are the keys trusted to sign push certificates,
+	// setting them lets clients sign pushes with git push --signed.
+	PushCertKeys *PushCertKeys
+	// RequireSignedPush rejects pushes without a push certificate
+	// signed by one of PushCertKeys with the nonce the server sent.
+	RequireSignedPush bool
+	// HooksDir holds the pre-receive and post-receive hooks run for pushes
+	// to every repository, by default each repository's hooks dir is used.
+	// Hooks that don't exist or aren't executable are skipped.
+	HooksDir string
+	// HookTimeout bounds each hook run, defaulting to 5m.
+	HookTimeout time.Duration
+
+	// Auth authenticates http requests with basic auth.
+	// If Auth, Tokens and ClientCAs are all nil, anonymous access is allowed.
+	Auth Authenticator
+	// Tokens authenticates http requests with bearer tokens.
+	Tokens TokenValidator
+	// AuthRealm is the realm sent in Basic auth challenges.
+	AuthRealm string
+	// AnonymousRead only requires authentication for pushes.
+	AnonymousRead bool
+	// Upstream returns the remote repo mirrors, if it's a mirror.
+	// Mirrors are fetched from their upstream before being read,
+	// created on the first read if they don't exist, and can't be pushed to.
+	Upstream func(repo string) (Upstream, bool)
+	// UpstreamInterval is how long a mirror is served
+	// before it's fetched again, defaulting to 1m.
+	UpstreamInterval time.Duration
+	// UpstreamTimeout bounds each fetch from an upstream, defaulting to 5m.
+	UpstreamTimeout time.Duration
+	// MaintenanceInterval is how often RunMaintenance runs git gc
+	// on each repository, 0 disables it.
+	MaintenanceInterval time.Duration
+	// Authorizer decides which repositories an authenticated
+	// or anonymous client may read and push to, nil allows all.
+	Authorizer Authorizer
+	// HideUnauthorized reports repositories a client may not access
+	// as not found, rather than forbidden, so their existence isn't revealed.
+	HideUnauthorized bool
+
+	// DrainTimeout bounds how long shutdown waits for in-flight requests,
+	// defaulting to 30s.
+	DrainTimeout time.Duration
+
+	// MaxConcurrentUploads and MaxConcurrentReceives cap the simultaneous
+	// upload-pack (fetch) and receive-pack (push) requests, 0 is unlimited.
+	// Requests over the limit get a 503 with a Retry-After.
+	MaxConcurrentUploads  int
+	MaxConcurrentReceives int
+	// ConcurrencyWait is how long a request over the limit waits
+	// for a slot before being rejected.
+	ConcurrencyWait time.Duration
+
+	// RateLimit is the sustained requests per second allowed from each client ip,
+	// 0 disables rate limiting. RateBurst is the bucket size,
+	// defaulting to RateLimit rounded up.
+	RateLimit float64
+	RateBurst int
+	// RateLimitExempt are client networks that are never rate limited.
+	RateLimitExempt []*net.IPNet
+	// TrustedProxies are the networks of proxies whose
+	// X-Forwarded-For and X-Forwarded-Proto headers are used
+	// to find the client ip and scheme.
+	TrustedProxies []*net.IPNet
+
+	// SocketMode is the file mode of unix sockets
+	// listened on with a "unix:" address, defaulting to 0660.
+	SocketMode fs.FileMode
+
+	// ReadHeaderTimeout bounds reading request headers, defaulting to 10s.
+	ReadHeaderTimeout time.Duration
+	// ReadTimeout bounds reading an entire http request, including the body,
+	// defaulting to 10m. It drops clients that trickle in a request,
+	// but must leave time for the largest pushes to be sent.
+	ReadTimeout time.Duration
+	// IdleTimeout bounds how long keep-alive connections wait
+	// for the next request, defaulting to 2m.
+	IdleTimeout time.Duration
+	// UploadTimeout bounds an entire upload-pack response,
+	// including streaming the pack, defaulting to 1h.
+	// It also sets the server's write timeout so stalled clients are dropped.
+	// A write timeout covers the whole response, not each write,
+	// so set too low it cuts off clones of large repositories part way.
+	UploadTimeout time.Duration
+	// MaxOperationDuration is a hard cap on each fetch, push or other git request
+	// over any transport, however busy it is, 0 is unlimited.
+	// Past it the request's context is cancelled and the timeout logged,
+	// ssh and git daemon connections are closed.
+	// Over http the write timeout still applies, see UploadTimeout.
+	MaxOperationDuration time.Duration
+	// MaxHeaderBytes limits the size of http request headers,
+	// defaulting to 64KiB, plenty for git and its credentials.
+	MaxHeaderBytes int
+
+	// MaxRequestBytes limits upload-pack request bodies,
+	// both as sent and after decompression, defaulting to 64MiB.
+	// It also limits compressed receive-pack request bodies after decompression.
+	MaxRequestBytes int64
+	// MaxHaves limits the have lines counted in each fetch request, 0 is unlimited.
+	// Over http each round of a negotiation is a request of its own,
+	// so it bounds the haves of one round, requests with more get a 400.
+	MaxHaves int
+	// MaxWants limits the distinct objects a fetch can want, 0 is unlimited.
+	// Fetches wanting more get a 400 and are logged with the client's ip.
+	MaxWants int
+	// MaxPackBytes limits the pack sent by a push, 0 is unlimited.
+	MaxPackBytes int64
+	// RepoQuotaBytes limits the size of a repository's objects,
+	// rejecting pushes that would take it over, 0 is unlimited.
+	RepoQuotaBytes int64
+
+	// TLSCertFile and TLSKeyFile enable https when set.
+	// The certificate file should contain the leaf certificate
+	// followed by any intermediates, all of which are served to clients.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ACMEHosts enables https without TLSCertFile,
+	// with certificates for these hosts from Let's Encrypt,
+	// accepting its terms of service.
+	// Certificates are kept in ACMECacheDir and renewed before they expire.
+	ACMEHosts    []string
+	ACMECacheDir string
+	// ACMEHTTPAddr serves the HTTP-01 challenge, defaulting to ":80",
+	// redirecting other requests to https.
+	ACMEHTTPAddr string
+	// HTTPRedirectAddr serves plain http alongside https,
+	// answering every request with a 301 to the same url over https,
+	// empty disables it, as when TLS is terminated upstream.
+	// With ACME on the same address the challenge server redirects instead.
+	HTTPRedirectAddr string
+	// TLSMinVersion is the minimum TLS version accepted, defaulting to TLS 1.2.
+	TLSMinVersion uint16
+	// TLSCipherSuites restricts the TLS 1.0-1.2 cipher suites,
+	// nil uses the crypto/tls defaults.
+	TLSCipherSuites []uint16
+	// ClientCAs enables mutual TLS, verifying client certificates against it.
+	// A verified certificate authenticates the request as its
+	// common name, or its first email, DNS or URI SAN,
+	// see IdentityFromContext.
+	ClientCAs *x509.CertPool
+	// ClientAuth is tls.RequireAndVerifyClientCert, the default with ClientCAs,
+	// or tls.VerifyClientCertIfGiven to also accept clients without one.
+	ClientAuth tls.ClientAuthType
+	// DisableHTTP2 serves https clients HTTP/1.1 only,
+	// for intermediaries that mishandle HTTP/2.
+	DisableHTTP2 bool
+
+	// CompressResponses gzips ref advertisements for clients that accept it.
+	// Packs are already compressed and are sent as is.
+	CompressResponses bool
+	// CompressionLevel is the gzip level, 0 uses gzip.DefaultCompression.
+	CompressionLevel int
+
+	// VerboseErrors sends the details of server errors to clients,
+	// by default they only get a request id to report.
+	VerboseErrors bool
+
+	// CORSOrigins are the origins browsers may make requests to the server from,
+	// "*" allows any origin.
+	CORSOrigins []string
+
+	// Middleware wraps each git route, the first being the outermost.
+	// It runs after the repository is resolved and the client authenticated,
+	// see RepoFromContext and IdentityFromContext,
+	// and before the route sets its response headers.
+	Middleware []Middleware
+
+	// Logger receives server logs, defaulting to the standard logger.
+	Logger Logger
+	// TraceWire logs the decoded wants, haves, capabilities and depth
+	// of each fetch and the number of objects sent,
+	// like GIT_TRACE_PACKET on the client. Long lists are truncated.
+	TraceWire bool
+	// AccessLog receives a Combined Log Format line for each http request,
+	// nil disables it.
+	AccessLog io.Writer
+	// AuditLog receives a JSON record of each authenticated fetch and push
+	// and each failed authentication, nil disables it.
+	// It's written to by every server sharing the option and must not be
+	// written elsewhere.
+	AuditLog io.Writer
+	// Metrics receives request measurements, nil disables them.
+	Metrics Metrics
+	// OnEvent is called after each successful fetch and push
+	// on any transport, nil disables it.
+	// It runs in the background once the response is written,
+	// so events arrive in no particular order,
+	// possibly before the client has read all of the response.
+	// Events are dropped while too many calls are backed up.
+	OnEvent func(Event)
+	// Activity records when repositories were last fetched from and pushed to,
+	// shown in the /repos listing and info.json.
+	Activity *Activity
+}
+
+// filesystem returns Dir as a filesystem.
+func (c Config) filesystem() billy.Filesystem {
+	if c.Filesystem == nil {
+		return osfs.New(c.Dir)
+	}
+	if c.Dir == "" || c.Dir == "/" || c.Dir == "." {
+		return c.Filesystem
+	}
+	return chroot.New(c.Filesystem, c.Dir)
+}
+
+// pathPrefix returns PathPrefix with a leading and no trailing slash,
+// empty if the server is at the root.
+func (c Config) pathPrefix() string {
+	p := strings.Trim(c.PathPrefix, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// pushEnabled reports whether pushes are served.
+func (c Config) pushEnabled() bool {
+	return c.ReceivePack && c.Filesystem == nil && !c.ReadOnly
+}
+
+func (c Config) logger() Logger {
+	if c.Logger == nil {
+		return NewStdLogger(log.Default(), LevelInfo)
+	}
+	return c.Logger
+}
+
+func (c Config) metrics() Metrics {
+	if c.Metrics == nil {
+		return nopMetrics{}
+	}
+	return c.Metrics
+}
+
+func (c Config) drainTimeout() time.Duration {
+	if c.DrainTimeout <= 0 {
+		return DefaultDrainTimeout
+	}
+	return c.DrainTimeout
+}
+
+func (c Config) socketMode() fs.FileMode {
+	if c.SocketMode == 0 {
+		return defaultSocketMode
+	}
+	return c.SocketMode
+}
+
+func (c Config) readHeaderTimeout() time.Duration {
+	if c.ReadHeaderTimeout <= 0 {
+		return DefaultReadHeaderTimeout
+	}
+	return c.ReadHeaderTimeout
+}
+
+func (c Config) readTimeout() time.Duration {
+	if c.ReadTimeout <= 0 {
+		return DefaultReadTimeout
+	}
+	return c.ReadTimeout
+}
+
+func (c Config) idleTimeout() time.Duration {
+	if c.IdleTimeout <= 0 {
+		return DefaultIdleTimeout
+	}
+	return c.IdleTimeout
+}
+
+func (c Config) uploadTimeout() time.Duration {
+	if c.UploadTimeout <= 0 {
+		return DefaultUploadTimeout
+	}
+	return c.UploadTimeout
+}
+
+func (c Config) upstreamInterval() time.Duration {
+	if c.UpstreamInterval <= 0 {
+		return DefaultUpstreamInterval
+	}
+	return c.UpstreamInterval
+}
+
+func (c Config) upstreamTimeout() time.Duration {
+	if c.UpstreamTimeout <= 0 {
+		return DefaultUpstreamTimeout
+	}
+	return c.UpstreamTimeout
+}
+
+func (c Config) hookTimeout() time.Duration {
+	if c.HookTimeout <= 0 {
+		return DefaultHookTimeout
+	}
+	return c.HookTimeout
+}
+
+func (c Config) agent() string {
+	if c.AgentString == "" {
+		return DefaultAgent
+	}
+	return c.AgentString
+}
+
+func (c Config) compressionLevel() int {
+	if c.CompressionLevel == 0 || c.CompressionLevel < gzip.HuffmanOnly || c.CompressionLevel > gzip.BestCompression {
+		return gzip.DefaultCompression
+	}
+	return c.CompressionLevel
+}
+
+func (c Config) maxHeaderBytes() int {
+	if c.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return c.MaxHeaderBytes
+}
+
+func (c Config) maxRequestBytes() int64 {
+	if c.MaxRequestBytes <= 0 {
+		return DefaultMaxRequestBytes
+	}
+	return c.MaxRequestBytes
+}
+
+// validate checks for settings that are invalid on their own or together.
+func (c Config) validate() error {
+	switch {
+	case c.Dir == "":
+		return errors.New("config: no repository dir")
+	case c.Addr == "":
+		return errors.New("config: no listen address")
+	case c.ReceivePack && c.Filesystem != nil:
+		return errors.New("config: ReceivePack can't be used with a Filesystem")
+	case c.MaintenanceInterval > 0 && c.Filesystem != nil:
+		return errors.New("config: MaintenanceInterval can't be used with a Filesystem")
+	case c.RepoRoots != nil && c.Filesystem != nil:
+		return errors.New("config: RepoRoots can't be used with a Filesystem")
+	case c.pathPrefix() != "" && (path.Clean(c.pathPrefix()) != c.pathPrefix() || strings.ContainsAny(c.PathPrefix, "?#%")):
+		return fmt.Errorf("config: invalid PathPrefix %q", c.PathPrefix)
+	case strings.ContainsAny(c.AgentString, " \t\r\n"):
+		return fmt.Errorf("config: AgentString %q contains whitespace", c.AgentString)
+	case c.AutoInit && !c.ReceivePack:
+		return errors.New("config: AutoInit requires ReceivePack")
+	case c.RequireSignedPush && c.PushCertKeys == nil:
+		return errors.New("config: RequireSignedPush requires PushCertKeys")
+	case c.AnonymousRead && !c.authEnabled():
+		return errors.New("config: AnonymousRead requires Auth, Tokens or ClientCAs")
+	case (c.TLSCertFile == "") != (c.TLSKeyFile == ""):
+		return errors.New("config: TLS requires both a certificate and a key file")
+	case c.TLSCertFile == "" && !c.acme() && (c.TLSMinVersion != 0 || c.TLSCipherSuites != nil || c.ClientCAs != nil || c.DisableHTTP2):
+		return errors.New("config: TLS options set without a certificate")
+	case c.HTTPRedirectAddr != "" && c.TLSCertFile == "" && !c.acme():
+		return errors.New("config: HTTPRedirectAddr requires TLS")
+	case len(c.ACMEHosts) == 0 && (c.ACMECacheDir != "" || c.ACMEHTTPAddr != ""):
+		return errors.New("config: ACME options set without ACMEHosts")
+	case len(c.ACMEHosts) > 0 && c.ACMECacheDir == "":
+		return errors.New("config: ACMEHosts requires ACMECacheDir")
+	case !c.DisableHTTP2 && c.TLSMinVersion < tls.VersionTLS13 && c.TLSCipherSuites != nil && !hasHTTP2CipherSuite(c.TLSCipherSuites):
+		return errors.New("config: HTTP/2 requires TLSCipherSuites to include an ECDHE AES-128-GCM suite")
+	case c.ClientAuth != tls.NoClientCert && c.ClientCAs == nil:
+		return errors.New("config: ClientAuth requires ClientCAs")
+	case c.ClientAuth != tls.NoClientCert && c.ClientAuth != tls.RequireAndVerifyClientCert && c.ClientAuth != tls.VerifyClientCertIfGiven:
+		return errors.New("config: ClientAuth must verify client certificates")
+	case c.MaxConcurrentUploads < 0, c.MaxConcurrentReceives < 0:
+		return errors.New("config: negative concurrency limit")
+	case c.RateLimit < 0, c.RateBurst < 0:
+		return errors.New("config: negative rate limit")
+	case c.RateBurst > 0 && c.RateLimit == 0:
+		return errors.New("config: RateBurst requires RateLimit")
+	case c.MaxAdvertisedRefs < 0:
+		return errors.New("config: negative MaxAdvertisedRefs")
+	case c.MaxRequestBytes < 0:
+		return errors.New("config: negative MaxRequestBytes")
+	case c.MaxHeaderBytes < 0:
+		return errors.New("config: negative MaxHeaderBytes")
+	case c.MinProtocolVersion < 0, c.MinProtocolVersion > 2:
+		return errors.New("config: MinProtocolVersion must be 0, 1 or 2")
+	case c.MaxHaves < 0:
+		return errors.New("config: negative MaxHaves")
+	case c.MaxWants < 0:
+		return errors.New("config: negative MaxWants")
+	case c.MaxPackBytes < 0, c.RepoQuotaBytes < 0:
+		return errors.New("config: negative push size limit")
+	case c.DrainTimeout < 0, c.ReadHeaderTimeout < 0, c.ReadTimeout < 0, c.IdleTimeout < 0,
+		c.UpstreamInterval < 0, c.UpstreamTimeout < 0, c.MaintenanceInterval < 0,
+		c.UploadTimeout < 0, c.HookTimeout < 0, c.ConcurrencyWait < 0, c.MaxOperationDuration < 0:
+		return errors.New("config: negative timeout")
+	case c.CompressResponses && c.CompressionLevel != 0 &&
+		(c.CompressionLevel < gzip.HuffmanOnly || c.CompressionLevel > gzip.BestCompression):
+		return fmt.Errorf("config: invalid compression level %d", c.CompressionLevel)
+	}
+	if err := checkBranchRules(c.BranchRules); err != nil {
+		return err
+	}
+	if err := checkRepoRoots(c.RepoRoots); err != nil {
+		return err
+	}
+	if err := checkAliases(c.Aliases); err != nil {
+		return err
+	}
+	fi, err := c.filesystem().Stat("/")
+	if err != nil {
+		return fmt.Errorf("config: repository dir: %w", err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("config: repository dir %s is not a directory", c.Dir)
+	}
+	return nil
+}
+
+// Option configures a git server.
+type Option func(*Config)
+
+// Validate checks the settings of opts as Serve does before starting,
+// so a command starting several servers can fail before starting any.
+func Validate(opts ...Option) error {
+	return newConfig(opts).validate()
+}
+
+func newConfig(opts []Option) Config {
+	var cfg Config
+	for _, o := range opts {
+		o(&cfg)
+	}
+	return cfg
+}
+
+// WithDir sets the dir of repositories to serve.
+func WithDir(dir string) Option {
+	return func(c *Config) { c.Dir = dir }
+}
+
+// WithRepoRoots permits serving repositories
+// that symlinks in Dir resolve to inside roots.
+func WithRepoRoots(roots ...string) Option {
+	return func(c *Config) { c.RepoRoots = append(c.RepoRoots, roots...) }
+}
+
+// WithAddr sets the http listen address.
+func WithAddr(addr string) Option {
+	return func(c *Config) { c.Addr = addr }
+}
+
+// WithReceivePack enables or disables pushes.
+func WithReceivePack(enabled bool) Option {
+	return func(c *Config) { c.ReceivePack = enabled }
+}
+
+// WithPathPrefix mounts the http server at prefix.
+func WithPathPrefix(prefix string) Option {
+	return func(c *Config) { c.PathPrefix = prefix }
+}
+
+// WithReadOnly refuses every write.
+func WithReadOnly(enabled bool) Option {
+	return func(c *Config) { c.ReadOnly = enabled }
+}
+
+// WithDumbHTTP serves the dumb http protocol alongside smart http.
+func WithDumbHTTP(enabled bool) Option {
+	return func(c *Config) { c.EnableDumbHTTP = enabled }
+}
+
+// WithExperimentalSHA256 serves sha256 repositories, which go-git can't read yet.
+func WithExperimentalSHA256(enabled bool) Option {
+	return func(c *Config) { c.ExperimentalSHA256 = enabled }
+}
+
+// WithAllowAnySHA1InWant allows protocol v0 fetches of any object.
+func WithAllowAnySHA1InWant(enabled bool) Option {
+	return func(c *Config) { c.AllowAnySHA1InWant = enabled }
+}
+
+// WithAliases serves each old repository name as its new name,
+// or with redirect set, redirects http GET requests to it.
+func WithAliases(aliases map[string]string, redirect bool) Option {
+	return func(c *Config) {
+		if c.Aliases == nil {
+			c.Aliases = make(map[string]string, len(aliases))
+		}
+		for from, to := range aliases {
+			c.Aliases[from] = to
+		}
+		c.RedirectAliases = redirect
+	}
+}
+
+// WithMaxAdvertisedRefs limits the refs advertised to protocol v0 fetches,
+// failing them or, with truncate set, advertising only the first max refs.
+func WithMaxAdvertisedRefs(max int, truncate bool) Option {
+	return func(c *Config) {
+		c.MaxAdvertisedRefs = max
+		c.TruncateAdvertisedRefs = truncate
+	}
+}
+
+// WithAgentString sets the agent advertised to clients.
+func WithAgentString(agent string) Option {
+	return func(c *Config) { c.AgentString = agent }
+}
+
+// WithAdvertiseCapabilities lets fn change the capabilities
+// of protocol v0 ref advertisements.
+func WithAdvertiseCapabilities(fn func(service string, caps *capability.List)) Option {
+	return func(c *Config) { c.AdvertiseCapabilities = fn }
+}
+
+// WithHiddenRefs hides refs with the given prefixes from fetches.
+func WithHiddenRefs(prefixes ...string) Option {
+	return func(c *Config) { c.HiddenRefs = append(c.HiddenRefs, prefixes...) }
+}
+
+// WithSettingsFile applies the settings in f to every repository,
+// reloaded with f.Reload.
+func WithSettingsFile(f SettingsFile) Option {
+	return func(c *Config) { c.Settings = f }
+}
+
+// WithDefaultBranch sets the branch advertised for a detached HEAD.
+func WithDefaultBranch(branch string) Option {
+	return func(c *Config) { c.DefaultBranch = branch }
+}
+
+// WithAutoInit enables creating repositories on push.
+func WithAutoInit(enabled bool) Option {
+	return func(c *Config) { c.AutoInit = enabled }
+}
+
+// WithDenyNonFastForwards rejects pushes rewriting refs with the given prefixes.
+func WithDenyNonFastForwards(prefixes ...string) Option {
+	return func(c *Config) { c.DenyNonFastForwards = append(c.DenyNonFastForwards, prefixes...) }
+}
+
+// WithDenyDeletes rejects pushes deleting refs with the given prefixes.
+func WithDenyDeletes(prefixes ...string) Option {
+	return func(c *Config) { c.DenyDeletes = append(c.DenyDeletes, prefixes...) }
+}
+
+// WithBranchRules protects refs with rules.
+func WithBranchRules(rules ...BranchRule) Option {
+	return func(c *Config) { c.BranchRules = append(c.BranchRules, rules...) }
+}
+
+// WithFsckObjects enables checking pushed objects.
+func WithFsckObjects(enabled bool) Option {
+	return func(c *Config) { c.FsckObjects = enabled }
+}
+
+// WithAtomicPushes makes every push atomic.
+func WithAtomicPushes(enabled bool) Option {
+	return func(c *Config) { c.AtomicPushes = enabled }
+}
+
+// WithSignedPushes verifies push certificates against keys,
+// and if require is set rejects pushes without a valid one.
+func WithSignedPushes(keys *PushCertKeys, require bool) Option {
+	return func(c *Config) {
+		c.PushCertKeys = keys
+		c.RequireSignedPush = require
+	}
+}
+
+// WithHooks sets the hooks dir shared by all repositories
+// and the hook timeout, zero values keep the defaults.
+func WithHooks(dir string, timeout time.Duration) Option {
+	return func(c *Config) {
+		c.HooksDir = dir
+		c.HookTimeout = timeout
+	}
+}
+
+// WithAuth sets the basic auth Authenticator.
+func WithAuth(a Authenticator) Option {
+	return func(c *Config) { c.Auth = a }
+}
+
+// WithTokens sets the bearer TokenValidator.
+func WithTokens(t TokenValidator) Option {
+	return func(c *Config) { c.Tokens = t }
+}
+
+// WithAuthRealm sets the realm sent in Basic auth challenges.
+func WithAuthRealm(realm string) Option {
+	return func(c *Config) { c.AuthRealm = realm }
+}
+
+// WithUpstream mirrors the repositories upstream returns a remote for,
+// fetching them when they were last fetched over interval ago
+// and bounding each fetch by timeout.
+// Zero durations keep the defaults.
+func WithUpstream(upstream func(repo string) (Upstream, bool), interval, timeout time.Duration) Option {
+	return func(c *Config) {
+		c.Upstream = upstream
+		c.UpstreamInterval = interval
+		c.UpstreamTimeout = timeout
+	}
+}
+
+// WithMaintenance runs git gc on each repository every interval.
+func WithMaintenance(interval time.Duration) Option {
+	return func(c *Config) { c.MaintenanceInterval = interval }
+}
+
+// WithAuthorizer checks each access to a repository with a,
+// reporting denied repositories as not found if hide is set.
+func WithAuthorizer(a Authorizer, hide bool) Option {
+	return func(c *Config) {
+		c.Authorizer = a
+		c.HideUnauthorized = hide
+	}
+}
+
+// WithAnonymousRead allows fetching without credentials.
+func WithAnonymousRead(enabled bool) Option {
+	return func(c *Config) { c.AnonymousRead = enabled }
+}
+
+// WithDrainTimeout sets how long shutdown waits for in-flight requests.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(c *Config) { c.DrainTimeout = d }
+}
+
+// WithConcurrencyLimits caps simultaneous fetches and pushes,
+// waiting up to wait for a slot.
+func WithConcurrencyLimits(uploads, receives int, wait time.Duration) Option {
+	return func(c *Config) {
+		c.MaxConcurrentUploads = uploads
+		c.MaxConcurrentReceives = receives
+		c.ConcurrencyWait = wait
+	}
+}
+
+// WithRateLimit limits each client ip to rate requests per second,
+// with bursts of up to burst requests.
+func WithRateLimit(rate float64, burst int) Option {
+	return func(c *Config) {
+		c.RateLimit = rate
+		c.RateBurst = burst
+	}
+}
+
+// WithRateLimitExempt exempts client networks from rate limiting.
+func WithRateLimitExempt(nets []*net.IPNet) Option {
+	return func(c *Config) { c.RateLimitExempt = nets }
+}
+
+// WithTrustedProxies sets the proxies trusted to report client ips.
+func WithTrustedProxies(nets []*net.IPNet) Option {
+	return func(c *Config) { c.TrustedProxies = nets }
+}
+
+// WithSocketMode sets the file mode of unix sockets.
+func WithSocketMode(mode fs.FileMode) Option {
+	return func(c *Config) { c.SocketMode = mode }
+}
+
+// WithTimeouts sets the http header read, idle connection
+// and upload-pack timeouts, zero values keep the defaults.
+func WithTimeouts(readHeader, idle, upload time.Duration) Option {
+	return func(c *Config) {
+		c.ReadHeaderTimeout = readHeader
+		c.IdleTimeout = idle
+		c.UploadTimeout = upload
+	}
+}
+
+// WithMaxOperationDuration bounds the time a single git request may take.
+func WithMaxOperationDuration(d time.Duration) Option {
+	return func(c *Config) { c.MaxOperationDuration = d }
+}
+
+// WithReadTimeout sets the time allowed to read an http request,
+// including its body, zero keeps the default.
+func WithReadTimeout(d time.Duration) Option {
+	return func(c *Config) { c.ReadTimeout = d }
+}
+
+// WithMaxHeaderBytes limits the size of http request headers.
+func WithMaxHeaderBytes(n int) Option {
+	return func(c *Config) { c.MaxHeaderBytes = n }
+}
+
+// WithMaxRequestBytes limits the size of upload-pack requests.
+func WithMaxRequestBytes(n int64) Option {
+	return func(c *Config) { c.MaxRequestBytes = n }
+}
+
+// WithMinProtocolVersion refuses fetches using an older protocol version.
+func WithMinProtocolVersion(v int) Option {
+	return func(c *Config) { c.MinProtocolVersion = v }
+}
+
+// WithMaxHaves limits the number of haves a fetch can send.
+func WithMaxHaves(n int) Option {
+	return func(c *Config) { c.MaxHaves = n }
+}
+
+// WithMaxWants limits the number of objects a fetch can want.
+func WithMaxWants(n int) Option {
+	return func(c *Config) { c.MaxWants = n }
+}
+
+// WithMaxPackBytes limits the size of pushed packs.
+func WithMaxPackBytes(n int64) Option {
+	return func(c *Config) { c.MaxPackBytes = n }
+}
+
+// WithRepoQuota limits the size of each repository's objects.
+func WithRepoQuota(n int64) Option {
+	return func(c *Config) { c.RepoQuotaBytes = n }
+}
+
+// WithTLS serves https with the given certificate chain and key files.
+func WithTLS(certFile, keyFile string) Option {
+	return func(c *Config) {
+		c.TLSCertFile = certFile
+		c.TLSKeyFile = keyFile
+	}
+}
+
+// WithACME gets certificates for hosts from Let's Encrypt,
+// caching them in cacheDir, unless WithTLS is also used.
+func WithACME(cacheDir string, hosts ...string) Option {
+	return func(c *Config) {
+		c.ACMECacheDir = cacheDir
+		c.ACMEHosts = append(c.ACMEHosts, hosts...)
+	}
+}
+
+// WithACMEHTTPAddr sets the address the HTTP-01 challenge is served on.
+func WithACMEHTTPAddr(addr string) Option {
+	return func(c *Config) { c.ACMEHTTPAddr = addr }
+}
+
+// WithHTTPRedirect redirects plain http requests on addr to https.
+func WithHTTPRedirect(addr string) Option {
+	return func(c *Config) { c.HTTPRedirectAddr = addr }
+}
+
+// WithTLSMinVersion sets the minimum accepted TLS version.
+func WithTLSMinVersion(v uint16) Option {
+	return func(c *Config) { c.TLSMinVersion = v }
+}
+
+// WithTLSCipherSuites restricts the accepted cipher suites.
+func WithTLSCipherSuites(ids []uint16) Option {
+	return func(c *Config) { c.TLSCipherSuites = ids }
+}
+
+// WithClientCAs requires client certificates signed by cas,
+// or accepts clients without one if optional is set.
+func WithClientCAs(cas *x509.CertPool, optional bool) Option {
+	return func(c *Config) {
+		c.ClientCAs = cas
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		if optional {
+			c.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+}
+
+// WithHTTP2 sets whether https is also served over HTTP/2, the default.
+func WithHTTP2(enabled bool) Option {
+	return func(c *Config) { c.DisableHTTP2 = !enabled }
+}
+
+// WithCompression gzips ref advertisements at the given level.
+func WithCompression(level int) Option {
+	return func(c *Config) {
+		c.CompressResponses = true
+		c.CompressionLevel = level
+	}
+}
+
+// WithVerboseErrors sends server error details to clients.
+func WithVerboseErrors(enabled bool) Option {
+	return func(c *Config) { c.VerboseErrors = enabled }
+}
+
+// WithCORSOrigins allows browser requests from the given origins.
+func WithCORSOrigins(origins ...string) Option {
+	return func(c *Config) { c.CORSOrigins = append(c.CORSOrigins, origins...) }
+}
+
+// WithMiddleware appends to the Middleware wrapping each git route.
+func WithMiddleware(mw ...Middleware) Option {
+	return func(c *Config) { c.Middleware = append(c.Middleware, mw...) }
+}
+
+// WithLogger sets the Logger.
+func WithLogger(l Logger) Option {
+	return func(c *Config) { c.Logger = l }
+}
+
+// WithTraceWire enables logging of fetch negotiations.
+func WithTraceWire(enabled bool) Option {
+	return func(c *Config) { c.TraceWire = enabled }
+}
+
+// WithFilesystem serves the repositories from fs instead of the OS filesystem.
+func WithFilesystem(fs billy.Filesystem) Option {
+	return func(c *Config) { c.Filesystem = fs }
+}
+
+// WithAccessLog writes an access log of http requests to w.
+func WithAccessLog(w io.Writer) Option {
+	return func(c *Config) { c.AccessLog = w }
+}
+
+// WithAuditLog writes an audit log of authenticated operations to w.
+// Writes are serialized across the servers given the option.
+func WithAuditLog(w io.Writer) Option {
+	lw := &lockedWriter{w: w}
+	return func(c *Config) { c.AuditLog = lw }
+}
+
+// WithMetrics sets the Metrics.
+func WithMetrics(m Metrics) Option {
+	return func(c *Config) { c.Metrics = m }
+}
+
+// WithOnEvent calls fn after each successful fetch and push.
+func WithOnEvent(fn func(Event)) Option {
+	return func(c *Config) { c.OnEvent = fn }
+}
+
+// WithActivity records repository activity in a.
+func WithActivity(a *Activity) Option {
+	return func(c *Config) { c.Activity = a }
+}
@@ -0,0 +1,50 @@
+package gitreposerver
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	corsMethods = "GET, HEAD, POST, OPTIONS"
+	corsHeaders = "Authorization, Content-Type, Content-Encoding, Accept-Encoding, Git-Protocol, If-None-Match"
+	// corsExposed are the response headers git clients in browsers need.
+	corsExposed = "Content-Type, Content-Encoding, ETag, WWW-Authenticate, Retry-After, X-Request-Id"
+	corsMaxAge  = "600"
+)
+
+// cors sets CORS headers for requests from the configured origins
+// and answers their preflight requests.
+func (h *httpHandler) cors(next http.Handler) http.Handler {
+	if len(h.cfg.CORSOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		addVary(rw.Header(), "Origin")
+		if origin == "" || !h.allowOrigin(origin) {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		rw.Header().Set("Access-Control-Expose-Headers", corsExposed)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			// preflights don't carry credentials, answer before auth
+			rw.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			rw.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+			rw.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (h *httpHandler) allowOrigin(origin string) bool {
+	for _, o := range h.cfg.CORSOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
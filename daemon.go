@@ -0,0 +1,173 @@
+package gitreposerver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+)
+
+// RunDaemon serves fetches over the git daemon protocol on addr.
+func RunDaemon(dir, addr string, opts ...Option) error {
+	return RunDaemonContext(context.Background(), dir, addr, opts...)
+}
+
+// RunDaemonContext serves fetches over the git daemon protocol on addr
+// until ctx is cancelled.
+// The protocol is unauthenticated, so only git-upload-pack is served,
+// with a repository path relative to dir.
+func RunDaemonContext(ctx context.Context, dir, addr string, opts ...Option) error {
+	cfg := newConfig(opts)
+	logger := cfg.logger()
+	h := newHTTPHandler(dir, cfg)
+	// sessions still running once this returns drop their events
+	defer h.events.close()
+
+	logger.Info("starting git daemon", "dir", dir, "addr", addr)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("git daemon stopped")
+				return nil
+			}
+			return err
+		}
+		go h.serveDaemon(ctx, conn)
+	}
+}
+
+// serveDaemon serves a single git daemon connection.
+func (h *httpHandler) serveDaemon(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.uploadTimeout())
+	defer cancel()
+	conn.SetDeadline(start.Add(h.cfg.uploadTimeout()))
+
+	info := &requestInfo{}
+	service, repo, err := h.daemonRequest(withRequestInfo(ctx, info), conn)
+	keyvals := []any{
+		"service", service, "repo", repo,
+		"remote", conn.RemoteAddr(), "duration", time.Since(start),
+	}
+	keyvals = append(keyvals, info.packKeyvals()...)
+	if err != nil {
+		code, msg := classifyError(err)
+		if code == http.StatusInternalServerError && !h.cfg.VerboseErrors {
+			msg = "internal server error"
+		}
+		pktline.NewEncoder(conn).Encodef("ERR %s\n", msg)
+		keyvals = append(keyvals, "err", err)
+	}
+	h.log.Info("daemon request", keyvals...)
+}
+
+// daemonRequest reads the request line,
+// "git-upload-pack /path\x00host=host\x00\x00extra\x00...",
+// and serves it.
+func (h *httpHandler) daemonRequest(ctx context.Context, conn net.Conn) (service, repo string, err error) {
+	defer func() {
+		if perr := h.recoverPanic(ctx, recover()); perr != nil {
+			err = perr
+		}
+	}()
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(h.cfg.readHeaderTimeout()))
+	line, typ, err := readPkt(br)
+	if err != nil {
+		return "", "", requestErrorf("read request: %v", err)
+	}
+	if typ != pktData {
+		return "", "", requestErrorf("missing request")
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	params := strings.Split(strings.TrimSuffix(string(line), "\n"), "\x00")
+	service, path, ok := strings.Cut(params[0], " ")
+	if !ok {
+		return "", "", requestErrorf("malformed request %q", params[0])
+	}
+	if service != "git-upload-pack" {
+		return service, "", requestErrorf("service %q not enabled", service)
+	}
+	// extra parameters, such as the protocol version,
+	// follow an empty parameter after the host
+	var extra []string
+	for i := 1; i < len(params); i++ {
+		if params[i] == "" {
+			for _, p := range params[i+1:] {
+				if p != "" {
+					extra = append(extra, p)
+				}
+			}
+			break
+		}
+	}
+
+	name := h.resolveAlias(strings.Trim(path, "/"))
+	repo, err = resolveRepoPath(h.fs, h.roots, name, h.cfg.ExperimentalSHA256)
+	if errors.Is(err, errRepoNotFound) && h.isMirror(initRepoName(name)) {
+		err = h.authorize(ctx, "", initRepoName(name), OpRead)
+		if err == nil {
+			repo, err = h.createMirror(ctx, name)
+		}
+	}
+	if err == nil {
+		err = h.authorize(ctx, "", repo, OpRead)
+	}
+	if err == nil {
+		err = h.checkService(ctx, repo, "git-upload-pack")
+	}
+	version := parseProtocolVersion(strings.Join(extra, ":"))
+	if err == nil {
+		err = h.checkProtocolVersion(version)
+	}
+	if err != nil {
+		return service, name, err
+	}
+	h.syncMirror(ctx, repo)
+	info := requestInfoFromContext(ctx)
+	info.repo = repo
+	ctx = withRepo(ctx, repo)
+	ctx, cancel := h.boundOperation(ctx, func() { conn.Close() })
+	defer cancel()
+
+	rw := &countingReadWriter{ReadWriter: daemonConn{br, conn}}
+	if version == 2 {
+		err = h.serveUploadPackV2(ctx, repo, rw)
+	} else {
+		err = h.serveUploadPack(ctx, repo, rw)
+	}
+	if err == nil {
+		h.events.report(info, "git", remoteHost(conn.RemoteAddr()), rw.in, rw.out)
+		h.cfg.Activity.record(info)
+	}
+	return service, repo, err
+}
+
+// daemonConn reads from the buffered reader
+// that already consumed the request line.
+type daemonConn struct {
+	r *bufio.Reader
+	net.Conn
+}
+
+func (c daemonConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
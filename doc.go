@@ -0,0 +1,7 @@
+// Package gitreposerver serves git repositories with go-git
+// over http, ssh and the git daemon protocol.
+//
+// NewHandler returns an http.Handler to mount in a larger server,
+// Serve, RunSSHContext and RunDaemonContext run a server for one transport.
+// The command in cmd/gitreposerver runs all of them from flags.
+package gitreposerver
@@ -0,0 +1,71 @@
+package gitreposerver
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// drainer tracks the requests in flight,
+// so shutdown can refuse new ones while they finish.
+type drainer struct {
+	mu       sync.Mutex
+	draining bool
+	active   int
+	// idle is closed once draining with no requests in flight.
+	idle chan struct{}
+}
+
+func newDrainer() *drainer {
+	return &drainer{idle: make(chan struct{})}
+}
+
+// enter counts a new request, reporting false once draining.
+func (d *drainer) enter() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return false
+	}
+	d.active++
+	return true
+}
+
+func (d *drainer) leave() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.active--
+	if d.draining && d.active == 0 {
+		close(d.idle)
+	}
+}
+
+// drain refuses new requests, returning a channel
+// closed once those in flight have finished.
+func (d *drainer) drain() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.draining {
+		d.draining = true
+		if d.active == 0 {
+			close(d.idle)
+		}
+	}
+	return d.idle
+}
+
+func (d *drainer) isDraining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// refuseDraining tells a client the server is shutting down,
+// with a 503 it can retry, against another server in a rolling restart.
+func (h *httpHandler) refuseDraining(rw http.ResponseWriter, r *http.Request) {
+	h.logger(r.Context()).Info("refused request while draining", "path", r.URL.Path)
+	rw.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	rw.Header().Set("Connection", "close")
+	http.Error(rw, "server is shutting down", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,200 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// This implements the read only half of the dumb http protocol,
+// for clients that can only GET files: HEAD, info/refs without a service,
+// objects/info/packs and the loose objects and packs under objects.
+// See https://git-scm.com/docs/http-protocol#_dumb_clients
+
+// dumbObjectPath matches the files under objects that dumb clients may get,
+// nothing else in the repository is served.
+var dumbObjectPath = regexp.MustCompile(`^(?:[0-9a-f]{2}/[0-9a-f]{38}|pack/pack-[0-9a-f]{40}\.(?:pack|idx))$`)
+
+// dumbContentTypes are the types git http-backend sends each kind of file with.
+var dumbContentTypes = map[string]string{
+	".pack": "application/x-git-packed-objects",
+	".idx":  "application/x-git-packed-objects-toc",
+	"":      "application/x-git-loose-object",
+}
+
+// dumbInfoRefs serves info/refs without a service, as update-server-info writes it:
+// each visible ref but HEAD with its id, followed by the peeled id of annotated tags.
+func (h *httpHandler) dumbInfoRefs(rw http.ResponseWriter, r *http.Request) {
+	if !h.dumbMethod(rw, r) {
+		return
+	}
+	repo := RepoFromContext(r.Context())
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	iter, err := sto.IterReferences()
+	if err != nil {
+		h.logger(r.Context()).Error("list references", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	hidden := h.hiddenRefs(r.Context(), repo)
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(name, "refs/") && !matchRef(hidden, name) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		h.logger(r.Context()).Error("list references", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	var buf bytes.Buffer
+	for _, ref := range refs {
+		fmt.Fprintf(&buf, "%s\t%s\n", ref.Hash(), ref.Name())
+		if peeled, ok := peelTag(sto, ref.Hash()); ok {
+			fmt.Fprintf(&buf, "%s\t%s^{}\n", peeled, ref.Name())
+		}
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	setNoCache(rw.Header())
+	if r.Method == http.MethodHead {
+		return
+	}
+	rw.Write(buf.Bytes())
+}
+
+// dumbHEAD serves the repository's HEAD, the branch a dumb clone checks out.
+func (h *httpHandler) dumbHEAD(rw http.ResponseWriter, r *http.Request) {
+	if !h.dumbMethod(rw, r) {
+		return
+	}
+	repo := RepoFromContext(r.Context())
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	head, err := sto.Reference(plumbing.HEAD)
+	if err != nil {
+		h.logger(r.Context()).Error("read HEAD", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain")
+	setNoCache(rw.Header())
+	if r.Method == http.MethodHead {
+		return
+	}
+	if head.Type() == plumbing.SymbolicReference {
+		fmt.Fprintf(rw, "ref: %s\n", head.Target())
+	} else {
+		fmt.Fprintf(rw, "%s\n", head.Hash())
+	}
+}
+
+// dumbObjects serves /{repo}/objects/{path}:
+// info/packs listing the packs, and the loose objects and packs themselves.
+// Other paths, including alternates, are not found,
+// as are files that aren't regular files, so symlinks aren't followed out.
+func (h *httpHandler) dumbObjects(rw http.ResponseWriter, r *http.Request) {
+	if !h.dumbMethod(rw, r) {
+		return
+	}
+	repo := RepoFromContext(r.Context())
+	arg := routeArgFromContext(r.Context())
+	if arg == "info/packs" {
+		h.dumbInfoPacks(rw, r)
+		return
+	}
+	if !dumbObjectPath.MatchString(arg) {
+		http.NotFound(rw, r)
+		return
+	}
+
+	name := path.Join("/", repo, "objects", arg)
+	fi, err := h.fs.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && !fi.Mode().IsRegular()) {
+		http.NotFound(rw, r)
+		return
+	} else if err != nil {
+		h.logger(r.Context()).Error("stat object file", "repo", repo, "file", arg, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	f, err := h.fs.Open(name)
+	if err != nil {
+		h.logger(r.Context()).Error("open object file", "repo", repo, "file", arg, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	defer f.Close()
+	// objects never change once written
+	rw.Header().Set("Content-Type", dumbContentTypes[path.Ext(arg)])
+	rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(rw, r, "", fi.ModTime(), f)
+}
+
+// dumbInfoPacks serves objects/info/packs, the packs a dumb client can get.
+func (h *httpHandler) dumbInfoPacks(rw http.ResponseWriter, r *http.Request) {
+	repo := RepoFromContext(r.Context())
+	entries, err := h.fs.ReadDir(path.Join("/", repo, "objects", "pack"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		h.logger(r.Context()).Error("list packs", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if e.Mode().IsRegular() && dumbObjectPath.MatchString("pack/"+e.Name()) && strings.HasSuffix(e.Name(), ".pack") {
+			fmt.Fprintf(&buf, "P %s\n", e.Name())
+		}
+	}
+	buf.WriteString("\n")
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	setNoCache(rw.Header())
+	if r.Method == http.MethodHead {
+		return
+	}
+	rw.Write(buf.Bytes())
+}
+
+// dumbMethod only allows GET and HEAD, the dumb protocol never writes.
+func (h *httpHandler) dumbMethod(rw http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
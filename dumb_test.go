@@ -0,0 +1,153 @@
+package gitreposerver
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// dumbClone clones url with git's dumb http client into a new dir and returns it.
+func dumbClone(t *testing.T, url string) string {
+	t.Helper()
+	dir := t.TempDir()
+	cmd := exec.Command("git", "clone", "-q", url, "out")
+	cmd.Dir = dir
+	cmd.Env = append(gitEnv(t.TempDir()), "GIT_SMART_HTTP=0")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("dumb clone: %v: %s", err, out)
+	}
+	return filepath.Join(dir, "out")
+}
+
+func TestDumbClone(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		name := "loose"
+		if packed {
+			name = "packed"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := newTestRepo(t, 3)
+			if packed {
+				runGit(t, filepath.Join(dir, "repo.git"), "repack", "-adq")
+			}
+			srv := newTestServer(t, dir, WithDumbHTTP(true))
+			out := dumbClone(t, srv.URL+"/repo.git")
+			if n := strings.TrimSpace(runGit(t, out, "rev-list", "--count", "HEAD")); n != "3" {
+				t.Errorf("cloned %s commits, want 3", n)
+			}
+			runGit(t, out, "fsck", "--strict")
+		})
+	}
+}
+
+func TestDumbHTTPDisabled(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	srv := newTestServer(t, dir)
+	for _, p := range []string{"/repo.git/info/refs", "/repo.git/HEAD", "/repo.git/objects/info/packs"} {
+		res, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode == http.StatusOK {
+			t.Errorf("GET %s without EnableDumbHTTP: status 200", p)
+		}
+	}
+}
+
+func TestDumbHiddenRefs(t *testing.T) {
+	dir, secret := newHiddenRefRepo(t)
+	srv := newTestServer(t, dir, WithDumbHTTP(true), WithHiddenRefs("refs/heads/secret"))
+	res, err := http.Get(srv.URL + "/repo.git/info/refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), secret) || !strings.Contains(string(b), "refs/heads/main") {
+		t.Errorf("info/refs:\n%s", b)
+	}
+}
+
+func TestDumbObjectPaths(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	bare := filepath.Join(dir, "repo.git")
+	head := strings.TrimSpace(runGit(t, bare, "rev-parse", "HEAD"))
+	loose := "objects/" + head[:2] + "/" + head[2:]
+	// a loose object pointing outside the repository
+	secret := filepath.Join(t.TempDir(), "secret")
+	writeTestFile(t, secret, "secret\n")
+	link := strings.Repeat("1", 40)
+	if err := os.MkdirAll(filepath.Join(bare, "objects", "11"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(bare, "objects", "11", link[2:])); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(bare, "objects", "info", "alternates"), "/somewhere/else\n")
+	srv := newTestServer(t, dir, WithDumbHTTP(true))
+
+	tests := []struct {
+		path string
+		want int
+	}{
+		{loose, http.StatusOK},
+		{"objects/info/packs", http.StatusOK},
+		{"objects/info/alternates", http.StatusNotFound},
+		{"objects/11/" + link[2:], http.StatusNotFound},
+		{"objects/" + head[:2] + "/" + strings.ToUpper(head[2:]), http.StatusNotFound},
+		{"objects/pack/pack-123.pack", http.StatusNotFound},
+		{"objects/%2e%2e/config", http.StatusNotFound},
+		{"config", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		res, err := http.Get(srv.URL + "/repo.git/" + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.want {
+			t.Errorf("GET %s: status %d, want %d", tt.path, res.StatusCode, tt.want)
+		}
+	}
+}
+
+func TestDumbMethods(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	srv := newTestServer(t, dir, WithDumbHTTP(true))
+	for _, p := range []string{"/repo.git/info/refs", "/repo.git/HEAD", "/repo.git/objects/info/packs"} {
+		for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+			req, err := http.NewRequest(method, srv.URL+p, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusMethodNotAllowed || res.Header.Get("Allow") != "GET, HEAD" {
+				t.Errorf("%s %s: status %d, Allow %q, want 405 and GET, HEAD", method, p, res.StatusCode, res.Header.Get("Allow"))
+			}
+		}
+		req, err := http.NewRequest(http.MethodHead, srv.URL+p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("HEAD %s: status %d", p, res.StatusCode)
+		}
+	}
+}
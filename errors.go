@@ -0,0 +1,84 @@
+package gitreposerver
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// errMalformedRequest wraps errors decoding a client request.
+var errMalformedRequest = errors.New("malformed request")
+
+// requestError is an error caused by the client's request,
+// its message is safe to send back.
+type requestError struct {
+	msg string
+}
+
+func (e *requestError) Error() string { return e.msg }
+
+func requestErrorf(format string, args ...any) error {
+	return &requestError{fmt.Sprintf(format, args...)}
+}
+
+// classifyError maps err to the http status and message sent to the client.
+// Anything not recognised as the client's fault is a 500,
+// other 5xx statuses are for limits of the server, with safe messages.
+func classifyError(err error) (int, string) {
+	var reqErr *requestError
+	var unexpected *packp.ErrUnexpectedData
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errRepoNotFound), errors.Is(err, transport.ErrRepositoryNotFound), errors.Is(err, errRepoOutsideRoots):
+		return http.StatusNotFound, errRepoNotFound.Error()
+	case errors.Is(err, errNotBareRepo), errors.Is(err, errRefNotFound), errors.Is(err, errFileNotFound):
+		return http.StatusNotFound, err.Error()
+	case errors.Is(err, errUnsupportedObjectFormat):
+		return http.StatusNotImplemented, err.Error()
+	case errors.Is(err, errBodyTooLarge), errors.As(err, &maxErr):
+		return http.StatusRequestEntityTooLarge, errBodyTooLarge.Error()
+	case errors.Is(err, errUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType, err.Error()
+	case errors.Is(err, transport.ErrAuthenticationRequired):
+		return http.StatusUnauthorized, err.Error()
+	case errors.Is(err, transport.ErrAuthorizationFailed), errors.Is(err, errMirror), errors.Is(err, errServiceDisabled),
+		errors.Is(err, errTooManyRefs), errors.Is(err, errReadOnly), errors.Is(err, errOldProtocol),
+		errors.Is(err, errPushDisabled), errors.Is(err, errDumbHTTP), errors.Is(err, errAnonymousPush):
+		return http.StatusForbidden, err.Error()
+	case errors.Is(err, errInvalidRepoPath),
+		errors.Is(err, errMalformedRequest),
+		errors.Is(err, errMalformedV2Request),
+		errors.Is(err, errTooManyWants),
+		errors.Is(err, pktline.ErrInvalidPktLen),
+		errors.Is(err, gzip.ErrHeader),
+		errors.Is(err, gzip.ErrChecksum),
+		errors.As(err, &reqErr),
+		errors.As(err, &unexpected):
+		return http.StatusBadRequest, err.Error()
+	}
+	return http.StatusInternalServerError, err.Error()
+}
+
+// clientError returns the status and message to send for err,
+// hiding the details of server faults unless VerboseErrors is set.
+// err is kept for the request log.
+func (h *httpHandler) clientError(r *http.Request, err error) (int, string) {
+	info := requestInfoFromContext(r.Context())
+	info.err = err
+	code, msg := classifyError(err)
+	if code == http.StatusInternalServerError && !h.cfg.VerboseErrors {
+		msg = "internal server error, request id " + info.id
+	}
+	return code, msg
+}
+
+// httpError responds to the client with the status and message for err.
+func (h *httpHandler) httpError(rw http.ResponseWriter, r *http.Request, err error) {
+	code, msg := h.clientError(r, err)
+	http.Error(rw, msg, code)
+}
@@ -0,0 +1,198 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+const (
+	eventWorkers   = 4
+	eventQueueSize = 256
+)
+
+// Event describes a completed fetch or push, for Config.OnEvent.
+type Event struct {
+	Time time.Time `json:"time"`
+	// Service is upload-pack or receive-pack.
+	Service string `json:"service"`
+	// Transport is http, ssh or git for the git daemon.
+	Transport string `json:"transport"`
+	Repo      string `json:"repo"`
+	Identity  string `json:"identity,omitempty"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	// Updates are the refs a push changed.
+	Updates []RefUpdate `json:"updates,omitempty"`
+	// Bytes is the size of the response to a fetch or the request of a push.
+	Bytes int64 `json:"bytes"`
+}
+
+// RefUpdate is a ref changed by a push,
+// Old is all zeros for a created ref and New for a deleted one.
+type RefUpdate struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// eventQueue delivers events to a callback from a fixed pool of goroutines,
+// so a slow callback doesn't hold up responses.
+// The goroutines start with the first event and stop once it's closed.
+// A nil eventQueue drops events.
+type eventQueue struct {
+	fn    func(Event)
+	log   Logger
+	c     chan Event
+	start sync.Once
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newEventQueue(fn func(Event), log Logger) *eventQueue {
+	if fn == nil {
+		return nil
+	}
+	return &eventQueue{fn: fn, log: log, c: make(chan Event, eventQueueSize)}
+}
+
+func (q *eventQueue) work() {
+	for ev := range q.c {
+		q.call(ev)
+	}
+}
+
+func (q *eventQueue) call(ev Event) {
+	defer func() {
+		if v := recover(); v != nil {
+			q.log.Error("event callback panicked", "repo", ev.Repo, "service", ev.Service, "panic", v)
+		}
+	}()
+	q.fn(ev)
+}
+
+// send queues ev, dropping it if the queue is full or closed.
+func (q *eventQueue) send(ev Event) {
+	if q == nil {
+		return
+	}
+	q.start.Do(func() {
+		for i := 0; i < eventWorkers; i++ {
+			go q.work()
+		}
+	})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		q.log.Warn("server stopped, dropping event", "repo", ev.Repo, "service", ev.Service)
+		return
+	}
+	select {
+	case q.c <- ev:
+	default:
+		q.log.Warn("event queue full, dropping event", "repo", ev.Repo, "service", ev.Service)
+	}
+}
+
+// close stops the goroutines once they've delivered the queued events.
+func (q *eventQueue) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.c)
+	}
+}
+
+// report sends the event a request recorded in info, if it succeeded.
+// in and out are the bytes read from and written to the client.
+func (q *eventQueue) report(info *requestInfo, transport, client string, in, out int64) {
+	if q == nil || info.event == nil || info.failure != "" {
+		return
+	}
+	ev := *info.event
+	ev.Time = time.Now()
+	ev.Transport = transport
+	ev.Repo = info.repo
+	ev.Identity = info.identity
+	ev.ClientIP = client
+	ev.Bytes = out
+	if ev.Service == "receive-pack" {
+		ev.Bytes = in
+	}
+	q.send(ev)
+}
+
+// refUpdates returns the commands with an ok status in rs.
+func refUpdates(cmds []*packp.Command, rs *packp.ReportStatus) []RefUpdate {
+	ok := make(map[string]bool)
+	for _, s := range rs.CommandStatuses {
+		if s.Status == "ok" {
+			ok[s.ReferenceName.String()] = true
+		}
+	}
+	var updates []RefUpdate
+	for _, cmd := range cmds {
+		if ok[cmd.Name.String()] {
+			updates = append(updates, RefUpdate{Name: cmd.Name.String(), Old: cmd.Old.String(), New: cmd.New.String()})
+		}
+	}
+	return updates
+}
+
+// countingReadWriter counts the bytes read and written on a stream.
+type countingReadWriter struct {
+	io.ReadWriter
+	in, out int64
+}
+
+func (c *countingReadWriter) Read(p []byte) (int, error) {
+	n, err := c.ReadWriter.Read(p)
+	c.in += int64(n)
+	return n, err
+}
+
+func (c *countingReadWriter) Write(p []byte) (int, error) {
+	n, err := c.ReadWriter.Write(p)
+	c.out += int64(n)
+	return n, err
+}
+
+// Webhook returns an OnEvent callback posting each event as JSON to url.
+func Webhook(url string, logger Logger) func(Event) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ev Event) {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			logger.Error("encode webhook event", "err", err)
+			return
+		}
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			logger.Error("create webhook request", "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			if res.StatusCode >= 300 {
+				err = fmt.Errorf("status %s", res.Status)
+			}
+		}
+		if err != nil {
+			logger.Warn("webhook", "repo", ev.Repo, "service", ev.Service, "err", err)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package gitreposerver
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestEventQueueGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	got := make(chan Event, 1)
+	q := newEventQueue(func(ev Event) { got <- ev }, testLogger{t})
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("%d goroutines before the first event, want %d", n, before)
+	}
+
+	q.send(Event{Repo: "repo.git"})
+	if ev := <-got; ev.Repo != "repo.git" {
+		t.Errorf("got event for %q", ev.Repo)
+	}
+	q.close()
+	q.send(Event{Repo: "late.git"})
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%d goroutines after close, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case ev := <-got:
+		t.Errorf("event for %q delivered after close", ev.Repo)
+	default:
+	}
+}
@@ -0,0 +1,81 @@
+package gitreposerver
+
+import (
+	"strconv"
+	"strings"
+)
+
+// objectFilter is a partial clone filter spec.
+// See the --filter option of git rev-list.
+type objectFilter struct {
+	// noBlobs omits all blobs, blob:none.
+	noBlobs bool
+	// blobLimit omits blobs of at least this size, blob:limit=<n>,
+	// negative for no limit.
+	blobLimit int64
+	// treeDepth omits trees and blobs at least this deep
+	// below the root tree, tree:<depth>, negative for no limit.
+	treeDepth int
+}
+
+var noFilter = objectFilter{blobLimit: -1, treeDepth: -1}
+
+// parseFilter parses the filter specs supported by planPack.
+func parseFilter(spec string) (objectFilter, error) {
+	f := noFilter
+	switch {
+	case spec == "blob:none":
+		f.noBlobs = true
+	case strings.HasPrefix(spec, "blob:limit="):
+		n, err := parseFilterSize(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil {
+			return f, requestErrorf("invalid filter %q", spec)
+		}
+		f.blobLimit = n
+	case strings.HasPrefix(spec, "tree:"):
+		n, err := strconv.Atoi(strings.TrimPrefix(spec, "tree:"))
+		if err != nil || n < 0 {
+			return f, requestErrorf("invalid filter %q", spec)
+		}
+		f.treeDepth = n
+	default:
+		return f, requestErrorf("unsupported filter %q", spec)
+	}
+	return f, nil
+}
+
+// parseFilterSize parses a size with an optional k, m or g suffix.
+func parseFilterSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, requestErrorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// omitTree reports whether a tree at depth below the root tree is filtered out.
+func (f objectFilter) omitTree(depth int) bool {
+	return f.treeDepth >= 0 && depth >= f.treeDepth
+}
+
+// omitBlob reports whether a blob of size at depth is filtered out.
+func (f objectFilter) omitBlob(size int64, depth int) bool {
+	return f.noBlobs || f.omitTree(depth) || (f.blobLimit >= 0 && size >= f.blobLimit)
+}
+
+// needsSize reports whether omitBlob depends on the blob size.
+func (f objectFilter) needsSize() bool {
+	return !f.noBlobs && f.blobLimit >= 0
+}
@@ -0,0 +1,89 @@
+package gitreposerver
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		spec string
+		want objectFilter
+		err  bool
+	}{
+		{"blob:none", objectFilter{noBlobs: true, blobLimit: -1, treeDepth: -1}, false},
+		{"blob:limit=0", objectFilter{blobLimit: 0, treeDepth: -1}, false},
+		{"blob:limit=10", objectFilter{blobLimit: 10, treeDepth: -1}, false},
+		{"blob:limit=2k", objectFilter{blobLimit: 2 << 10, treeDepth: -1}, false},
+		{"blob:limit=1m", objectFilter{blobLimit: 1 << 20, treeDepth: -1}, false},
+		{"tree:0", objectFilter{blobLimit: -1, treeDepth: 0}, false},
+		{"tree:3", objectFilter{blobLimit: -1, treeDepth: 3}, false},
+		{"blob:limit=", noFilter, true},
+		{"blob:limit=-1", noFilter, true},
+		{"blob:limit=1x", noFilter, true},
+		{"tree:-1", noFilter, true},
+		{"tree:", noFilter, true},
+		{"sparse:oid=abc", noFilter, true},
+		{"combine:blob:none+tree:1", noFilter, true},
+	}
+	for _, tt := range tests {
+		got, err := parseFilter(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("parseFilter(%q): %v, want error %v", tt.spec, err, tt.err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseFilter(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+// countPrefixed returns the number of fields of out starting with prefix,
+// such as the missing objects git rev-list --missing=print marks with ?.
+func countPrefixed(out, prefix string) int {
+	n := 0
+	for _, f := range strings.Fields(out) {
+		if strings.HasPrefix(f, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPartialClone(t *testing.T) {
+	dir := newTestRepo(t, 3)
+	srv := newTestServer(t, dir)
+
+	// the blobs of all 3 versions of file.txt and the 3 added files
+	blobs := countPrefixed(runGit(t, filepath.Join(dir, "repo.git"), "rev-list", "--objects", "--filter=blob:none", "--filter-print-omitted", "main"), "~")
+	if blobs != 6 {
+		t.Fatalf("repository has %d blobs, want 6", blobs)
+	}
+	out := cloneV2(t, srv.URL+"/repo.git", "--filter=blob:none", "--no-checkout")
+	if missing := countPrefixed(runGit(t, out, "rev-list", "--objects", "--missing=print", "HEAD"), "?"); missing != blobs {
+		t.Errorf("blob:none clone is missing %d objects, want its %d blobs", missing, blobs)
+	}
+
+	// checking out fetches the missing blobs of the commit
+	runGit(t, out, "-c", "protocol.version=2", "checkout", "-q", "main")
+	if got := readTestFile(t, filepath.Join(out, "file.txt")); got != "version 3\n" {
+		t.Errorf("checked out file.txt %q", got)
+	}
+	runGit(t, out, "-c", "protocol.version=2", "fsck", "--no-progress")
+}
+
+func TestPartialCloneTreeDepth(t *testing.T) {
+	dir := newTestRepo(t, 2)
+	srv := newTestServer(t, dir)
+
+	out := cloneV2(t, srv.URL+"/repo.git", "--filter=tree:0", "--no-checkout")
+	// rev-list can't list what's under the missing root trees
+	if missing := countPrefixed(runGit(t, out, "rev-list", "--objects", "--missing=print", "HEAD"), "?"); missing != 2 {
+		t.Errorf("tree:0 clone is missing %d objects, want its 2 root trees", missing)
+	}
+	runGit(t, out, "-c", "protocol.version=2", "checkout", "-q", "main")
+	if got := readTestFile(t, filepath.Join(out, "file2.txt")); got != "file 2\n" {
+		t.Errorf("checked out file2.txt %q", got)
+	}
+}
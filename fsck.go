@@ -0,0 +1,139 @@
+package gitreposerver
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// fsckObjects checks that every object in sto is well formed,
+// like git's transfer.fsckObjects.
+func fsckObjects(sto storer.EncodedObjectStorer) error {
+	iter, err := sto.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return fmt.Errorf("list objects: %w", err)
+	}
+	defer iter.Close()
+	return iter.ForEach(func(obj plumbing.EncodedObject) error {
+		if err := fsckObject(sto, obj); err != nil {
+			return fmt.Errorf("fsck %s %s: %w", obj.Type(), obj.Hash(), err)
+		}
+		return nil
+	})
+}
+
+func fsckObject(sto storer.EncodedObjectStorer, obj plumbing.EncodedObject) error {
+	switch obj.Type() {
+	case plumbing.CommitObject:
+		commit, err := object.DecodeCommit(sto, obj)
+		if err != nil {
+			return err
+		}
+		if commit.TreeHash.IsZero() {
+			return errors.New("missing tree")
+		}
+		if commit.Author.Email == "" && commit.Author.Name == "" {
+			return errors.New("missing author")
+		}
+		if commit.Committer.Email == "" && commit.Committer.Name == "" {
+			return errors.New("missing committer")
+		}
+	case plumbing.TreeObject:
+		tree, err := object.DecodeTree(sto, obj)
+		if err != nil {
+			return err
+		}
+		var prev string
+		for i, e := range tree.Entries {
+			switch {
+			case e.Name == "", strings.ContainsRune(e.Name, '/'):
+				return fmt.Errorf("bad entry name %q", e.Name)
+			case e.Name == ".", e.Name == "..", strings.EqualFold(e.Name, ".git"):
+				return fmt.Errorf("disallowed entry name %q", e.Name)
+			}
+			switch e.Mode {
+			case filemode.Dir, filemode.Regular, filemode.Executable, filemode.Symlink, filemode.Submodule, filemode.Deprecated:
+			default:
+				return fmt.Errorf("entry %q: bad mode %o", e.Name, e.Mode)
+			}
+			// git sorts entries as if trees had a trailing slash
+			name := e.Name
+			if e.Mode == filemode.Dir {
+				name += "/"
+			}
+			if i > 0 && name <= prev {
+				return fmt.Errorf("entries not sorted or duplicated at %q", e.Name)
+			}
+			prev = name
+		}
+	case plumbing.TagObject:
+		tag, err := object.DecodeTag(sto, obj)
+		if err != nil {
+			return err
+		}
+		if tag.Target.IsZero() {
+			return errors.New("missing target")
+		}
+		if tag.Name == "" {
+			return errors.New("missing tag name")
+		}
+		if !tag.TargetType.Valid() {
+			return errors.New("bad target type")
+		}
+	}
+	return nil
+}
+
+// checkConnected checks that every object reachable from h exists.
+// The walk stops at objects already in live,
+// as those were checked when they were received.
+func checkConnected(objects, live storer.EncodedObjectStorer, h plumbing.Hash) error {
+	seen := make(map[plumbing.Hash]bool)
+	stack := []plumbing.Hash{h}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if live.HasEncodedObject(h) == nil {
+			continue
+		}
+		obj, err := objects.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return fmt.Errorf("get object %s: %w", h, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			commit, err := object.DecodeCommit(objects, obj)
+			if err != nil {
+				return fmt.Errorf("decode commit %s: %w", h, err)
+			}
+			stack = append(stack, commit.TreeHash)
+			stack = append(stack, commit.ParentHashes...)
+		case plumbing.TreeObject:
+			tree, err := object.DecodeTree(objects, obj)
+			if err != nil {
+				return fmt.Errorf("decode tree %s: %w", h, err)
+			}
+			for _, e := range tree.Entries {
+				if e.Mode != filemode.Submodule {
+					stack = append(stack, e.Hash)
+				}
+			}
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(objects, obj)
+			if err != nil {
+				return fmt.Errorf("decode tag %s: %w", h, err)
+			}
+			stack = append(stack, tag.Target)
+		}
+	}
+	return nil
+}
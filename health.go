@@ -0,0 +1,150 @@
+package gitreposerver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+var errFoundRepo = errors.New("found repository")
+
+// healthz reports whether repositories can be served,
+// checking the repository named by ?repo= or the first one found under dir.
+// While shutting down it fails, so load balancers stop sending requests.
+func (h *httpHandler) healthz(rw http.ResponseWriter, r *http.Request) {
+	if h.drain.isDraining() {
+		http.Error(rw, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	name := r.URL.Query().Get("repo")
+	if name != "" && h.cfg.authEnabled() && !h.cfg.AnonymousRead {
+		var ok bool
+		r, ok = h.checkAuth(rw, r, name, false)
+		if !ok {
+			return
+		}
+	}
+
+	err := h.checkRepo(name)
+	if errors.Is(err, errInvalidRepoPath) {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		h.logger(r.Context()).Warn("health check failed", "repo", name, "err", err)
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	rw.Header().Set("content-type", "text/plain; charset=utf-8")
+	setNoCache(rw.Header())
+	fmt.Fprintln(rw, "ok")
+}
+
+// checkRepo verifies that the named repository,
+// or any repository if name is empty, can be opened.
+func (h *httpHandler) checkRepo(name string) error {
+	fi, err := h.fs.Stat("/")
+	if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", h.dir)
+	}
+
+	var repo string
+	if name != "" {
+		repo, err = resolveRepoPath(h.fs, h.roots, name, h.cfg.ExperimentalSHA256)
+	} else {
+		repo, err = findRepo(h.fs, h.roots)
+	}
+	if err != nil {
+		return err
+	}
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		return fmt.Errorf("create endpoint: %w", err)
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		return fmt.Errorf("load repository: %w", err)
+	}
+	if _, err := sto.Reference(plumbing.HEAD); err != nil {
+		return fmt.Errorf("read HEAD: %w", err)
+	}
+	return nil
+}
+
+// findRepo returns the path in fsys of the first repository in it.
+func findRepo(fsys billy.Filesystem, roots *repoRoots) (string, error) {
+	var found string
+	err := walkRepos(fsys, roots, func(repo string) error {
+		found = repo
+		return errFoundRepo
+	})
+	if errors.Is(err, errFoundRepo) {
+		return found, nil
+	} else if err != nil {
+		return "", err
+	}
+	return "", errRepoNotFound
+}
+
+// walkRepos calls fn with the slash separated path in fsys
+// of each repository in it.
+// It doesn't look for repositories nested inside others,
+// or inside symlinked directories, but includes symlinked repositories in roots.
+func walkRepos(fsys billy.Filesystem, roots *repoRoots, fn func(repo string) error) error {
+	return walkFS(fsys, "/", func(name string, fi fs.FileInfo) error {
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			if st, err := fsys.Stat(name); err != nil || !st.IsDir() || !isRepo(fsys, name) ||
+				roots.check(strings.TrimPrefix(name, "/")) != nil {
+				return nil
+			}
+			return fn(strings.TrimPrefix(name, "/"))
+		}
+		if !fi.IsDir() || !isRepo(fsys, name) {
+			return nil
+		}
+		if err := fn(strings.TrimPrefix(name, "/")); err != nil {
+			return err
+		}
+		return filepath.SkipDir
+	})
+}
+
+// walkFS walks the tree at root in fsys like filepath.Walk,
+// without following symlinks.
+func walkFS(fsys billy.Filesystem, root string, fn func(name string, fi fs.FileInfo) error) error {
+	fi, err := fsys.Lstat(root)
+	if err != nil {
+		return err
+	}
+	return walkFSDir(fsys, root, fi, fn)
+}
+
+func walkFSDir(fsys billy.Filesystem, name string, fi fs.FileInfo, fn func(name string, fi fs.FileInfo) error) error {
+	err := fn(name, fi)
+	if !fi.IsDir() || errors.Is(err, filepath.SkipDir) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := walkFSDir(fsys, path.Join(name, e.Name()), e, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
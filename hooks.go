@@ -0,0 +1,96 @@
+package gitreposerver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// errHookFailed is returned when a hook exits with an error,
+// rejecting the push for pre-receive.
+var errHookFailed = errors.New("hook failed")
+
+// hookRunner runs the hooks of a repository during a push.
+// A nil hookRunner runs nothing.
+type hookRunner struct {
+	// dir holds the hooks.
+	dir string
+	// gitDir is the repository, hooks run in it.
+	gitDir string
+	// env is added to the server's environment.
+	env []string
+	// timeout bounds each hook.
+	timeout time.Duration
+	log     Logger
+	// out receives the hooks' stdout and stderr.
+	out io.Writer
+}
+
+// run runs the named hook if it exists and is executable,
+// passing it the "<old> <new> <ref>" lines for cmds on stdin
+// and env in addition to r.env.
+func (r *hookRunner) run(ctx context.Context, name string, cmds []*packp.Command, env ...string) error {
+	if r == nil {
+		return nil
+	}
+	path := filepath.Join(r.dir, name)
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() || fi.Mode()&0o111 == 0 {
+		return nil
+	}
+
+	var stdin strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&stdin, "%s %s %s\n", cmd.Old, cmd.New, cmd.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	// The hook gets a pipe rather than r.out so a timed out hook's
+	// children still holding it open don't keep Wait from returning.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("run %s hook: %w", name, err)
+	}
+	defer pr.Close()
+	c := exec.CommandContext(ctx, path)
+	c.Dir = r.gitDir
+	c.Env = append(append(os.Environ(), r.env...), env...)
+	c.Stdin = strings.NewReader(stdin.String())
+	c.Stdout = pw
+	c.Stderr = pw
+	err = c.Start()
+	pw.Close()
+	if err == nil {
+		copied := make(chan struct{})
+		go func() {
+			io.Copy(r.out, pr)
+			close(copied)
+		}()
+		err = c.Wait()
+		select {
+		case <-copied:
+		case <-ctx.Done():
+		}
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		r.log.Warn("hook timed out", "hook", name, "dir", r.gitDir)
+		return fmt.Errorf("%w: %s timed out", errHookFailed, name)
+	case errors.As(err, &exitErr):
+		r.log.Info("hook failed", "hook", name, "dir", r.gitDir, "err", err)
+		return fmt.Errorf("%w: %s: %v", errHookFailed, name, err)
+	case err != nil:
+		return fmt.Errorf("run %s hook: %w", name, err)
+	}
+	return nil
+}
@@ -1,135 +1,1347 @@
-package main
+package gitreposerver
 
 import (
-	"compress/gzip"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/format/pktline"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
 	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/server"
 )
 
-func RunHTTP(dir, addr string) error {
-	log.Printf("Starting HTTP server for dir '%s' on addr '%s'\n", dir, addr)
+// RunHTTP serves git over http on addr.
+func RunHTTP(dir, addr string, opts ...Option) error {
+	return RunHTTPContext(context.Background(), dir, addr, opts...)
+}
 
-	http.HandleFunc("/info/refs", httpInfoRefs(dir))
-	http.HandleFunc("/git-upload-pack", httpGitUploadPack(dir))
+// RunHTTPContext serves git over http on addr until ctx is cancelled.
+// addr may be a unix socket path prefixed with "unix:".
+// dir and addr take precedence over WithDir and WithAddr.
+func RunHTTPContext(ctx context.Context, dir, addr string, opts ...Option) error {
+	return Serve(ctx, append(opts, WithDir(dir), WithAddr(addr))...)
+}
 
-	err := http.ListenAndServe(addr, nil)
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		log.Printf("Error during ListenAndServe: %v\n", err)
-			log.Printf("HTTP server failed to start on addr '%s'\n", addr)
+// RunHTTPMulti serves git over http on each of addrs,
+// such as both an IPv4 and an IPv6 address.
+func RunHTTPMulti(dir string, addrs []string, opts ...Option) error {
+	return RunHTTPMultiContext(context.Background(), dir, addrs, opts...)
+}
+
+// RunHTTPMultiContext serves git over http on each of addrs until ctx is cancelled,
+// with one handler shared by all of them, so limits and caches are too.
+// If any address can't be listened on nothing is served,
+// and if any server fails the others are shut down.
+// The errors of all the servers are returned together.
+func RunHTTPMultiContext(ctx context.Context, dir string, addrs []string, opts ...Option) error {
+	if len(addrs) == 0 {
+		return errors.New("config: no listen address")
+	}
+	cfg := newConfig(append(opts, WithDir(dir), WithAddr(addrs[0])))
+	for _, addr := range addrs {
+		if addr == "" {
+			return errors.New("config: empty listen address")
+		}
+	}
+	if err := cfg.validate(); err != nil {
 		return err
 	}
-	log.Println("HTTP server stopped")
-	return nil
+	return serveHTTP(ctx, cfg, addrs)
 }
 
-func httpInfoRefs(dir string) http.HandlerFunc {
-	return func(rw http.ResponseWriter, r *http.Request) {
-		if r.URL.Query().Get("service") != "git-upload-pack" {
-			http.Error(rw, "only smart git", http.StatusForbidden)
-			log.Printf("Request to /info/refs with invalid service: %s\n", r.URL.Query().Get("service"))
-			return
-		}
+// Serve serves git over http as configured by opts until ctx is cancelled,
+// WithDir and WithAddr set what's served and where.
+// The configuration is validated before anything is started.
+// In-flight requests are given the drain timeout to complete
+// before their connections are closed, new git requests
+// meanwhile get a 503 with a Retry-After.
+func Serve(ctx context.Context, opts ...Option) error {
+	cfg := newConfig(opts)
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	return serveHTTP(ctx, cfg, []string{cfg.Addr})
+}
 
-		rw.Header().Set("content-type", "application/x-git-upload-pack-advertisement")
+// serveHTTP runs an http server for each of addrs sharing one handler,
+// shutting all of them down when ctx is cancelled or one fails.
+func serveHTTP(ctx context.Context, cfg Config, addrs []string) error {
+	dir := cfg.Dir
+	logger := cfg.logger()
+	h := newHTTPHandler(dir, cfg)
+	handler := newHandler(h)
+	tlsConfig := cfg.tlsConfig()
+	if len(cfg.ACMEHosts) > 0 && !cfg.acme() {
+		logger.Info("using the tls certificate file instead of acme", "cert", cfg.TLSCertFile)
+	}
+	// the acme challenge and https redirect servers are last,
+	// redirecting to the port of the first address
+	redirectHandler := redirectHTTPS(addrs[0])
+	challenge, redirect := -1, -1
+	var challengeHandler http.Handler
+	if cfg.acme() {
+		challengeHandler = cfg.useACME(tlsConfig, redirectHandler)
+		challenge = len(addrs)
+		addrs = append(addrs[:len(addrs):len(addrs)], cfg.acmeHTTPAddr())
+	}
+	if cfg.HTTPRedirectAddr != "" && !(cfg.acme() && cfg.HTTPRedirectAddr == cfg.acmeHTTPAddr()) {
+		redirect = len(addrs)
+		addrs = append(addrs[:len(addrs):len(addrs)], cfg.HTTPRedirectAddr)
+	}
 
-		ep, err := transport.NewEndpoint("/")
+	// listen on everything first, so a bad address serves nothing
+	listeners := make([]net.Listener, len(addrs))
+	for i, addr := range addrs {
+		l, err := listen(addr, cfg)
 		if err != nil {
-			log.Printf("Error creating endpoint: %v\n", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
+			logger.Error("http server failed", "addr", addr, "err", err)
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return err
 		}
+		listeners[i] = l
+	}
 
-		bfs := osfs.New(dir)
-		ld := server.NewFilesystemLoader(bfs)
-		svr := server.NewServer(ld)
-		sess, err := svr.NewUploadPackSession(ep, nil)
-		if err != nil {
-			log.Printf("Error creating upload pack session: %v\n", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+	servers := make([]*http.Server, len(addrs))
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	errs := make([]error, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		srvHandler, srvTLS := handler, tlsConfig
+		switch i {
+		case challenge:
+			logger.Info("starting acme challenge server", "addr", addr, "hosts", strings.Join(cfg.ACMEHosts, ","))
+			srvHandler, srvTLS = challengeHandler, nil
+		case redirect:
+			logger.Info("starting https redirect server", "addr", addr)
+			srvHandler, srvTLS = redirectHandler, nil
+		default:
+			logger.Info("starting http server", "dir", dir, "addr", addr)
+		}
+		srv := &http.Server{
+			Handler: srvHandler,
+			// each server configures HTTP/2 in its own copy
+			TLSConfig:         srvTLS.Clone(),
+			TLSNextProto:      cfg.tlsNextProto(),
+			ReadHeaderTimeout: cfg.readHeaderTimeout(),
+			// The request, including a pushed pack, must arrive in time,
+			// the response has its own budget.
+			ReadTimeout: cfg.readTimeout(),
+			// Uploads set their own deadline,
+			// this catches clients that stop reading the response.
+			WriteTimeout:   cfg.uploadTimeout(),
+			IdleTimeout:    cfg.idleTimeout(),
+			MaxHeaderBytes: cfg.maxHeaderBytes(),
+		}
+		servers[i] = srv
+		wg.Add(1)
+		go func(i int, addr string, l net.Listener) {
+			defer wg.Done()
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(l, cfg.TLSCertFile, cfg.TLSKeyFile)
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("http server failed", "addr", addr, "err", err)
+				errs[i] = err
+				failOnce.Do(func() { close(failed) })
+			}
+		}(i, addr, listeners[i])
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-failed:
+	}
+	logger.Info("shutting down http server")
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.drainTimeout())
+	defer cancel()
+	// keep listening so new requests get a 503 rather than a refused connection
+	select {
+	case <-h.drain.drain():
+	case <-drainCtx.Done():
+	}
+	shutdownErrs := make([]error, len(servers))
+	var shutdown sync.WaitGroup
+	for i, srv := range servers {
+		shutdown.Add(1)
+		go func(i int, srv *http.Server) {
+			defer shutdown.Done()
+			err := srv.Shutdown(drainCtx)
+			if errors.Is(err, context.DeadlineExceeded) {
+				logger.Warn("http server drain timed out, closing remaining connections", "addr", addrs[i])
+				err = srv.Close()
+			}
+			shutdownErrs[i] = err
+		}(i, srv)
+	}
+	shutdown.Wait()
+	wg.Wait()
+	h.events.close()
+	logger.Info("http server stopped")
+	return joinErrors(append(errs, shutdownErrs...))
+}
+
+// joinErrors returns the non-nil errs as one error, nil if there are none.
+func joinErrors(errs []error) error {
+	var msgs []string
+	var first error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first = err
+		}
+		msgs = append(msgs, err.Error())
+	}
+	if len(msgs) <= 1 {
+		return first
+	}
+	return fmt.Errorf("%w (and %s)", first, strings.Join(msgs[1:], "; "))
+}
+
+// NewHandler returns an http.Handler serving the git smart http protocol
+// for the repositories under dir.
+func NewHandler(dir string, opts ...Option) http.Handler {
+	return newHandler(newHTTPHandler(dir, newConfig(opts)))
+}
+
+// httpHandler serves the repositories under dir.
+type httpHandler struct {
+	dir   string
+	fs    billy.Filesystem
+	cfg   Config
+	log   Logger
+	ld    server.Loader
+	svr   transport.Transport
+	cache *refsCache
+	// events receives completed fetches and pushes for cfg.OnEvent.
+	events *eventQueue
+	// audit records authenticated operations to cfg.AuditLog.
+	audit *auditLog
+	// mirrors tracks fetches of repositories with an upstream.
+	mirrors *mirrors
+	// repoConfigs caches the settings in each repository's config.
+	repoConfigs *repoConfigs
+	// settingsLogged is the settings file contents whose ignored entries were logged.
+	settingsLogged atomic.Pointer[repoSettings]
+	// roots are where symlinked repositories may be.
+	roots *repoRoots
+	// aliases maps the aliasKey of old repository names to their new names.
+	aliases map[string]string
+	// nonceSeed is the key of the nonces signed pushes sign.
+	nonceSeed []byte
+	// drain refuses new requests while shutting down.
+	drain *drainer
+
+	// routes are matched by path suffix,
+	// argRoutes by a path segment followed by an argument.
+	routes    map[string]http.Handler
+	argRoutes map[string]http.Handler
+}
+
+// newHandler returns the http routes of h.
+func newHandler(h *httpHandler) http.Handler {
+	cfg := h.cfg
+	uploads := newLimiter(cfg.MaxConcurrentUploads)
+	routes := map[string]http.HandlerFunc{
+		"/info/refs":       h.infoRefs,
+		"/git-upload-pack": h.limit(uploads, "upload-pack", h.uploadPack),
+		"/info.json":       h.infoJSON,
+		"/refs":            h.listRefs,
+	}
+	if cfg.pushEnabled() {
+		routes["/git-receive-pack"] = h.limit(newLimiter(cfg.MaxConcurrentReceives), "receive-pack", h.receivePack)
+	} else if cfg.ReadOnly {
+		routes["/git-receive-pack"] = h.readOnly
+	}
+	if cfg.EnableDumbHTTP {
+		routes["/HEAD"] = h.dumbHEAD
+	}
+	h.routes = make(map[string]http.Handler, len(routes))
+	for suffix, route := range routes {
+		h.routes[suffix] = applyMiddleware(route, cfg.Middleware)
+	}
+	argRoutes := map[string]http.HandlerFunc{
+		"/archive/": h.limit(uploads, "archive", h.archive),
+		"/raw/":     h.limit(uploads, "raw", h.raw),
+	}
+	if cfg.EnableDumbHTTP {
+		argRoutes["/objects/"] = h.limit(uploads, "dumb", h.dumbObjects)
+	}
+	h.argRoutes = make(map[string]http.Handler, len(argRoutes))
+	for segment, route := range argRoutes {
+		h.argRoutes[segment] = applyMiddleware(route, cfg.Middleware)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", h.rateLimit(http.HandlerFunc(h.route)))
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.Handle("/repos", h.rateLimit(http.HandlerFunc(h.listRepos)))
+	return observeRequests(h.log, cfg.metrics(), h.events, cfg.Activity, h.audit, cfg.TrustedProxies, h.accessLog(h.cors(h.recoverPanics(stripPathPrefix(cfg.pathPrefix(), mux)))))
+}
+
+// stripPathPrefix serves the requests under prefix with next,
+// as if prefix weren't there, and 404s the rest.
+func stripPathPrefix(prefix string, next http.Handler) http.Handler {
+	if prefix == "" {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, prefix)
+		if len(p) == len(r.URL.Path) || (p != "" && p[0] != '/') {
+			http.NotFound(rw, r)
 			return
 		}
+		if p == "" {
+			p = "/"
+		}
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = p
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		next.ServeHTTP(rw, r2)
+	})
+}
+
+// newHTTPHandler returns an httpHandler without its routes,
+// for serving git over other transports.
+func newHTTPHandler(dir string, cfg Config) *httpHandler {
+	// The loader and server are stateless, sessions load a fresh storer
+	// for each request, so they can be shared.
+	cfg.Dir = dir
+	fs := cfg.filesystem()
+	ld := fsLoader{fs}
+	return &httpHandler{
+		dir:    dir,
+		fs:     fs,
+		cfg:    cfg,
+		log:    cfg.logger(),
+		ld:     ld,
+		svr:    server.NewServer(ld),
+		cache:  newRefsCache(),
+		events: newEventQueue(cfg.OnEvent, cfg.logger()),
+		audit:  newAuditLog(cfg.AuditLog, cfg.logger()),
+
+		mirrors:     newMirrors(),
+		aliases:     newAliases(cfg.Aliases),
+		repoConfigs: newRepoConfigs(),
+		roots:       newRepoRoots(cfg),
 
-		ar, err := sess.AdvertisedReferencesContext(r.Context())
+		nonceSeed: newNonceSeed(),
+		drain:     newDrainer(),
+	}
+}
+
+// route routes requests of the form /{repo}/info/refs,
+// /{repo}/git-upload-pack, /{repo}/git-receive-pack, /{repo}/info.json
+// and /{repo}/refs,
+// and the /{repo}/{route}/{arg} forms of h.argRoutes,
+// to the repository found under dir.
+func (h *httpHandler) route(rw http.ResponseWriter, r *http.Request) {
+	if !h.drain.enter() {
+		h.refuseDraining(rw, r)
+		return
+	}
+	defer h.drain.leave()
+
+	m, ok := h.match(r.URL.Path)
+	if !ok {
+		http.NotFound(rw, r)
+		return
+	}
+	name, repo, err := m.name, m.repo, m.err
+	if errors.Is(err, errInvalidRepoPath) {
+		h.logger(r.Context()).Warn("invalid repository path", "name", name)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	// Authenticate before reporting a missing repository
+	// so anonymous clients can't probe for repositories.
+	write := m.route == "/git-receive-pack" || r.URL.Query().Get("service") == "git-receive-pack"
+	if write && h.cfg.ReadOnly {
+		h.readOnly(rw, r)
+		return
+	}
+	if h.cfg.authEnabled() && (write || !h.cfg.AnonymousRead) {
+		authRepo := repo
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			log.Printf("Error getting advertised references: %v\n", err)
+			authRepo = name
+		}
+		var ok bool
+		r, ok = h.checkAuth(rw, r, authRepo, write)
+		if !ok {
 			return
 		}
+	}
+
+	// git only follows redirects of the first request of a fetch or push,
+	// later requests to the old name are served as the new one
+	if m.alias != "" && h.cfg.RedirectAliases && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		u := *r.URL
+		u.Path = h.cfg.pathPrefix() + "/" + name + strings.TrimPrefix(u.Path, "/"+m.alias)
+		u.RawPath = ""
+		h.logger(r.Context()).Info("redirect alias", "alias", m.alias, "name", name)
+		http.Redirect(rw, r, u.RequestURI(), http.StatusMovedPermanently)
+		return
+	}
 
-		ar.Prefix = [][]byte{
-			[]byte("# service=git-upload-pack"),
-			pktline.Flush,
+	op := OpRead
+	if write {
+		op = OpWrite
+	}
+	identity := IdentityFromContext(r.Context())
+	// set before authorizing so denials are logged with who was denied
+	info := requestInfoFromContext(r.Context())
+	info.repo = name
+	info.identity = identity
+	if errors.Is(err, errRepoNotFound) && write && name != "" && h.cfg.pushEnabled() && h.cfg.AutoInit && !h.isMirror(initRepoName(name)) {
+		err = h.authorize(r.Context(), identity, initRepoName(name), op)
+		if err == nil {
+			repo, err = initRepo(h.fs, h.roots, name)
 		}
-		err = ar.Encode(rw)
-		if err != nil {
-			log.Printf("Error encoding advertised references: %v\n", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			return
+		if err == nil {
+			h.logger(r.Context()).Info("created repository", "repo", repo, "identity", identity)
+		}
+	}
+	if errors.Is(err, errRepoNotFound) && !write && h.isMirror(initRepoName(name)) {
+		err = h.authorize(r.Context(), identity, initRepoName(name), op)
+		if err == nil {
+			repo, err = h.createMirror(r.Context(), name)
 		}
 	}
+	if err == nil {
+		err = h.authorize(r.Context(), identity, repo, op)
+	}
+	if err == nil && write && h.isMirror(repo) {
+		err = errMirror
+	}
+	if err == nil {
+		// info.json, refs, archives and raw files are reads too
+		err = h.checkService(r.Context(), repo, op.service())
+	}
+	if errors.Is(err, errRepoNotFound) {
+		h.logger(r.Context()).Info("repository not found", "name", name)
+		h.httpError(rw, r, err)
+		return
+	} else if errors.Is(err, errNotBareRepo) {
+		h.logger(r.Context()).Warn("not a bare repository, expected a bare repository or a working tree with a .git dir", "name", name)
+		h.httpError(rw, r, err)
+		return
+	} else if errors.Is(err, errUnsupportedObjectFormat) || errors.Is(err, errRepoOutsideRoots) {
+		h.logger(r.Context()).Warn("unsupported repository", "name", name, "err", err)
+		h.httpError(rw, r, err)
+		return
+	} else if errors.Is(err, transport.ErrAuthorizationFailed) || errors.Is(err, errMirror) {
+		h.httpError(rw, r, err)
+		return
+	} else if errors.Is(err, errServiceDisabled) {
+		h.logger(r.Context()).Info("service disabled", "repo", repo, "service", op.service())
+		h.httpError(rw, r, err)
+		return
+	} else if err != nil {
+		h.logger(r.Context()).Error("resolve repository path", "name", name, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	if !write {
+		h.syncMirror(r.Context(), repo)
+	}
+
+	info.repo = repo
+	// cancelling ctx doesn't unblock reading from or writing to a stalled client,
+	// the deadlines do, for HTTP/2 only on this request's stream
+	rc := http.NewResponseController(rw)
+	ctx, cancel := h.boundOperation(withRouteArg(withRepo(r.Context(), repo), m.arg), func() {
+		rc.SetReadDeadline(time.Now())
+		rc.SetWriteDeadline(time.Now())
+	})
+	defer cancel()
+	m.handle.ServeHTTP(rw, r.WithContext(ctx))
 }
 
-func httpGitUploadPack(dir string) http.HandlerFunc {
-	return func(rw http.ResponseWriter, r *http.Request) {
-		rw.Header().Set("content-type", "application/x-git-upload-pack-result")
+// routeMatch is the route a request path matched.
+type routeMatch struct {
+	// route is the key of the matched route in h.routes or h.argRoutes.
+	route  string
+	handle http.Handler
+	// name is the repository named in the path,
+	// repo and err the result of resolving it.
+	name string
+	repo string
+	err  error
+	// arg is the rest of the path for h.argRoutes.
+	arg string
+	// alias is the name in the path if it's an alias of name.
+	alias string
+}
 
-		var bodyReader io.Reader = r.Body
-		if r.Header.Get("Content-Encoding") == "gzip" {
-			gzipReader, err := gzip.NewReader(r.Body)
-			if err != nil {
-				log.Printf("Error creating gzip reader: %v\n", err)
-				http.Error(rw, err.Error(), http.StatusInternalServerError)
-				return
+// resolve sets the repository of the name in the path, following its alias.
+func (m *routeMatch) resolve(h *httpHandler, name string) {
+	m.name = h.resolveAlias(name)
+	if m.name != name {
+		m.alias = name
+	}
+	m.repo, m.err = resolveRepoPath(h.fs, h.roots, m.name, h.cfg.ExperimentalSHA256)
+}
+
+// match finds the route for urlPath.
+// The longest matching suffix is used, so /info/refs isn't taken as /refs.
+// An arg route's segment may also appear in a repository name or an arg,
+// so the first split naming an existing repository is used.
+func (h *httpHandler) match(urlPath string) (routeMatch, bool) {
+	var suffix string
+	for s := range h.routes {
+		if strings.HasSuffix(urlPath, s) && len(s) > len(suffix) {
+			suffix = s
+		}
+	}
+	if suffix != "" {
+		m := routeMatch{route: suffix, handle: h.routes[suffix]}
+		m.resolve(h, strings.TrimPrefix(strings.TrimSuffix(urlPath, suffix), "/"))
+		return m, true
+	}
+
+	var first routeMatch
+	found := false
+	for segment, handle := range h.argRoutes {
+		for i := 0; i < len(urlPath); {
+			j := strings.Index(urlPath[i:], segment)
+			if j < 0 {
+				break
+			}
+			j += i
+			i = j + 1
+			m := routeMatch{
+				route:  segment,
+				handle: handle,
+				arg:    urlPath[j+len(segment):],
+			}
+			m.resolve(h, strings.TrimPrefix(urlPath[:j], "/"))
+			if m.err == nil {
+				return m, true
+			}
+			if !found {
+				first, found = m, true
 			}
-			defer gzipReader.Close()
-			bodyReader = gzipReader
 		}
+	}
+	return first, found
+}
 
-		upr := packp.NewUploadPackRequest()
-		err := upr.Decode(bodyReader)
-		if err != nil {
-			log.Printf("Error decoding upload pack request: %v\n", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+type routeArgKey struct{}
+
+func withRouteArg(ctx context.Context, arg string) context.Context {
+	return context.WithValue(ctx, routeArgKey{}, arg)
+}
+
+// routeArgFromContext returns the part of the path after the route segment
+// for h.argRoutes, such as the ref of an archive.
+func routeArgFromContext(ctx context.Context) string {
+	arg, _ := ctx.Value(routeArgKey{}).(string)
+	return arg
+}
+
+// readOnly refuses a write to a ReadOnly server.
+func (h *httpHandler) readOnly(rw http.ResponseWriter, r *http.Request) {
+	h.httpError(rw, r, errReadOnly)
+}
+
+func (h *httpHandler) infoRefs(rw http.ResponseWriter, r *http.Request) {
+	repo := RepoFromContext(r.Context())
+	service := r.URL.Query().Get("service")
+	// No service is a dumb client, only served with EnableDumbHTTP,
+	// a service git doesn't have is a bad request,
+	// and a push to a server that doesn't take them is forbidden.
+	var err error
+	switch service {
+	case "git-upload-pack":
+	case "git-receive-pack":
+		if !h.cfg.pushEnabled() {
+			err = errPushDisabled
+		}
+	case "":
+		if h.cfg.EnableDumbHTTP {
+			h.dumbInfoRefs(rw, r)
 			return
 		}
+		err = errDumbHTTP
+	default:
+		err = requestErrorf("unsupported service %q, expected git-upload-pack or git-receive-pack", service)
+	}
+	if err != nil {
+		h.logger(r.Context()).Info("invalid service", "repo", repo, "service", service, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
 
-		ep, err := transport.NewEndpoint("/")
-		if err != nil {
-			log.Printf("Error creating endpoint: %v\n", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+	if service == "git-upload-pack" {
+		if err := h.checkProtocolVersion(protocolVersion(r)); err != nil {
+			h.logger(r.Context()).Info("refused fetch", "repo", repo, "err", err)
+			h.httpError(rw, r, err)
 			return
 		}
+	}
+
+	rw.Header().Set("content-type", "application/x-"+service+"-advertisement")
+	setNoCache(rw.Header())
+	if service == "git-upload-pack" {
+		// the protocol version picks the v0 or v2 advertisement
+		addVary(rw.Header(), "Git-Protocol")
+	}
+	if h.cfg.CompressResponses {
+		// also for v2, which isn't compressed,
+		// so caches see every variant vary the same way
+		addVary(rw.Header(), "Accept-Encoding")
+	}
+
+	v2 := service == "git-upload-pack" && protocolVersion(r) == 2
+	// the push-cert nonce is stamped with the time it's advertised,
+	// so signed push advertisements are built for each request
+	// and never cached or answered with a 304
+	fresh := service == "git-receive-pack" && h.cfg.PushCertKeys != nil
+	if r.Method == http.MethodHead {
+		// probing for existence and auth, skip building the advertisement
+		if !v2 && !fresh {
+			h.headInfoRefs(rw, r, service)
+		}
+		return
+	}
+
+	// Protocol v2 only applies to upload-pack,
+	// other clients get the v0 advertisement they fall back to.
+	if v2 {
+		err := pktline.NewEncoder(rw).EncodeString("# service="+service+"\n", pktline.FlushString)
+		if err == nil {
+			err = advertiseV2(rw, h.cfg.agent(), h.objectFormat(r.Context(), repo))
+		}
+		if err != nil {
+			h.logger(r.Context()).Error("encode protocol v2 capabilities", "repo", repo, "err", err)
+		}
+		return
+	}
 
-		bfs := osfs.New(dir)
-		ld := server.NewFilesystemLoader(bfs)
-		svr := server.NewServer(ld)
-		sess, err := svr.NewUploadPackSession(ep, nil)
+	if fresh {
+		body, err := h.advertiseRefs(r.Context(), repo, service)
 		if err != nil {
-			log.Printf("Error creating upload pack session: %v\n", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			h.logger(r.Context()).Error("advertise refs", "repo", repo, "service", service, "err", err)
+			h.httpError(rw, r, err)
 			return
 		}
+		h.writeAdvertisement(rw, r, body)
+		return
+	}
+
+	fingerprint, modTime, err := h.advertisementFingerprint(repo)
+	if err != nil {
+		h.logger(r.Context()).Error("read refs", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
 
-		res, err := sess.UploadPack(r.Context(), upr)
+	adv, ok := h.cache.get(repo, service, fingerprint)
+	if !ok {
+		body, err := h.advertiseRefs(r.Context(), repo, service)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
-			log.Printf("Error during upload pack: %v\n", err)
+			h.logger(r.Context()).Error("advertise refs", "repo", repo, "service", service, "err", err)
+			h.httpError(rw, r, err)
 			return
 		}
+		adv = h.cache.put(repo, service, fingerprint, body)
+	}
+
+	if h.checkNotModified(rw, r, adv, modTime, h.compressResponse(rw, r)) {
+		return
+	}
+	h.writeAdvertisement(rw, r, adv.body)
+}
+
+// writeAdvertisement writes an encoded ref advertisement,
+// gzipped if the client accepts it and responses are compressed.
+func (h *httpHandler) writeAdvertisement(rw http.ResponseWriter, r *http.Request, body []byte) {
+	if h.compressResponse(rw, r) {
+		gz := h.gzipWriter(rw)
+		gz.Write(body)
+		gz.Close()
+		return
+	}
+	rw.Write(body)
+}
+
+// headInfoRefs answers a HEAD request for the ref advertisement,
+// setting the ETag if the advertisement is already cached.
+func (h *httpHandler) headInfoRefs(rw http.ResponseWriter, r *http.Request, service string) {
+	repo := RepoFromContext(r.Context())
+	fingerprint, modTime, err := h.advertisementFingerprint(repo)
+	if err != nil {
+		h.logger(r.Context()).Error("read refs", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	compress := h.compressResponse(rw, r)
+	adv, _ := h.cache.get(repo, service, fingerprint)
+	h.checkNotModified(rw, r, adv, modTime, compress)
+}
+
+// checkNotModified sets the ETag for adv, if it's not nil,
+// and the Last-Modified time of the refs,
+// responding with 304 Not Modified and returning true if the client has it.
+// As in RFC 7232, If-Modified-Since is ignored when If-None-Match is sent.
+func (h *httpHandler) checkNotModified(rw http.ResponseWriter, r *http.Request, adv *advertisement, modTime time.Time, compress bool) bool {
+	var etag string
+	if adv != nil {
+		etag = adv.etag
+		if compress {
+			etag = gzipETag(etag)
+		}
+		rw.Header().Set("ETag", etag)
+	}
+	// Last-Modified only has a resolution of seconds,
+	// a ref changed again within the same second would look unmodified,
+	// so it's only sent once that second has passed.
+	modTime = modTime.Truncate(time.Second)
+	settled := !modTime.IsZero() && time.Since(modTime) >= time.Second
+	if settled {
+		rw.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
 
-		err = res.Encode(rw)
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag != "" && etagMatch(inm, etag) {
+			rw.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && settled {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modTime.After(t) {
+			rw.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// advertiseRefs encodes the smart http ref advertisement for service.
+func (h *httpHandler) advertiseRefs(ctx context.Context, repo, service string) ([]byte, error) {
+	ar, err := h.advertisedRefs(ctx, repo, service)
+	if err != nil {
+		return nil, err
+	}
+	ar.Prefix = [][]byte{
+		[]byte("# service=" + service),
+		pktline.Flush,
+	}
+	var buf bytes.Buffer
+	err = ar.Encode(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("encode advertised references: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// advertisedRefs returns the refs and capabilities to advertise for service.
+func (h *httpHandler) advertisedRefs(ctx context.Context, repo, service string) (*packp.AdvRefs, error) {
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		return nil, fmt.Errorf("create endpoint: %w", err)
+	}
+
+	var sess transport.Session
+	if service == "git-receive-pack" {
+		sess, err = h.svr.NewReceivePackSession(ep, nil)
+	} else {
+		sess, err = h.svr.NewUploadPackSession(ep, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s session: %w", service, err)
+	}
+
+	ar, err := sess.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get advertised references: %w", err)
+	}
+	if service == "git-upload-pack" {
+		if err := h.advertiseHead(ep, ar, h.defaultBranch(ctx, repo)); err != nil {
+			return nil, err
+		}
+		hidden := h.hiddenRefs(ctx, repo)
+		for name := range ar.References {
+			if matchRef(hidden, name) {
+				delete(ar.References, name)
+				delete(ar.Peeled, name)
+			}
+		}
+	}
+	h.warnLargeAdvertisement(ctx, repo, service, ar)
+	if service == "git-upload-pack" {
+		// pushes can't avoid the advertisement, so they're only warned about
+		if err := h.limitRefs(ctx, repo, ar); err != nil {
+			return nil, err
+		}
+	}
+	if service == "git-receive-pack" {
+		// receive relays hook output over the sideband
+		err = ar.Capabilities.Add(capability.Sideband64k)
+		if err == nil {
+			err = ar.Capabilities.Add(capability.Atomic)
+		}
+		if err == nil && h.cfg.PushCertKeys != nil {
+			err = ar.Capabilities.Set(capability.PushCert, h.pushCertNonce(repo, time.Now()))
+		}
+		if err == nil {
+			// go-git can't index thin packs, their bases are outside the pack
+			err = ar.Capabilities.Add(capability.Capability("no-thin"))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("add capabilities: %w", err)
+		}
+	}
+	if service == "git-upload-pack" {
+		// go-git's upload-pack doesn't follow tags, includeTagWants does,
+		// nor serve shallow clients, uploadPack does
+		for _, c := range []capability.Capability{capability.IncludeTag, capability.Shallow, capability.DeepenSince, capability.DeepenNot} {
+			if err := ar.Capabilities.Add(c); err != nil {
+				return nil, fmt.Errorf("add capabilities: %w", err)
+			}
+		}
+	}
+	if service == "git-upload-pack" && h.cfg.AllowAnySHA1InWant {
+		// lets clients fetch commits that aren't ref tips
+		err = ar.Capabilities.Add(capability.AllowTipSHA1InWant)
+		if err == nil {
+			err = ar.Capabilities.Add(capability.AllowReachableSHA1InWant)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("add capabilities: %w", err)
+		}
+	}
+	// List.Set would leave go-git's agent in the encoded list
+	ar.Capabilities.Delete(capability.Agent)
+	if err := ar.Capabilities.Add(capability.Agent, h.cfg.agent()); err != nil {
+		return nil, fmt.Errorf("set agent: %w", err)
+	}
+	if format := h.objectFormat(ctx, repo); format != "sha1" {
+		// go-git doesn't know the capability, git assumes sha1 without it
+		if err := ar.Capabilities.Add(capability.Capability("object-format"), format); err != nil {
+			return nil, fmt.Errorf("add capabilities: %w", err)
+		}
+	}
+	if h.cfg.AdvertiseCapabilities != nil {
+		h.cfg.AdvertiseCapabilities(service, ar.Capabilities)
+	}
+	return ar, nil
+}
+
+func (h *httpHandler) uploadPack(rw http.ResponseWriter, r *http.Request) {
+	repo := RepoFromContext(r.Context())
+	rw.Header().Set("content-type", "application/x-git-upload-pack-result")
+	setNoCache(rw.Header())
+
+	// Limit both the compressed and decompressed size
+	// so a small gzip body can't expand without bound.
+	maxBytes := h.cfg.maxRequestBytes()
+	r.Body = http.MaxBytesReader(rw, r.Body, maxBytes)
+	bodyReader, err := decodeBody(r)
+	if err != nil {
+		h.logger(r.Context()).Warn("decode request body", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	defer bodyReader.Close()
+	body := newLimitedReader(bodyReader, maxBytes)
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.cfg.uploadTimeout())
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	if protocolVersion(r) == 2 {
+		h.uploadPackV2(rw, r, body)
+		return
+	}
+	if err := h.checkProtocolVersion(protocolVersion(r)); err != nil {
+		h.logger(r.Context()).Info("refused fetch", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	upr := packp.NewUploadPackRequest()
+	err = upr.Decode(body)
+	if body.exceeded {
+		h.logger(r.Context()).Warn("upload-pack request too large", "repo", repo, "limit", body.limit)
+		h.httpError(rw, r, errBodyTooLarge)
+		return
+	} else if err != nil {
+		h.logger(r.Context()).Warn("decode upload-pack request", "repo", repo, "err", err)
+		h.httpError(rw, r, fmt.Errorf("%w: %v", errMalformedRequest, err))
+		return
+	}
+	if err := checkWants(upr.Wants, h.cfg.MaxWants); err != nil {
+		h.logger(r.Context()).Warn("upload-pack", "repo", repo, "client", clientIP(r, h.cfg.TrustedProxies), "wants", len(upr.Wants), "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	sess, err := h.uploadPackSession(ctx, ep)
+	if err != nil {
+		h.logger(r.Context()).Error("create upload-pack session", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	// go-git sends whatever is asked for,
+	// only allow the advertised ref tips as stock git does by default,
+	// which leaves out hidden refs.
+	if !h.cfg.AllowAnySHA1InWant {
+		ar, err := h.advertisedRefs(ctx, repo, "git-upload-pack")
 		if err != nil {
-			log.Printf("Error encoding upload pack result: %v\n", err)
-			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			h.logger(r.Context()).Error("get advertised references", "repo", repo, "err", err)
+			h.httpError(rw, r, err)
+			return
+		}
+		if err := checkAdvertisedWants(ar, upr.Wants); err != nil {
+			h.logger(r.Context()).Warn("upload-pack", "repo", repo, "err", err)
+			h.httpError(rw, r, err)
 			return
 		}
 	}
+
+	sto, err := ctxLoader{h.ld, ctx}.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	haves, err := readHaves(body, sto, h.cfg.MaxHaves)
+	if body.exceeded {
+		err = errBodyTooLarge
+	}
+	if err != nil {
+		h.logger(r.Context()).Warn("upload-pack", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	upr.Haves = haves.common
+	if !haves.done {
+		// A round of a stateless client's negotiation gets no pack.
+		// Without multi_ack the first common have ends it.
+		// Every response to a client deepening starts with the shallow-update,
+		// the first request only has the wants to get it.
+		if !upr.Depth.IsZero() {
+			su, err := shallowUpdate(sto, h.hiddenRefs(ctx, repo), upr)
+			if err == nil {
+				err = su.Encode(rw)
+			}
+			if err != nil {
+				h.logger(r.Context()).Error("shallow update", "repo", repo, "err", err)
+				h.httpError(rw, r, err)
+				return
+			}
+		}
+		if haves.flushed {
+			if err := (&packp.ServerResponse{ACKs: firstHash(haves.common)}).Encode(rw); err != nil {
+				h.logger(r.Context()).Warn("encode negotiation response", "repo", repo, "err", err)
+			}
+		}
+		return
+	}
+	if err := includeTagWants(sto, h.hiddenRefs(ctx, repo), upr); err != nil {
+		h.logger(r.Context()).Error("include tags", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	res, err := uploadPack(ctx, sess, sto, h.hiddenRefs(ctx, repo), upr)
+	if ctx.Err() != nil {
+		h.logger(r.Context()).Warn("upload-pack cancelled", "repo", repo, "err", ctx.Err())
+		return
+	} else if err != nil {
+		h.httpError(rw, r, err)
+		h.logger(r.Context()).Error("upload-pack", "repo", repo, "err", err)
+		return
+	}
+	// stops go-git's encoder if the pack isn't read to the end
+	defer res.Close()
+	res.ACKs = firstHash(upr.Haves)
+
+	// The pack is generated as it's written, reading it
+	// and reading the objects to pack fail once ctx is done.
+	trace := h.wireTrace(ctx, repo)
+	trace.uploadPackRequest(upr)
+	pw := newPackHeaderWriter(flushWriter{rw})
+	err = res.Encode(pw)
+	trace.packSent(pw.objects)
+	if pw.objects >= 0 {
+		requestInfoFromContext(r.Context()).addPack(pw.objects, pw.packBytes())
+	}
+	if ctx.Err() != nil {
+		h.logger(r.Context()).Warn("upload-pack cancelled", "repo", repo, "err", ctx.Err())
+		return
+	} else if err != nil {
+		h.logger(r.Context()).Error("encode upload-pack response", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	requestInfoFromContext(r.Context()).event = &Event{Service: "upload-pack"}
+}
+
+// uploadPackV2 serves a single protocol v2 command.
+func (h *httpHandler) uploadPackV2(rw http.ResponseWriter, r *http.Request, body *limitedReader) {
+	repo := RepoFromContext(r.Context())
+	req, err := readV2Request(body)
+	if body.exceeded {
+		h.logger(r.Context()).Warn("protocol v2 request too large", "repo", repo, "limit", body.limit)
+		h.httpError(rw, r, errBodyTooLarge)
+		return
+	} else if err != nil {
+		h.logger(r.Context()).Warn("decode protocol v2 request", "repo", repo, "err", err)
+		h.httpError(rw, r, fmt.Errorf("%w: %v", errMalformedRequest, err))
+		return
+	}
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sto, err := ctxLoader{h.ld, r.Context()}.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	// ls-refs is text worth compressing, fetch is mostly an already compressed pack
+	var w io.Writer = rw
+	if req.command == "fetch" {
+		w = flushWriter{rw}
+	} else if req.command == "ls-refs" && h.compressResponse(rw, r) {
+		gz := h.gzipWriter(rw)
+		defer gz.Close()
+		w = gz
+	}
+
+	err = serveV2(r.Context(), w, sto, req, h.v2Config(r.Context(), repo))
+	if r.Context().Err() != nil {
+		h.logger(r.Context()).Warn("protocol v2 command cancelled", "repo", repo, "command", req.command, "err", r.Context().Err())
+		return
+	} else if err != nil {
+		if errors.Is(err, errTooManyWants) {
+			h.logger(r.Context()).Warn("protocol v2 command", "repo", repo, "command", req.command, "client", clientIP(r, h.cfg.TrustedProxies), "err", err)
+		} else {
+			h.logger(r.Context()).Error("protocol v2 command", "repo", repo, "command", req.command, "err", err)
+		}
+		requestInfoFromContext(r.Context()).failure = "protocol"
+		_, msg := h.clientError(r, err)
+		writeV2Error(w, msg)
+	} else if req.command == "fetch" {
+		requestInfoFromContext(r.Context()).event = &Event{Service: "upload-pack"}
+	}
+}
+
+func (h *httpHandler) v2Config(ctx context.Context, repo string) v2Config {
+	return v2Config{
+		defaultBranch: h.defaultBranch(ctx, repo),
+		hiddenRefs:    h.hiddenRefs(ctx, repo),
+		trace:         h.wireTrace(ctx, repo),
+		maxHaves:      h.cfg.MaxHaves,
+		maxWants:      h.cfg.MaxWants,
+		objectFormat:  h.objectFormat(ctx, repo),
+	}
+}
+
+func (h *httpHandler) receivePack(rw http.ResponseWriter, r *http.Request) {
+	repo := RepoFromContext(r.Context())
+	rw.Header().Set("content-type", "application/x-git-receive-pack-result")
+	setNoCache(rw.Header())
+
+	bodyReader, err := decodeBody(r)
+	if err != nil {
+		h.logger(r.Context()).Warn("decode request body", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	defer bodyReader.Close()
+	// Pushes are as large as their pack, but git only compresses small ones,
+	// so a compressed body is limited like an upload-pack request
+	// rather than letting it expand an endless command list.
+	body := io.Reader(bodyReader)
+	var limited *limitedReader
+	if _, ok := bodyReader.(decodedBody); ok {
+		limited = newLimitedReader(bodyReader, h.cfg.maxRequestBytes())
+		body = limited
+	}
+	tooLarge := func() bool {
+		if limited == nil || !limited.exceeded {
+			return false
+		}
+		h.logger(r.Context()).Warn("compressed receive-pack request too large", "repo", repo, "limit", limited.limit)
+		h.httpError(rw, r, errBodyTooLarge)
+		return true
+	}
+
+	upr, cert, err := decodeUpdateRequest(body)
+	if tooLarge() {
+		return
+	} else if err != nil {
+		h.logger(r.Context()).Warn("decode reference update request", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+
+	err = h.push(r.Context(), repo, upr, cert, rw, h.hookEnv(r))
+	if tooLarge() {
+		return
+	} else if err != nil {
+		h.httpError(rw, r, err)
+	}
+}
+
+// push applies upr to repo, writing the report status to w.
+// It only returns errors from before anything is written to w,
+// failures after that are reported to the client and logged.
+// cert is the push certificate of a signed push, nil for unsigned pushes.
+// env is added to the hooks' environment.
+func (h *httpHandler) push(ctx context.Context, repo string, upr *packp.ReferenceUpdateRequest, cert *pushCert, w io.Writer, env []string) error {
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(ctx).Error("create endpoint", "repo", repo, "err", err)
+		return err
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		h.logger(ctx).Error("load repository", "repo", repo, "err", err)
+		return err
+	}
+	gitDir, err := filepath.Abs(filepath.Join(h.dir, filepath.FromSlash(repo)))
+	if err != nil {
+		h.logger(ctx).Error("resolve repository dir", "repo", repo, "err", err)
+		return err
+	}
+
+	// Hook output goes to the client over the sideband if it asked for one,
+	// otherwise it's dropped like git's stderr over http.
+	var mux *sideband.Muxer
+	progress := io.Discard
+	switch {
+	case upr.Capabilities.Supports(capability.Sideband64k):
+		mux = sideband.NewMuxer(sideband.Sideband64k, w)
+	case upr.Capabilities.Supports(capability.Sideband):
+		mux = sideband.NewMuxer(sideband.Sideband, w)
+	}
+	if mux != nil {
+		progress = progressWriter{mux, w}
+	}
+	hooks := &hookRunner{
+		dir:     filepath.Join(gitDir, "hooks"),
+		gitDir:  gitDir,
+		env:     append([]string{"GIT_DIR=" + gitDir}, env...),
+		timeout: h.cfg.hookTimeout(),
+		log:     h.logger(ctx),
+		out:     progress,
+	}
+	if h.cfg.HooksDir != "" {
+		hooks.dir = h.cfg.HooksDir
+	}
+
+	signed := h.checkPushCert(repo, cert)
+	hooks.env = append(hooks.env, signed.env()...)
+	var reject string
+	if h.cfg.RequireSignedPush {
+		reject = signed.rejection()
+	}
+	switch {
+	case signed.status == "G":
+		requestInfoFromContext(ctx).signer = signed.signer
+	case cert != nil || reject != "":
+		h.logger(ctx).Warn("push certificate not verified", "repo", repo, "key", signed.key, "err", signed.err)
+	}
+
+	// A failed ref update still produces a report status,
+	// send it so the client can show the per-ref result.
+	res, err := receive(ctx, pushRequest{
+		gitDir: gitDir,
+		sto:    sto,
+		cmds:   upr.Commands,
+		pack:   upr.Packfile,
+		fsck:   h.cfg.FsckObjects,
+		atomic: h.cfg.AtomicPushes || upr.Capabilities.Supports(capability.Atomic),
+
+		denyNonFastForwards: h.cfg.DenyNonFastForwards,
+		denyDeletes:         h.cfg.DenyDeletes,
+		rules:               h.cfg.BranchRules,
+		identity:            IdentityFromContext(ctx),
+		maxPackBytes:        h.cfg.MaxPackBytes,
+		quotaBytes:          h.repoQuota(ctx, repo),
+		hooks:               hooks,
+		progress:            progress,
+		reject:              reject,
+	})
+	h.cache.invalidate(repo)
+	if errors.Is(err, errBodyTooLarge) {
+		// the pack was cut short by the request's limit before anything was written
+		return err
+	}
+	if updates := refUpdates(upr.Commands, res); len(updates) > 0 {
+		requestInfoFromContext(ctx).event = &Event{Service: "receive-pack", Updates: updates}
+	}
+	var tooLarge *packTooLargeError
+	switch {
+	case errors.As(err, &tooLarge):
+		h.logger(ctx).Warn("push too large", "repo", repo, "read", tooLarge.read, "limit", tooLarge.limit, "quota", tooLarge.quota)
+		requestInfoFromContext(ctx).failure = "too_large"
+	case err != nil:
+		h.logger(ctx).Error("receive-pack", "repo", repo, "err", err)
+		requestInfoFromContext(ctx).failure = "receive_pack"
+	}
+
+	out := w
+	if mux != nil {
+		out = mux
+	}
+	if upr.Capabilities.Supports(capability.ReportStatus) {
+		if err := res.Encode(out); err != nil {
+			h.logger(ctx).Error("encode report status", "repo", repo, "err", err)
+			return nil
+		}
+	}
+	if mux != nil {
+		if err := pktline.NewEncoder(w).Flush(); err != nil {
+			h.logger(ctx).Error("write flush", "repo", repo, "err", err)
+		}
+	}
+	return nil
+}
+
+// hookEnv returns the environment hooks run with for a push over http.
+func (h *httpHandler) hookEnv(r *http.Request) []string {
+	var env []string
+	if p := r.Header.Get("Git-Protocol"); p != "" {
+		env = append(env, "GIT_PROTOCOL="+p)
+	}
+	if id := IdentityFromContext(r.Context()); id != "" {
+		env = append(env, "REMOTE_USER="+id)
+	}
+	if ip := clientIP(r, h.cfg.TrustedProxies); ip != nil {
+		env = append(env, "REMOTE_ADDR="+ip.String())
+	}
+	return env
+}
+
+// progressWriter writes to the progress channel of a sideband,
+// flushing http responses so clients see messages as they're written.
+type progressWriter struct {
+	mux *sideband.Muxer
+	w   io.Writer
+}
+
+func (p progressWriter) Write(b []byte) (int, error) {
+	n, err := p.mux.WriteChannel(sideband.ProgressMessage, b)
+	if f, ok := p.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// flushWriter flushes each write to an http response,
+// so clients receive a pack as it's encoded.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if fl, ok := f.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+	return n, err
+}
+
+func (h *httpHandler) advertiseHead(ep *transport.Endpoint, ar *packp.AdvRefs, defaultBranch string) error {
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		return fmt.Errorf("load repository: %w", err)
+	}
+	// go-git adds the symref even if HEAD's target doesn't exist
+	ar.Capabilities.Delete(capability.SymRef)
+	target, ok := headTarget(sto, defaultBranch)
+	if !ok {
+		return nil
+	}
+	ref, err := sto.Reference(target)
+	if err != nil {
+		return fmt.Errorf("get %s: %w", target, err)
+	}
+	hash := ref.Hash()
+	ar.Head = &hash
+	return ar.Capabilities.Add(capability.SymRef, "HEAD:"+target.String())
+}
+
+// checkAdvertisedWants rejects wants that aren't advertised refs.
+func checkAdvertisedWants(ar *packp.AdvRefs, wants []plumbing.Hash) error {
+	tips := make(map[plumbing.Hash]bool)
+	if ar.Head != nil {
+		tips[*ar.Head] = true
+	}
+	for _, h := range ar.References {
+		tips[h] = true
+	}
+	for _, h := range ar.Peeled {
+		tips[h] = true
+	}
+	for _, h := range wants {
+		if !tips[h] {
+			return requestErrorf("want %s: not our ref", h)
+		}
+	}
+	return nil
+}
+
+// addVary adds field to the Vary header of a response,
+// unless it's already listed.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// setNoCache marks a response as dynamic,
+// as required by the git smart http protocol.
+func setNoCache(h http.Header) {
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Pragma", "no-cache")
+	h.Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
 }
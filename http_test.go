@@ -0,0 +1,408 @@
+package gitreposerver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+)
+
+// TestNewHandlerIndependent serves two handlers in one process,
+// neither sees the other's repositories or configuration.
+func TestNewHandlerIndependent(t *testing.T) {
+	dirA, dirB := newTestRepo(t, 1), newTestRepo(t, 2)
+	a := httptest.NewServer(NewHandler(dirA, WithLogger(testLogger{t}), WithReceivePack(true)))
+	defer a.Close()
+	b := httptest.NewServer(NewHandler(dirB, WithLogger(testLogger{t})))
+	defer b.Close()
+
+	for _, tt := range []struct {
+		srv     *httptest.Server
+		commits string
+	}{{a, "1"}, {b, "2"}} {
+		out := filepath.Join(t.TempDir(), "out")
+		runGit(t, t.TempDir(), "clone", "-q", tt.srv.URL+"/repo.git", out)
+		if n := strings.TrimSpace(runGit(t, out, "rev-list", "--count", "HEAD")); n != tt.commits {
+			t.Errorf("%s: cloned %s commits, want %s", tt.srv.URL, n, tt.commits)
+		}
+	}
+
+	for srv, want := range map[*httptest.Server]int{a: http.StatusOK, b: http.StatusForbidden} {
+		res, err := http.Get(srv.URL + "/repo.git/info/refs?service=git-receive-pack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("%s: receive-pack status %d, want %d", srv.URL, res.StatusCode, want)
+		}
+	}
+}
+
+// TestNewHandlerMounted serves the git routes under a prefix of a larger app.
+func TestNewHandlerMounted(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	mux := http.NewServeMux()
+	mux.Handle("/git/", NewHandler(dir, WithLogger(testLogger{t}), WithPathPrefix("/git")))
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		io.WriteString(rw, "app")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	runGit(t, t.TempDir(), "clone", "-q", srv.URL+"/git/repo.git", "out")
+	res, err := http.Get(srv.URL + "/repo.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := io.ReadAll(res.Body); string(body) != "app" {
+		t.Errorf("request outside the prefix got %q, want the app's response", body)
+	}
+}
+
+func TestNoCacheHeaders(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	srv := newTestServer(t, dir, WithReceivePack(true))
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+
+	check := func(name string, res *http.Response) {
+		t.Helper()
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", name, res.StatusCode)
+		}
+		want := map[string]string{
+			"Cache-Control": "no-cache",
+			"Pragma":        "no-cache",
+			"Expires":       "Fri, 01 Jan 1980 00:00:00 GMT",
+		}
+		for k, v := range want {
+			if got := res.Header.Get(k); got != v {
+				t.Errorf("%s: %s %q, want %q", name, k, got, v)
+			}
+		}
+	}
+	for _, service := range []string{"git-upload-pack", "git-receive-pack"} {
+		res, err := http.Get(srv.URL + "/repo.git/info/refs?service=" + service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check("info/refs "+service, res)
+	}
+	res, err := http.Post(srv.URL+"/repo.git/git-upload-pack", "application/x-git-upload-pack-request", uploadPackRequest([]string{main}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("git-upload-pack", res)
+}
+
+// TestVaryHeaders checks responses name the request headers they vary by,
+// so caches don't serve one client's variant to another.
+func TestVaryHeaders(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	plain := newTestServer(t, dir, WithReceivePack(true))
+	compressed := newTestServer(t, dir, WithReceivePack(true), WithCompression(-1))
+
+	tests := []struct {
+		name     string
+		url      string
+		protocol string
+		want     []string
+	}{
+		{"upload-pack", plain.URL + "/repo.git/info/refs?service=git-upload-pack", "", []string{"Git-Protocol"}},
+		{"receive-pack", plain.URL + "/repo.git/info/refs?service=git-receive-pack", "", nil},
+		{"compressed upload-pack", compressed.URL + "/repo.git/info/refs?service=git-upload-pack", "", []string{"Git-Protocol", "Accept-Encoding"}},
+		{"compressed upload-pack v2", compressed.URL + "/repo.git/info/refs?service=git-upload-pack", "version=2", []string{"Git-Protocol", "Accept-Encoding"}},
+		{"compressed receive-pack", compressed.URL + "/repo.git/info/refs?service=git-receive-pack", "", []string{"Accept-Encoding"}},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", "gzip")
+		if tt.protocol != "" {
+			req.Header.Set("Git-Protocol", tt.protocol)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		var got []string
+		for _, v := range res.Header.Values("Vary") {
+			for _, f := range strings.Split(v, ",") {
+				if f = strings.TrimSpace(f); f != "Origin" {
+					got = append(got, f)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Vary %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestConcurrentFetches fetches from one handler from many goroutines,
+// sharing its loader and server, run it with -race.
+func TestConcurrentFetches(t *testing.T) {
+	dir := newTestRepo(t, 3)
+	srv := newTestServer(t, dir)
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+
+	errc := make(chan error, 16)
+	for i := 0; i < cap(errc); i++ {
+		go func() {
+			res, err := http.Get(srv.URL + "/repo.git/info/refs?service=git-upload-pack")
+			if err == nil {
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				res, err = http.Post(srv.URL+"/repo.git/git-upload-pack", "application/x-git-upload-pack-request", uploadPackRequest([]string{main}, nil))
+			}
+			if err == nil {
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					err = fmt.Errorf("status %d", res.StatusCode)
+				}
+			}
+			errc <- err
+		}()
+	}
+	for i := 0; i < cap(errc); i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// BenchmarkUploadPackSession compares creating the loader and server for each request
+// with shared ones, as the handler does, for the advertisement of a fetch.
+func BenchmarkUploadPackSession(b *testing.B) {
+	dir := newTestRepo(b, 3)
+	shared := server.NewServer(server.NewFilesystemLoader(osfs.New(dir)))
+	ep, err := transport.NewEndpoint("/repo.git")
+	if err != nil {
+		b.Fatal(err)
+	}
+	advertise := func(b *testing.B, svr transport.Transport) {
+		sess, err := svr.NewUploadPackSession(ep, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := sess.AdvertisedReferencesContext(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+		sess.Close()
+	}
+	b.Run("per-request", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			advertise(b, server.NewServer(server.NewFilesystemLoader(osfs.New(dir))))
+		}
+	})
+	b.Run("shared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			advertise(b, shared)
+		}
+	})
+}
+
+// newBlobRepo creates a repository like newTestRepo with a commit
+// adding n files of size random bytes each, so nothing in it deltas or compresses.
+func newBlobRepo(t testing.TB, n, size int) string {
+	t.Helper()
+	requireGit(t)
+	work := t.TempDir()
+	runGit(t, work, "init", "-q", "-b", "main")
+	rnd := rand.New(rand.NewSource(int64(n)))
+	b := make([]byte, size)
+	for i := 0; i < n; i++ {
+		rnd.Read(b)
+		writeTestFile(t, filepath.Join(work, fmt.Sprintf("blob%d", i)), string(b))
+	}
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "-q", "-m", "blobs")
+	dir := t.TempDir()
+	runGit(t, dir, "clone", "-q", "--bare", work, "repo.git")
+	return dir
+}
+
+// peakHeapFetch fetches everything in the repository under dir over http
+// and returns the peak heap in use while serving it, sampled every millisecond.
+// The fetch is done with a raw request so only the server allocates.
+func peakHeapFetch(t testing.TB, dir string) uint64 {
+	t.Helper()
+	srv := newTestServer(t, dir)
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+	runtime.GC()
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak {
+				peak = ms.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	res, err := http.Post(srv.URL+"/repo.git/git-upload-pack", "application/x-git-upload-pack-request", uploadPackRequest([]string{main}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	close(done)
+	<-sampled
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("fetch: status %d, %v", res.StatusCode, err)
+	}
+	t.Logf("sent %d bytes, peak heap %d", n, peak)
+	return peak
+}
+
+// TestFetchMemory checks the memory a fetch takes doesn't grow with the pack:
+// four times the objects mustn't take four times the heap.
+// The repositories aren't packed, go-git kept loose objects in memory.
+func TestFetchMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates 20MiB of repositories")
+	}
+	small := peakHeapFetch(t, newBlobRepo(t, 16, 256<<10))
+	large := peakHeapFetch(t, newBlobRepo(t, 64, 256<<10))
+	// the large pack alone is 16MiB
+	if large > small+8<<20 {
+		t.Errorf("peak heap %d MiB for a 16MiB pack, %d MiB for 4MiB", large>>20, small>>20)
+	}
+}
+
+// TestMaxOperationDurationStalledClient checks a download to a client
+// that stopped reading it is cut off at MaxOperationDuration
+// rather than blocking in a write until the client goes away.
+func TestMaxOperationDurationStalledClient(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates a 16MiB repository")
+	}
+	dir := newBlobRepo(t, 64, 256<<10)
+	h := newHandler(newTestHandler(t, dir, WithMaxOperationDuration(time.Second)))
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(rw, r)
+		close(done)
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.(*net.TCPConn).SetReadBuffer(4096); err != nil {
+		t.Fatal(err)
+	}
+	// the archive is larger than the socket buffers, and never read,
+	// so the handler is stuck writing it well before the limit
+	fmt.Fprintf(conn, "GET /repo.git/archive/main.tar HTTP/1.1\r\nHost: test\r\n\r\n")
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("archive still writing to a stalled client 10s past the limit")
+	}
+}
+
+// TestCancelledFetch cancels a fetch once the pack is streaming,
+// the handler stops building it and frees its concurrency slot
+// for the next fetch.
+func TestCancelledFetch(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates a 4MiB repository")
+	}
+	dir := newBlobRepo(t, 16, 256<<10)
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+	// no waiting, a slot still held fails the next fetch
+	h := newHandler(newTestHandler(t, dir, WithConcurrencyLimits(1, 0, 0)))
+	done := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(rw, r)
+		if strings.HasSuffix(r.URL.Path, "/git-upload-pack") {
+			done <- struct{}{}
+		}
+	}))
+	defer srv.Close()
+
+	fetch := func(ctx context.Context) *http.Response {
+		t.Helper()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/repo.git/git-upload-pack", uploadPackRequest([]string{main}, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res := fetch(ctx)
+	if _, err := io.ReadFull(res.Body, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	res.Body.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handler still sending the pack 10s after the fetch was cancelled")
+	}
+
+	res = fetch(context.Background())
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("fetch after a cancelled one: status %d, want 200", res.StatusCode)
+	}
+	<-done
+}
+
+// BenchmarkFetchMemory reports the peak heap of fetching 4, 16 and 64MiB packs,
+// which should stay flat.
+func BenchmarkFetchMemory(b *testing.B) {
+	for _, n := range []int{16, 64, 256} {
+		b.Run(fmt.Sprintf("%dMiB", n/4), func(b *testing.B) {
+			dir := newBlobRepo(b, n, 256<<10)
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				if p := peakHeapFetch(b, dir); p > peak {
+					peak = p
+				}
+			}
+			b.ReportMetric(float64(peak), "peak-heap-bytes")
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package gitreposerver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// repoSummary is the /{repo}/info.json summary of a repository.
+type repoSummary struct {
+	Name          string `json:"name"`
+	DefaultBranch string `json:"default_branch,omitempty"`
+	// Head is the commit the default branch points to.
+	Head     string `json:"head,omitempty"`
+	Branches int    `json:"branches"`
+	Tags     int    `json:"tags"`
+	// LastCommit is the committer time of Head.
+	LastCommit *time.Time `json:"last_commit,omitempty"`
+	// LastFetch and LastPush are set if the server has seen any.
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	LastPush  *time.Time `json:"last_push,omitempty"`
+}
+
+// infoJSON serves /{repo}/info.json, a summary of the repository
+// for pages that don't want to clone it.
+// Hidden refs aren't counted.
+func (h *httpHandler) infoJSON(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repo := RepoFromContext(r.Context())
+
+	// the summary only changes with the refs and activity
+	fingerprint, _, err := h.advertisementFingerprint(repo)
+	if err != nil {
+		h.logger(r.Context()).Error("read refs", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	activity := h.cfg.Activity.get(repo)
+	etag := `"` + fingerprint[:32] + `"`
+	if last := activity.last(); !last.IsZero() {
+		etag = fmt.Sprintf(`"%s-%x"`, fingerprint[:32], last.UnixNano())
+	}
+	setNoCache(rw.Header())
+	rw.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	summary, err := h.summarize(sto, repo, h.hiddenRefs(r.Context(), repo), h.defaultBranch(r.Context(), repo))
+	if err != nil {
+		h.logger(r.Context()).Error("summarize repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	summary.LastFetch, summary.LastPush = activity.times()
+
+	rw.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	json.NewEncoder(rw).Encode(summary)
+}
+
+func (h *httpHandler) summarize(sto storer.Storer, repo string, hidden []string, defaultBranch string) (repoSummary, error) {
+	summary := repoSummary{Name: repo}
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return summary, fmt.Errorf("list references: %w", err)
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if matchRef(hidden, ref.Name().String()) {
+			return nil
+		}
+		switch {
+		case ref.Name().IsBranch():
+			summary.Branches++
+		case ref.Name().IsTag():
+			summary.Tags++
+		}
+		return nil
+	})
+	if err != nil {
+		return summary, fmt.Errorf("list references: %w", err)
+	}
+
+	target, ok := headTarget(sto, defaultBranch)
+	if !ok || matchRef(hidden, target.String()) {
+		// empty repository
+		return summary, nil
+	}
+	ref, err := storer.ResolveReference(sto, target)
+	if err != nil {
+		return summary, fmt.Errorf("resolve %s: %w", target, err)
+	}
+	summary.DefaultBranch = target.Short()
+	summary.Head = ref.Hash().String()
+	commit, err := peelCommit(sto, ref.Hash())
+	if err != nil {
+		return summary, err
+	}
+	if commit != nil {
+		when := commit.Committer.When
+		summary.LastCommit = &when
+	}
+	return summary, nil
+}
@@ -0,0 +1,92 @@
+package gitreposerver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// retryAfter is the Retry-After sent when a service is at its limit.
+const retryAfter = 5 * time.Second
+
+// limiter is a counting semaphore, a nil limiter is unlimited.
+type limiter chan struct{}
+
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+// acquire takes a slot, waiting up to wait for one to free up.
+func (l limiter) acquire(r *http.Request, wait time.Duration) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+	}
+	if wait <= 0 {
+		return false
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case l <- struct{}{}:
+		return true
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+	return false
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+// limit runs next only while l has a free slot,
+// rejecting requests with a 503 when it's full.
+func (h *httpHandler) limit(l limiter, service string, next http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return next
+	}
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if !l.acquire(r, h.cfg.ConcurrencyWait) {
+			h.logger(r.Context()).Warn("concurrency limit reached", "service", service, "repo", RepoFromContext(r.Context()), "limit", cap(l))
+			rw.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+			http.Error(rw, "too many concurrent "+service+" requests", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release()
+		next(rw, r)
+	}
+}
+
+// boundOperation cancels ctx once the operation has run for MaxOperationDuration,
+// if it's set, logging the timeout and calling abort, if it's not nil,
+// to stop writes stuck on a slow client.
+// The returned cancel must be called when the operation is done.
+func (h *httpHandler) boundOperation(ctx context.Context, abort func()) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	d := h.cfg.MaxOperationDuration
+	if d <= 0 {
+		return ctx, cancel
+	}
+	t := time.AfterFunc(d, func() {
+		h.logger(ctx).Warn("operation timed out", "repo", RepoFromContext(ctx), "limit", d)
+		cancel()
+		if abort != nil {
+			abort()
+		}
+	})
+	return ctx, func() {
+		t.Stop()
+		cancel()
+	}
+}
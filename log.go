@@ -0,0 +1,113 @@
+package gitreposerver
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Logger receives leveled log records with alternating key value pairs.
+// It is satisfied by *slog.Logger.
+type Logger interface {
+	Debug(msg string, keyvals ...any)
+	Info(msg string, keyvals ...any)
+	Warn(msg string, keyvals ...any)
+	Error(msg string, keyvals ...any)
+}
+
+// Level is the minimum level a stdLogger writes.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// ParseLevel parses a level name such as "info".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// stdLogger writes records as "LEVEL msg key=value ..." lines
+// to a standard library logger.
+type stdLogger struct {
+	l     *log.Logger
+	level Level
+}
+
+// NewStdLogger returns a Logger writing records at or above level to l.
+func NewStdLogger(l *log.Logger, level Level) Logger {
+	return stdLogger{l, level}
+}
+
+func (s stdLogger) Debug(msg string, keyvals ...any) { s.output(LevelDebug, "DEBUG", msg, keyvals) }
+func (s stdLogger) Info(msg string, keyvals ...any)  { s.output(LevelInfo, "INFO", msg, keyvals) }
+func (s stdLogger) Warn(msg string, keyvals ...any)  { s.output(LevelWarn, "WARN", msg, keyvals) }
+func (s stdLogger) Error(msg string, keyvals ...any) { s.output(LevelError, "ERROR", msg, keyvals) }
+
+func (s stdLogger) output(level Level, name, msg string, keyvals []any) {
+	if level < s.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		key, val := fmt.Sprint(keyvals[i]), "!MISSING"
+		if i+1 < len(keyvals) {
+			val = fmt.Sprint(keyvals[i+1])
+		}
+		if val == "" || strings.ContainsAny(val, " \t\n\"=") {
+			val = strconv.Quote(val)
+		}
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(val)
+	}
+	s.l.Output(3, b.String())
+}
+
+// NopLogger discards all records.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// keyvalsLogger adds keyvals to every record.
+type keyvalsLogger struct {
+	l       Logger
+	keyvals []any
+}
+
+// withKeyvals returns a Logger adding keyvals to every record written to l.
+func withKeyvals(l Logger, keyvals ...any) Logger {
+	return keyvalsLogger{l, keyvals}
+}
+
+func (k keyvalsLogger) Debug(msg string, keyvals ...any) { k.l.Debug(msg, k.with(keyvals)...) }
+func (k keyvalsLogger) Info(msg string, keyvals ...any)  { k.l.Info(msg, k.with(keyvals)...) }
+func (k keyvalsLogger) Warn(msg string, keyvals ...any)  { k.l.Warn(msg, k.with(keyvals)...) }
+func (k keyvalsLogger) Error(msg string, keyvals ...any) { k.l.Error(msg, k.with(keyvals)...) }
+
+func (k keyvalsLogger) with(keyvals []any) []any {
+	return append(append(make([]any, 0, len(k.keyvals)+len(keyvals)), k.keyvals...), keyvals...)
+}
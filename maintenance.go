@@ -0,0 +1,112 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// staleQuarantine is the age after which a push's quarantine
+// no longer holds off maintenance.
+const staleQuarantine = 24 * time.Hour
+
+// RunMaintenance runs git gc on the repositories under dir
+// every MaintenanceInterval.
+func RunMaintenance(dir string, opts ...Option) error {
+	return RunMaintenanceContext(context.Background(), dir, opts...)
+}
+
+// RunMaintenanceContext runs git gc on the repositories under dir
+// every MaintenanceInterval until ctx is cancelled,
+// packing loose objects and refs so fetches stay fast.
+// It returns immediately if MaintenanceInterval isn't set
+// or the server is ReadOnly.
+// Repositories with a push in progress are skipped until the next run.
+func RunMaintenanceContext(ctx context.Context, dir string, opts ...Option) error {
+	cfg := newConfig(append(opts, WithDir(dir)))
+	if cfg.MaintenanceInterval <= 0 {
+		return nil
+	}
+	if cfg.ReadOnly {
+		cfg.logger().Info("maintenance disabled, server is read-only", "dir", dir)
+		return nil
+	}
+	if cfg.Filesystem != nil {
+		return errors.New("maintenance: git gc can't be used with a Filesystem")
+	}
+	logger := cfg.logger()
+	if _, err := exec.LookPath("git"); err != nil {
+		return fmt.Errorf("maintenance: %w", err)
+	}
+	logger.Info("starting maintenance", "dir", dir, "interval", cfg.MaintenanceInterval)
+
+	roots := newRepoRoots(cfg)
+	t := time.NewTicker(cfg.MaintenanceInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Info("maintenance stopped")
+			return nil
+		case <-t.C:
+		}
+		err := walkRepos(cfg.filesystem(), roots, func(repo string) error {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			gc(ctx, logger, filepath.Join(dir, filepath.FromSlash(repo)), repo)
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			logger.Error("list repositories", "err", err)
+		}
+	}
+}
+
+// gc runs git gc on the repository at gitDir, logging the result.
+func gc(ctx context.Context, logger Logger, gitDir, repo string) {
+	if pushing(gitDir) {
+		logger.Info("skipping gc, push in progress", "repo", repo)
+		return
+	}
+	logger.Info("gc started", "repo", repo)
+	start := time.Now()
+	var out bytes.Buffer
+	c := exec.CommandContext(ctx, "git", "gc", "--quiet")
+	c.Dir = gitDir
+	c.Stdout = &out
+	c.Stderr = &out
+	if err := c.Run(); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Warn("gc failed", "repo", repo, "duration", time.Since(start), "err", err, "output", strings.TrimSpace(out.String()))
+		return
+	}
+	logger.Info("gc finished", "repo", repo, "duration", time.Since(start))
+}
+
+// pushing reports whether the repository at gitDir has a push in progress,
+// which has its objects in a quarantine.
+// Quarantines older than staleQuarantine were left by a crash.
+func pushing(gitDir string) bool {
+	entries, err := os.ReadDir(filepath.Join(gitDir, "objects"))
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "incoming-") {
+			continue
+		}
+		if fi, err := e.Info(); err == nil && time.Since(fi.ModTime()) < staleQuarantine {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package gitreposerver
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Metrics receives measurements of http requests,
+// for example to export as Prometheus collectors.
+// Methods are called concurrently.
+type Metrics interface {
+	// RequestStarted is called when a request for service starts.
+	RequestStarted(service string)
+	// RequestFinished is called once the response has been sent.
+	RequestFinished(stats RequestStats)
+}
+
+// RequestStats describes a completed request.
+type RequestStats struct {
+	// Service is upload-pack or receive-pack, empty for other paths.
+	Service  string
+	Status   int
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	// Error is a short kind for failed requests, such as "not_found",
+	// "unauthorized" or "internal", empty on success.
+	Error string
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) RequestStarted(string)        {}
+func (nopMetrics) RequestFinished(RequestStats) {}
+
+// requestService returns the git service a request is for.
+func requestService(r *http.Request) string {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/git-upload-pack"):
+		return "upload-pack"
+	case strings.HasSuffix(r.URL.Path, "/git-receive-pack"):
+		return "receive-pack"
+	case strings.HasSuffix(r.URL.Path, "/info/refs"):
+		switch r.URL.Query().Get("service") {
+		case "git-upload-pack":
+			return "upload-pack"
+		case "git-receive-pack":
+			return "receive-pack"
+		}
+	}
+	return ""
+}
+
+// errorKind classifies a failed response by its status.
+func errorKind(status int) string {
+	switch {
+	case status < 400:
+		return ""
+	case status == http.StatusBadRequest:
+		return "bad_request"
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status == http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case status == http.StatusTooManyRequests:
+		return "rate_limited"
+	case status < 500:
+		return "client"
+	case status == http.StatusServiceUnavailable:
+		return "overloaded"
+	}
+	return "internal"
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
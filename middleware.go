@@ -0,0 +1,264 @@
+package gitreposerver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedReader fails reads past limit bytes,
+// recording whether the limit, or an enclosing http.MaxBytesReader, was hit.
+type limitedReader struct {
+	r        io.Reader
+	n        int64
+	limit    int64
+	exceeded bool
+}
+
+func newLimitedReader(r io.Reader, limit int64) *limitedReader {
+	return &limitedReader{r: r, n: limit, limit: limit}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, errBodyTooLarge
+	}
+	if l.n <= 0 {
+		// only fail if there's more to read
+		var b [1]byte
+		n, err := l.r.Read(b[:])
+		if n > 0 {
+			l.exceeded = true
+			return 0, errBodyTooLarge
+		}
+		return 0, l.check(err)
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, l.check(err)
+}
+
+func (l *limitedReader) check(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		l.exceeded = true
+	}
+	return err
+}
+
+// responseRecorder captures the status and size of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through flushes for streamed packs.
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap allows http.ResponseController to reach the underlying writer.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestInfo collects details about a request
+// discovered while it's being handled.
+type requestInfo struct {
+	id       string
+	repo     string
+	identity string
+	// failure is set for errors sent in a successful response,
+	// such as protocol v2 ERR packets.
+	failure string
+	// err is the error behind a failed response.
+	err error
+	// event is the fetch or push the request completed, for Config.OnEvent.
+	event *Event
+	// signer is the verified signer of a signed push.
+	signer string
+	// packs counts the packs sent to a fetch,
+	// packObjects and packBytes are their total objects and size.
+	packs       int
+	packObjects int64
+	packBytes   int64
+}
+
+// addPack adds a pack sent to the request.
+func (info *requestInfo) addPack(objects, bytes int64) {
+	info.packs++
+	info.packObjects += objects
+	info.packBytes += bytes
+}
+
+// packKeyvals returns the keyvals logging the packs sent, if any.
+func (info *requestInfo) packKeyvals() []any {
+	if info.packs == 0 {
+		return nil
+	}
+	return []any{"pack_objects", info.packObjects, "pack_bytes", info.packBytes}
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFromContext returns the requestInfo to fill in,
+// or a throwaway one if the request isn't being logged.
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, ok := ctx.Value(requestInfoKey{}).(*requestInfo)
+	if !ok {
+		return &requestInfo{}
+	}
+	return info
+}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// Middleware wraps a git route handler.
+type Middleware func(http.Handler) http.Handler
+
+// applyMiddleware wraps h so that mw[0] is the outermost handler.
+func applyMiddleware(h http.Handler, mw []Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// newRequestID returns a random id to correlate logs with client reports.
+func newRequestID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestID returns the X-Request-Id set by a proxy or the client,
+// so logs can be correlated across them,
+// or a new id if there isn't a usable one.
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" || len(id) > 64 {
+		return newRequestID()
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.':
+		default:
+			return newRequestID()
+		}
+	}
+	return id
+}
+
+// RequestIDFromContext returns the id of the request,
+// as sent in the X-Request-Id response header and logged with the request.
+func RequestIDFromContext(ctx context.Context) string {
+	return requestInfoFromContext(ctx).id
+}
+
+// logger returns the Logger for records about the request in ctx,
+// which include its id.
+func (h *httpHandler) logger(ctx context.Context) Logger {
+	id := RequestIDFromContext(ctx)
+	if id == "" {
+		return h.log
+	}
+	return withKeyvals(h.log, "id", id)
+}
+
+// observeRequests logs and measures every request,
+// sending the events of successful ones to events and activity
+// and recording authenticated fetches and pushes to audit.
+// trusted are the proxies whose forwarded headers are used
+// for the logged client ip and scheme.
+func observeRequests(logger Logger, metrics Metrics, events *eventQueue, activity *Activity, audit *auditLog, trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		service := requestService(r)
+		metrics.RequestStarted(service)
+
+		info := &requestInfo{id: requestID(r)}
+		rw.Header().Set("X-Request-Id", info.id)
+		rec := &responseRecorder{ResponseWriter: rw}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		next.ServeHTTP(rec, r.WithContext(withRequestInfo(r.Context(), info)))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		duration := time.Since(start)
+
+		keyvals := []any{
+			"id", info.id,
+			"client", clientIP(r, trusted),
+			"scheme", clientScheme(r, trusted),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"repo", info.repo,
+			"identity", info.identity,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration", duration,
+		}
+		keyvals = append(keyvals, info.packKeyvals()...)
+		if info.err != nil {
+			keyvals = append(keyvals, "err", info.err)
+		}
+		logger.Info("request", keyvals...)
+
+		failure := info.failure
+		if failure == "" {
+			failure = errorKind(rec.status)
+		}
+		metrics.RequestFinished(RequestStats{
+			Service:  service,
+			Status:   rec.status,
+			BytesIn:  body.n,
+			BytesOut: rec.bytes,
+			Duration: duration,
+			Error:    failure,
+		})
+		var client string
+		if ip := clientIP(r, trusted); ip != nil {
+			client = ip.String()
+		}
+		if failure == "" {
+			events.report(info, "http", client, body.n, rec.bytes)
+			activity.record(info)
+		}
+		if service != "" && r.Method == http.MethodPost {
+			audit.operation(info, "http", client, service == "receive-pack", failure)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package gitreposerver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// upstreamRetry is how long a failed upstream fetch is remembered,
+// so a broken or missing upstream isn't asked again for every request.
+const upstreamRetry = 30 * time.Second
+
+// errMirror is returned for pushes to a mirrored repository.
+var errMirror = errors.New("repository is a read-only mirror")
+
+// Upstream is the remote a mirrored repository is fetched from.
+type Upstream struct {
+	URL string
+	// Auth authenticates to the upstream, nil for none.
+	Auth transport.AuthMethod
+}
+
+// UpstreamPrefix mirrors every repository from the same path
+// under prefix, such as https://github.com/.
+func UpstreamPrefix(prefix string) func(repo string) (Upstream, bool) {
+	return func(repo string) (Upstream, bool) {
+		return Upstream{URL: strings.TrimSuffix(prefix, "/") + "/" + repo}, true
+	}
+}
+
+// mirrors tracks when each mirrored repository was last fetched.
+type mirrors struct {
+	mu    sync.Mutex
+	state map[string]*mirrorState
+}
+
+type mirrorState struct {
+	// mu is held while fetching, so a repository is fetched once at a time.
+	mu      sync.Mutex
+	fetched time.Time
+	failed  time.Time
+}
+
+func newMirrors() *mirrors {
+	return &mirrors{state: make(map[string]*mirrorState)}
+}
+
+func (m *mirrors) get(repo string) *mirrorState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.state[repo]
+	if !ok {
+		s = &mirrorState{}
+		m.state[repo] = s
+	}
+	return s
+}
+
+// isMirror reports whether repo has an upstream.
+func (h *httpHandler) isMirror(repo string) bool {
+	_, ok := h.upstream(repo)
+	return ok
+}
+
+// upstream returns the upstream of repo if it's a mirror.
+func (h *httpHandler) upstream(repo string) (Upstream, bool) {
+	if h.cfg.Upstream == nil {
+		return Upstream{}, false
+	}
+	return h.cfg.Upstream(repo)
+}
+
+// createMirror creates and fetches the missing mirror for name,
+// returning errRepoNotFound if its upstream can't be fetched
+// or the server is ReadOnly.
+func (h *httpHandler) createMirror(ctx context.Context, name string) (string, error) {
+	if name == "" || h.cfg.ReadOnly {
+		return "", errRepoNotFound
+	}
+	s := h.mirrors.get(initRepoName(name))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.failed) < upstreamRetry {
+		return "", errRepoNotFound
+	}
+	// another request may have created it while this one waited
+	if existing, err := resolveRepoPath(h.fs, h.roots, name, h.cfg.ExperimentalSHA256); err == nil {
+		return existing, nil
+	}
+
+	repo, err := initRepo(h.fs, h.roots, name)
+	if err != nil {
+		return "", err
+	}
+	if err := h.fetchUpstream(ctx, repo, s); err != nil {
+		if rerr := util.RemoveAll(h.fs, repo); rerr != nil {
+			h.logger(ctx).Error("remove failed mirror", "repo", repo, "err", rerr)
+		}
+		return "", errRepoNotFound
+	}
+	h.logger(ctx).Info("created mirror", "repo", repo)
+	return repo, nil
+}
+
+// syncMirror fetches repo from its upstream if it's a mirror
+// that wasn't fetched in the last UpstreamInterval.
+// A failed fetch is logged and the repository served as it is,
+// as are all mirrors of a ReadOnly server.
+func (h *httpHandler) syncMirror(ctx context.Context, repo string) {
+	if h.cfg.ReadOnly || !h.isMirror(repo) {
+		return
+	}
+	s := h.mirrors.get(repo)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.fetched) < h.cfg.upstreamInterval() || time.Since(s.failed) < upstreamRetry {
+		return
+	}
+	h.fetchUpstream(ctx, repo, s)
+}
+
+// fetchUpstream makes repo match its upstream, fetching all branches and tags,
+// deleting those the upstream no longer has and copying its HEAD.
+// s.mu must be held.
+func (h *httpHandler) fetchUpstream(ctx context.Context, repo string, s *mirrorState) error {
+	up, _ := h.upstream(repo)
+	start := time.Now()
+	err := h.mirror(ctx, repo, up)
+	if err != nil {
+		s.failed = time.Now()
+		h.logger(ctx).Warn("fetch upstream", "repo", repo, "upstream", up.URL, "err", err)
+		return err
+	}
+	s.fetched = time.Now()
+	h.cache.invalidate(repo)
+	h.logger(ctx).Info("fetched upstream", "repo", repo, "upstream", up.URL, "duration", time.Since(start))
+	return nil
+}
+
+func (h *httpHandler) mirror(ctx context.Context, repo string, up Upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, h.cfg.upstreamTimeout())
+	defer cancel()
+
+	sto := filesystem.NewStorage(chroot.New(h.fs, repo), cache.NewObjectLRUDefault())
+	remote := git.NewRemote(sto, &config.RemoteConfig{Name: "upstream", URLs: []string{up.URL}})
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: up.Auth})
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("list upstream refs: %w", err)
+	}
+	err = remote.FetchContext(ctx, &git.FetchOptions{
+		RefSpecs: []config.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"},
+		Auth:     up.Auth,
+		Tags:     git.NoTags,
+		Force:    true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("fetch upstream: %w", err)
+	}
+
+	upstream := make(map[plumbing.ReferenceName]bool, len(refs))
+	for _, ref := range refs {
+		upstream[ref.Name()] = true
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			if err := sto.SetReference(ref); err != nil {
+				return fmt.Errorf("set HEAD: %w", err)
+			}
+		}
+	}
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return fmt.Errorf("list references: %w", err)
+	}
+	return iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		if (name.IsBranch() || name.IsTag()) && !upstream[name] {
+			if err := sto.RemoveReference(name); err != nil {
+				return fmt.Errorf("remove %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
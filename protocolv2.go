@@ -0,0 +1,696 @@
+package gitreposerver
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// go-git only implements the server side of protocol v0,
+// this implements the upload-pack half of protocol v2
+// (ls-refs and fetch) on top of its storage and pack encoder.
+// See https://git-scm.com/docs/protocol-v2
+
+var errMalformedV2Request = errors.New("malformed protocol v2 request")
+
+// errOldProtocol is returned for fetches older than MinProtocolVersion.
+var errOldProtocol = errors.New("protocol version not supported")
+
+// checkProtocolVersion refuses a fetch with protocol version
+// if it's older than MinProtocolVersion.
+func (h *httpHandler) checkProtocolVersion(version int) error {
+	if version < h.cfg.MinProtocolVersion {
+		return fmt.Errorf("%w: the server requires protocol v%d, fetch with git -c protocol.version=%d", errOldProtocol, h.cfg.MinProtocolVersion, h.cfg.MinProtocolVersion)
+	}
+	return nil
+}
+
+// protocolVersion returns the protocol version requested
+// by the Git-Protocol header, 0 if none was requested.
+func protocolVersion(r *http.Request) int {
+	return parseProtocolVersion(r.Header.Get("Git-Protocol"))
+}
+
+// parseProtocolVersion parses the colon separated key=value list
+// sent in the Git-Protocol header or the GIT_PROTOCOL environment variable.
+func parseProtocolVersion(s string) int {
+	version := 0
+	for _, kv := range strings.Split(s, ":") {
+		if strings.HasPrefix(kv, "version=") {
+			n, err := strconv.Atoi(strings.TrimPrefix(kv, "version="))
+			if err == nil && n > version {
+				version = n
+			}
+		}
+	}
+	if version > 2 {
+		version = 2
+	}
+	return version
+}
+
+// advertiseV2 writes the protocol v2 capability advertisement.
+func advertiseV2(w io.Writer, agent, objectFormat string) error {
+	lines := []string{
+		"version 2\n",
+		"agent=" + agent + "\n",
+		"ls-refs=unborn\n",
+		"fetch=shallow filter ref-in-want\n",
+	}
+	if objectFormat != "sha1" {
+		// git assumes sha1 without it
+		lines = append(lines, "object-format="+objectFormat+"\n")
+	}
+	return pktline.NewEncoder(w).EncodeString(append(lines, pktline.FlushString)...)
+}
+
+type pktType int
+
+const (
+	pktData pktType = iota
+	pktFlush
+	pktDelim
+	pktResponseEnd
+)
+
+// readPkt reads a single pkt-line.
+// pktline.Scanner can't be used as it rejects the v2 special packets.
+func readPkt(r io.Reader) ([]byte, pktType, error) {
+	var lenBuf [4]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, 0, pktline.ErrInvalidPktLen
+		}
+		return nil, 0, err
+	}
+	n, err := strconv.ParseUint(string(lenBuf[:]), 16, 16)
+	if err != nil {
+		return nil, 0, pktline.ErrInvalidPktLen
+	}
+	switch {
+	case n == 0:
+		return nil, pktFlush, nil
+	case n == 1:
+		return nil, pktDelim, nil
+	case n == 2:
+		return nil, pktResponseEnd, nil
+	case n < 4 || n > pktline.MaxPayloadSize+4:
+		return nil, 0, pktline.ErrInvalidPktLen
+	}
+	payload := make([]byte, n-4)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, pktline.ErrInvalidPktLen
+	}
+	return payload, pktData, nil
+}
+
+// v2Request is a protocol v2 command request.
+type v2Request struct {
+	command string
+	caps    []string
+	args    []string
+}
+
+// readV2Request reads a single command request,
+// returning io.EOF if r ends before a new request starts.
+func readV2Request(r io.Reader) (*v2Request, error) {
+	line, typ, err := readPkt(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != pktData {
+		return nil, errMalformedV2Request
+	}
+	command := strings.TrimSuffix(string(line), "\n")
+	if !strings.HasPrefix(command, "command=") {
+		return nil, errMalformedV2Request
+	}
+
+	req := &v2Request{command: strings.TrimPrefix(command, "command=")}
+	dst := &req.caps
+	for {
+		line, typ, err := readPkt(r)
+		if errors.Is(err, io.EOF) {
+			return nil, errMalformedV2Request
+		} else if err != nil {
+			return nil, err
+		}
+		switch typ {
+		case pktFlush:
+			return req, nil
+		case pktDelim:
+			if dst == &req.args {
+				return nil, errMalformedV2Request
+			}
+			dst = &req.args
+		case pktData:
+			*dst = append(*dst, strings.TrimSuffix(string(line), "\n"))
+		default:
+			return nil, errMalformedV2Request
+		}
+	}
+}
+
+// v2Config holds server settings for protocol v2 commands.
+type v2Config struct {
+	// defaultBranch is advertised as HEAD when it's detached or dangling.
+	defaultBranch string
+	// hiddenRefs are ref prefixes left out of ls-refs and refused as wants.
+	hiddenRefs []string
+	// trace logs the requests and packs, if it's set.
+	trace *wireTrace
+	// maxHaves limits the haves of a fetch, 0 is unlimited.
+	maxHaves int
+	// maxWants limits the distinct wants of a fetch, 0 is unlimited.
+	maxWants int
+	// objectFormat is the hash naming the repository's objects, sha1 if empty,
+	// commands asking for another are refused.
+	objectFormat string
+}
+
+// serveV2 runs a single protocol v2 command against sto.
+func serveV2(ctx context.Context, w io.Writer, sto storer.Storer, req *v2Request, cfg v2Config) error {
+	cfg.trace.v2Request(req)
+	objectFormat := cfg.objectFormat
+	if objectFormat == "" {
+		objectFormat = "sha1"
+	}
+	for _, c := range req.caps {
+		if strings.HasPrefix(c, "object-format=") && c != "object-format="+objectFormat {
+			return requestErrorf("%s, the repository uses %s", c, objectFormat)
+		}
+	}
+	switch req.command {
+	case "ls-refs":
+		return lsRefs(w, sto, req.args, cfg)
+	case "fetch":
+		return fetchV2(ctx, w, sto, req.args, cfg)
+	}
+	return requestErrorf("unknown command %q", req.command)
+}
+
+// writeV2Error reports msg to the client in an ERR packet.
+func writeV2Error(w io.Writer, msg string) error {
+	return pktline.NewEncoder(w).Encodef("ERR %s\n", msg)
+}
+
+// lsRefs implements the ls-refs command.
+func lsRefs(w io.Writer, sto storer.Storer, args []string, cfg v2Config) error {
+	var symrefs, peel, unborn bool
+	var prefixes []string
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case arg == "unborn":
+			unborn = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		default:
+			return requestErrorf("ls-refs: unsupported argument %q", arg)
+		}
+	}
+
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return fmt.Errorf("ls-refs: list references: %w", err)
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD && !matchRef(cfg.hiddenRefs, ref.Name().String()) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ls-refs: list references: %w", err)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+	head, err := sto.Reference(plumbing.HEAD)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return fmt.Errorf("ls-refs: get HEAD: %w", err)
+	}
+	if target, ok := headTarget(sto, cfg.defaultBranch); ok {
+		head = plumbing.NewSymbolicReference(plumbing.HEAD, target)
+	}
+	if head != nil {
+		refs = append([]*plumbing.Reference{head}, refs...)
+	}
+
+	e := pktline.NewEncoder(w)
+	for _, ref := range refs {
+		if !hasRefPrefix(prefixes, ref.Name().String()) {
+			continue
+		}
+		resolved := ref
+		if ref.Type() == plumbing.SymbolicReference {
+			resolved, err = storer.ResolveReference(sto, ref.Target())
+			if errors.Is(err, plumbing.ErrReferenceNotFound) {
+				// an unborn HEAD, as in a new repository,
+				// tells clients which branch to create
+				if unborn && ref.Name() == plumbing.HEAD && !matchRef(cfg.hiddenRefs, ref.Target().String()) {
+					line := "unborn HEAD"
+					if symrefs {
+						line += " symref-target:" + ref.Target().String()
+					}
+					if err := e.EncodeString(line + "\n"); err != nil {
+						return err
+					}
+				}
+				continue
+			} else if err != nil {
+				return fmt.Errorf("ls-refs: resolve %s: %w", ref.Name(), err)
+			}
+		}
+
+		line := resolved.Hash().String() + " " + ref.Name().String()
+		if symrefs && ref.Type() == plumbing.SymbolicReference {
+			line += " symref-target:" + ref.Target().String()
+		}
+		if peel {
+			if peeled, ok := peelTag(sto, resolved.Hash()); ok {
+				line += " peeled:" + peeled.String()
+			}
+		}
+		if err := e.EncodeString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return e.Flush()
+}
+
+// hasRefPrefix reports whether name starts with one of prefixes,
+// any name does if there are none.
+// Unlike hidden refs, these are plain string prefixes, as in git.
+func hasRefPrefix(prefixes []string, name string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// peelTag returns the non tag object h points to if h is an annotated tag.
+func peelTag(sto storer.EncodedObjectStorer, h plumbing.Hash) (plumbing.Hash, bool) {
+	peeled := false
+	for {
+		tag, err := object.GetTag(sto, h)
+		if err != nil {
+			return h, peeled
+		}
+		h, peeled = tag.Target, true
+	}
+}
+
+// fetchV2 implements the fetch command.
+func fetchV2(ctx context.Context, w io.Writer, sto storer.Storer, args []string, cfg v2Config) error {
+	var wants, haves, shallows []plumbing.Hash
+	var wantRefs []*plumbing.Reference
+	var done, ofsDelta, noProgress, includeTag bool
+	depth := 0
+	var since time.Time
+	var exclude []plumbing.Hash
+	filter, filterSpec := noFilter, ""
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "want "):
+			h, err := parseHash(strings.TrimPrefix(arg, "want "))
+			if err != nil {
+				return fmt.Errorf("fetch: %w", err)
+			}
+			wants = append(wants, h)
+		case strings.HasPrefix(arg, "want-ref "):
+			ref, err := resolveWantRef(sto, cfg.hiddenRefs, strings.TrimPrefix(arg, "want-ref "))
+			if err != nil {
+				return fmt.Errorf("fetch: %w", err)
+			}
+			wantRefs = append(wantRefs, ref)
+		case strings.HasPrefix(arg, "have "):
+			h, err := parseHash(strings.TrimPrefix(arg, "have "))
+			if err != nil {
+				return fmt.Errorf("fetch: %w", err)
+			}
+			haves = append(haves, h)
+			if err := checkHaves(len(haves), cfg.maxHaves); err != nil {
+				return fmt.Errorf("fetch: %w", err)
+			}
+		case strings.HasPrefix(arg, "shallow "):
+			h, err := parseHash(strings.TrimPrefix(arg, "shallow "))
+			if err != nil {
+				return fmt.Errorf("fetch: %w", err)
+			}
+			shallows = append(shallows, h)
+		case strings.HasPrefix(arg, "deepen "):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "deepen "))
+			if err != nil || n <= 0 {
+				return requestErrorf("fetch: invalid depth %q", arg)
+			}
+			depth = n
+		case strings.HasPrefix(arg, "deepen-since "):
+			t, err := strconv.ParseInt(strings.TrimPrefix(arg, "deepen-since "), 10, 64)
+			if err != nil {
+				return requestErrorf("fetch: invalid deepen-since %q", arg)
+			}
+			since = time.Unix(t, 0)
+		case strings.HasPrefix(arg, "deepen-not "):
+			h, err := resolveDeepenNot(sto, cfg.hiddenRefs, strings.TrimPrefix(arg, "deepen-not "))
+			if err != nil {
+				return fmt.Errorf("fetch: %w", err)
+			}
+			exclude = append(exclude, h)
+		case arg == "deepen-relative":
+			return requestErrorf("fetch: deepen-relative is not supported, use --depth")
+		case strings.HasPrefix(arg, "filter "):
+			filterSpec = strings.TrimPrefix(arg, "filter ")
+			f, err := parseFilter(filterSpec)
+			if err != nil {
+				return fmt.Errorf("fetch: %w", err)
+			}
+			filter = f
+		case arg == "done":
+			done = true
+		case arg == "ofs-delta":
+			ofsDelta = true
+		case arg == "no-progress":
+			noProgress = true
+		case arg == "include-tag":
+			includeTag = true
+		case arg == "thin-pack":
+			// we always send full packs
+		default:
+			return requestErrorf("fetch: unsupported argument %q", arg)
+		}
+	}
+	cfg.trace.v2Fetch(wants, wantRefs, haves, shallows, depth, filterSpec, done)
+	if len(wants) == 0 && len(wantRefs) == 0 {
+		return requestErrorf("fetch: no wants")
+	}
+	deepenBy := !since.IsZero() || len(exclude) > 0
+	if depth > 0 && deepenBy {
+		return requestErrorf("fetch: deepen and deepen-since (or deepen-not) cannot be used together")
+	}
+	for _, h := range wants {
+		if err := sto.HasEncodedObject(h); err != nil {
+			return requestErrorf("fetch: want %s: not our ref", h)
+		}
+	}
+	if err := checkHiddenWants(sto, cfg.hiddenRefs, wants); err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+	// want-refs were checked by name
+	for _, ref := range wantRefs {
+		wants = append(wants, ref.Hash())
+	}
+	if err := checkWants(wants, cfg.maxWants); err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+
+	var common []plumbing.Hash
+	for _, h := range haves {
+		if sto.HasEncodedObject(h) == nil {
+			common = append(common, h)
+		}
+	}
+	// ignore shallow commits we don't know about
+	known := shallows[:0]
+	for _, h := range shallows {
+		if sto.HasEncodedObject(h) == nil {
+			known = append(known, h)
+		}
+	}
+	shallows = known
+
+	e := pktline.NewEncoder(w)
+	if !done {
+		if err := e.EncodeString("acknowledgments\n"); err != nil {
+			return err
+		}
+		if len(common) == 0 {
+			// nothing in common yet, let the client send more haves
+			if err := e.EncodeString("NAK\n"); err != nil {
+				return err
+			}
+			return e.Flush()
+		}
+		for _, h := range common {
+			if err := e.Encodef("ACK %s\n", h); err != nil {
+				return err
+			}
+		}
+		if err := e.EncodeString("ready\n"); err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte("0001")); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var tags []plumbing.Hash
+	if includeTag {
+		var err error
+		tags, err = annotatedTags(sto, cfg.hiddenRefs)
+		if err != nil {
+			return fmt.Errorf("fetch: %w", err)
+		}
+	}
+	plan, err := planPack(sto, packRequest{
+		wants:    wants,
+		common:   common,
+		shallows: shallows,
+		depth:    depth,
+		since:    since,
+		exclude:  exclude,
+		filter:   filter,
+		tags:     tags,
+	})
+	if err != nil {
+		return fmt.Errorf("fetch: list objects: %w", err)
+	}
+
+	if depth > 0 || deepenBy || len(plan.shallow) > 0 || len(plan.unshallow) > 0 {
+		if err := e.EncodeString("shallow-info\n"); err != nil {
+			return err
+		}
+		for _, h := range plan.shallow {
+			if err := e.Encodef("shallow %s\n", h); err != nil {
+				return err
+			}
+		}
+		for _, h := range plan.unshallow {
+			if err := e.Encodef("unshallow %s\n", h); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write([]byte("0001")); err != nil {
+			return err
+		}
+	}
+
+	if len(wantRefs) > 0 {
+		if err := e.EncodeString("wanted-refs\n"); err != nil {
+			return err
+		}
+		for _, ref := range wantRefs {
+			if err := e.Encodef("%s %s\n", ref.Hash(), ref.Name()); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write([]byte("0001")); err != nil {
+			return err
+		}
+	}
+
+	if err := e.EncodeString("packfile\n"); err != nil {
+		return err
+	}
+	mux := sideband.NewMuxer(sideband.Sideband64k, ctxWriter{ctx, w})
+	pw := &packProgress{mux: mux}
+	if !noProgress {
+		pw.progress = progressWriter{mux, w}
+	}
+	pw.printf("Enumerating objects: %d, done.\n", len(plan.objects))
+	stop := pw.start(time.Second)
+	_, err = packfile.NewEncoder(pw, sto, !ofsDelta).Encode(plan.objects, 10)
+	stop()
+	if err != nil {
+		mux.WriteChannel(sideband.ErrorMessage, []byte(err.Error()+"\n"))
+		return fmt.Errorf("fetch: encode packfile: %w", err)
+	}
+	pw.printf("Total %d (%s), done.\n", len(plan.objects), formatBytes(pw.sent))
+	cfg.trace.packSent(int64(len(plan.objects)))
+	requestInfoFromContext(ctx).addPack(int64(len(plan.objects)), pw.sent)
+	return e.Flush()
+}
+
+// packProgress sends a pack on the sideband's pack data channel,
+// reporting how much was sent on its progress channel,
+// which also keeps the connection alive while deltas are computed.
+// A nil progress writer reports nothing.
+type packProgress struct {
+	mu       sync.Mutex
+	mux      *sideband.Muxer
+	progress io.Writer
+	sent     int64
+}
+
+// maxPackData is the most pack data a sideband packet holds.
+// go-git's muxer allows one byte more than fits in a pkt-line.
+const maxPackData = pktline.MaxPayloadSize - 1
+
+func (p *packProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var written int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPackData {
+			chunk = chunk[:maxPackData]
+		}
+		n, err := p.mux.Write(chunk)
+		written += n
+		p.sent += int64(n)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (p *packProgress) printf(format string, args ...any) {
+	if p.progress == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(p.progress, format, args...)
+}
+
+// start reports progress every interval until the returned func is called.
+func (p *packProgress) start(interval time.Duration) func() {
+	if p.progress == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			p.mu.Lock()
+			sent := p.sent
+			p.mu.Unlock()
+			if sent == 0 {
+				p.printf("Compressing objects...\r")
+			} else {
+				p.printf("Sending objects: %s\r", formatBytes(sent))
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// formatBytes formats n like git's progress output, such as 1.50 MiB.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+// resolveWantRef resolves the ref named by a want-ref argument,
+// returning a ref with its name and the object it points to.
+// Hidden refs are reported as unknown, like missing ones.
+func resolveWantRef(sto storer.ReferenceStorer, hidden []string, name string) (*plumbing.Reference, error) {
+	refName := plumbing.ReferenceName(name)
+	if matchRef(hidden, name) {
+		return nil, requestErrorf("want-ref %s: unknown ref", name)
+	}
+	ref, err := storer.ResolveReference(sto, refName)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil, requestErrorf("want-ref %s: unknown ref", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("want-ref %s: %w", name, err)
+	}
+	return plumbing.NewHashReference(refName, ref.Hash()), nil
+}
+
+// resolveDeepenNot resolves the ref a deepen-not excludes,
+// expanded like git does for a short name such as v1.0 or main.
+func resolveDeepenNot(sto storer.ReferenceStorer, hidden []string, name string) (plumbing.Hash, error) {
+	for _, full := range []string{name, "refs/" + name, "refs/tags/" + name, "refs/heads/" + name} {
+		if !strings.HasPrefix(full, "refs/") || matchRef(hidden, full) {
+			continue
+		}
+		ref, err := storer.ResolveReference(sto, plumbing.ReferenceName(full))
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			continue
+		} else if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("deepen-not %s: %w", name, err)
+		}
+		return ref.Hash(), nil
+	}
+	return plumbing.ZeroHash, requestErrorf("deepen-not %s: not a ref", name)
+}
+
+// ctxWriter fails writes once ctx is done,
+// aborting long running pack encodes.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c ctxWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+func parseHash(s string) (plumbing.Hash, error) {
+	if len(s) != 40 {
+		return plumbing.ZeroHash, requestErrorf("invalid object id %q", s)
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return plumbing.ZeroHash, requestErrorf("invalid object id %q", s)
+	}
+	return plumbing.NewHash(s), nil
+}
@@ -0,0 +1,80 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+)
+
+// lsRefsV2 sends a protocol v2 ls-refs command with args to the repository at url
+// and returns the ref names listed.
+func lsRefsV2(t *testing.T, url string, args ...string) []string {
+	t.Helper()
+	var b bytes.Buffer
+	e := pktline.NewEncoder(&b)
+	e.Encodef("command=ls-refs\n")
+	b.WriteString("0001")
+	for _, arg := range args {
+		e.Encodef("%s\n", arg)
+	}
+	e.Flush()
+	code, body := postUploadPack(t, url, "version=2", &b)
+	if code != http.StatusOK {
+		t.Fatalf("ls-refs: status %d: %s", code, body)
+	}
+	var names []string
+	r := strings.NewReader(body)
+	for {
+		line, typ, err := readPkt(r)
+		if err != nil {
+			t.Fatalf("read ls-refs response: %v", err)
+		}
+		if typ == pktFlush {
+			break
+		}
+		fields := strings.Fields(string(line))
+		if len(fields) < 2 {
+			t.Fatalf("ls-refs line %q", line)
+		}
+		names = append(names, fields[1])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLsRefsPrefix(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	bare := filepath.Join(dir, "repo.git")
+	for _, tag := range []string{"v1.0", "v2.0", "other"} {
+		runGit(t, bare, "tag", tag)
+	}
+	runGit(t, bare, "branch", "v-branch")
+	srv := newTestServer(t, dir)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"ref-prefix refs/tags/v"}, "refs/tags/v1.0 refs/tags/v2.0"},
+		{[]string{"ref-prefix refs/tags/v", "ref-prefix refs/heads/main"}, "refs/heads/main refs/tags/v1.0 refs/tags/v2.0"},
+		{[]string{"ref-prefix refs/tags/none"}, ""},
+		{[]string{"ref-prefix refs/heads/"}, "refs/heads/main refs/heads/v-branch"},
+		{nil, "HEAD refs/heads/main refs/heads/v-branch refs/tags/other refs/tags/v1.0 refs/tags/v2.0"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(lsRefsV2(t, srv.URL+"/repo.git", tt.args...), " "); got != tt.want {
+			t.Errorf("ls-refs %q: %s, want %s", tt.args, got, tt.want)
+		}
+	}
+
+	// git sends ref-prefix for the refspecs of a fetch
+	out := runGit(t, t.TempDir(), "-c", "protocol.version=2", "ls-remote", "--tags", srv.URL+"/repo.git", "refs/tags/v*")
+	if strings.Contains(out, "other") || strings.Count(out, "refs/tags/v") != 2 {
+		t.Errorf("ls-remote refs/tags/v*:\n%s", out)
+	}
+}
@@ -0,0 +1,367 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"golang.org/x/crypto/ssh"
+)
+
+// pushCertNonceSlop is how long the nonce advertised for a signed push stays valid,
+// pushes over http fetch it in an earlier request.
+const pushCertNonceSlop = 5 * time.Minute
+
+// errUntrustedKey is returned for push certificates signed by keys not in PushCertKeys.
+var errUntrustedKey = errors.New("signed by an untrusted key")
+
+// PushCertKeys are the OpenPGP and ssh keys trusted to sign push certificates.
+type PushCertKeys struct {
+	names []string
+	mu    sync.RWMutex
+	pgp   openpgp.EntityList
+	ssh   authorizedKeys
+}
+
+// LoadPushCertKeys reads the keys trusted to sign push certificates
+// from files of armored OpenPGP public keys, as written by gpg --export --armor,
+// or of ssh public keys in the authorized_keys format.
+// Signers are identified by their key's primary user id or ssh key comment.
+func LoadPushCertKeys(names ...string) (*PushCertKeys, error) {
+	keys := &PushCertKeys{names: names}
+	if err := keys.Reload(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Reload reads the key files again for the pushes that follow.
+// If any can't be read the keys loaded before are kept.
+func (k *PushCertKeys) Reload() error {
+	var pgp openpgp.EntityList
+	sshKeys := make(authorizedKeys)
+	for _, name := range k.names {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("read push certificate keys: %w", err)
+		}
+		if !bytes.Contains(b, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+			keys, err := readAuthorizedKeys(name)
+			if err != nil {
+				return err
+			}
+			for key, identity := range keys {
+				sshKeys[key] = identity
+			}
+			continue
+		}
+		el, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("parse push certificate keys %s: %w", name, err)
+		}
+		pgp = append(pgp, el...)
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.pgp, k.ssh = pgp, sshKeys
+	return nil
+}
+
+// verify checks sig is a valid signature of payload by a trusted key,
+// returning the signer's identity and the key's fingerprint.
+func (k *PushCertKeys) verify(payload, sig []byte) (signer, key string, err error) {
+	k.mu.RLock()
+	pgp, sshKeys := k.pgp, k.ssh
+	k.mu.RUnlock()
+	switch {
+	case bytes.HasPrefix(sig, []byte("-----BEGIN PGP SIGNATURE-----")):
+		e, err := openpgp.CheckArmoredDetachedSignature(pgp, bytes.NewReader(payload), bytes.NewReader(sig), nil)
+		if err != nil {
+			return "", "", err
+		}
+		key = fmt.Sprintf("%X", e.PrimaryKey.Fingerprint)
+		if id := e.PrimaryIdentity(); id != nil {
+			return id.Name, key, nil
+		}
+		return key, key, nil
+	case bytes.HasPrefix(sig, []byte("-----BEGIN SSH SIGNATURE-----")):
+		pub, err := verifySSHSignature(payload, sig, "git")
+		if err != nil {
+			return "", "", err
+		}
+		key = ssh.FingerprintSHA256(pub)
+		signer, ok := sshKeys[string(pub.Marshal())]
+		if !ok {
+			return "", key, errUntrustedKey
+		}
+		return signer, key, nil
+	}
+	return "", "", errors.New("unsupported signature format")
+}
+
+// verifySSHSignature checks an armored ssh signature of msg,
+// as made by ssh-keygen -Y sign, returning the key that made it.
+// The key still has to be checked against the trusted keys.
+func verifySSHSignature(msg, armored []byte, namespace string) (ssh.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" || !bytes.HasPrefix(block.Bytes, []byte("SSHSIG")) {
+		return nil, errors.New("malformed ssh signature")
+	}
+	var blob struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := ssh.Unmarshal(block.Bytes[len("SSHSIG"):], &blob); err != nil {
+		return nil, fmt.Errorf("malformed ssh signature: %w", err)
+	}
+	if blob.Version != 1 {
+		return nil, fmt.Errorf("unsupported ssh signature version %d", blob.Version)
+	}
+	if blob.Namespace != namespace {
+		return nil, fmt.Errorf("ssh signature for namespace %q, not %q", blob.Namespace, namespace)
+	}
+	var hf hash.Hash
+	switch blob.HashAlgorithm {
+	case "sha256":
+		hf = sha256.New()
+	case "sha512":
+		hf = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported ssh signature hash %q", blob.HashAlgorithm)
+	}
+	hf.Write(msg)
+	pub, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse ssh signature key: %w", err)
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(blob.Signature, &sig); err != nil {
+		return nil, fmt.Errorf("malformed ssh signature: %w", err)
+	}
+	// what's signed, per OpenSSH's PROTOCOL.sshsig
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{blob.Namespace, blob.Reserved, blob.HashAlgorithm, hf.Sum(nil)})...)
+	if err := pub.Verify(signed, &sig); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// pushCert is the push certificate git push --signed sends
+// in place of the command list.
+type pushCert struct {
+	// payload is the signed text, sig its armored detached signature.
+	payload []byte
+	sig     []byte
+	nonce   string
+}
+
+// decodeUpdateRequest decodes a push, which go-git can't do for signed pushes:
+// the commands in a push certificate are decoded as if they were sent unsigned.
+// cert is nil for unsigned pushes.
+func decodeUpdateRequest(r io.Reader) (*packp.ReferenceUpdateRequest, *pushCert, error) {
+	var head bytes.Buffer
+	e := pktline.NewEncoder(&head)
+	s := pktline.NewScanner(r)
+	var cert *pushCert
+	for s.Scan() {
+		line := s.Bytes()
+		if bytes.HasPrefix(line, []byte("shallow ")) {
+			e.Encode(line)
+			continue
+		}
+		if bytes.HasPrefix(line, []byte("push-cert\x00")) {
+			// the scanner reuses line for the certificate
+			caps := string(bytes.TrimSuffix(line[len("push-cert\x00"):], []byte("\n")))
+			var cmds [][]byte
+			var err error
+			cert, cmds, err = decodePushCert(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %v", errMalformedRequest, err)
+			}
+			for i, cmd := range cmds {
+				if i == 0 {
+					cmd = []byte(strings.TrimSuffix(string(cmd), "\n") + "\x00" + caps)
+				}
+				e.Encode(cmd)
+			}
+		} else if len(line) == 0 {
+			e.Flush()
+		} else {
+			e.Encode(line)
+		}
+		break
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errMalformedRequest, err)
+	}
+	upr := packp.NewReferenceUpdateRequest()
+	if err := upr.Decode(io.MultiReader(&head, r)); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errMalformedRequest, err)
+	}
+	return upr, cert, nil
+}
+
+// decodePushCert reads a push certificate up to its push-cert-end line,
+// returning it and the command lines it signs.
+func decodePushCert(s *pktline.Scanner) (*pushCert, [][]byte, error) {
+	var text []byte
+	for s.Scan() {
+		line := bytes.TrimSuffix(s.Bytes(), []byte("\n"))
+		if string(line) == "push-cert-end" {
+			return parsePushCert(text)
+		}
+		if len(s.Bytes()) == 0 {
+			break
+		}
+		text = append(append(text, line...), '\n')
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, err
+	}
+	return nil, nil, errors.New("unterminated push certificate")
+}
+
+func parsePushCert(text []byte) (*pushCert, [][]byte, error) {
+	cert := &pushCert{payload: text}
+	if i := bytes.Index(text, []byte("\n-----BEGIN ")); i >= 0 {
+		cert.payload, cert.sig = text[:i+1], text[i+1:]
+	}
+	header, body, ok := bytes.Cut(cert.payload, []byte("\n\n"))
+	if !ok {
+		return nil, nil, errors.New("push certificate without commands")
+	}
+	for i, line := range strings.Split(string(header), "\n") {
+		if i == 0 && line != "certificate version 0.1" {
+			return nil, nil, fmt.Errorf("unsupported push certificate %q", line)
+		}
+		if strings.HasPrefix(line, "nonce ") {
+			cert.nonce = strings.TrimPrefix(line, "nonce ")
+		}
+	}
+	var cmds [][]byte
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if len(line) > 0 {
+			cmds = append(cmds, line)
+		}
+	}
+	if len(cmds) == 0 {
+		return nil, nil, errors.New("push certificate without commands")
+	}
+	return cert, cmds, nil
+}
+
+// pushCertResult is the outcome of checking a push's certificate.
+type pushCertResult struct {
+	// status is G for a good signature by a trusted key,
+	// B for a bad or untrusted one and N for an unsigned push,
+	// as in git's GIT_PUSH_CERT_STATUS.
+	status string
+	signer string
+	key    string
+	// nonceStatus is OK, BAD or MISSING,
+	// empty for unsigned pushes.
+	nonceStatus string
+	// err is why status isn't G.
+	err error
+}
+
+// env returns the GIT_PUSH_CERT_ variables hooks get, like from git receive-pack.
+func (r pushCertResult) env() []string {
+	if r.status == "N" {
+		return nil
+	}
+	return []string{
+		"GIT_PUSH_CERT_STATUS=" + r.status,
+		"GIT_PUSH_CERT_SIGNER=" + r.signer,
+		"GIT_PUSH_CERT_KEY=" + r.key,
+		"GIT_PUSH_CERT_NONCE_STATUS=" + r.nonceStatus,
+	}
+}
+
+// rejection returns why RequireSignedPush rejects the push, empty if it doesn't.
+func (r pushCertResult) rejection() string {
+	switch {
+	case r.status == "N":
+		return "push certificate required, use git push --signed"
+	case r.status != "G":
+		return "invalid push certificate signature"
+	case r.nonceStatus != "OK":
+		return "push certificate nonce is invalid or expired"
+	}
+	return ""
+}
+
+// checkPushCert verifies the signature and nonce of cert, nil for unsigned pushes.
+func (h *httpHandler) checkPushCert(repo string, cert *pushCert) pushCertResult {
+	if cert == nil {
+		return pushCertResult{status: "N", err: errors.New("unsigned push")}
+	}
+	res := pushCertResult{status: "G", nonceStatus: h.checkPushCertNonce(repo, cert.nonce, time.Now())}
+	if h.cfg.PushCertKeys == nil {
+		res.status, res.err = "B", errUntrustedKey
+		return res
+	}
+	res.signer, res.key, res.err = h.cfg.PushCertKeys.verify(cert.payload, cert.sig)
+	if res.err != nil {
+		res.status = "B"
+	}
+	return res
+}
+
+// pushCertNonce returns the nonce advertised for signed pushes to repo at t,
+// a timestamp and a MAC of it so the server can check it without keeping state.
+func (h *httpHandler) pushCertNonce(repo string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, h.nonceSeed)
+	io.WriteString(mac, repo+"\x00"+ts)
+	return fmt.Sprintf("%s-%x", ts, mac.Sum(nil))
+}
+
+// checkPushCertNonce returns git's nonce status for a certificate signing nonce:
+// OK if this server advertised it for repo within pushCertNonceSlop.
+func (h *httpHandler) checkPushCertNonce(repo, nonce string, now time.Time) string {
+	if nonce == "" {
+		return "MISSING"
+	}
+	ts, _, _ := strings.Cut(nonce, "-")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "BAD"
+	}
+	t := time.Unix(sec, 0)
+	if !hmac.Equal([]byte(nonce), []byte(h.pushCertNonce(repo, t))) || now.Sub(t) > pushCertNonceSlop || t.After(now) {
+		return "BAD"
+	}
+	return "OK"
+}
+
+// newNonceSeed returns the random key nonces are signed with.
+func newNonceSeed() []byte {
+	seed := make([]byte, 32)
+	rand.Read(seed)
+	return seed
+}
@@ -0,0 +1,224 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+)
+
+func TestPushCertNonce(t *testing.T) {
+	h := newTestHandler(t, t.TempDir())
+	now := time.Now()
+	tests := []struct {
+		name  string
+		nonce string
+		want  string
+	}{
+		{"fresh", h.pushCertNonce("repo.git", now), "OK"},
+		{"within slop", h.pushCertNonce("repo.git", now.Add(-pushCertNonceSlop+time.Minute)), "OK"},
+		{"stale", h.pushCertNonce("repo.git", now.Add(-pushCertNonceSlop-time.Minute)), "BAD"},
+		{"future", h.pushCertNonce("repo.git", now.Add(time.Hour)), "BAD"},
+		{"other repo", h.pushCertNonce("other.git", now), "BAD"},
+		{"forged", strings.Split(h.pushCertNonce("repo.git", now), "-")[0] + "-00", "BAD"},
+		{"garbage", "not-a-nonce", "BAD"},
+		{"missing", "", "MISSING"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.checkPushCertNonce("repo.git", tt.nonce, now); got != tt.want {
+				t.Errorf("nonce status %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPushCertNonceNotCached checks a receive-pack advertisement isn't served
+// from the cache with an old nonce while the refs stay the same.
+func TestPushCertNonceNotCached(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	keys := writeSSHSigningKey(t, t.TempDir())
+	h := newTestHandler(t, dir, WithReceivePack(true), WithSignedPushes(keys.trusted, true))
+	srv := httptest.NewServer(newHandler(h))
+	defer srv.Close()
+
+	// what the cache would hold had the refs not changed for longer than the slop
+	fingerprint, _, err := refsFingerprint(h.fs, "repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := h.pushCertNonce("repo.git", time.Now().Add(-time.Hour))
+	h.cache.put("repo.git", "git-receive-pack", fingerprint, []byte(stale))
+
+	for i := 0; i < 2; i++ {
+		nonce := receivePackNonce(t, srv.URL+"/repo.git")
+		if status := h.checkPushCertNonce("repo.git", nonce, time.Now()); status != "OK" {
+			t.Fatalf("request %d: advertised nonce %q has status %s", i, nonce, status)
+		}
+	}
+}
+
+// receivePackNonce returns the push-cert nonce advertised at url.
+func receivePackNonce(t *testing.T, url string) string {
+	t.Helper()
+	res, err := http.Get(url + "/info/refs?service=git-receive-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", res.StatusCode)
+	}
+	if etag := res.Header.Get("ETag"); etag != "" {
+		t.Errorf("signed push advertisement has ETag %s", etag)
+	}
+	ar := packp.NewAdvRefs()
+	if err := ar.Decode(skipServiceLine(t, res.Body)); err != nil {
+		t.Fatal(err)
+	}
+	nonces := ar.Capabilities.Get(capability.PushCert)
+	if len(nonces) != 1 {
+		t.Fatalf("push-cert capability %q", nonces)
+	}
+	return nonces[0]
+}
+
+// skipServiceLine reads past the "# service=" line of an http advertisement
+// and the flush after it.
+func skipServiceLine(t *testing.T, r io.Reader) io.Reader {
+	t.Helper()
+	for _, want := range []pktType{pktData, pktFlush} {
+		if _, typ, err := readPkt(r); err != nil || typ != want {
+			t.Fatalf("read service line: type %d, err %v", typ, err)
+		}
+	}
+	return r
+}
+
+// sshSigningKey is an ssh key git can sign push certificates with.
+type sshSigningKey struct {
+	// private is the private key file, public the authorized_keys line.
+	private string
+	public  string
+	trusted *PushCertKeys
+}
+
+// writeSSHSigningKey creates an ed25519 key for alice in dir,
+// skipping the test if ssh-keygen isn't installed.
+func writeSSHSigningKey(t *testing.T, dir string) sshSigningKey {
+	t.Helper()
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	private := filepath.Join(dir, "key")
+	out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "alice", "-f", private).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen: %v: %s", err, out)
+	}
+	public, err := os.ReadFile(private + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := LoadPushCertKeys(private + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sshSigningKey{private, string(public), trusted}
+}
+
+// signedPushConfig are the git -c options signing pushes with key.
+func signedPushConfig(key sshSigningKey) []string {
+	return []string{"-c", "gpg.format=ssh", "-c", "user.signingKey=" + key.private}
+}
+
+func TestSignedPush(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	key := writeSSHSigningKey(t, t.TempDir())
+	srv := newTestServer(t, dir, WithReceivePack(true), WithSignedPushes(key.trusted, true))
+
+	work := t.TempDir()
+	runGit(t, work, "clone", "-q", srv.URL+"/repo.git", "out")
+	work = filepath.Join(work, "out")
+	writeTestFile(t, filepath.Join(work, "signed.txt"), "signed\n")
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "-q", "-m", "signed")
+
+	if _, err := tryGit(t, work, "push", "origin", "HEAD:refs/heads/unsigned"); err == nil {
+		t.Error("unsigned push accepted with RequireSignedPush")
+	}
+	runGit(t, work, append(signedPushConfig(key), "push", "-q", "--signed", "origin", "HEAD:refs/heads/signed")...)
+	want := runGit(t, work, "rev-parse", "HEAD")
+	if got := runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "refs/heads/signed"); got != want {
+		t.Errorf("signed push updated the ref to %s, want %s", got, want)
+	}
+}
+
+func TestSignedPushUntrustedKey(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	trusted := writeSSHSigningKey(t, t.TempDir())
+	other := writeSSHSigningKey(t, t.TempDir())
+	srv := newTestServer(t, dir, WithReceivePack(true), WithSignedPushes(trusted.trusted, true))
+
+	work := t.TempDir()
+	runGit(t, work, "clone", "-q", srv.URL+"/repo.git", "out")
+	work = filepath.Join(work, "out")
+	if _, err := tryGit(t, work, append(signedPushConfig(other), "push", "--signed", "origin", "HEAD:refs/heads/other")...); err == nil {
+		t.Error("push signed by an untrusted key accepted")
+	}
+}
+
+func TestCheckPushCertTampered(t *testing.T) {
+	key := writeSSHSigningKey(t, t.TempDir())
+	h := newTestHandler(t, t.TempDir(), WithSignedPushes(key.trusted, true))
+	payload := "certificate version 0.1\n" +
+		"pusher alice 1700000000 +0000\n" +
+		"pushee http://localhost/repo.git\n" +
+		"nonce " + h.pushCertNonce("repo.git", time.Now()) + "\n" +
+		"\n" +
+		"0000000000000000000000000000000000000000 1111111111111111111111111111111111111111 refs/heads/main\n"
+	sig := sshSign(t, key, payload)
+
+	cert, _, err := parsePushCert([]byte(payload + sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := h.checkPushCert("repo.git", cert); res.status != "G" || res.nonceStatus != "OK" || res.signer != "alice" {
+		t.Fatalf("valid certificate: status %s, nonce %s, signer %q, err %v", res.status, res.nonceStatus, res.signer, res.err)
+	}
+
+	tampered := strings.Replace(payload, "refs/heads/main", "refs/heads/prod", 1)
+	cert, _, err = parsePushCert([]byte(tampered + sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := h.checkPushCert("repo.git", cert)
+	if res.status != "B" {
+		t.Errorf("tampered certificate: status %s, want B", res.status)
+	}
+	if res.rejection() == "" {
+		t.Error("tampered certificate not rejected")
+	}
+}
+
+// sshSign signs msg with key for git's namespace, as git push --signed does.
+func sshSign(t *testing.T, key sshSigningKey, msg string) string {
+	t.Helper()
+	cmd := exec.Command("ssh-keygen", "-Y", "sign", "-n", "git", "-f", key.private)
+	cmd.Stdin = strings.NewReader(msg)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("ssh-keygen -Y sign: %v: %s", err, stderr.String())
+	}
+	return string(out)
+}
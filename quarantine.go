@@ -0,0 +1,134 @@
+package gitreposerver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// quarantine holds the objects of a push outside the repository's
+// object store until the push is accepted, like git's incoming dirs,
+// so a rejected push leaves nothing behind.
+type quarantine struct {
+	// dir is the quarantine's git dir, its objects are in dir/objects.
+	dir     string
+	gitDir  string
+	sto     *filesystem.Storage
+	objects storer.EncodedObjectStorer
+}
+
+// newQuarantine stores pack in a new quarantine inside gitDir.
+// live is the repository's object store,
+// which the quarantined objects may refer to.
+func newQuarantine(gitDir string, live storer.EncodedObjectStorer, pack io.Reader) (*quarantine, error) {
+	dir, err := os.MkdirTemp(filepath.Join(gitDir, "objects"), "incoming-")
+	if err != nil {
+		return nil, fmt.Errorf("create quarantine: %w", err)
+	}
+	sto := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	q := &quarantine{
+		dir:     dir,
+		gitDir:  gitDir,
+		sto:     sto,
+		objects: overlayObjects{sto, live},
+	}
+	if err := packfile.UpdateObjectStorage(sto, pack); err != nil {
+		q.remove()
+		return nil, err
+	}
+	return q, nil
+}
+
+// env points git commands run by hooks at the quarantined objects.
+func (q *quarantine) env() []string {
+	objects := filepath.Join(q.dir, "objects")
+	return []string{
+		"GIT_QUARANTINE_PATH=" + objects,
+		"GIT_OBJECT_DIRECTORY=" + objects,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + filepath.Join(q.gitDir, "objects"),
+	}
+}
+
+// migrate moves the quarantined packs into the repository.
+// Packs are moved before their indexes so readers never see
+// an index without its pack.
+func (q *quarantine) migrate() error {
+	src := filepath.Join(q.dir, "objects", "pack")
+	dst := filepath.Join(q.gitDir, "objects", "pack")
+	entries, err := os.ReadDir(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("list quarantined packs: %w", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "pack-") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return strings.HasSuffix(names[i], ".pack") && !strings.HasSuffix(names[j], ".pack")
+	})
+	if err := os.MkdirAll(dst, 0o755); err != nil {
+		return fmt.Errorf("create pack dir: %w", err)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dst, name)); err == nil {
+			// the repository already has this pack
+			continue
+		}
+		if err := os.Rename(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return fmt.Errorf("migrate %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// remove deletes the quarantine and anything left in it.
+func (q *quarantine) remove() error {
+	return os.RemoveAll(q.dir)
+}
+
+// overlayObjects reads objects from a quarantine,
+// falling back to the repository it's for.
+// Writes and iteration only use the quarantine.
+type overlayObjects struct {
+	storer.EncodedObjectStorer
+	live storer.EncodedObjectStorer
+}
+
+func (o overlayObjects) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := o.EncodedObjectStorer.EncodedObject(t, h)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return o.live.EncodedObject(t, h)
+	}
+	return obj, err
+}
+
+func (o overlayObjects) HasEncodedObject(h plumbing.Hash) error {
+	err := o.EncodedObjectStorer.HasEncodedObject(h)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return o.live.HasEncodedObject(h)
+	}
+	return err
+}
+
+func (o overlayObjects) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	size, err := o.EncodedObjectStorer.EncodedObjectSize(h)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return o.live.EncodedObjectSize(h)
+	}
+	return size, err
+}
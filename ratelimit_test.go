@@ -0,0 +1,180 @@
+package gitreposerver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d within the burst refused", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok {
+		t.Fatal("request over the burst allowed")
+	}
+	if wait <= 0 || wait > time.Second/2 {
+		t.Errorf("wait %v, want up to 500ms at 2 per second", wait)
+	}
+	if ok, _ := l.allow("b", now); !ok {
+		t.Error("other client limited")
+	}
+	if ok, _ := l.allow("a", now.Add(wait)); !ok {
+		t.Error("request after the wait refused")
+	}
+	if ok, _ := l.allow("a", now.Add(wait)); ok {
+		t.Error("second request after one token refilled allowed")
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	now := time.Now()
+	l.allow("idle", now)
+	now = now.Add(time.Minute)
+	for i := 0; len(l.buckets) < maxBuckets; i++ {
+		l.allow(strconv.Itoa(i), now)
+	}
+	l.allow("new", now)
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("refilled bucket kept past maxBuckets")
+	}
+	if len(l.buckets) > maxBuckets {
+		t.Errorf("%d buckets, want at most %d", len(l.buckets), maxBuckets)
+	}
+}
+
+func mustParseCIDRs(t *testing.T, s string) []*net.IPNet {
+	t.Helper()
+	nets, err := ParseCIDRs(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nets
+}
+
+// rateLimitedStatus sends n requests from remote with X-Forwarded-For xff
+// and returns the status of the last one and its Retry-After.
+func rateLimitedStatus(t *testing.T, h http.Handler, n int, remote, xff string) (int, string) {
+	t.Helper()
+	var rec *httptest.ResponseRecorder
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/repos", nil)
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set("X-Forwarded-For", xff)
+		}
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+	}
+	return rec.Code, rec.Header().Get("Retry-After")
+}
+
+func TestRateLimit(t *testing.T) {
+	h := NewHandler(newTestRepo(t, 1),
+		WithLogger(testLogger{t}),
+		WithRateLimit(1, 2),
+		WithRateLimitExempt(mustParseCIDRs(t, "10.1.0.0/16")),
+		WithTrustedProxies(mustParseCIDRs(t, "10.0.0.1")),
+	)
+
+	code, retry := rateLimitedStatus(t, h, 3, "192.0.2.1:1234", "")
+	if code != http.StatusTooManyRequests || retry != "1" {
+		t.Errorf("over the burst: status %d, Retry-After %q, want 429 and 1", code, retry)
+	}
+	if code, _ := rateLimitedStatus(t, h, 1, "192.0.2.2:1234", ""); code != http.StatusOK {
+		t.Errorf("other client: status %d", code)
+	}
+	if code, _ := rateLimitedStatus(t, h, 5, "10.1.2.3:1234", ""); code != http.StatusOK {
+		t.Errorf("exempt client: status %d", code)
+	}
+
+	// clients behind the trusted proxy get a bucket each
+	if code, _ := rateLimitedStatus(t, h, 2, "10.0.0.1:1234", "192.0.2.3"); code != http.StatusOK {
+		t.Errorf("proxied client: status %d", code)
+	}
+	if code, _ := rateLimitedStatus(t, h, 2, "10.0.0.1:1234", "192.0.2.4"); code != http.StatusOK {
+		t.Errorf("second proxied client: status %d", code)
+	}
+	if code, _ := rateLimitedStatus(t, h, 5, "10.0.0.1:1234", "10.1.0.9"); code != http.StatusOK {
+		t.Errorf("exempt proxied client: status %d", code)
+	}
+
+	// an untrusted client can't escape its bucket or claim to be exempt
+	for _, xff := range []string{"192.0.2.6", "10.1.0.9"} {
+		if code, _ := rateLimitedStatus(t, h, 3, "192.0.2.5:1234", xff); code != http.StatusTooManyRequests {
+			t.Errorf("spoofed X-Forwarded-For %s: status %d, want 429", xff, code)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.0/8, 2001:db8::1")
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer", "192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"198.51.100.1, 10.0.0.2, 10.0.0.3"}, "198.51.100.1"},
+		{"spoofed hops before the client", "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"repeated headers", "10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:1234", []string{"198.51.100.1, nonsense, 10.0.0.2"}, "10.0.0.2"},
+		{"ipv6 proxy", "[2001:db8::1]:1234", []string{"2001:db8::2"}, "2001:db8::2"},
+		{"ipv6 client", "[2001:db8::3]:1234", []string{"198.51.100.1"}, "2001:db8::3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(req, trusted); got.String() != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientScheme(t *testing.T) {
+	trusted := mustParseCIDRs(t, "10.0.0.1")
+	tests := []struct {
+		name   string
+		remote string
+		proto  string
+		want   string
+	}{
+		{"direct", "192.0.2.1:1234", "", "http"},
+		{"untrusted peer", "192.0.2.1:1234", "https", "http"},
+		{"trusted proxy", "10.0.0.1:1234", "https", "https"},
+		{"chain nearest the client first", "10.0.0.1:1234", "https, http", "https"},
+		{"upper case", "10.0.0.1:1234", "HTTPS", "https"},
+		{"unknown scheme", "10.0.0.1:1234", "gopher", "http"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if got := clientScheme(req, trusted); got != tt.want {
+				t.Errorf("clientScheme = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package gitreposerver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// errFileNotFound is returned for paths that aren't a file at a revision.
+var errFileNotFound = errors.New("file not found")
+
+// raw serves /{repo}/raw/{rev}/{path}, the contents of a single file.
+// The Content-Type is guessed from the file's extension or contents.
+// Files are served sandboxed, so html in a repository can't run scripts
+// as the server's origin.
+func (h *httpHandler) raw(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repo := RepoFromContext(r.Context())
+	arg := routeArgFromContext(r.Context())
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	blob, name, err := h.rawBlob(sto, h.hiddenRefs(r.Context(), repo), arg)
+	if err != nil {
+		h.httpError(rw, r, err)
+		return
+	}
+
+	etag := `"` + blob.Hash.String() + `"`
+	rw.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	br, err := blob.Reader()
+	if err != nil {
+		h.logger(r.Context()).Error("read blob", "repo", repo, "blob", blob.Hash, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	defer br.Close()
+	buf := bufio.NewReader(br)
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		head, _ := buf.Peek(512)
+		contentType = http.DetectContentType(head)
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+	rw.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := buf.WriteTo(rw); err != nil {
+		h.logger(r.Context()).Warn("write blob", "repo", repo, "blob", blob.Hash, "err", err)
+		requestInfoFromContext(r.Context()).err = err
+	}
+}
+
+// rawBlob finds the blob named by arg, "{rev}/{path}".
+// Revisions can contain slashes, so each split is tried,
+// shortest revision first.
+func (h *httpHandler) rawBlob(sto storer.Storer, hidden []string, arg string) (*object.Blob, string, error) {
+	for i := strings.IndexByte(arg, '/'); i >= 0; {
+		rev, name := arg[:i], arg[i+1:]
+		hash, err := resolveRevision(sto, hidden, rev)
+		if err == nil {
+			blob, err := treeBlob(sto, hash, name)
+			return blob, name, err
+		} else if !errors.Is(err, errRefNotFound) {
+			return nil, "", err
+		}
+		j := strings.IndexByte(arg[i+1:], '/')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return nil, "", errRefNotFound
+}
+
+// treeBlob returns the file at name in the tree of h.
+// A symlink's blob holds its target.
+func treeBlob(sto storer.EncodedObjectStorer, h plumbing.Hash, name string) (*object.Blob, error) {
+	tree, _, err := archiveTree(sto, h)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, errFileNotFound
+	}
+	if err := checkTreePath(name); err != nil {
+		return nil, err
+	}
+	e, err := tree.FindEntry(name)
+	if errors.Is(err, object.ErrEntryNotFound) || errors.Is(err, object.ErrDirectoryNotFound) {
+		return nil, errFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	switch e.Mode {
+	case filemode.Dir:
+		return nil, fmt.Errorf("%w: %s is a directory", errFileNotFound, name)
+	case filemode.Submodule:
+		return nil, fmt.Errorf("%w: %s is a submodule", errFileNotFound, name)
+	}
+	blob, err := object.GetBlob(sto, e.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// checkTreePath rejects a path within a tree that's absolute,
+// has an empty, . or .. element, goes into a .git directory
+// or holds a NUL byte. Git doesn't let any of these into a tree,
+// so they could only be trying to reach something else.
+func checkTreePath(name string) error {
+	if strings.HasPrefix(name, "/") {
+		return requestErrorf("invalid path %q: must be relative", name)
+	}
+	if strings.IndexByte(name, 0) >= 0 {
+		return requestErrorf("invalid path %q: contains a NUL byte", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		switch {
+		case elem == "", elem == ".", elem == "..":
+			return requestErrorf("invalid path %q: element %q", name, elem)
+		case strings.EqualFold(elem, ".git"):
+			return requestErrorf("invalid path %q: inside .git", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package gitreposerver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+func TestCheckTreePath(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"file.txt", true},
+		{"dir/file.txt", true},
+		{".gitignore", true},
+		{"..", false},
+		{"../file.txt", false},
+		{"dir/../../file.txt", false},
+		{"/etc/passwd", false},
+		{"dir//file.txt", false},
+		{"./file.txt", false},
+		{".git/config", false},
+		{"dir/.GIT/config", false},
+		{"file\x00.txt", false},
+	}
+	for _, tt := range tests {
+		if err := checkTreePath(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkTreePath(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// TestRawTraversal routes paths the ServeMux would clean first,
+// as a handler mounted without one sees them.
+func TestRawTraversal(t *testing.T) {
+	h := newTestHandler(t, newTestRepo(t, 1))
+	newHandler(h)
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/repo.git/raw/main/file.txt", http.StatusOK},
+		{"/repo.git/raw/main/../file.txt", http.StatusBadRequest},
+		{"/repo.git/raw/main/file1.txt/../file.txt", http.StatusBadRequest},
+		{"/repo.git/raw/main//etc/passwd", http.StatusBadRequest},
+		{"/repo.git/raw/main/.git/config", http.StatusBadRequest},
+		{"/repo.git/raw/main/file\x00.txt", http.StatusBadRequest},
+		// an archive names a revision, not a path
+		{"/repo.git/archive/../main.tar", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = tt.path
+		rec := httptest.NewRecorder()
+		h.route(rec, req)
+		if rec.Code != tt.code {
+			t.Errorf("GET %q: status %d, want %d", tt.path, rec.Code, tt.code)
+		}
+	}
+}
+
+// TestArchiveTraversal serves a tree git wouldn't make,
+// with entries named .. and .git, the archives leave them out.
+func TestArchiveTraversal(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	sto := filesystem.NewStorage(osfs.New(filepath.Join(dir, "repo.git")), cache.NewObjectLRUDefault())
+	blob := sto.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	w, _ := blob.Writer()
+	io.WriteString(w, "escaped\n")
+	w.Close()
+	blobHash, err := sto.SetEncodedObject(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := &object.Tree{Entries: []object.TreeEntry{
+		{Name: "..", Mode: filemode.Regular, Hash: blobHash},
+		{Name: ".git", Mode: filemode.Regular, Hash: blobHash},
+		{Name: "ok.txt", Mode: filemode.Regular, Hash: blobHash},
+	}}
+	treeObj := sto.NewEncodedObject()
+	if err := tree.Encode(treeObj); err != nil {
+		t.Fatal(err)
+	}
+	treeHash, err := sto.SetEncodedObject(treeObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := object.Signature{Name: "Test", Email: "test@example.com", When: time.Unix(1700000000, 0)}
+	commit := &object.Commit{Author: sig, Committer: sig, Message: "traversal\n", TreeHash: treeHash}
+	commitObj := sto.NewEncodedObject()
+	if err := commit.Encode(commitObj); err != nil {
+		t.Fatal(err)
+	}
+	commitHash, err := sto.SetEncodedObject(commitObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sto.SetReference(plumbing.NewHashReference("refs/heads/evil", commitHash)); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, dir)
+	srv := httptest.NewServer(newHandler(h))
+	defer srv.Close()
+
+	get := func(path string) []byte {
+		t.Helper()
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: status %d, %s", path, res.StatusCode, b)
+		}
+		return b
+	}
+	want := []string{"repo-evil/ok.txt"}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(get("/repo.git/archive/evil.tar")))
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag != tar.TypeXGlobalHeader && hdr.Typeflag != tar.TypeDir {
+			names = append(names, hdr.Name)
+		}
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("tar files %q, want %q", names, want)
+	}
+
+	b := get("/repo.git/archive/evil.zip")
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	for _, f := range zr.File {
+		if !f.FileInfo().IsDir() {
+			names = append(names, f.Name)
+		}
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("zip files %q, want %q", names, want)
+	}
+
+	for _, path := range []string{"/repo.git/raw/evil/..", "/repo.git/raw/evil/.git"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = path
+		rec := httptest.NewRecorder()
+		h.route(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", path, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package gitreposerver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// pushRequest is a decoded push and what it runs against.
+type pushRequest struct {
+	gitDir string
+	sto    storer.Storer
+	cmds   []*packp.Command
+	pack   io.Reader
+	// objects reads the pushed objects and the repository's,
+	// it's set by receive.
+	objects storer.EncodedObjectStorer
+	// fsck checks the pushed objects are well formed.
+	fsck bool
+	// atomic updates all refs or none of them.
+	atomic bool
+	// denyNonFastForwards and denyDeletes are ref prefixes
+	// that can't be force pushed or deleted.
+	denyNonFastForwards []string
+	denyDeletes         []string
+	// rules are the branch rules applied to the pushing identity.
+	rules    []BranchRule
+	identity string
+	// maxPackBytes limits the pack, quotaBytes the repository's objects
+	// after the push, 0 is unlimited.
+	maxPackBytes int64
+	quotaBytes   int64
+	// hooks runs the repository's hooks, writing their output to the client.
+	hooks *hookRunner
+	// progress receives messages for the client, as shown by git as "remote:".
+	progress io.Writer
+	// reject is why every command is rejected once the pack is read,
+	// such as a missing push certificate, empty to apply the push.
+	reject string
+}
+
+// packTooLargeError rejects a push with a pack over
+// the pack size limit or the repository's quota.
+type packTooLargeError struct {
+	// read is the bytes read before giving up,
+	// the pack is at least this large.
+	read  int64
+	limit int64
+	quota bool
+}
+
+func (e *packTooLargeError) Error() string {
+	if e.quota {
+		return fmt.Sprintf("push exceeds the repository quota, %d bytes left", e.limit)
+	}
+	return fmt.Sprintf("pack exceeds the %d byte limit", e.limit)
+}
+
+// receive applies a push: it quarantines and checks the pack,
+// runs the pre-receive hook, moves the pack into the repository,
+// updates the refs and runs the post-receive hook.
+// An atomic push is rejected as a whole if any command is,
+// and refs already updated are restored if a later update fails.
+// It returns the status to report to the client,
+// and an error if the push failed as a whole.
+func receive(ctx context.Context, req pushRequest) (*packp.ReportStatus, error) {
+	rs := packp.NewReportStatus()
+	rs.UnpackStatus = "ok"
+	status := make(map[plumbing.ReferenceName]string, len(req.cmds))
+	report := func() *packp.ReportStatus {
+		for _, cmd := range req.cmds {
+			msg, ok := status[cmd.Name]
+			if !ok {
+				msg = "ok"
+			}
+			rs.CommandStatuses = append(rs.CommandStatuses, &packp.CommandStatus{
+				ReferenceName: cmd.Name,
+				Status:        msg,
+			})
+		}
+		return rs
+	}
+
+	unpackFailed := func(err error) (*packp.ReportStatus, error) {
+		rs.UnpackStatus = err.Error()
+		for _, cmd := range req.cmds {
+			status[cmd.Name] = "unpacker error"
+		}
+		return report(), err
+	}
+
+	// clients only send a pack if something other than deletes needs one
+	req.objects = req.sto
+	var q *quarantine
+	for _, cmd := range req.cmds {
+		if cmd.Action() != packp.Delete {
+			pack, tooLarge, err := req.limitPack()
+			if err != nil {
+				return unpackFailed(err)
+			}
+			q, err = newQuarantine(req.gitDir, req.sto, pack)
+			if perr := tooLarge(); perr != nil {
+				fmt.Fprintf(req.progress, "error: %v\n", perr)
+				return unpackFailed(perr)
+			} else if err != nil {
+				return unpackFailed(fmt.Errorf("store pack: %w", err))
+			}
+			defer q.remove()
+			req.objects = q.objects
+			break
+		}
+	}
+	if q != nil && req.fsck {
+		if err := fsckObjects(q.sto); err != nil {
+			return unpackFailed(err)
+		}
+	}
+
+	if req.reject != "" {
+		fmt.Fprintf(req.progress, "error: %s\n", req.reject)
+		for _, cmd := range req.cmds {
+			status[cmd.Name] = req.reject
+		}
+		return report(), nil
+	}
+
+	var accepted []*packp.Command
+	for _, cmd := range req.cmds {
+		if msg := req.check(cmd); msg != "" {
+			status[cmd.Name] = msg
+			continue
+		}
+		accepted = append(accepted, cmd)
+	}
+	if req.atomic && len(accepted) < len(req.cmds) {
+		for _, cmd := range accepted {
+			status[cmd.Name] = "atomic push failure"
+		}
+		return report(), nil
+	}
+	if len(accepted) == 0 {
+		return report(), nil
+	}
+
+	var quarantineEnv []string
+	if q != nil {
+		quarantineEnv = q.env()
+	}
+	if err := req.hooks.run(ctx, "pre-receive", accepted, quarantineEnv...); err != nil {
+		for _, cmd := range accepted {
+			status[cmd.Name] = "pre-receive hook declined"
+		}
+		if errors.Is(err, errHookFailed) {
+			return report(), nil
+		}
+		return report(), err
+	}
+
+	if q != nil {
+		if err := q.migrate(); err != nil {
+			for _, cmd := range accepted {
+				status[cmd.Name] = "failed to store objects"
+			}
+			return report(), err
+		}
+	}
+
+	var updated []*packp.Command
+	var firstErr error
+	for _, cmd := range accepted {
+		if err := updateRef(req.sto, cmd); err != nil {
+			status[cmd.Name] = "failed to update ref"
+			if firstErr == nil {
+				firstErr = fmt.Errorf("update %s: %w", cmd.Name, err)
+			}
+			if req.atomic {
+				break
+			}
+			continue
+		}
+		updated = append(updated, cmd)
+	}
+	if req.atomic && firstErr != nil {
+		updated, firstErr = restoreRefs(req.sto, updated, firstErr)
+		kept := make(map[plumbing.ReferenceName]bool, len(updated))
+		for _, cmd := range updated {
+			kept[cmd.Name] = true
+		}
+		for _, cmd := range accepted {
+			if _, ok := status[cmd.Name]; !ok && !kept[cmd.Name] {
+				status[cmd.Name] = "atomic push failure"
+			}
+		}
+	}
+
+	if len(updated) > 0 {
+		// the refs are already updated, a failing hook can't undo that
+		if err := req.hooks.run(ctx, "post-receive", updated); err != nil && !errors.Is(err, errHookFailed) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return report(), firstErr
+}
+
+// limitPack returns the pack limited to the smaller of
+// the pack size limit and the space left in the quota,
+// and a func returning the error for a pack over the limit once it's read.
+func (req pushRequest) limitPack() (io.Reader, func() error, error) {
+	limit, quota := req.maxPackBytes, false
+	if req.quotaBytes > 0 {
+		size, err := objectsSize(req.gitDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		if left := req.quotaBytes - size; limit == 0 || left < limit {
+			limit, quota = left, true
+			if limit < 0 {
+				limit = 0
+			}
+		}
+	}
+	if limit == 0 && !quota {
+		return req.pack, func() error { return nil }, nil
+	}
+	lr := newLimitedReader(req.pack, limit)
+	tooLarge := func() error {
+		if !lr.exceeded {
+			return nil
+		}
+		return &packTooLargeError{read: limit - lr.n + 1, limit: limit, quota: quota}
+	}
+	return lr, tooLarge, nil
+}
+
+// objectsSize returns the size of the objects in the repository at gitDir,
+// excluding quarantined pushes.
+func objectsSize(gitDir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(filepath.Join(gitDir, "objects"), func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), "incoming-") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("measure repository: %w", err)
+	}
+	return size, nil
+}
+
+// check returns why cmd can't be applied,
+// or an empty string if it can.
+func (req pushRequest) check(cmd *packp.Command) string {
+	sto := req.sto
+	ref, err := sto.Reference(cmd.Name)
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return "failed to read ref"
+	}
+	switch cmd.Action() {
+	case packp.Create:
+		if ref != nil {
+			return "already exists"
+		}
+	case packp.Update, packp.Delete:
+		if ref == nil {
+			return "does not exist"
+		}
+		if ref.Type() != plumbing.HashReference || ref.Hash() != cmd.Old {
+			return "stale info"
+		}
+	case packp.Invalid:
+		return "invalid command"
+	}
+	if cmd.Action() == packp.Delete {
+		if matchRef(req.denyDeletes, cmd.Name.String()) {
+			return "deletion prohibited"
+		}
+		return req.checkRules(cmd)
+	}
+	if err := checkConnected(req.objects, sto, cmd.New); err != nil {
+		return "missing necessary objects"
+	}
+	if cmd.Action() == packp.Update && matchRef(req.denyNonFastForwards, cmd.Name.String()) {
+		ff, err := isFastForward(req.objects, cmd.Old, cmd.New)
+		if err != nil {
+			return "failed to check fast-forward"
+		}
+		if !ff {
+			return "non-fast-forward"
+		}
+	}
+	return req.checkRules(cmd)
+}
+
+// isFastForward reports whether new is a descendant of old.
+// Like git, an update involving something other than a commit,
+// or a tag of one, is never a fast-forward.
+func isFastForward(sto storer.EncodedObjectStorer, old, new plumbing.Hash) (bool, error) {
+	oldCommit, err := peelCommit(sto, old)
+	if err != nil || oldCommit == nil {
+		return false, err
+	}
+	newCommit, err := peelCommit(sto, new)
+	if err != nil || newCommit == nil {
+		return false, err
+	}
+	return oldCommit.IsAncestor(newCommit)
+}
+
+// peelCommit returns the commit h is or a tag of h points to,
+// or nil if h isn't a commit.
+func peelCommit(sto storer.EncodedObjectStorer, h plumbing.Hash) (*object.Commit, error) {
+	for {
+		obj, err := sto.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, fmt.Errorf("get object %s: %w", h, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return object.DecodeCommit(sto, obj)
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(sto, obj)
+			if err != nil {
+				return nil, fmt.Errorf("decode tag %s: %w", h, err)
+			}
+			h = tag.Target
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// updateRef applies cmd, failing if the ref moved since it was checked.
+func updateRef(sto storer.Storer, cmd *packp.Command) error {
+	if cmd.Action() == packp.Delete {
+		return sto.RemoveReference(cmd.Name)
+	}
+	var old *plumbing.Reference
+	if cmd.Action() == packp.Update {
+		old = plumbing.NewHashReference(cmd.Name, cmd.Old)
+	}
+	return sto.CheckAndSetReference(plumbing.NewHashReference(cmd.Name, cmd.New), old)
+}
+
+// restoreRefs undoes the updates of a failed atomic push,
+// returning the commands that couldn't be undone.
+func restoreRefs(sto storer.Storer, updated []*packp.Command, err error) ([]*packp.Command, error) {
+	var kept []*packp.Command
+	for _, cmd := range updated {
+		var rerr error
+		switch cmd.Action() {
+		case packp.Create:
+			rerr = sto.RemoveReference(cmd.Name)
+		case packp.Update:
+			rerr = sto.CheckAndSetReference(plumbing.NewHashReference(cmd.Name, cmd.Old), plumbing.NewHashReference(cmd.Name, cmd.New))
+		case packp.Delete:
+			rerr = sto.SetReference(plumbing.NewHashReference(cmd.Name, cmd.Old))
+		}
+		if rerr != nil {
+			err = fmt.Errorf("%w, restore %s: %v", err, cmd.Name, rerr)
+			kept = append(kept, cmd)
+		}
+	}
+	return kept, err
+}
@@ -0,0 +1,141 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+)
+
+// objectFiles lists the files under the objects dir of the repository at gitDir.
+func objectFiles(t *testing.T, gitDir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(filepath.Join(gitDir, "objects"), func(name string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			names = append(names, name)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// newPushClone clones repo.git from url and commits a new file,
+// returning the work tree and the new commit.
+func newPushClone(t *testing.T, url string) (string, string) {
+	t.Helper()
+	work := t.TempDir()
+	runGit(t, work, "clone", "-q", url+"/repo.git", "out")
+	work = filepath.Join(work, "out")
+	writeTestFile(t, filepath.Join(work, "pushed.txt"), "pushed\n")
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "-q", "-m", "pushed")
+	return work, strings.TrimSpace(runGit(t, work, "rev-parse", "HEAD"))
+}
+
+func TestPushHookRejected(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	hooks := t.TempDir()
+	if err := os.WriteFile(filepath.Join(hooks, "pre-receive"), []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, dir, WithReceivePack(true), WithHooks(hooks, 0))
+	gitDir := filepath.Join(dir, "repo.git")
+	work, commit := newPushClone(t, srv.URL)
+
+	refs, objects := runGit(t, gitDir, "show-ref"), objectFiles(t, gitDir)
+	if _, err := tryGit(t, work, "push", "-q", "origin", "HEAD:refs/heads/rejected"); err == nil {
+		t.Fatal("push accepted with a failing pre-receive hook")
+	}
+	if got := runGit(t, gitDir, "show-ref"); got != refs {
+		t.Errorf("refs after the rejected push:\n%s\nwant\n%s", got, refs)
+	}
+	if got := objectFiles(t, gitDir); !reflect.DeepEqual(got, objects) {
+		t.Errorf("objects after the rejected push: %q, want %q", got, objects)
+	}
+	if _, err := tryGit(t, gitDir, "cat-file", "-e", commit); err == nil {
+		t.Error("rejected commit in the repository")
+	}
+}
+
+// TestPushTruncatedPack cuts the pack off partway,
+// as a client disconnecting during the transfer does.
+func TestPushTruncatedPack(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	srv := newTestServer(t, dir, WithReceivePack(true))
+	gitDir := filepath.Join(dir, "repo.git")
+	work, commit := newPushClone(t, srv.URL)
+
+	cmd := exec.Command("git", "pack-objects", "--stdout", "--revs")
+	cmd.Dir = work
+	cmd.Env = gitEnv(t.TempDir())
+	cmd.Stdin = strings.NewReader(commit + "\n^origin/main\n")
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	e := pktline.NewEncoder(&body)
+	e.Encodef("%s %s refs/heads/truncated\x00report-status\n", plumbing.ZeroHash, commit)
+	e.Flush()
+	body.Write(pack[:len(pack)/2])
+
+	refs, objects := runGit(t, gitDir, "show-ref"), objectFiles(t, gitDir)
+	res, err := http.Post(srv.URL+"/repo.git/git-receive-pack", "application/x-git-receive-pack-request", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if strings.Contains(string(b), "ok refs/heads/truncated") {
+		t.Errorf("truncated pack accepted: %q", b)
+	}
+	if got := runGit(t, gitDir, "show-ref"); got != refs {
+		t.Errorf("refs after the truncated push:\n%s\nwant\n%s", got, refs)
+	}
+	if got := objectFiles(t, gitDir); !reflect.DeepEqual(got, objects) {
+		t.Errorf("objects after the truncated push: %q, want %q", got, objects)
+	}
+}
+
+func TestPushFetchOnlyRepo(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	gitDir := filepath.Join(dir, "repo.git")
+	runGit(t, gitDir, "config", "gitreposerver.receivepack", "false")
+	srv := newTestServer(t, dir, WithReceivePack(true))
+	work, _ := newPushClone(t, srv.URL)
+
+	res, err := http.Get(srv.URL + "/repo.git/info/refs?service=git-receive-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("receive-pack advertisement: status %d, want 403", res.StatusCode)
+	}
+
+	refs := runGit(t, gitDir, "show-ref")
+	_, err = tryGit(t, work, "push", "origin", "HEAD:refs/heads/pushed")
+	if err == nil {
+		t.Fatal("push to a fetch-only repository accepted")
+	}
+	if !strings.Contains(err.Error(), "git-receive-pack is disabled for this repository") {
+		t.Errorf("push error %v, want it to say receive-pack is disabled", err)
+	}
+	if got := runGit(t, gitDir, "show-ref"); got != refs {
+		t.Errorf("refs after the refused push:\n%s\nwant\n%s", got, refs)
+	}
+}
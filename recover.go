@@ -0,0 +1,51 @@
+package gitreposerver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// panicError is a recovered panic.
+type panicError struct {
+	value any
+}
+
+func (e panicError) Error() string { return fmt.Sprintf("panic: %v", e.value) }
+
+// recoverPanic converts a panic into an error, logging its stack.
+// It must be called directly by a deferred function.
+func (h *httpHandler) recoverPanic(ctx context.Context, v any) error {
+	if v == nil {
+		return nil
+	}
+	h.logger(ctx).Error("panic", "repo", RepoFromContext(ctx), "panic", v, "stack", string(debug.Stack()))
+	return panicError{v}
+}
+
+// recoverPanics keeps a panicking request, such as one for a corrupt
+// repository, from crashing the server. The client gets a 500,
+// or a truncated response if the response was already started.
+func (h *httpHandler) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rec := &responseRecorder{ResponseWriter: rw}
+		defer func() {
+			v := recover()
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			err := h.recoverPanic(r.Context(), v)
+			if err == nil {
+				return
+			}
+			requestInfoFromContext(r.Context()).failure = "panic"
+			if rec.status != 0 {
+				requestInfoFromContext(r.Context()).err = err
+				return
+			}
+			h.httpError(rw, r, err)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
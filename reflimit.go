@@ -0,0 +1,76 @@
+package gitreposerver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+)
+
+// warnAdvertisedRefs is the number of refs in a protocol v0 advertisement
+// above which a warning is logged, whatever MaxAdvertisedRefs is.
+const warnAdvertisedRefs = 10000
+
+// errTooManyRefs is returned for protocol v0 fetches of repositories
+// with more refs than MaxAdvertisedRefs.
+var errTooManyRefs = errors.New("too many refs to advertise")
+
+// limitRefs applies MaxAdvertisedRefs to the advertisement of a fetch,
+// truncating it if TruncateAdvertisedRefs is set, otherwise failing.
+func (h *httpHandler) limitRefs(ctx context.Context, repo string, ar *packp.AdvRefs) error {
+	limit := h.cfg.MaxAdvertisedRefs
+	n := len(ar.References)
+	if limit <= 0 || n <= limit {
+		return nil
+	}
+	if !h.cfg.TruncateAdvertisedRefs {
+		return fmt.Errorf("%w: the repository has %d refs, over the limit of %d, fetch with protocol v2 (git -c protocol.version=2) which only lists the refs asked for", errTooManyRefs, n, limit)
+	}
+
+	// keep HEAD's branch, then branches, then tags, then the rest
+	var head string
+	for _, v := range ar.Capabilities.Get(capability.SymRef) {
+		if strings.HasPrefix(v, "HEAD:") {
+			head = strings.TrimPrefix(v, "HEAD:")
+		}
+	}
+	rank := func(name string) int {
+		switch {
+		case name == head:
+			return 0
+		case strings.HasPrefix(name, "refs/heads/"):
+			return 1
+		case strings.HasPrefix(name, "refs/tags/"):
+			return 2
+		}
+		return 3
+	}
+	names := make([]string, 0, n)
+	for name := range ar.References {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if ri, rj := rank(names[i]), rank(names[j]); ri != rj {
+			return ri < rj
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names[limit:] {
+		delete(ar.References, name)
+		delete(ar.Peeled, name)
+	}
+	h.logger(ctx).Warn("truncated ref advertisement", "repo", repo, "refs", n, "limit", limit)
+	return nil
+}
+
+// warnLargeAdvertisement logs advertisements of over warnAdvertisedRefs refs,
+// which can take clients and the server a lot of memory.
+func (h *httpHandler) warnLargeAdvertisement(ctx context.Context, repo, service string, ar *packp.AdvRefs) {
+	if n := len(ar.References); n > warnAdvertisedRefs {
+		h.logger(ctx).Warn("advertising a large number of refs, consider protocol v2 or MaxAdvertisedRefs", "repo", repo, "service", service, "refs", n)
+	}
+}
@@ -0,0 +1,156 @@
+package gitreposerver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// refInfo describes a branch or tag in the /{repo}/refs listing.
+type refInfo struct {
+	Name string `json:"name"`
+	// Type is branch or tag.
+	Type   string `json:"type"`
+	Target string `json:"target"`
+	// Object and Message are set for annotated tags,
+	// Object is what the tag points to.
+	Object  string `json:"object,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// refList is a page of the /{repo}/refs listing.
+type refList struct {
+	Refs []refInfo `json:"refs"`
+	// Next is the after value for the next page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// listRefs serves a JSON listing of the branches and tags of a repository,
+// only those of ?type=branch or tag if given, in pages of ?limit= refs
+// starting after the ?after= ref name.
+// Hidden refs aren't listed.
+func (h *httpHandler) listRefs(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	repo := RepoFromContext(r.Context())
+	typ := r.URL.Query().Get("type")
+	switch typ {
+	case "", "branch", "tag":
+	default:
+		h.httpError(rw, r, requestErrorf("invalid type %q, use branch or tag", typ))
+		return
+	}
+	limit, err := listLimit(r)
+	if err != nil {
+		h.httpError(rw, r, err)
+		return
+	}
+	after := r.URL.Query().Get("after")
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		h.logger(r.Context()).Error("create endpoint", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		h.logger(r.Context()).Error("load repository", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	iter, err := sto.IterReferences()
+	if err != nil {
+		h.logger(r.Context()).Error("list references", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	hidden := h.hiddenRefs(r.Context(), repo)
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || matchRef(hidden, ref.Name().String()) {
+			return nil
+		}
+		if refType(ref.Name()) != "" && (typ == "" || refType(ref.Name()) == typ) {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		h.logger(r.Context()).Error("list references", "repo", repo, "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+	start := sort.Search(len(refs), func(i int) bool { return refs[i].Name().String() >= after })
+	if start < len(refs) && refs[start].Name().String() == after {
+		start++
+	}
+	refs = refs[start:]
+
+	list := refList{Refs: []refInfo{}}
+	if len(refs) > limit {
+		refs = refs[:limit]
+		list.Next = refs[limit-1].Name().String()
+	}
+	for _, ref := range refs {
+		info, err := describeRef(sto, ref)
+		if err != nil {
+			h.logger(r.Context()).Error("describe ref", "repo", repo, "ref", ref.Name(), "err", err)
+			h.httpError(rw, r, err)
+			return
+		}
+		list.Refs = append(list.Refs, info)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	setNoCache(rw.Header())
+	if r.Method == http.MethodHead {
+		return
+	}
+	json.NewEncoder(rw).Encode(list)
+}
+
+// refType returns branch or tag for refs in the listing,
+// an empty string for others.
+func refType(name plumbing.ReferenceName) string {
+	switch {
+	case name.IsBranch():
+		return "branch"
+	case name.IsTag():
+		return "tag"
+	}
+	return ""
+}
+
+// describeRef describes ref, reading the tag if it's an annotated tag.
+func describeRef(sto storer.EncodedObjectStorer, ref *plumbing.Reference) (refInfo, error) {
+	info := refInfo{
+		Name:   ref.Name().String(),
+		Type:   refType(ref.Name()),
+		Target: ref.Hash().String(),
+	}
+	if info.Type != "tag" {
+		return info, nil
+	}
+	tag, err := object.GetTag(sto, ref.Hash())
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		// a lightweight tag
+		return info, nil
+	} else if err != nil {
+		return info, fmt.Errorf("get tag %s: %w", ref.Hash(), err)
+	}
+	info.Object = tag.Target.String()
+	info.Message = tag.Message
+	return info, nil
+}
@@ -0,0 +1,154 @@
+package gitreposerver
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// errRefNotFound is returned for revisions that don't name a visible ref or commit.
+var errRefNotFound = errors.New("ref not found")
+
+// matchRef reports whether name matches patterns,
+// ref prefixes like git's transfer.hideRefs.
+// A pattern starting with ! excludes refs, later patterns take precedence.
+func matchRef(patterns []string, name string) bool {
+	match := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimSuffix(strings.TrimPrefix(p, "!"), "/")
+		if p == "" {
+			continue
+		}
+		if name == p || strings.HasPrefix(name, p+"/") {
+			match = !negate
+		}
+	}
+	return match
+}
+
+// checkHiddenWants rejects wants that are only the tips of hidden refs,
+// so clients can't fetch refs they aren't shown.
+func checkHiddenWants(sto storer.ReferenceStorer, patterns []string, wants []plumbing.Hash) error {
+	if len(patterns) == 0 {
+		return nil
+	}
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return fmt.Errorf("list references: %w", err)
+	}
+	visible := make(map[plumbing.Hash]bool)
+	hidden := make(map[plumbing.Hash]bool)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		if matchRef(patterns, ref.Name().String()) {
+			hidden[ref.Hash()] = true
+		} else {
+			visible[ref.Hash()] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("list references: %w", err)
+	}
+	for _, h := range wants {
+		if hidden[h] && !visible[h] {
+			return requestErrorf("want %s: not our ref", h)
+		}
+	}
+	return nil
+}
+
+// annotatedTags returns the tag objects of the tags that patterns don't hide.
+func annotatedTags(sto storer.Storer, patterns []string) ([]plumbing.Hash, error) {
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("list references: %w", err)
+	}
+	var tags []plumbing.Hash
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if !ref.Name().IsTag() || ref.Type() != plumbing.HashReference || matchRef(patterns, ref.Name().String()) {
+			return nil
+		}
+		obj, err := sto.EncodedObject(plumbing.AnyObject, ref.Hash())
+		if err != nil {
+			return fmt.Errorf("get %s: %w", ref.Name(), err)
+		}
+		if obj.Type() == plumbing.TagObject {
+			tags = append(tags, ref.Hash())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// resolveRevision resolves rev, a ref name such as main, tags/v1 or
+// refs/heads/main, or a full object id, like git rev-parse.
+// Refs matching hidden can't be used.
+func resolveRevision(sto storer.Storer, hidden []string, rev string) (plumbing.Hash, error) {
+	if len(rev) == 2*len(plumbing.ZeroHash) {
+		if _, err := hex.DecodeString(rev); err == nil {
+			h := plumbing.NewHash(rev)
+			if sto.HasEncodedObject(h) != nil {
+				return plumbing.ZeroHash, errRefNotFound
+			}
+			if err := checkHiddenWants(sto, hidden, []plumbing.Hash{h}); err != nil {
+				return plumbing.ZeroHash, errRefNotFound
+			}
+			return h, nil
+		}
+	}
+	if !validRefName(rev) {
+		return plumbing.ZeroHash, errRefNotFound
+	}
+	rules := plumbing.RefRevParseRules
+	if rev == "HEAD" || strings.HasPrefix(rev, "refs/") {
+		rules = append([]string{"%s"}, rules...)
+	}
+	for _, rule := range rules {
+		name := plumbing.ReferenceName(fmt.Sprintf(rule, rev))
+		if matchRef(hidden, name.String()) {
+			continue
+		}
+		ref, err := storer.ResolveReference(sto, name)
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			continue
+		} else if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("resolve %s: %w", name, err)
+		}
+		if matchRef(hidden, ref.Name().String()) {
+			continue
+		}
+		return ref.Hash(), nil
+	}
+	return plumbing.ZeroHash, errRefNotFound
+}
+
+// validRefName reports whether name follows the rules of git check-ref-format,
+// which also keeps it inside the refs dir.
+func validRefName(name string) bool {
+	if name == "" || strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || strings.HasPrefix(elem, ".") || strings.HasSuffix(elem, ".lock") {
+			return false
+		}
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || strings.ContainsRune(" ~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+)
+
+func TestMatchRef(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{[]string{"refs/pull"}, "refs/pull/1/head", true},
+		{[]string{"refs/pull/"}, "refs/pull/1/head", true},
+		{[]string{"refs/pull"}, "refs/pulls", false},
+		{[]string{"refs/pull"}, "refs/heads/main", false},
+		{[]string{"refs/heads/secret"}, "refs/heads/secret", true},
+		{[]string{"refs/pull", "!refs/pull/1"}, "refs/pull/1/head", false},
+		{[]string{"refs/pull", "!refs/pull/1"}, "refs/pull/2/head", true},
+		{[]string{"!refs/pull/1", "refs/pull"}, "refs/pull/1/head", true},
+		{nil, "refs/heads/main", false},
+	}
+	for _, tt := range tests {
+		if got := matchRef(tt.patterns, tt.name); got != tt.want {
+			t.Errorf("matchRef(%q, %q) = %v, want %v", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
+
+// newHiddenRefRepo returns a repository dir whose refs/heads/secret
+// points to a commit no other ref has, and that commit.
+func newHiddenRefRepo(t *testing.T) (dir, secret string) {
+	t.Helper()
+	dir = newTestRepo(t, 2)
+	bare := filepath.Join(dir, "repo.git")
+	secret = strings.TrimSpace(runGit(t, bare, "commit-tree", "HEAD^{tree}", "-p", "HEAD", "-m", "secret"))
+	runGit(t, bare, "update-ref", "refs/heads/secret", secret)
+	return dir, secret
+}
+
+func TestHiddenRefsNotAdvertised(t *testing.T) {
+	dir, secret := newHiddenRefRepo(t)
+	srv := newTestServer(t, dir, WithHiddenRefs("refs/heads/secret"))
+
+	res, err := http.Get(srv.URL + "/repo.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "secret") || strings.Contains(string(body), secret) {
+		t.Errorf("hidden ref advertised:\n%s", body)
+	}
+	if !strings.Contains(string(body), "refs/heads/main") {
+		t.Errorf("main not advertised:\n%s", body)
+	}
+
+	for _, version := range []string{"0", "2"} {
+		out := runGit(t, t.TempDir(), "-c", "protocol.version="+version, "ls-remote", srv.URL+"/repo.git")
+		if strings.Contains(out, "secret") || strings.Contains(out, secret) {
+			t.Errorf("protocol v%s: hidden ref listed:\n%s", version, out)
+		}
+	}
+}
+
+func TestHiddenRefsNotFetchable(t *testing.T) {
+	dir, secret := newHiddenRefRepo(t)
+	srv := newTestServer(t, dir, WithHiddenRefs("refs/heads/secret"))
+
+	for _, version := range []string{"0", "2"} {
+		t.Run("v"+version, func(t *testing.T) {
+			work := t.TempDir()
+			runGit(t, work, "init", "-q")
+			if _, err := tryGit(t, work, "-c", "protocol.version="+version, "fetch", "-q", srv.URL+"/repo.git", secret); err == nil {
+				t.Errorf("fetched the tip of a hidden ref by its id")
+			}
+			if _, err := tryGit(t, work, "-c", "protocol.version="+version, "fetch", "-q", srv.URL+"/repo.git", "refs/heads/secret"); err == nil {
+				t.Errorf("fetched a hidden ref by name")
+			}
+			runGit(t, work, "-c", "protocol.version="+version, "fetch", "-q", srv.URL+"/repo.git", "main")
+		})
+	}
+}
+
+// TestHiddenRefsNotFetchableV0 sends the wants itself,
+// as git won't ask a protocol v0 server for objects it didn't advertise.
+func TestHiddenRefsNotFetchableV0(t *testing.T) {
+	dir, secret := newHiddenRefRepo(t)
+	srv := newTestServer(t, dir, WithHiddenRefs("refs/heads/secret"))
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+
+	tests := []struct {
+		want string
+		code int
+	}{
+		{secret, http.StatusBadRequest},
+		{main, http.StatusOK},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		e := pktline.NewEncoder(&body)
+		e.Encodef("want %s ofs-delta\n", tt.want)
+		e.Flush()
+		e.Encodef("done\n")
+		res, err := http.Post(srv.URL+"/repo.git/git-upload-pack", "application/x-git-upload-pack-request", &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.code {
+			t.Errorf("want %s: status %d, want %d", tt.want, res.StatusCode, tt.code)
+		}
+	}
+}
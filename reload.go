@@ -0,0 +1,110 @@
+package gitreposerver
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// reloadable holds what was last loaded from a file,
+// replaced when Reload loads it again, such as on SIGHUP.
+type reloadable[T any] struct {
+	name string
+	load func(name string) (T, error)
+	v    atomic.Pointer[T]
+}
+
+func newReloadable[T any](name string, load func(string) (T, error)) (*reloadable[T], error) {
+	r := &reloadable[T]{name: name, load: load}
+	return r, r.Reload()
+}
+
+// Reload loads the file again for the requests that follow.
+// If it can't be loaded what was loaded before is kept,
+// so a bad edit doesn't lock everyone out.
+func (r *reloadable[T]) Reload() error {
+	v, err := r.load(r.name)
+	if err != nil {
+		return err
+	}
+	r.v.Store(&v)
+	return nil
+}
+
+func (r *reloadable[T]) get() T {
+	return *r.v.Load()
+}
+
+// AuthFile is an Authenticator for a file of "user:hash" lines,
+// bcrypt hashes as produced by `htpasswd -nbB user pass`.
+// Every user has access to every repository.
+type AuthFile struct{ *reloadable[userFile] }
+
+// LoadAuthFile reads the user file name, Reload reads it again.
+func LoadAuthFile(name string) (AuthFile, error) {
+	users, err := newReloadable(name, readUserFile)
+	return AuthFile{users}, err
+}
+
+// Reload reads the user file again for the requests that follow,
+// keeping the previous users if it can't be read.
+func (u AuthFile) Reload() error { return u.reloadable.Reload() }
+
+func (u AuthFile) Authenticate(user, pass, repo string, write bool) (bool, error) {
+	return u.get().Authenticate(user, pass, repo, write)
+}
+
+// TokenFile is a TokenValidator for a file of "token identity [expiry]" lines,
+// with an optional RFC 3339 expiry time.
+// Every token has access to every repository.
+type TokenFile struct{ *reloadable[tokenFile] }
+
+// LoadTokenFile reads the token file name, Reload reads it again.
+func LoadTokenFile(name string) (TokenFile, error) {
+	tokens, err := newReloadable(name, readTokenFile)
+	return TokenFile{tokens}, err
+}
+
+// Reload reads the token file again for the requests that follow,
+// keeping the previous tokens if it can't be read.
+func (t TokenFile) Reload() error { return t.reloadable.Reload() }
+
+func (t TokenFile) ValidateToken(token, repo string, write bool) (string, bool) {
+	return t.get().ValidateToken(token, repo, write)
+}
+
+// AuthorizedKeys accepts the ssh public keys in an OpenSSH authorized_keys file,
+// identifying clients by the key's comment or, without one, its fingerprint.
+// Every key has access to every repository.
+type AuthorizedKeys struct{ *reloadable[authorizedKeys] }
+
+// LoadAuthorizedKeys reads the authorized_keys file name, Reload reads it again.
+func LoadAuthorizedKeys(name string) (AuthorizedKeys, error) {
+	keys, err := newReloadable(name, readAuthorizedKeys)
+	return AuthorizedKeys{keys}, err
+}
+
+// Reload reads the authorized_keys file again for the connections that follow,
+// keeping the previous keys if it can't be read.
+func (a AuthorizedKeys) Reload() error { return a.reloadable.Reload() }
+
+// PublicKey is a PublicKeyCallback accepting the listed keys.
+func (a AuthorizedKeys) PublicKey(user string, key ssh.PublicKey) (string, bool) {
+	return a.get().PublicKey(user, key)
+}
+
+// SettingsFile is a git config file setting what a repository's own config can
+// in its gitreposerver section, hiderefs, quota, defaultbranch, uploadpack
+// and receivepack, for every repository. A repository's config overrides it,
+// and it overrides the Config, adding to HiddenRefs.
+type SettingsFile struct{ *reloadable[repoSettings] }
+
+// LoadSettingsFile reads the settings file name, Reload reads it again.
+func LoadSettingsFile(name string) (SettingsFile, error) {
+	settings, err := newReloadable(name, readSettingsFile)
+	return SettingsFile{settings}, err
+}
+
+// Reload reads the settings file again for the requests that follow,
+// keeping the previous settings if it can't be read or has an invalid value.
+func (s SettingsFile) Reload() error { return s.reloadable.Reload() }
@@ -0,0 +1,157 @@
+package gitreposerver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// userLine returns the user file line for user with pass.
+func userLine(t *testing.T, user, pass string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user + ":" + string(hash) + "\n"
+}
+
+// TestReloadAuthInFlight changes the user file between the requests of a clone,
+// the rest of the clone gets the new users without a restart.
+func TestReloadAuthInFlight(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	name := filepath.Join(t.TempDir(), "users")
+	writeTestFile(t, name, userLine(t, "alice", "secret"))
+	users, err := LoadAuthFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, dir, WithAuth(users))
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+
+	fetch := func(user, pass string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/repo.git/git-upload-pack", uploadPackRequest([]string{main}, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		req.SetBasicAuth(user, pass)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// the clone starts with the ref advertisement
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/repo.git/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("alice", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("advertisement: status %d", res.StatusCode)
+	}
+
+	writeTestFile(t, name, userLine(t, "bob", "secret"))
+	if err := users.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code := fetch("alice", "secret"); code != http.StatusUnauthorized {
+		t.Errorf("removed user's fetch: status %d, want 401", code)
+	}
+	if code := fetch("bob", "secret"); code != http.StatusOK {
+		t.Errorf("added user's fetch: status %d, want 200", code)
+	}
+
+	// a broken file keeps the users loaded before
+	writeTestFile(t, name, "bob\n")
+	if err := users.Reload(); err == nil {
+		t.Error("reloaded a malformed user file")
+	}
+	if code := fetch("bob", "secret"); code != http.StatusOK {
+		t.Errorf("fetch after a failed reload: status %d, want 200", code)
+	}
+}
+
+func TestReloadSettingsFile(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	runGit(t, filepath.Join(dir, "repo.git"), "update-ref", "refs/pull/1/head", "main")
+	name := filepath.Join(t.TempDir(), "settings")
+	writeTestFile(t, name, "[gitreposerver]\n\tquota = 1m\n")
+	settings, err := LoadSettingsFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(t, dir, WithSettingsFile(settings), WithRepoQuota(1<<30))
+	srv := newTestServer(t, dir, WithSettingsFile(settings))
+	advertised := func() bool {
+		t.Helper()
+		res, err := http.Get(srv.URL + "/repo.git/info/refs?service=git-upload-pack")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return strings.Contains(string(b), "refs/pull/1/head")
+	}
+
+	ctx := context.Background()
+	if quota := h.repoQuota(ctx, "repo.git"); quota != 1<<20 {
+		t.Errorf("quota %d, want 1MiB from the settings file", quota)
+	}
+	if !advertised() {
+		t.Error("refs/pull/1/head hidden before the settings file hides it")
+	}
+
+	writeTestFile(t, name, "[gitreposerver]\n\thiderefs = refs/pull/\n")
+	if err := settings.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if quota := h.repoQuota(ctx, "repo.git"); quota != 1<<30 {
+		t.Errorf("quota %d after reload, want the server's 1GiB", quota)
+	}
+	if advertised() {
+		t.Error("refs/pull/1/head advertised after reloading the settings file hiding it")
+	}
+
+	// settings only a restart changes and unknown keys are skipped,
+	// the rest of the file still applies
+	writeTestFile(t, name, "[gitreposerver]\n\tlisten = :80\n\thidrefs = refs/heads/\n\tquota = 2m\n\thiderefs = refs/pull/\n")
+	if err := settings.Reload(); err != nil {
+		t.Fatalf("reload with listen: %v", err)
+	}
+	if quota := h.repoQuota(ctx, "repo.git"); quota != 2<<20 {
+		t.Errorf("quota %d after reload with listen, want 2MiB", quota)
+	}
+	if advertised() {
+		t.Error("refs/pull/1/head advertised after reloading with listen")
+	}
+	want := []string{"gitreposerver.listen only changes on restart", "gitreposerver.hidrefs is not a setting"}
+	if got := settings.get().ignored; !reflect.DeepEqual(got, want) {
+		t.Errorf("ignored %q, want %q", got, want)
+	}
+
+	// invalid values fail the reload, keeping the settings loaded before
+	writeTestFile(t, name, "[gitreposerver]\n\tquota = lots\n")
+	if err := settings.Reload(); err == nil {
+		t.Error("reloaded a settings file with an invalid quota")
+	}
+	if quota := h.repoQuota(ctx, "repo.git"); quota != 2<<20 {
+		t.Errorf("quota %d after a failed reload, want the 2MiB loaded before", quota)
+	}
+}
@@ -0,0 +1,441 @@
+package gitreposerver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/helper/chroot"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/format/objfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+var (
+	// errInvalidRepoPath is returned for repository names
+	// that are malformed or would escape the base directory.
+	errInvalidRepoPath = errors.New("invalid repository path")
+	// errRepoNotFound is returned when no repository exists at a valid path.
+	errRepoNotFound = errors.New("repository not found")
+	// errNotBareRepo is returned for directories that look like
+	// part of a git repository but aren't a bare repository or a .git dir.
+	errNotBareRepo = errors.New("not a bare repository")
+	// errUnsupportedObjectFormat is returned for repositories
+	// using an object format other than sha1, which go-git can't read.
+	errUnsupportedObjectFormat = errors.New("unsupported object format")
+	// errServiceDisabled is returned for services a repository turns off.
+	errServiceDisabled = errors.New("disabled for this repository")
+	// errReadOnly is returned for writes to a server with ReadOnly set.
+	errReadOnly = errors.New("server is read-only")
+	// errPushDisabled is returned for pushes to a server without ReceivePack.
+	errPushDisabled = errors.New("git-receive-pack not enabled on this server")
+	// errDumbHTTP is returned for ref listings without a service,
+	// sent by clients using the dumb http protocol.
+	errDumbHTTP = errors.New("dumb http protocol not supported, use a git client with smart http")
+)
+
+// resolveRepoPath resolves the repository named in a request path in fsys,
+// accepting both the "name" and "name.git" forms.
+// It returns the slash separated repository path within fsys,
+// an empty name refers to the root of fsys itself.
+// Repositories symlinks lead to outside roots aren't resolved,
+// nor sha256 repositories unless sha256 is set.
+func resolveRepoPath(fsys billy.Filesystem, roots *repoRoots, name string, sha256 bool) (string, error) {
+	if err := checkRepoName(name); err != nil {
+		return "", err
+	}
+
+	full := path.Clean(name)
+	if full == "." {
+		full = ""
+	}
+	candidates := []string{full}
+	if strings.HasSuffix(full, ".git") {
+		candidates = append(candidates, strings.TrimSuffix(full, ".git"))
+	} else if full != "" {
+		candidates = append(candidates, full+".git")
+	}
+	for _, c := range candidates {
+		repo := c
+		if !isRepo(fsys, repo) {
+			// a working tree, serve its .git dir
+			repo = path.Join(c, ".git")
+			if !isRepo(fsys, repo) {
+				continue
+			}
+		}
+		if err := roots.check(repo); err != nil {
+			return "", err
+		}
+		if err := checkObjectFormat(fsys, repo, sha256); err != nil {
+			return "", err
+		}
+		return repo, nil
+	}
+	for _, c := range candidates {
+		if looksLikeRepo(fsys, c) {
+			return "", errNotBareRepo
+		}
+	}
+	return "", errRepoNotFound
+}
+
+// checkRepoName returns errInvalidRepoPath for names
+// that are malformed or would escape the base directory.
+func checkRepoName(name string) error {
+	if strings.ContainsRune(name, 0) || strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return errInvalidRepoPath
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return errInvalidRepoPath
+		}
+	}
+	return nil
+}
+
+// isRepo reports whether dir holds a bare repository or is a .git dir.
+// It checks for the layout git creates,
+// FilesystemLoader itself only requires the config file.
+func isRepo(fsys billy.Filesystem, dir string) bool {
+	for _, name := range []string{"config", "HEAD"} {
+		fi, err := fsys.Stat(path.Join("/", dir, name))
+		if err != nil || fi.IsDir() {
+			return false
+		}
+	}
+	for _, name := range []string{"objects", "refs"} {
+		fi, err := fsys.Stat(path.Join("/", dir, name))
+		if err != nil || !fi.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// checkObjectFormat rejects repositories whose objects
+// aren't named by sha1 hashes, such as git init --object-format=sha256,
+// allowing sha256 ones if sha256 is set.
+func checkObjectFormat(fsys billy.Filesystem, dir string, sha256 bool) error {
+	cfg, err := readRepoConfig(fsys, dir)
+	if err != nil {
+		return err
+	}
+	format := configObjectFormat(cfg)
+	if format != "sha1" && (format != "sha256" || !sha256) {
+		return fmt.Errorf("%w %s, only sha1 repositories are supported", errUnsupportedObjectFormat, format)
+	}
+	return nil
+}
+
+// configObjectFormat returns the hash naming the objects of a repository with cfg,
+// sha1 unless it sets extensions.objectFormat.
+func configObjectFormat(cfg *config.Config) string {
+	format := strings.ToLower(cfg.Section("extensions").Option("objectformat"))
+	if format == "" {
+		return "sha1"
+	}
+	return format
+}
+
+// readRepoConfig reads the git config of the repository at dir.
+func readRepoConfig(fsys billy.Filesystem, dir string) (*config.Config, error) {
+	f, err := fsys.Open(path.Join("/", dir, "config"))
+	if err != nil {
+		return nil, fmt.Errorf("read repository config: %w", err)
+	}
+	defer f.Close()
+	cfg := config.New()
+	if err := config.NewDecoder(f).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("read repository config: %w", err)
+	}
+	return cfg, nil
+}
+
+// parseGitBool parses a git config boolean,
+// an option without a value is true.
+func parseGitBool(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "", "true", "yes", "on", "1":
+		return true, true
+	case "false", "no", "off", "0":
+		return false, true
+	}
+	return false, false
+}
+
+// looksLikeRepo reports whether dir has some of a repository's files,
+// such as a partially copied repository.
+func looksLikeRepo(fsys billy.Filesystem, dir string) bool {
+	for _, name := range []string{"config", "HEAD", ".git"} {
+		if _, err := fsys.Stat(path.Join("/", dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// initRepo creates a bare repository for name in fsys,
+// adding a .git suffix if name doesn't have one.
+// name must have been checked by resolveRepoPath.
+func initRepo(fsys billy.Filesystem, roots *repoRoots, name string) (string, error) {
+	name = initRepoName(name)
+	sto := filesystem.NewStorage(chroot.New(fsys, name), cache.NewObjectLRUDefault())
+	_, err := git.Init(sto, nil)
+	if err != nil && !errors.Is(err, git.ErrRepositoryAlreadyExists) {
+		return "", fmt.Errorf("init repository %s: %w", name, err)
+	}
+	// resolve again in case another push created it first,
+	// git.Init creates sha1 repositories
+	return resolveRepoPath(fsys, roots, name, false)
+}
+
+// initRepoName returns the path initRepo creates for name.
+func initRepoName(name string) string {
+	if !strings.HasSuffix(name, ".git") {
+		name += ".git"
+	}
+	return name
+}
+
+// headTarget returns the branch to advertise HEAD as pointing to.
+// defaultBranch is used when HEAD is detached or points to a missing branch.
+func headTarget(sto storer.ReferenceStorer, defaultBranch string) (plumbing.ReferenceName, bool) {
+	head, err := sto.Reference(plumbing.HEAD)
+	if err == nil && head.Type() == plumbing.SymbolicReference {
+		if _, err := sto.Reference(head.Target()); err == nil {
+			return head.Target(), true
+		}
+	}
+	if defaultBranch == "" {
+		return "", false
+	}
+	name := plumbing.ReferenceName(defaultBranch)
+	if !strings.HasPrefix(defaultBranch, "refs/") {
+		name = plumbing.NewBranchReferenceName(defaultBranch)
+	}
+	if _, err := sto.Reference(name); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+type repoKey struct{}
+
+func withRepo(ctx context.Context, repo string) context.Context {
+	return context.WithValue(ctx, repoKey{}, repo)
+}
+
+// RepoFromContext returns the repository path, relative to the base dir,
+// that the request was routed to.
+func RepoFromContext(ctx context.Context) string {
+	repo, _ := ctx.Value(repoKey{}).(string)
+	return repo
+}
+
+// objectCacheBytes bounds the objects each request's storer caches.
+// go-git's 96 MiB default fills with the objects of a large pack as it's sent,
+// so memory grew with the repository for every fetch in flight.
+const objectCacheBytes = 8 << 20
+
+// fsLoader loads the repositories in fs like server.NewFilesystemLoader,
+// with a smaller object cache.
+type fsLoader struct {
+	fs billy.Filesystem
+}
+
+func (l fsLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	fs, err := l.fs.Chroot(ep.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fs.Stat("config"); err != nil {
+		return nil, transport.ErrRepositoryNotFound
+	}
+	return looseBlobStorage{filesystem.NewStorage(fs, cache.NewObjectLRU(objectCacheBytes)), fs}, nil
+}
+
+// looseBlobStorage returns loose blobs that read their file when opened.
+// go-git reads loose objects into memory when they're looked up,
+// and the pack encoder holds on to every object it packs until it's done,
+// so fetching from a repository that isn't packed took memory for all its blobs.
+type looseBlobStorage struct {
+	*filesystem.Storage
+	fs billy.Filesystem
+}
+
+func (s looseBlobStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, ok := s.looseBlob(t, h); ok {
+		return obj, nil
+	}
+	return s.Storage.EncodedObject(t, h)
+}
+
+// DeltaObject is used by the pack encoder in place of EncodedObject.
+func (s looseBlobStorage) DeltaObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, ok := s.looseBlob(t, h); ok {
+		return obj, nil
+	}
+	return s.Storage.DeltaObject(t, h)
+}
+
+func (s looseBlobStorage) looseBlob(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, bool) {
+	if t != plumbing.AnyObject && t != plumbing.BlobObject {
+		return nil, false
+	}
+	obj := &looseObject{fs: s.fs, name: looseObjectName(h), hash: h}
+	r, err := obj.open()
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	typ, size, err := r.Header()
+	if err != nil || typ != plumbing.BlobObject {
+		return nil, false
+	}
+	obj.size = size
+	return obj, true
+}
+
+func looseObjectName(h plumbing.Hash) string {
+	hex := h.String()
+	return path.Join("objects", hex[:2], hex[2:])
+}
+
+// looseObject is a loose blob read from its file each time it's opened.
+type looseObject struct {
+	fs   billy.Filesystem
+	name string
+	hash plumbing.Hash
+	size int64
+}
+
+func (o *looseObject) Hash() plumbing.Hash         { return o.hash }
+func (o *looseObject) Type() plumbing.ObjectType   { return plumbing.BlobObject }
+func (o *looseObject) SetType(plumbing.ObjectType) {}
+func (o *looseObject) Size() int64                 { return o.size }
+func (o *looseObject) SetSize(int64)               {}
+func (o *looseObject) Writer() (io.WriteCloser, error) {
+	return nil, errors.New("loose objects are read only")
+}
+
+func (o *looseObject) Reader() (io.ReadCloser, error) {
+	r, err := o.open()
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := r.Header(); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// open returns a reader of the object's file, closing it closes the file.
+func (o *looseObject) open() (*looseReader, error) {
+	f, err := o.fs.Open(o.name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := objfile.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &looseReader{r, f}, nil
+}
+
+type looseReader struct {
+	*objfile.Reader
+	f billy.File
+}
+
+func (r *looseReader) Close() error {
+	err := r.Reader.Close()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ctxLoader loads storers whose object reads fail once ctx is done,
+// so go-git stops listing and packing objects for a client that's gone.
+type ctxLoader struct {
+	ld  server.Loader
+	ctx context.Context
+}
+
+func (l ctxLoader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	sto, err := l.ld.Load(ep)
+	if err != nil {
+		return nil, err
+	}
+	return ctxStorer{sto, l.ctx}, nil
+}
+
+// ctxStorer fails object reads with ctx's error once it's done.
+// The objects it returns fail to open too,
+// as the pack encoder reopens them while searching for deltas.
+type ctxStorer struct {
+	storer.Storer
+	ctx context.Context
+}
+
+func (s ctxStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	obj, err := s.Storer.EncodedObject(t, h)
+	if err != nil {
+		return nil, err
+	}
+	return ctxObject{obj, s.ctx}, nil
+}
+
+// DeltaObject lets the pack encoder reuse stored deltas, as it does for the storer.
+func (s ctxStorer) DeltaObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	d, ok := s.Storer.(storer.DeltaObjectStorer)
+	if !ok {
+		return s.EncodedObject(t, h)
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	obj, err := d.DeltaObject(t, h)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := obj.(plumbing.DeltaObject); ok {
+		// the encoder checks for plumbing.DeltaObject to reuse it
+		return obj, nil
+	}
+	return ctxObject{obj, s.ctx}, nil
+}
+
+type ctxObject struct {
+	plumbing.EncodedObject
+	ctx context.Context
+}
+
+func (o ctxObject) Reader() (io.ReadCloser, error) {
+	if err := o.ctx.Err(); err != nil {
+		return nil, err
+	}
+	return o.EncodedObject.Reader()
+}
+
+// uploadPackSession starts a go-git upload-pack session that stops once ctx is done.
+func (h *httpHandler) uploadPackSession(ctx context.Context, ep *transport.Endpoint) (transport.UploadPackSession, error) {
+	return server.NewServer(ctxLoader{h.ld, ctx}).NewUploadPackSession(ep, nil)
+}
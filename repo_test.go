@@ -0,0 +1,300 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+)
+
+func TestCheckRepoName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"repo.git", true},
+		{"org/repo.git", true},
+		{"", true},
+		{"repo..git", true},
+		{"..", false},
+		{"../repo.git", false},
+		{"org/../../repo.git", false},
+		{"org/..", false},
+		{"/etc", false},
+		{"/repo.git", false},
+		{"repo\x00.git", false},
+	}
+	for _, tt := range tests {
+		err := checkRepoName(tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("checkRepoName(%q): %v", tt.name, err)
+		} else if !tt.ok && !errors.Is(err, errInvalidRepoPath) {
+			t.Errorf("checkRepoName(%q): %v, want %v", tt.name, err, errInvalidRepoPath)
+		}
+	}
+}
+
+func TestResolveRepoPath(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	fsys := osfs.New(dir)
+	tests := []struct {
+		name string
+		repo string
+		err  error
+	}{
+		{"repo.git", "repo.git", nil},
+		{"repo", "repo.git", nil},
+		{"repo.git/", "repo.git", nil},
+		{"./repo.git", "repo.git", nil},
+		{"missing.git", "", errRepoNotFound},
+		{"../repo.git", "", errInvalidRepoPath},
+		{"repo.git/../../etc", "", errInvalidRepoPath},
+		{"/repo.git", "", errInvalidRepoPath},
+		{filepath.Join(dir, "repo.git"), "", errInvalidRepoPath},
+	}
+	for _, tt := range tests {
+		repo, err := resolveRepoPath(fsys, nil, tt.name, false)
+		if !errors.Is(err, tt.err) || repo != tt.repo {
+			t.Errorf("resolveRepoPath(%q) = %q, %v, want %q, %v", tt.name, repo, err, tt.repo, tt.err)
+		}
+	}
+}
+
+// TestRepoPathTraversal requests a repository next to the served dir
+// with paths that escape it once decoded.
+func TestRepoPathTraversal(t *testing.T) {
+	base := newTestRepo(t, 1)
+	if err := os.Rename(filepath.Join(base, "repo.git"), filepath.Join(base, "outside.git")); err != nil {
+		t.Fatal(err)
+	}
+	served := filepath.Join(base, "served")
+	if err := os.Mkdir(served, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, served)
+
+	for _, p := range []string{
+		"/../outside.git",
+		"/%2e%2e/outside.git",
+		"/%2e%2e%2foutside.git",
+		"/..%2foutside.git",
+		"/%2E%2E%2Foutside.git",
+		"/sub/%2e%2e%2f%2e%2e%2foutside.git",
+		"/%2f" + filepath.ToSlash(filepath.Join(base, "outside.git")),
+		"//" + filepath.ToSlash(filepath.Join(base, "outside.git")),
+	} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+p+"/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest && res.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 400 or 404", p, res.StatusCode)
+		}
+	}
+}
+
+// TestRouteInvalidRepoPath routes paths the ServeMux would clean first,
+// as a handler mounted without one sees them.
+func TestRouteInvalidRepoPath(t *testing.T) {
+	h := newTestHandler(t, newTestRepo(t, 1))
+	newHandler(h)
+	for _, p := range []string{"/../repo.git/info/refs", "/org/../../repo.git/info/refs", "//etc/info/refs"} {
+		req := httptest.NewRequest(http.MethodGet, "/?service=git-upload-pack", nil)
+		req.URL.Path = p
+		rec := httptest.NewRecorder()
+		h.route(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", p, rec.Code)
+		}
+	}
+}
+
+func TestBareAndNonBareLayouts(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	runGit(t, dir, "clone", "-q", filepath.Join(dir, "repo.git"), "work")
+	// a repository's working tree copied without its .git dir
+	writeTestFile(t, filepath.Join(dir, "broken", "HEAD"), "ref: refs/heads/main\n")
+	writeTestFile(t, filepath.Join(dir, "plain", "README"), "not a repository\n")
+
+	fsys := osfs.New(dir)
+	tests := []struct {
+		name string
+		repo string
+		err  error
+	}{
+		{"repo.git", "repo.git", nil},
+		{"work", "work/.git", nil},
+		{"work.git", "work/.git", nil},
+		{"work/.git", "work/.git", nil},
+		{"broken", "", errNotBareRepo},
+		{"plain", "", errRepoNotFound},
+	}
+	for _, tt := range tests {
+		repo, err := resolveRepoPath(fsys, nil, tt.name, false)
+		if !errors.Is(err, tt.err) || repo != tt.repo {
+			t.Errorf("resolveRepoPath(%q) = %q, %v, want %q, %v", tt.name, repo, err, tt.repo, tt.err)
+		}
+	}
+
+	srv := newTestServer(t, dir)
+	runGit(t, t.TempDir(), "clone", "-q", srv.URL+"/repo.git", "bare")
+	runGit(t, t.TempDir(), "clone", "-q", srv.URL+"/work", "work")
+	res, err := http.Get(srv.URL + "/broken/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNotFound || !strings.Contains(string(body), errNotBareRepo.Error()) {
+		t.Errorf("non-bare directory: status %d, %q, want 404 and %q", res.StatusCode, body, errNotBareRepo)
+	}
+}
+
+// copyToFilesystem copies the files and directories under src into fsys.
+func copyToFilesystem(t *testing.T, src string, fsys billy.Filesystem) {
+	t.Helper()
+	err := filepath.Walk(src, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, name)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			// git leaves directories such as refs/heads empty
+			return fsys.MkdirAll(filepath.ToSlash(rel), fi.Mode().Perm())
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		return util.WriteFile(fsys, filepath.ToSlash(rel), b, fi.Mode())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemfsRepository(t *testing.T) {
+	dir := newTestRepo(t, 2)
+	mem := memfs.New()
+	copyToFilesystem(t, dir, mem)
+	// nothing is read from disk
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, "/", WithFilesystem(mem))
+
+	out := filepath.Join(t.TempDir(), "out")
+	runGit(t, t.TempDir(), "clone", "-q", srv.URL+"/repo.git", out)
+	if n := strings.TrimSpace(runGit(t, out, "rev-list", "--count", "HEAD")); n != "2" {
+		t.Errorf("cloned %s commits, want 2", n)
+	}
+	runGit(t, t.TempDir(), "-c", "protocol.version=0", "clone", "-q", srv.URL+"/repo.git", "v0")
+
+	res, err := http.Get(srv.URL + "/missing.git/info/refs?service=git-upload-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("missing repository: status %d, want 404", res.StatusCode)
+	}
+}
+
+func TestMemfsRefusesPush(t *testing.T) {
+	cfg := newConfig([]Option{WithDir("/"), WithAddr("127.0.0.1:0"), WithFilesystem(memfs.New()), WithReceivePack(true)})
+	if err := cfg.validate(); err == nil {
+		t.Error("ReceivePack with a Filesystem validated")
+	}
+}
+
+// TestSHA256Repository checks sha256 repositories are refused with a 501,
+// as go-git can't read them.
+func TestSHA256Repository(t *testing.T) {
+	requireGit(t)
+	dir := t.TempDir()
+	if _, err := tryGit(t, dir, "init", "-q", "--bare", "--object-format=sha256", "sha256.git"); err != nil {
+		t.Skipf("git without sha256 support: %v", err)
+	}
+	if _, err := resolveRepoPath(osfs.New(dir), nil, "sha256.git", false); !errors.Is(err, errUnsupportedObjectFormat) {
+		t.Errorf("resolveRepoPath: %v, want %v", err, errUnsupportedObjectFormat)
+	}
+
+	srv := newTestServer(t, dir)
+	for _, p := range []string{"/sha256.git/info/refs?service=git-upload-pack", "/sha256.git/info/refs?service=git-receive-pack"} {
+		res, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotImplemented || !strings.Contains(string(body), "sha256") {
+			t.Errorf("GET %s: status %d, %q, want 501 naming sha256", p, res.StatusCode, body)
+		}
+	}
+	if _, err := tryGit(t, t.TempDir(), "clone", "-q", srv.URL+"/sha256.git", "out"); err == nil {
+		t.Error("cloned a sha256 repository")
+	}
+}
+
+func TestExperimentalSHA256(t *testing.T) {
+	requireGit(t)
+	dir := t.TempDir()
+	if _, err := tryGit(t, dir, "init", "-q", "--bare", "--object-format=sha256", "sha256.git"); err != nil {
+		t.Skipf("git without sha256 support: %v", err)
+	}
+	if _, err := resolveRepoPath(osfs.New(dir), nil, "sha256.git", true); err != nil {
+		t.Errorf("resolveRepoPath: %v", err)
+	}
+
+	srv := newTestServer(t, dir, WithExperimentalSHA256(true))
+	for _, protocol := range []string{"", "version=2"} {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/sha256.git/info/refs?service=git-upload-pack", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if protocol != "" {
+			req.Header.Set("Git-Protocol", protocol)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || !strings.Contains(string(body), "object-format=sha256") {
+			t.Errorf("%q advertisement: status %d, %q, want object-format=sha256", protocol, res.StatusCode, body)
+		}
+	}
+
+	var b bytes.Buffer
+	e := pktline.NewEncoder(&b)
+	e.Encodef("command=ls-refs\n")
+	e.Encodef("object-format=sha1\n")
+	b.WriteString("0001")
+	e.Flush()
+	if _, body := postUploadPack(t, srv.URL+"/sha256.git", "version=2", &b); !strings.Contains(body, "the repository uses sha256") {
+		t.Errorf("sha1 ls-refs of a sha256 repository: %q, want it refused", body)
+	}
+}
@@ -0,0 +1,259 @@
+package gitreposerver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+)
+
+// repoSettings are the overrides a repository sets
+// in the gitreposerver section of its own git config.
+type repoSettings struct {
+	// services maps uploadpack and receivepack to whether they're enabled,
+	// those not set are left to the server.
+	services map[string]bool
+	// hiddenRefs follow the server's HiddenRefs,
+	// so a ! prefix can show a ref the server hides.
+	hiddenRefs []string
+	// defaultBranch replaces the server's DefaultBranch if set.
+	defaultBranch string
+	// quotaBytes replaces the server's RepoQuotaBytes, -1 if not set.
+	quotaBytes int64
+	// objectFormat is the hash naming the repository's objects,
+	// from extensions.objectFormat rather than the gitreposerver section.
+	objectFormat string
+	// ignored describes the entries of a settings file that were skipped,
+	// logged once it's in use.
+	ignored []string
+}
+
+var noRepoSettings = repoSettings{quotaBytes: -1}
+
+// repoConfigs caches the settings of each repository,
+// read again when its config file changes.
+type repoConfigs struct {
+	mu      sync.Mutex
+	entries map[string]repoConfigEntry
+}
+
+type repoConfigEntry struct {
+	modTime  time.Time
+	size     int64
+	settings repoSettings
+}
+
+func newRepoConfigs() *repoConfigs {
+	return &repoConfigs{entries: make(map[string]repoConfigEntry)}
+}
+
+// repoSettings returns the settings of repo.
+// A config that can't be read gets the server's settings,
+// invalid entries in it are logged and ignored.
+func (h *httpHandler) repoSettings(ctx context.Context, repo string) repoSettings {
+	fi, err := h.fs.Stat(path.Join("/", repo, "config"))
+	if err != nil {
+		h.logger(ctx).Warn("read repository config", "repo", repo, "err", err)
+		return noRepoSettings
+	}
+	c := h.repoConfigs
+	c.mu.Lock()
+	e, ok := c.entries[repo]
+	c.mu.Unlock()
+	if ok && e.modTime.Equal(fi.ModTime()) && e.size == fi.Size() {
+		return e.settings
+	}
+
+	settings := noRepoSettings
+	cfg, err := readRepoConfig(h.fs, repo)
+	if err != nil {
+		h.logger(ctx).Warn("read repository config", "repo", repo, "err", err)
+	} else {
+		sec := cfg.Section("gitreposerver")
+		var invalid []string
+		settings, invalid = parseRepoSettings(sec.Options.Get, sec.Options.GetAll)
+		for _, msg := range invalid {
+			h.logger(ctx).Warn("ignored invalid repository config", "repo", repo, "err", msg)
+		}
+		settings.objectFormat = configObjectFormat(cfg)
+	}
+	c.mu.Lock()
+	c.entries[repo] = repoConfigEntry{modTime: fi.ModTime(), size: fi.Size(), settings: settings}
+	c.mu.Unlock()
+	return settings
+}
+
+// restartOnlySettings are flags, without dashes, that a settings file may
+// mistake for settings: they only change on restart, so they're skipped.
+var restartOnlySettings = map[string]bool{
+	"listen": true, "addr": true, "httpaddr": true, "sshaddr": true, "daemonaddr": true,
+	"dir": true, "gitdir": true, "pathprefix": true, "reporoots": true,
+	"tlscert": true, "tlskey": true, "sshhostkey": true, "sshauthorizedkeys": true,
+	"authfile": true, "tokenfile": true, "settingsfile": true, "hooksdir": true, "loglevel": true,
+}
+
+// readSettingsFile reads the gitreposerver section of the git config file name,
+// refusing invalid entries, as a repository's config would ignore them.
+// Settings that only change on restart and unknown keys are skipped,
+// recorded in the settings' ignored for the handler to log.
+func readSettingsFile(name string) (repoSettings, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return noRepoSettings, err
+	}
+	defer f.Close()
+	cfg := config.New()
+	if err := config.NewDecoder(f).Decode(cfg); err != nil {
+		return noRepoSettings, fmt.Errorf("read settings file %s: %w", name, err)
+	}
+	sec := cfg.Section("gitreposerver")
+	settings, invalid := parseRepoSettings(sec.Options.Get, sec.Options.GetAll)
+	if len(invalid) > 0 {
+		return noRepoSettings, fmt.Errorf("settings file %s: %s", name, strings.Join(invalid, "; "))
+	}
+	for _, o := range sec.Options {
+		switch key := strings.ToLower(o.Key); {
+		case key == "uploadpack", key == "receivepack", key == "hiderefs", key == "defaultbranch", key == "quota":
+		case restartOnlySettings[strings.ReplaceAll(key, "-", "")]:
+			settings.ignored = append(settings.ignored, fmt.Sprintf("gitreposerver.%s only changes on restart", o.Key))
+		default:
+			settings.ignored = append(settings.ignored, fmt.Sprintf("gitreposerver.%s is not a setting", o.Key))
+		}
+	}
+	return settings, nil
+}
+
+// serverSettings returns the settings of the Config's SettingsFile as last loaded,
+// logging the entries it skipped the first time they're used.
+func (h *httpHandler) serverSettings() repoSettings {
+	if h.cfg.Settings.reloadable == nil {
+		return noRepoSettings
+	}
+	settings := h.cfg.Settings.v.Load()
+	if len(settings.ignored) > 0 && h.settingsLogged.Swap(settings) != settings {
+		for _, msg := range settings.ignored {
+			h.log.Warn("ignored settings file entry", "file", h.cfg.Settings.name, "err", msg)
+		}
+	}
+	return *settings
+}
+
+// advertisementFingerprint is the refsFingerprint of repo, adding the hidden refs
+// and default branch of the settings file, which change the advertisement
+// without touching the repository.
+func (h *httpHandler) advertisementFingerprint(repo string) (string, time.Time, error) {
+	fingerprint, modTime, err := refsFingerprint(h.fs, repo)
+	if settings := h.serverSettings(); len(settings.hiddenRefs) > 0 || settings.defaultBranch != "" {
+		sum := sha256.Sum256([]byte(fingerprint + "\x00" + strings.Join(settings.hiddenRefs, "\x00") + "\x00" + settings.defaultBranch))
+		fingerprint = hex.EncodeToString(sum[:])
+	}
+	return fingerprint, modTime, err
+}
+
+// parseRepoSettings parses the gitreposerver options given by get and getAll,
+// returning what's wrong with those it ignored.
+func parseRepoSettings(get func(string) string, getAll func(string) []string) (repoSettings, []string) {
+	settings := noRepoSettings
+	var invalid []string
+	for _, key := range []string{"uploadpack", "receivepack"} {
+		values := getAll(key)
+		if len(values) == 0 {
+			continue
+		}
+		enabled, ok := parseGitBool(values[len(values)-1])
+		if !ok {
+			invalid = append(invalid, fmt.Sprintf("gitreposerver.%s %q is not a boolean", key, values[len(values)-1]))
+			continue
+		}
+		if settings.services == nil {
+			settings.services = make(map[string]bool)
+		}
+		settings.services[key] = enabled
+	}
+	for _, prefix := range getAll("hiderefs") {
+		if !strings.HasPrefix(strings.TrimPrefix(prefix, "!"), "refs/") {
+			invalid = append(invalid, fmt.Sprintf("gitreposerver.hiderefs %q is not under refs/", prefix))
+			continue
+		}
+		settings.hiddenRefs = append(settings.hiddenRefs, prefix)
+	}
+	if branch := get("defaultbranch"); branch != "" {
+		if !validRefName(plumbing.NewBranchReferenceName(branch).String()) {
+			invalid = append(invalid, fmt.Sprintf("gitreposerver.defaultbranch %q is not a branch name", branch))
+		} else {
+			settings.defaultBranch = branch
+		}
+	}
+	if quota := get("quota"); quota != "" {
+		n, err := parseFilterSize(quota)
+		if err != nil {
+			invalid = append(invalid, fmt.Sprintf("gitreposerver.quota %q is not a size", quota))
+		} else {
+			settings.quotaBytes = n
+		}
+	}
+	return settings, invalid
+}
+
+// checkService returns errServiceDisabled if repo turns off service,
+// git-upload-pack or git-receive-pack.
+// Services the server doesn't serve can't be turned on.
+func (h *httpHandler) checkService(ctx context.Context, repo, service string) error {
+	key := strings.ReplaceAll(strings.TrimPrefix(service, "git-"), "-", "")
+	for _, settings := range []repoSettings{h.repoSettings(ctx, repo), h.serverSettings()} {
+		if enabled, ok := settings.services[key]; ok {
+			if !enabled {
+				return fmt.Errorf("%s is %w", service, errServiceDisabled)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// hiddenRefs returns the ref prefixes hidden in repo.
+func (h *httpHandler) hiddenRefs(ctx context.Context, repo string) []string {
+	server, extra := h.serverSettings().hiddenRefs, h.repoSettings(ctx, repo).hiddenRefs
+	if len(server) == 0 && len(extra) == 0 {
+		return h.cfg.HiddenRefs
+	}
+	return append(append(append([]string(nil), h.cfg.HiddenRefs...), server...), extra...)
+}
+
+// defaultBranch returns the branch advertised for repo's detached HEAD.
+func (h *httpHandler) defaultBranch(ctx context.Context, repo string) string {
+	if branch := h.repoSettings(ctx, repo).defaultBranch; branch != "" {
+		return branch
+	}
+	if branch := h.serverSettings().defaultBranch; branch != "" {
+		return branch
+	}
+	return h.cfg.DefaultBranch
+}
+
+// objectFormat returns the hash naming repo's objects, such as sha1 or sha256.
+func (h *httpHandler) objectFormat(ctx context.Context, repo string) string {
+	if format := h.repoSettings(ctx, repo).objectFormat; format != "" {
+		return format
+	}
+	return "sha1"
+}
+
+// repoQuota returns the limit on the size of repo's objects, 0 for none.
+func (h *httpHandler) repoQuota(ctx context.Context, repo string) int64 {
+	if quota := h.repoSettings(ctx, repo).quotaBytes; quota >= 0 {
+		return quota
+	}
+	if quota := h.serverSettings().quotaBytes; quota >= 0 {
+		return quota
+	}
+	return h.cfg.RepoQuotaBytes
+}
@@ -0,0 +1,145 @@
+package gitreposerver
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// repoInfo describes a repository in the /repos listing.
+type repoInfo struct {
+	Name          string    `json:"name"`
+	LastModified  time.Time `json:"last_modified"`
+	DefaultBranch string    `json:"default_branch,omitempty"`
+	// LastFetch and LastPush are set if the server has seen any.
+	LastFetch *time.Time `json:"last_fetch,omitempty"`
+	LastPush  *time.Time `json:"last_push,omitempty"`
+}
+
+// repoList is a page of the /repos listing.
+type repoList struct {
+	Repos []repoInfo `json:"repos"`
+	// Next is the after value for the next page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// listRepos serves a JSON listing of the repositories under dir,
+// in pages of ?limit= repositories starting after the ?after= name.
+func (h *httpHandler) listRepos(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.cfg.authEnabled() && !h.cfg.AnonymousRead {
+		// Authenticators see an empty repo for the listing.
+		var ok bool
+		r, ok = h.checkAuth(rw, r, "", false)
+		if !ok {
+			return
+		}
+	}
+
+	limit, err := listLimit(r)
+	if err != nil {
+		h.httpError(rw, r, err)
+		return
+	}
+	after := r.URL.Query().Get("after")
+
+	var repos []string
+	identity := IdentityFromContext(r.Context())
+	err = walkRepos(h.fs, h.roots, func(repo string) error {
+		ok, err := h.allowed(identity, repo, OpRead)
+		if ok {
+			repos = append(repos, repo)
+		}
+		return err
+	})
+	if err != nil {
+		h.logger(r.Context()).Error("list repositories", "err", err)
+		h.httpError(rw, r, err)
+		return
+	}
+	// walk order isn't lexical across directories
+	sort.Strings(repos)
+	start := sort.SearchStrings(repos, after)
+	if start < len(repos) && repos[start] == after {
+		start++
+	}
+	repos = repos[start:]
+
+	list := repoList{Repos: []repoInfo{}}
+	if len(repos) > limit {
+		repos = repos[:limit]
+		list.Next = repos[limit-1]
+	}
+	for _, repo := range repos {
+		info, err := h.repoInfo(repo)
+		if err != nil {
+			h.logger(r.Context()).Error("describe repository", "repo", repo, "err", err)
+			h.httpError(rw, r, err)
+			return
+		}
+		list.Repos = append(list.Repos, info)
+	}
+
+	rw.Header().Set("content-type", "application/json")
+	setNoCache(rw.Header())
+	json.NewEncoder(rw).Encode(list)
+}
+
+// listLimit returns the page size of a listing from ?limit=.
+func listLimit(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return defaultListLimit, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, requestErrorf("invalid limit %q", v)
+	}
+	if n > maxListLimit {
+		n = maxListLimit
+	}
+	return n, nil
+}
+
+// repoInfo describes repo, a path in h.fs.
+func (h *httpHandler) repoInfo(repo string) (repoInfo, error) {
+	info := repoInfo{Name: repo}
+	err := statRefs(h.fs, repo, func(name string, fi fs.FileInfo) {
+		if fi.ModTime().After(info.LastModified) {
+			info.LastModified = fi.ModTime()
+		}
+	})
+	if err != nil {
+		return info, err
+	}
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		return info, err
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		return info, err
+	}
+	head, err := sto.Reference(plumbing.HEAD)
+	if err == nil && head.Type() == plumbing.SymbolicReference {
+		info.DefaultBranch = head.Target().Short()
+	}
+	info.LastFetch, info.LastPush = h.cfg.Activity.get(repo).times()
+	return info, nil
+}
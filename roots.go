@@ -0,0 +1,107 @@
+package gitreposerver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errRepoOutsideRoots is returned for repositories that symlinks
+// resolve to outside Dir and RepoRoots.
+// Clients are told the repository wasn't found.
+var errRepoOutsideRoots = errors.New("repository is outside the permitted roots")
+
+// repoRoots are the real paths repositories may resolve to,
+// after following any symlinks in Dir.
+// A nil repoRoots permits anything, for a Filesystem that isn't the OS's.
+type repoRoots struct {
+	base  string
+	roots []string
+}
+
+// newRepoRoots returns the roots of cfg, nil if it serves a Filesystem.
+func newRepoRoots(cfg Config) *repoRoots {
+	if cfg.Filesystem != nil {
+		return nil
+	}
+	r := &repoRoots{base: realPath(cfg.Dir)}
+	r.roots = append(r.roots, r.base)
+	for _, root := range cfg.RepoRoots {
+		r.roots = append(r.roots, realPath(root))
+	}
+	return r
+}
+
+// realPath returns the absolute path of name with symlinks resolved,
+// or as far as it can be resolved.
+func realPath(name string) string {
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		name = real
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		name = abs
+	}
+	return name
+}
+
+// check returns errRepoOutsideRoots if the repository at repo,
+// a slash separated path in Dir, resolves to outside every root,
+// or its objects, refs or hooks do: a symlinked hooks dir would run
+// programs from anywhere, symlinked objects or refs expose another repository.
+func (r *repoRoots) check(repo string) error {
+	if r == nil {
+		return nil
+	}
+	dir := filepath.Join(r.base, filepath.FromSlash(repo))
+	if err := r.checkPath(repo, dir); err != nil {
+		return err
+	}
+	for _, name := range []string{"objects", "refs", "hooks"} {
+		err := r.checkPath(path.Join(repo, name), filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			// hooks is optional, the others were checked by isRepo
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkPath returns errRepoOutsideRoots if name,
+// the file of the slash separated path p in Dir, resolves to outside every root.
+func (r *repoRoots) checkPath(p, name string) error {
+	real, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return fmt.Errorf("resolve repository %s: %w", p, err)
+	}
+	for _, root := range r.roots {
+		if within(root, real) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is in %s", errRepoOutsideRoots, p, real)
+}
+
+// within reports whether name is root or inside it.
+func within(root, name string) bool {
+	rel, err := filepath.Rel(root, name)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkRepoRoots checks that each of roots is a directory.
+func checkRepoRoots(roots []string) error {
+	for _, root := range roots {
+		fi, err := os.Stat(root)
+		if err != nil {
+			return fmt.Errorf("config: repository root: %w", err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("config: repository root %s is not a directory", root)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package gitreposerver
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepoRootsSymlinks(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	outside := newTestRepo(t, 1)
+	symlink := func(t *testing.T, target, name string) {
+		t.Helper()
+		if err := os.RemoveAll(name); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, name); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+	// a copy of repo.git with one of its dirs replaced by a symlink to target
+	copies := 0
+	linkedRepo := func(t *testing.T, name, target string) string {
+		t.Helper()
+		copies++
+		repo := fmt.Sprintf("copy%d.git", copies)
+		runGit(t, dir, "clone", "-q", "--bare", "repo.git", repo)
+		if err := os.MkdirAll(filepath.Join(dir, repo, "hooks"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		symlink(t, target, filepath.Join(dir, repo, name))
+		return repo
+	}
+
+	tests := []struct {
+		name  string
+		repo  func(t *testing.T) string
+		roots []string
+		ok    bool
+	}{
+		{"plain", func(t *testing.T) string { return "repo.git" }, nil, true},
+		{"repo outside", func(t *testing.T) string {
+			symlink(t, filepath.Join(outside, "repo.git"), filepath.Join(dir, "linked.git"))
+			return "linked.git"
+		}, nil, false},
+		{"repo in roots", func(t *testing.T) string {
+			symlink(t, filepath.Join(outside, "repo.git"), filepath.Join(dir, "linked.git"))
+			return "linked.git"
+		}, []string{outside}, true},
+		{"objects outside", func(t *testing.T) string {
+			return linkedRepo(t, "objects", filepath.Join(outside, "repo.git", "objects"))
+		}, nil, false},
+		{"refs outside", func(t *testing.T) string {
+			return linkedRepo(t, "refs", filepath.Join(outside, "repo.git", "refs"))
+		}, nil, false},
+		{"hooks outside", func(t *testing.T) string {
+			return linkedRepo(t, "hooks", t.TempDir())
+		}, nil, false},
+		{"hooks inside", func(t *testing.T) string {
+			return linkedRepo(t, "hooks", filepath.Join(dir, "repo.git", "hooks"))
+		}, nil, true},
+		{"objects in roots", func(t *testing.T) string {
+			return linkedRepo(t, "objects", filepath.Join(outside, "repo.git", "objects"))
+		}, []string{outside}, true},
+		{"no hooks", func(t *testing.T) string {
+			repo := linkedRepo(t, "hooks", filepath.Join(dir, "repo.git", "hooks"))
+			if err := os.Remove(filepath.Join(dir, repo, "hooks")); err != nil {
+				t.Fatal(err)
+			}
+			return repo
+		}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := tt.repo(t)
+			roots := newRepoRoots(Config{Dir: dir, RepoRoots: tt.roots})
+			err := roots.check(repo)
+			if tt.ok && err != nil {
+				t.Errorf("check %s: %v", repo, err)
+			} else if !tt.ok && !errors.Is(err, errRepoOutsideRoots) {
+				t.Errorf("check %s: %v, want %v", repo, err, errRepoOutsideRoots)
+			}
+		})
+	}
+}
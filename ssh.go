@@ -1,38 +1,92 @@
-package main
+package gitreposerver
 
 import (
+	"bufio"
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/anmitsu/go-shlex"
-	"github.com/go-git/go-billy/v5/osfs"
-	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
 	"github.com/go-git/go-git/v5/plumbing/transport"
-	"github.com/go-git/go-git/v5/plumbing/transport/server"
 	"golang.org/x/crypto/ssh"
 )
 
-func runSSH(dir, addr string) error {
-	config := &ssh.ServerConfig{
-		NoClientAuth: true,
+// errAnonymousPush is returned for ssh pushes to a server accepting any client.
+var errAnonymousPush = errors.New("git-receive-pack over ssh requires authenticated clients")
+
+// PublicKeyCallback authenticates an ssh client by its public key,
+// returning the client's identity and whether the key is accepted.
+type PublicKeyCallback func(user string, key ssh.PublicKey) (identity string, ok bool)
+
+// RunSSH serves git over ssh on addr.
+func RunSSH(dir, addr string, hostKey ssh.Signer, auth PublicKeyCallback, opts ...Option) error {
+	return RunSSHContext(context.Background(), dir, addr, hostKey, auth, opts...)
+}
+
+// RunSSHContext serves git over ssh on addr until ctx is cancelled.
+// hostKey identifies the server, nil generates a key for this run.
+// auth authenticates clients, nil accepts any client but only for fetches.
+// Clients run git-upload-pack or git-receive-pack
+// with a repository path relative to dir.
+func RunSSHContext(ctx context.Context, dir, addr string, hostKey ssh.Signer, auth PublicKeyCallback, opts ...Option) error {
+	cfg := newConfig(opts)
+	logger := cfg.logger()
+	h := newHTTPHandler(dir, cfg)
+	// sessions still running once this returns drop their events
+	defer h.events.close()
+
+	config := &ssh.ServerConfig{}
+	if auth == nil {
+		config.NoClientAuth = true
+		if cfg.pushEnabled() {
+			logger.Warn("no ssh client authentication, refusing pushes over ssh")
+		}
+	} else {
+		config.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			identity, ok := auth(conn.User(), key)
+			if !ok {
+				return nil, fmt.Errorf("public key %s not accepted", ssh.FingerprintSHA256(key))
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"identity": identity}}, nil
+		}
 	}
-	_, edSigner, _ := ed25519.GenerateKey(rand.Reader)
-	sshSigner, _ := ssh.NewSignerFromSigner(edSigner)
-	config.AddHostKey(sshSigner)
+	if hostKey == nil {
+		logger.Warn("no ssh host key, generating one for this run")
+		_, edSigner, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("generate ssh host key: %w", err)
+		}
+		hostKey, err = ssh.NewSignerFromSigner(edSigner)
+		if err != nil {
+			return fmt.Errorf("generate ssh host key: %w", err)
+		}
+	}
+	config.AddHostKey(hostKey)
 
-	log.Println("starting ssh server on", addr)
+	logger.Info("starting ssh server", "dir", dir, "addr", addr)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 	defer lis.Close()
+	go func() {
+		<-ctx.Done()
+		lis.Close()
+	}()
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				logger.Info("ssh server stopped")
+				return nil
+			}
 			return err
 		}
 
@@ -41,127 +95,245 @@ func runSSH(dir, addr string) error {
 
 			sshConn, chanc, reqc, err := ssh.NewServerConn(conn, config)
 			if err != nil {
-				log.Println(err)
+				logger.Warn("ssh handshake", "remote", conn.RemoteAddr(), "err", err)
+				var authErr *ssh.ServerAuthError
+				if errors.As(err, &authErr) {
+					h.audit.authFailed("", "ssh", remoteHost(conn.RemoteAddr()), "", "")
+				}
 				return
 			}
 			defer sshConn.Close()
+			var identity string
+			if sshConn.Permissions != nil {
+				identity = sshConn.Permissions.Extensions["identity"]
+			}
 			go ssh.DiscardRequests(reqc)
 			for chanr := range chanc {
-				switch chanr.ChannelType() {
-				case "session":
-					ch, reqc, err := chanr.Accept()
-					if err != nil {
-						log.Println(err)
-						return
-					}
-					handleSSHSession(dir, ch, reqc)
+				if chanr.ChannelType() != "session" {
+					chanr.Reject(ssh.UnknownChannelType, "unknown channel type")
+					continue
+				}
+				ch, reqc, err := chanr.Accept()
+				if err != nil {
+					logger.Error("accept ssh channel", "remote", conn.RemoteAddr(), "err", err)
+					return
+				}
+				sess := &sshSession{
+					h:         h,
+					ch:        ch,
+					identity:  identity,
+					anonymous: auth == nil,
+					remote:    conn.RemoteAddr(),
 				}
+				sess.serve(ctx, reqc)
 			}
 		}(conn)
 	}
 }
 
-func handleSSHSession(dir string, ch ssh.Channel, reqc <-chan *ssh.Request) {
-	defer ch.Close()
+// sshSession is a session channel running a single git command.
+type sshSession struct {
+	h        *httpHandler
+	ch       ssh.Channel
+	identity string
+	// anonymous is set when the server doesn't authenticate clients.
+	anonymous bool
+	remote    net.Addr
+	env       map[string]string
+}
+
+func (s *sshSession) serve(ctx context.Context, reqc <-chan *ssh.Request) {
+	defer s.ch.Close()
 
 	var exitCode uint32
 	defer func() {
 		b := ssh.Marshal(struct{ Value uint32 }{exitCode})
-		ch.SendRequest("exit-status", false, b)
+		s.ch.SendRequest("exit-status", false, b)
 	}()
 
-	envs := make(map[string]string)
+	s.env = make(map[string]string)
 	for req := range reqc {
 		switch req.Type {
 		case "env":
 			payload := struct{ Key, Value string }{}
 			ssh.Unmarshal(req.Payload, &payload)
-			envs[payload.Key] = payload.Value
+			s.env[payload.Key] = payload.Value
 			req.Reply(true, nil)
 
 		case "exec":
 			payload := struct{ Value string }{}
 			ssh.Unmarshal(req.Payload, &payload)
-			args, err := shlex.Split(payload.Value, true)
-			if err != nil {
-				log.Println("lex args", err)
-				exitCode = 1
-				return
-			}
-
-			cmd := args[0]
-			switch cmd {
-			case "git-upload-pack": // read
-				if gp := envs["GIT_PROTOCOL"]; gp != "version=2" {
-					log.Println("unhandled GIT_PROTOCOL", gp)
-					exitCode = 1
-					return
-				}
-
-				// TODO: get directory from args[1]
-
-				err := handleUploadPack(dir, ch)
-				if err != nil {
-					log.Println(err)
-					exitCode = 1
-					return
-				}
-
-				req.Reply(true, nil)
-				return
-
-			default:
-				req.Reply(false, nil)
-				exitCode = 1
-				return
+			req.Reply(true, nil)
+			if err := s.exec(ctx, payload.Value); err != nil {
+				exitCode = 128
 			}
+			return
 
 		default:
 			req.Reply(false, nil)
-			exitCode = 1
-			return
 		}
 	}
 }
 
-func handleUploadPack(dir string, ch ssh.Channel) error {
-	ctx := context.Background()
-
-	ep, err := transport.NewEndpoint("/")
+// exec runs command, reporting errors on the channel's stderr.
+func (s *sshSession) exec(ctx context.Context, command string) error {
+	start := time.Now()
+	info := &requestInfo{identity: s.identity}
+	service, repo, err := s.run(withRequestInfo(ctx, info), command)
+	keyvals := []any{
+		"service", service, "repo", repo, "identity", s.identity,
+		"remote", s.remote, "duration", time.Since(start),
+	}
+	keyvals = append(keyvals, info.packKeyvals()...)
 	if err != nil {
-		return fmt.Errorf("create transport endpoint: %w", err)
+		code, msg := classifyError(err)
+		if code == http.StatusInternalServerError && !s.h.cfg.VerboseErrors {
+			msg = "internal server error"
+		}
+		fmt.Fprintf(s.ch.Stderr(), "fatal: %s\n", msg)
+		keyvals = append(keyvals, "err", err)
+	}
+	s.h.log.Info("ssh request", keyvals...)
+	if service == "git-upload-pack" || service == "git-receive-pack" {
+		info.repo = repo
+		failure := info.failure
+		if err != nil {
+			code, _ := classifyError(err)
+			failure = errorKind(code)
+		}
+		s.h.audit.operation(info, "ssh", remoteHost(s.remote), service == "git-receive-pack", failure)
 	}
-	bfs := osfs.New(dir)
-	ld := server.NewFilesystemLoader(bfs)
-	svr := server.NewServer(ld)
-	sess, err := svr.NewUploadPackSession(ep, nil)
+	return err
+}
+
+func (s *sshSession) run(ctx context.Context, command string) (service, repo string, err error) {
+	defer func() {
+		if perr := s.h.recoverPanic(ctx, recover()); perr != nil {
+			err = perr
+		}
+	}()
+	args, err := shlex.Split(command, true)
 	if err != nil {
-		return fmt.Errorf("create upload-pack session: %w", err)
+		return "", "", requestErrorf("parse command: %v", err)
+	}
+	if len(args) == 3 && args[0] == "git" {
+		// "git upload-pack dir"
+		args = []string{"git-" + args[1], args[2]}
+	}
+	if len(args) != 2 {
+		return "", "", requestErrorf("unsupported command %q", command)
+	}
+	service = args[0]
+	write := service == "git-receive-pack"
+	version := parseProtocolVersion(s.env["GIT_PROTOCOL"])
+	switch {
+	case service == "git-upload-pack":
+	case write && s.h.cfg.ReadOnly:
+		return service, "", errReadOnly
+	case write && s.anonymous:
+		return service, "", errAnonymousPush
+	case write && s.h.cfg.pushEnabled():
+	case write:
+		return service, "", transport.ErrAuthorizationFailed
+	default:
+		return service, "", requestErrorf("unsupported command %q", service)
 	}
 
-	ar, err := sess.AdvertisedReferencesContext(ctx)
+	op := OpRead
+	if write {
+		op = OpWrite
+	}
+	name := s.h.resolveAlias(strings.Trim(args[1], "/"))
+	repo, err = resolveRepoPath(s.h.fs, s.h.roots, name, s.h.cfg.ExperimentalSHA256)
+	if errors.Is(err, errRepoNotFound) && write && name != "" && s.h.cfg.AutoInit && !s.h.isMirror(initRepoName(name)) {
+		err = s.h.authorize(ctx, s.identity, initRepoName(name), op)
+		if err == nil {
+			repo, err = initRepo(s.h.fs, s.h.roots, name)
+		}
+		if err == nil {
+			s.h.log.Info("created repository", "repo", repo, "identity", s.identity)
+		}
+	}
+	if errors.Is(err, errRepoNotFound) && !write && s.h.isMirror(initRepoName(name)) {
+		err = s.h.authorize(ctx, s.identity, initRepoName(name), op)
+		if err == nil {
+			repo, err = s.h.createMirror(ctx, name)
+		}
+	}
+	if err == nil {
+		err = s.h.authorize(ctx, s.identity, repo, op)
+	}
+	if err == nil && write && s.h.isMirror(repo) {
+		err = errMirror
+	}
+	if err == nil {
+		err = s.h.checkService(ctx, repo, service)
+	}
+	if err == nil && !write {
+		err = s.h.checkProtocolVersion(version)
+	}
 	if err != nil {
-		return fmt.Errorf("get advertised references: %w", err)
+		return service, name, err
+	}
+	if !write {
+		s.h.syncMirror(ctx, repo)
 	}
-	err = ar.Encode(ch)
+	ctx = withIdentity(withRepo(ctx, repo), s.identity)
+	ctx, cancel := s.h.boundOperation(ctx, func() { s.ch.Close() })
+	defer cancel()
+	info := requestInfoFromContext(ctx)
+	info.repo = repo
+	rw := &countingReadWriter{ReadWriter: s.ch}
+
+	switch {
+	case write:
+		err = s.receivePack(ctx, repo, rw)
+	case version == 2:
+		err = s.h.serveUploadPackV2(ctx, repo, rw)
+	default:
+		err = s.h.serveUploadPack(ctx, repo, rw)
+	}
+	if err == nil {
+		s.h.events.report(info, "ssh", remoteHost(s.remote), rw.in, rw.out)
+		s.h.cfg.Activity.record(info)
+	}
+	return service, repo, err
+}
+
+// receivePack serves a push on rw.
+func (s *sshSession) receivePack(ctx context.Context, repo string, rw io.ReadWriter) error {
+	ar, err := s.h.advertisedRefs(ctx, repo, "git-receive-pack")
 	if err != nil {
+		return err
+	}
+	if err := ar.Encode(rw); err != nil {
 		return fmt.Errorf("encode advertised references: %w", err)
 	}
 
-	upr := packp.NewUploadPackRequest()
-	err = upr.Decode(ch)
+	br := bufio.NewReader(rw)
+	if done, err := flushNext(br); done || err != nil {
+		// nothing to push
+		return err
+	}
+	upr, cert, err := decodeUpdateRequest(br)
 	if err != nil {
-		return fmt.Errorf("decode upload-pack request: %w", err)
+		return err
 	}
 
-	res, err := sess.UploadPack(ctx, upr)
-	if err != nil {
-		return fmt.Errorf("create upload-pack response: %w", err)
+	env := []string{"REMOTE_ADDR=" + remoteHost(s.remote)}
+	if s.identity != "" {
+		env = append(env, "REMOTE_USER="+s.identity)
 	}
-	err = res.Encode(ch)
-	if err != nil {
-		return fmt.Errorf("encode upload-pack response: %w", err)
+	if p := s.env["GIT_PROTOCOL"]; p != "" {
+		env = append(env, "GIT_PROTOCOL="+p)
 	}
+	return s.h.push(ctx, repo, upr, cert, rw, env)
+}
 
-	return nil
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
 }
@@ -0,0 +1,124 @@
+package gitreposerver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSSHServer serves the repositories under dir over ssh
+// until the test ends, and returns its address.
+func newTestSSHServer(t *testing.T, dir string, auth PublicKeyCallback, opts ...Option) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- RunSSHContext(ctx, dir, addr, nil, auth, append([]Option{WithLogger(testLogger{t})}, opts...)...)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("ssh server: %v", err)
+		}
+	})
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		if i == 100 {
+			t.Fatalf("ssh server not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sshConfig are the git -c options connecting to addr with the private key,
+// or without one if it's empty. It skips the test if ssh isn't installed.
+func sshConfig(t *testing.T, addr, key string) []string {
+	t.Helper()
+	if _, err := exec.LookPath("ssh"); err != nil {
+		t.Skip("ssh not installed")
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	cmd := "ssh -p " + port + " -o BatchMode=yes -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null -o IdentitiesOnly=yes"
+	if key != "" {
+		cmd += " -i " + key
+	}
+	return []string{"-c", "core.sshCommand=" + cmd}
+}
+
+// pushOverSSH clones repo.git from addr and pushes a new commit to refs/heads/pushed.
+func pushOverSSH(t *testing.T, addr, key string) (string, error) {
+	t.Helper()
+	ssh := sshConfig(t, addr, key)
+	url := fmt.Sprintf("ssh://git@%s/repo.git", addr)
+	work := t.TempDir()
+	runGit(t, work, append(ssh, "clone", "-q", url, "out")...)
+	work = filepath.Join(work, "out")
+	writeTestFile(t, filepath.Join(work, "pushed.txt"), "pushed\n")
+	runGit(t, work, "add", "-A")
+	runGit(t, work, "commit", "-q", "-m", "pushed")
+	return tryGit(t, work, append(ssh, "push", "-q", url, "HEAD:refs/heads/pushed")...)
+}
+
+func TestSSHAnonymousPushRefused(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	addr := newTestSSHServer(t, dir, nil, WithReceivePack(true))
+
+	_, err := pushOverSSH(t, addr, "")
+	if err == nil {
+		t.Fatal("anonymous push over ssh accepted")
+	}
+	if !strings.Contains(err.Error(), errAnonymousPush.Error()) {
+		t.Errorf("push error %v, want %q", err, errAnonymousPush)
+	}
+	if _, err := tryGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "--verify", "refs/heads/pushed"); err == nil {
+		t.Error("anonymous push updated refs/heads/pushed")
+	}
+}
+
+func TestSSHAuthenticatedPush(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	key := writeSSHSigningKey(t, t.TempDir())
+	keys, err := readAuthorizedKeys(key.private + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestSSHServer(t, dir, keys.PublicKey, WithReceivePack(true))
+
+	if _, err := pushOverSSH(t, addr, key.private); err != nil {
+		t.Fatalf("push with an authorized key: %v", err)
+	}
+	runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "--verify", "refs/heads/pushed")
+}
+
+func TestSSHShallowClone(t *testing.T) {
+	dir := newTestRepo(t, 10)
+	addr := newTestSSHServer(t, dir, nil)
+	ssh := sshConfig(t, addr, "")
+	out := filepath.Join(t.TempDir(), "out")
+
+	runGit(t, t.TempDir(), append(ssh, "-c", "protocol.version=0", "clone", "-q", "--depth=1", fmt.Sprintf("ssh://git@%s/repo.git", addr), out)...)
+	if n := commitCount(t, out, "HEAD"); n != "1" {
+		t.Errorf("depth 1 clone has %s commits, want 1", n)
+	}
+	runGit(t, out, append(ssh, "-c", "protocol.version=0", "fetch", "-q", "--depth=3")...)
+	if n := commitCount(t, out, "HEAD"); n != "3" {
+		t.Errorf("deepened clone has %s commits, want 3", n)
+	}
+	runGit(t, out, "fsck", "--no-progress")
+}
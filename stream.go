@@ -0,0 +1,221 @@
+package gitreposerver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// serveUploadPack serves a protocol v0 fetch on a bidirectional stream,
+// as used by ssh and the git daemon.
+func (h *httpHandler) serveUploadPack(ctx context.Context, repo string, rw io.ReadWriter) error {
+	ctx, rw, cancel := cancelOnWriteError(ctx, rw)
+	defer cancel()
+	ar, err := h.advertisedRefs(ctx, repo, "git-upload-pack")
+	if err != nil {
+		return err
+	}
+	if err := ar.Encode(rw); err != nil {
+		return fmt.Errorf("encode advertised references: %w", err)
+	}
+
+	br := bufio.NewReader(rw)
+	if done, err := flushNext(br); done || err != nil {
+		// the client only wanted the refs
+		return err
+	}
+	upr := packp.NewUploadPackRequest()
+	if err := upr.Decode(br); err != nil {
+		return fmt.Errorf("%w: %v", errMalformedRequest, err)
+	}
+	// the caller logs the error with the client's address
+	if err := checkWants(upr.Wants, h.cfg.MaxWants); err != nil {
+		return err
+	}
+	if !h.cfg.AllowAnySHA1InWant {
+		if err := checkAdvertisedWants(ar, upr.Wants); err != nil {
+			return err
+		}
+	}
+
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		return fmt.Errorf("create endpoint: %w", err)
+	}
+	sto, err := h.ld.Load(ep)
+	if err != nil {
+		return fmt.Errorf("load repository: %w", err)
+	}
+
+	// Unlike over http, where every request gets the whole response,
+	// the shallow-update follows the wants and comes before negotiating.
+	deepen := !upr.Depth.IsZero()
+	if deepen {
+		su, err := shallowUpdate(sto, h.hiddenRefs(ctx, repo), upr)
+		if err != nil {
+			return fmt.Errorf("shallow update: %w", err)
+		}
+		if err := su.Encode(rw); err != nil {
+			return err
+		}
+	}
+
+	// Negotiate without multi_ack: NAK each round of haves until done,
+	// then send the pack without the objects the client has.
+	// go-git's decoder leaves the haves to this loop, count them as they're read.
+	e := pktline.NewEncoder(rw)
+	haves, maxHaves := 0, h.cfg.MaxHaves
+	for {
+		line, typ, err := readPkt(br)
+		if errors.Is(err, io.EOF) {
+			// the client gave up
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if typ == pktFlush {
+			if err := e.Encodef("NAK\n"); err != nil {
+				return err
+			}
+			continue
+		}
+		cmd := strings.TrimSuffix(string(line), "\n")
+		if cmd == "done" {
+			break
+		}
+		if !strings.HasPrefix(cmd, "have ") {
+			return requestErrorf("unexpected %q during negotiation", cmd)
+		}
+		h, err := parseHash(strings.TrimPrefix(cmd, "have "))
+		if err != nil {
+			return err
+		}
+		haves++
+		if err := checkHaves(haves, maxHaves); err != nil {
+			return err
+		}
+		if sto.HasEncodedObject(h) == nil {
+			upr.Haves = append(upr.Haves, h)
+		}
+	}
+
+	if err := includeTagWants(sto, h.hiddenRefs(ctx, repo), upr); err != nil {
+		return fmt.Errorf("include tags: %w", err)
+	}
+	sess, err := h.uploadPackSession(ctx, ep)
+	if err != nil {
+		return fmt.Errorf("create upload-pack session: %w", err)
+	}
+	trace := h.wireTrace(ctx, repo)
+	trace.uploadPackRequest(upr)
+	res, err := uploadPack(ctx, sess, sto, h.hiddenRefs(ctx, repo), upr)
+	if err != nil {
+		return fmt.Errorf("upload-pack: %w", err)
+	}
+	// stops go-git's encoder if the pack isn't read to the end
+	defer res.Close()
+	pw := newPackHeaderWriter(rw)
+	if deepen {
+		// the shallow-update was sent already
+		err = res.ServerResponse.Encode(pw)
+		if err == nil {
+			_, err = io.Copy(pw, res)
+		}
+	} else {
+		err = res.Encode(pw)
+	}
+	trace.packSent(pw.objects)
+	if pw.objects >= 0 {
+		requestInfoFromContext(ctx).addPack(pw.objects, pw.packBytes())
+	}
+	if err != nil {
+		return fmt.Errorf("encode upload-pack response: %w", err)
+	}
+	requestInfoFromContext(ctx).event = &Event{Service: "upload-pack"}
+	return nil
+}
+
+// serveUploadPackV2 serves protocol v2 commands on a bidirectional stream
+// until the client is done.
+func (h *httpHandler) serveUploadPackV2(ctx context.Context, repo string, rw io.ReadWriter) error {
+	ctx, rw, cancel := cancelOnWriteError(ctx, rw)
+	defer cancel()
+	if err := advertiseV2(rw, h.cfg.agent(), h.objectFormat(ctx, repo)); err != nil {
+		return err
+	}
+	ep, err := transport.NewEndpoint("/" + repo)
+	if err != nil {
+		return fmt.Errorf("create endpoint: %w", err)
+	}
+	sto, err := ctxLoader{h.ld, ctx}.Load(ep)
+	if err != nil {
+		return fmt.Errorf("load repository: %w", err)
+	}
+
+	br := bufio.NewReader(rw)
+	for {
+		if done, err := flushNext(br); done || errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		req, err := readV2Request(br)
+		if err != nil {
+			return err
+		}
+		if err := serveV2(ctx, rw, sto, req, h.v2Config(ctx, repo)); err != nil {
+			_, msg := classifyError(err)
+			writeV2Error(rw, msg)
+			return err
+		}
+		if req.command == "fetch" {
+			requestInfoFromContext(ctx).event = &Event{Service: "upload-pack"}
+		}
+	}
+}
+
+// flushNext reports whether the next pkt-line in br is a flush,
+// consuming it if it is.
+func flushNext(br *bufio.Reader) (bool, error) {
+	b, err := br.Peek(4)
+	if errors.Is(err, io.EOF) && len(b) == 0 {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(b, []byte("0000")) {
+		return false, nil
+	}
+	_, err = br.Discard(4)
+	return true, err
+}
+
+// cancelOnWriteError returns a context that's cancelled
+// once writing to rw fails, as it does when the client disconnects,
+// so building a pack for a client that's gone stops.
+// Streams have no other sign of the client leaving while a pack is built.
+func cancelOnWriteError(ctx context.Context, rw io.ReadWriter) (context.Context, io.ReadWriter, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancelWriter{rw, cancel}, cancel
+}
+
+type cancelWriter struct {
+	io.ReadWriter
+	cancel context.CancelFunc
+}
+
+func (w cancelWriter) Write(p []byte) (int, error) {
+	n, err := w.ReadWriter.Write(p)
+	if err != nil {
+		w.cancel()
+	}
+	return n, err
+}
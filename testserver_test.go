@@ -0,0 +1,154 @@
+package gitreposerver
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestServer serves the repositories under dir with NewHandler's routes
+// on an httptest server, closed when the test ends.
+// Its URL is the base url of the repositories, such as URL+"/repo.git".
+func newTestServer(t testing.TB, dir string, opts ...Option) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(newHandler(newTestHandler(t, dir, opts...)))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newTestHandler returns the handler for the repositories under dir,
+// failing the test if opts don't validate. It logs to the test.
+func newTestHandler(t testing.TB, dir string, opts ...Option) *httpHandler {
+	t.Helper()
+	// the httptest server picks the address
+	cfg := newConfig(append([]Option{WithLogger(testLogger{t}), WithDir(dir), WithAddr("127.0.0.1:0")}, opts...))
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return newHTTPHandler(dir, cfg)
+}
+
+// testLogger logs records with t.Log, they're shown for failed tests.
+type testLogger struct {
+	t testing.TB
+}
+
+func (l testLogger) Debug(msg string, keyvals ...any) { l.log("DEBUG", msg, keyvals) }
+func (l testLogger) Info(msg string, keyvals ...any)  { l.log("INFO", msg, keyvals) }
+func (l testLogger) Warn(msg string, keyvals ...any)  { l.log("WARN", msg, keyvals) }
+func (l testLogger) Error(msg string, keyvals ...any) { l.log("ERROR", msg, keyvals) }
+
+func (l testLogger) log(level, msg string, keyvals []any) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", level, msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	l.t.Log(b.String())
+}
+
+// requireGit skips the test if the git command isn't installed.
+func requireGit(t testing.TB) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+}
+
+// gitEnv isolates git commands run by tests from the user's config
+// and the GIT_ variables of the environment, such as GIT_SSL_CAINFO.
+func gitEnv(home string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GIT_") {
+			env = append(env, kv)
+		}
+	}
+	return append(env,
+		"HOME="+home,
+		"XDG_CONFIG_HOME="+home,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+	)
+}
+
+// runGit runs git in dir, failing the test if it fails, and returns its stdout.
+func runGit(t testing.TB, dir string, args ...string) string {
+	t.Helper()
+	out, err := tryGit(t, dir, args...)
+	if err != nil {
+		t.Fatalf("git %s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+// tryGit runs git in dir, returning its stdout,
+// or an error including its stderr if it fails.
+func tryGit(t testing.TB, dir string, args ...string) (string, error) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = gitEnv(t.TempDir())
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("%w: %s", err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// newTestRepo creates a bare repository named repo.git in a new dir,
+// with commits commits on main, each changing file.txt and adding a file,
+// and returns the dir to serve.
+func newTestRepo(t testing.TB, commits int) string {
+	t.Helper()
+	requireGit(t)
+	work := t.TempDir()
+	runGit(t, work, "init", "-q", "-b", "main")
+	for i := 1; i <= commits; i++ {
+		writeTestFile(t, filepath.Join(work, "file.txt"), fmt.Sprintf("version %d\n", i))
+		writeTestFile(t, filepath.Join(work, fmt.Sprintf("file%d.txt", i)), fmt.Sprintf("file %d\n", i))
+		runGit(t, work, "add", "-A")
+		runGit(t, work, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+	}
+	dir := t.TempDir()
+	runGit(t, dir, "clone", "-q", "--bare", work, "repo.git")
+	return dir
+}
+
+// writeTestFile writes content to name, failing the test if it can't.
+func writeTestFile(t testing.TB, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewTestServerClone(t *testing.T) {
+	dir := newTestRepo(t, 3)
+	srv := newTestServer(t, dir)
+	clone := t.TempDir()
+	runGit(t, clone, "clone", "-q", srv.URL+"/repo.git", "out")
+	if n := strings.TrimSpace(runGit(t, filepath.Join(clone, "out"), "rev-list", "--count", "HEAD")); n != "3" {
+		t.Errorf("cloned %s commits, want 3", n)
+	}
+}
+
+// readTestFile returns the content of name, failing the test if it can't.
+func readTestFile(t testing.TB, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
@@ -0,0 +1,47 @@
+// Package testutil runs gitreposerver in tests,
+// so code using git can be tested against a real server.
+package testutil
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.seankhliao.com/gitreposerver"
+)
+
+// NewTestServer serves the repositories under dir with gitreposerver.NewHandler
+// on an httptest server, logging to t and failing it if opts don't validate.
+// Its URL is the base url of the repositories, such as URL+"/repo.git".
+// cleanup closes the server, it's also closed when the test ends.
+func NewTestServer(t testing.TB, dir string, opts ...gitreposerver.Option) (srv *httptest.Server, cleanup func()) {
+	t.Helper()
+	opts = append([]gitreposerver.Option{gitreposerver.WithLogger(testLogger{t})}, opts...)
+	// the httptest server picks the address
+	if err := gitreposerver.Validate(append(opts, gitreposerver.WithDir(dir), gitreposerver.WithAddr("127.0.0.1:0"))...); err != nil {
+		t.Fatal(err)
+	}
+	srv = httptest.NewServer(gitreposerver.NewHandler(dir, opts...))
+	t.Cleanup(srv.Close)
+	return srv, srv.Close
+}
+
+// testLogger logs records with t.Log, they're shown for failed tests.
+type testLogger struct {
+	t testing.TB
+}
+
+func (l testLogger) Debug(msg string, keyvals ...any) { l.log("DEBUG", msg, keyvals) }
+func (l testLogger) Info(msg string, keyvals ...any)  { l.log("INFO", msg, keyvals) }
+func (l testLogger) Warn(msg string, keyvals ...any)  { l.log("WARN", msg, keyvals) }
+func (l testLogger) Error(msg string, keyvals ...any) { l.log("ERROR", msg, keyvals) }
+
+func (l testLogger) log(level, msg string, keyvals []any) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s", level, msg)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	l.t.Log(b.String())
+}
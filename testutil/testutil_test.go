@@ -0,0 +1,61 @@
+package testutil_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.seankhliao.com/gitreposerver/testutil"
+)
+
+func TestNewTestServerClone(t *testing.T) {
+	dir := t.TempDir()
+	work := filepath.Join(dir, "repo")
+	repo, err := git.PlainInit(work, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// go-git only writes the config once something is set,
+	// the server looks for it to recognize a repository
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(work, "file.txt"), []byte("hello\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wt.Add("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := wt.Commit("add file.txt", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, cleanup := testutil.NewTestServer(t, dir)
+	defer cleanup()
+
+	clone, err := git.PlainClone(t.TempDir(), false, &git.CloneOptions{URL: srv.URL + "/repo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := clone.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Hash() != commit {
+		t.Errorf("cloned HEAD %s, want %s", head.Hash(), commit)
+	}
+}
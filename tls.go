@@ -0,0 +1,186 @@
+package gitreposerver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// RunHTTPS serves git over https on addr
+// using the certificate chain in certFile and the key in keyFile.
+// With WithACME, certFile and keyFile may be empty
+// to get certificates from Let's Encrypt instead.
+func RunHTTPS(dir, addr, certFile, keyFile string, opts ...Option) error {
+	return RunHTTP(dir, addr, append(opts, WithTLS(certFile, keyFile))...)
+}
+
+// tlsConfig returns the tls.Config to serve with,
+// or nil if TLS isn't configured.
+// The certificate settings must have been checked by validate.
+// With ACME, GetCertificate is left for acmeManager.
+func (c Config) tlsConfig() *tls.Config {
+	if c.TLSCertFile == "" && !c.acme() {
+		return nil
+	}
+	minVersion := c.TLSMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	cfg := &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: c.TLSCipherSuites,
+	}
+	if c.ClientCAs != nil {
+		cfg.ClientCAs = c.ClientCAs
+		cfg.ClientAuth = c.ClientAuth
+		if cfg.ClientAuth == tls.NoClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg
+}
+
+// acme reports whether certificates come from Let's Encrypt,
+// which they don't if a certificate file is set.
+func (c Config) acme() bool {
+	return len(c.ACMEHosts) > 0 && c.TLSCertFile == ""
+}
+
+func (c Config) acmeHTTPAddr() string {
+	if c.ACMEHTTPAddr == "" {
+		return ":80"
+	}
+	return c.ACMEHTTPAddr
+}
+
+// useACME makes cfg get certificates for ACMEHosts from Let's Encrypt,
+// answering TLS-ALPN-01 challenges too,
+// and returns the handler for the HTTP-01 challenge,
+// which passes other requests to fallback.
+// Certificates are renewed in the background once they're first used.
+func (c Config) useACME(cfg *tls.Config, fallback http.Handler) http.Handler {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.ACMEHosts...),
+		Cache:      autocert.DirCache(c.ACMECacheDir),
+	}
+	cfg.GetCertificate = m.GetCertificate
+	cfg.NextProtos = append(cfg.NextProtos, acme.ALPNProto)
+	return m.HTTPHandler(fallback)
+}
+
+// redirectHTTPS returns a handler that permanently redirects requests
+// to https on the port of addr, keeping the host, path and query,
+// so git clones of http:// urls follow it there.
+// The port is left out if it's 443 or addr is a unix socket.
+func redirectHTTPS(addr string) http.Handler {
+	_, port, err := net.SplitHostPort(addr)
+	if _, unix := unixSocketPath(addr); unix || err != nil || port == "443" {
+		port = ""
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		if port != "" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(rw, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// tlsNextProto returns the http.Server TLSNextProto to serve with,
+// nil for HTTP/2 and none to leave only HTTP/1.1.
+func (c Config) tlsNextProto() map[string]func(*http.Server, *tls.Conn, http.Handler) {
+	if !c.DisableHTTP2 {
+		return nil
+	}
+	return map[string]func(*http.Server, *tls.Conn, http.Handler){}
+}
+
+// hasHTTP2CipherSuite reports whether ids allows a TLS 1.2 handshake
+// with the suites HTTP/2 requires.
+func hasHTTP2CipherSuite(ids []uint16) bool {
+	for _, id := range ids {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadClientCAs reads a file of PEM encoded CA certificates.
+func LoadClientCAs(name string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read client CAs: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("read client CAs: no certificates in %s", name)
+	}
+	return pool, nil
+}
+
+// certIdentity returns the identity of a verified client certificate.
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return cert.SerialNumber.String()
+}
+
+// ParseTLSVersion parses a version such as "1.2".
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls: unknown version %q", s)
+}
+
+// ParseCipherSuites parses a comma separated list of cipher suite names,
+// as listed by tls.CipherSuites.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("tls: unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
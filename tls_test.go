@@ -0,0 +1,232 @@
+package gitreposerver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key for tests.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issueCert creates a certificate for name signed by parent,
+// or self signed if parent is nil. CAs can sign other certificates,
+// others are valid for 127.0.0.1.
+func issueCert(t *testing.T, parent *testCert, name string, ca bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if ca {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert, key}
+}
+
+func (c *testCert) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+}
+
+// writeKey writes the certificate's key to a new file and returns its name.
+func (c *testCert) writeKey(t *testing.T) string {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "key.pem")
+	writeTestFile(t, name, string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+	return name
+}
+
+// serveTest runs Serve for the repositories under dir on a free local port
+// until the test ends, and returns its address.
+func serveTest(t *testing.T, dir string, opts ...Option) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Serve(ctx, append([]Option{WithLogger(testLogger{t}), WithDir(dir), WithAddr(addr)}, opts...)...)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-errc; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return addr
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("serve: %v", err)
+		default:
+		}
+		if i == 100 {
+			t.Fatalf("server not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestTLSIntermediates serves a chain whose intermediate clients don't have,
+// they can only verify the leaf if the server sends it along.
+func TestTLSIntermediates(t *testing.T) {
+	root := issueCert(t, nil, "root", true)
+	intermediate := issueCert(t, root, "intermediate", true)
+	leaf := issueCert(t, intermediate, "leaf", false)
+	chain := filepath.Join(t.TempDir(), "chain.pem")
+	writeTestFile(t, chain, leaf.pem()+intermediate.pem())
+	rootFile := filepath.Join(t.TempDir(), "root.pem")
+	writeTestFile(t, rootFile, root.pem())
+
+	dir := newTestRepo(t, 1)
+	addr := serveTest(t, dir, WithTLS(chain, leaf.writeKey(t)))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatalf("verify chain: %v", err)
+	}
+	state := conn.ConnectionState()
+	conn.Close()
+	if n := len(state.PeerCertificates); n != 2 {
+		t.Errorf("server sent %d certificates, want the leaf and intermediate", n)
+	}
+
+	runGit(t, t.TempDir(), "-c", "http.sslCAInfo="+rootFile, "clone", "-q", "https://"+addr+"/repo.git", "out")
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	leaf := issueCert(t, nil, "leaf", false)
+	cert := filepath.Join(t.TempDir(), "cert.pem")
+	writeTestFile(t, cert, leaf.pem())
+	addr := serveTest(t, t.TempDir(), WithTLS(cert, leaf.writeKey(t)), WithTLSMinVersion(tls.VersionTLS13))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf.cert)
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}); err == nil {
+		conn.Close()
+		t.Error("TLS 1.2 handshake accepted with a TLS 1.3 minimum")
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if v := conn.ConnectionState().Version; v != tls.VersionTLS13 {
+		t.Errorf("negotiated version %x, want TLS 1.3", v)
+	}
+}
+
+// TestHTTP2Clone streams packs over HTTP/2, to git and to a Go client.
+func TestHTTP2Clone(t *testing.T) {
+	dir := newBlobRepo(t, 16, 64<<10)
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+	h := newHandler(newTestHandler(t, dir))
+	var mu sync.Mutex
+	protos := make(map[string]bool)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		protos[r.Proto] = true
+		mu.Unlock()
+		h.ServeHTTP(rw, r)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/repo.git/git-upload-pack", uploadPackRequest([]string{main}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ProtoMajor != 2 {
+		t.Errorf("fetched over %s, want HTTP/2", res.Proto)
+	}
+	// the commit, its tree and the blobs
+	if n := packObjects(t, string(body)); n != 18 {
+		t.Errorf("pack has %d objects, want 18", n)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestFile(t, caFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})))
+	mu.Lock()
+	protos = make(map[string]bool)
+	mu.Unlock()
+	out := filepath.Join(t.TempDir(), "out")
+	runGit(t, t.TempDir(), "-c", "http.sslCAInfo="+caFile, "-c", "http.version=HTTP/2", "clone", "-q", srv.URL+"/repo.git", out)
+	runGit(t, out, "fsck", "--no-progress")
+	mu.Lock()
+	defer mu.Unlock()
+	if !protos["HTTP/2.0"] {
+		t.Logf("git cloned over %v, its curl may not support HTTP/2", protos)
+	}
+}
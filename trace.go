@@ -0,0 +1,157 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+const (
+	// traceListLimit is how many object ids or arguments
+	// a trace line lists before summarizing the rest.
+	traceListLimit = 10
+	// traceScanBytes is how far into a response the pack header is looked for.
+	traceScanBytes = 64 << 10
+)
+
+// wireTrace logs the decoded fetch negotiation for Config.TraceWire,
+// like GIT_TRACE_PACKET on the client. A nil wireTrace logs nothing.
+type wireTrace struct {
+	log  Logger
+	repo string
+}
+
+// wireTrace returns the tracer for a fetch of repo, nil unless TraceWire is set.
+func (h *httpHandler) wireTrace(ctx context.Context, repo string) *wireTrace {
+	if !h.cfg.TraceWire {
+		return nil
+	}
+	return &wireTrace{log: h.logger(ctx), repo: repo}
+}
+
+// uploadPackRequest logs a protocol v0 fetch once its haves are known.
+func (t *wireTrace) uploadPackRequest(upr *packp.UploadPackRequest) {
+	if t == nil {
+		return
+	}
+	t.log.Info("wire upload-pack request", "repo", t.repo,
+		"capabilities", upr.Capabilities.String(),
+		"wants", traceHashes(upr.Wants),
+		"haves", traceHashes(upr.Haves),
+		"shallows", traceHashes(upr.Shallows),
+		"depth", traceDepth(upr.Depth),
+	)
+}
+
+// v2Request logs a protocol v2 command,
+// fetch arguments are logged by v2Fetch once they're decoded.
+func (t *wireTrace) v2Request(req *v2Request) {
+	if t == nil {
+		return
+	}
+	keyvals := []any{"repo", t.repo, "command", req.command, "capabilities", strings.Join(req.caps, " ")}
+	if req.command != "fetch" {
+		keyvals = append(keyvals, "args", traceList(req.args))
+	}
+	t.log.Info("wire protocol v2 request", keyvals...)
+}
+
+// v2Fetch logs the decoded arguments of a protocol v2 fetch.
+func (t *wireTrace) v2Fetch(wants []plumbing.Hash, wantRefs []*plumbing.Reference, haves, shallows []plumbing.Hash, depth int, filter string, done bool) {
+	if t == nil {
+		return
+	}
+	refs := make([]string, len(wantRefs))
+	for i, ref := range wantRefs {
+		refs[i] = ref.Name().String()
+	}
+	t.log.Info("wire fetch request", "repo", t.repo,
+		"wants", traceHashes(wants),
+		"want_refs", traceList(refs),
+		"haves", traceHashes(haves),
+		"shallows", traceHashes(shallows),
+		"depth", depth,
+		"filter", filter,
+		"done", done,
+	)
+}
+
+// packSent logs the number of objects in the pack sent to the client,
+// -1 if it's unknown.
+func (t *wireTrace) packSent(objects int64) {
+	if t == nil {
+		return
+	}
+	t.log.Info("wire pack sent", "repo", t.repo, "objects", objects)
+}
+
+// packHeaderWriter finds the object count in the header
+// of a pack written to w, possibly within sideband packets,
+// and counts the bytes written from the header on.
+type packHeaderWriter struct {
+	w       io.Writer
+	buf     []byte
+	objects int64
+	// written is all that was written, start where the pack began.
+	written int64
+	start   int64
+}
+
+func newPackHeaderWriter(w io.Writer) *packHeaderWriter {
+	return &packHeaderWriter{w: w, objects: -1}
+}
+
+func (p *packHeaderWriter) Write(b []byte) (int, error) {
+	if p.objects < 0 && len(p.buf) < traceScanBytes {
+		p.buf = append(p.buf, b...)
+		if i := bytes.Index(p.buf, []byte("PACK")); i >= 0 && len(p.buf) >= i+12 {
+			p.objects = int64(binary.BigEndian.Uint32(p.buf[i+8 : i+12]))
+			p.start = int64(i)
+			p.buf = nil
+		}
+	}
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	return n, err
+}
+
+// packBytes is the size of the pack written so far,
+// including any sideband framing within it.
+func (p *packHeaderWriter) packBytes() int64 {
+	return p.written - p.start
+}
+
+// traceHashes lists hs, summarizing those past traceListLimit.
+func traceHashes(hs []plumbing.Hash) string {
+	s := make([]string, len(hs))
+	for i, h := range hs {
+		s[i] = h.String()
+	}
+	return traceList(s)
+}
+
+func traceList(s []string) string {
+	if len(s) <= traceListLimit {
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(s[:traceListLimit], ","), len(s)-traceListLimit)
+}
+
+func traceDepth(d packp.Depth) string {
+	switch d := d.(type) {
+	case packp.DepthCommits:
+		return fmt.Sprint(int(d))
+	case packp.DepthSince:
+		return "since " + time.Time(d).Format(time.RFC3339)
+	case packp.DepthReference:
+		return "not " + string(d)
+	}
+	return ""
+}
@@ -0,0 +1,630 @@
+package gitreposerver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/utils/ioutil"
+)
+
+// packRequest describes the objects a client wants in a fetch.
+type packRequest struct {
+	wants []plumbing.Hash
+	// common are the haves the server also has.
+	common []plumbing.Hash
+	// shallows are the commits the client has without their parents.
+	shallows []plumbing.Hash
+	// depth limits the history sent from wants, 0 is unlimited.
+	depth int
+	// since omits commits committed before it, for deepen-since.
+	since time.Time
+	// exclude omits commits reachable from these, for deepen-not.
+	exclude []plumbing.Hash
+	// filter omits trees and blobs for partial clones,
+	// objects named in wants are always sent.
+	filter objectFilter
+	// tags are annotated tags sent if what they point at is,
+	// for include-tag.
+	tags []plumbing.Hash
+}
+
+// packPlan is the result of planning a fetch.
+type packPlan struct {
+	objects []plumbing.Hash
+	// shallow are the new shallow boundary commits for the client.
+	shallow []plumbing.Hash
+	// unshallow are client shallow commits whose parents are now sent.
+	unshallow []plumbing.Hash
+}
+
+// planPack lists the objects reachable from the wants
+// that the client doesn't have.
+// Unlike revlist.Objects, it stops at shallow boundaries.
+func planPack(sto storer.EncodedObjectStorer, req packRequest) (*packPlan, error) {
+	w := &objectWalker{
+		sto:           sto,
+		filter:        req.filter,
+		have:          make(map[plumbing.Hash]bool),
+		sent:          make(map[plumbing.Hash]bool),
+		clientShallow: make(map[plumbing.Hash]bool),
+	}
+	for _, h := range req.shallows {
+		w.clientShallow[h] = true
+	}
+	for _, h := range req.common {
+		if err := w.markHave(h); err != nil {
+			return nil, err
+		}
+	}
+	// cutting history by time or ref rather than depth
+	cut := !req.since.IsZero() || len(req.exclude) > 0
+	excluded, err := reachableCommits(sto, req.exclude, nil)
+	if err != nil {
+		return nil, err
+	}
+	// omit reports whether the commit h is outside the requested history.
+	omit := func(h plumbing.Hash) (bool, error) {
+		if excluded[h] {
+			return true, nil
+		}
+		if req.since.IsZero() {
+			return false, nil
+		}
+		commit, err := object.GetCommit(sto, h)
+		if err != nil {
+			return false, fmt.Errorf("get commit %s: %w", h, err)
+		}
+		return commit.Committer.When.Before(req.since), nil
+	}
+
+	plan := &packPlan{}
+	type queued struct {
+		h     plumbing.Hash
+		depth int
+	}
+	var queue []queued
+	visited := make(map[plumbing.Hash]bool)
+	for _, h := range req.wants {
+		commit, err := w.peelWant(h)
+		if err != nil {
+			return nil, err
+		}
+		if commit == plumbing.ZeroHash || visited[commit] {
+			continue
+		}
+		visited[commit] = true
+		if cut {
+			omitted, err := omit(commit)
+			if err != nil {
+				return nil, err
+			}
+			if omitted {
+				continue
+			}
+		}
+		queue = append(queue, queued{commit, 1})
+	}
+	if cut && len(queue) == 0 {
+		return nil, requestErrorf("no commits selected for shallow requests")
+	}
+
+	// Deepening a shallow client walks through the commits it has
+	// to find its shallow boundary, a region bounded by markHave.
+	deepening := (req.depth > 0 || cut) && len(w.clientShallow) > 0
+
+	// breadth first so each commit is reached at its lowest depth
+	for len(queue) > 0 {
+		q := queue[0]
+		queue = queue[1:]
+
+		shallow := w.clientShallow[q.h]
+		if shallow && req.depth == 0 && !cut {
+			// not deepening, the client keeps its boundary
+			continue
+		}
+		if w.have[q.h] && !shallow && !deepening {
+			continue
+		}
+
+		commit, err := object.GetCommit(w.sto, q.h)
+		if err != nil {
+			return nil, fmt.Errorf("get commit %s: %w", q.h, err)
+		}
+		if !w.have[q.h] {
+			w.add(q.h)
+			if err := w.addTree(commit.TreeHash, 0); err != nil {
+				return nil, err
+			}
+		}
+
+		if len(commit.ParentHashes) == 0 {
+			continue
+		}
+		if req.depth > 0 && q.depth >= req.depth {
+			if !shallow {
+				plan.shallow = append(plan.shallow, q.h)
+			}
+			continue
+		}
+		// Like git, a commit with any omitted parent is a boundary,
+		// its other parents are still sent.
+		boundary := false
+		for _, p := range commit.ParentHashes {
+			if cut {
+				omitted, err := omit(p)
+				if err != nil {
+					return nil, err
+				}
+				if omitted {
+					boundary = true
+					continue
+				}
+			}
+			if !visited[p] {
+				visited[p] = true
+				queue = append(queue, queued{p, q.depth + 1})
+			}
+		}
+		switch {
+		case boundary && !shallow:
+			plan.shallow = append(plan.shallow, q.h)
+		case !boundary && shallow:
+			plan.unshallow = append(plan.unshallow, q.h)
+		}
+	}
+
+	for _, h := range req.tags {
+		if err := w.includeTag(h); err != nil {
+			return nil, err
+		}
+	}
+
+	plan.objects = w.objects
+	return plan, nil
+}
+
+// errTooManyWants is returned for fetches wanting more than MaxWants objects.
+var errTooManyWants = errors.New("too many wants")
+
+// checkWants returns errTooManyWants if wants has more than max distinct objects,
+// if max is set.
+func checkWants(wants []plumbing.Hash, max int) error {
+	if max <= 0 || len(wants) <= max {
+		return nil
+	}
+	distinct := make(map[plumbing.Hash]bool, len(wants))
+	for _, h := range wants {
+		distinct[h] = true
+	}
+	if n := len(distinct); n > max {
+		return fmt.Errorf("%w: %d wants, over the limit of %d", errTooManyWants, n, max)
+	}
+	return nil
+}
+
+// checkHaves returns a request error once a fetch has sent more than max haves,
+// if max is set.
+func checkHaves(n, max int) error {
+	if max > 0 && n > max {
+		return requestErrorf("more than %d haves", max)
+	}
+	return nil
+}
+
+// v0Haves is the negotiation that follows the wants of a protocol v0 http request.
+type v0Haves struct {
+	// common are the haves the repository has, in the order they were sent.
+	common []plumbing.Hash
+	// flushed is set if a round of haves ended with a flush.
+	flushed bool
+	// done is set if the client asked for the pack.
+	done bool
+}
+
+// readHaves reads the have lines that follow the wants of a protocol v0 http request,
+// up to done or the end of r, returning a request error past max.
+// go-git's decoder stops at the flush after the wants and ignores the haves,
+// only those sto has are kept, the others leave nothing out of the pack.
+func readHaves(r io.Reader, sto storer.EncodedObjectStorer, max int) (v0Haves, error) {
+	var haves v0Haves
+	n := 0
+	for {
+		line, typ, err := readPkt(r)
+		if errors.Is(err, io.EOF) {
+			return haves, nil
+		} else if err != nil {
+			return haves, fmt.Errorf("%w: %v", errMalformedRequest, err)
+		}
+		if typ == pktFlush {
+			haves.flushed = true
+			continue
+		} else if typ != pktData {
+			continue
+		}
+		cmd := strings.TrimSuffix(string(line), "\n")
+		if cmd == "done" {
+			haves.done = true
+			return haves, nil
+		}
+		if !strings.HasPrefix(cmd, "have ") {
+			return haves, requestErrorf("unexpected %q during negotiation", cmd)
+		}
+		h, err := parseHash(strings.TrimPrefix(cmd, "have "))
+		if err != nil {
+			return haves, err
+		}
+		n++
+		if err := checkHaves(n, max); err != nil {
+			return haves, err
+		}
+		if sto.HasEncodedObject(h) == nil {
+			haves.common = append(haves.common, h)
+		}
+	}
+}
+
+// firstHash returns the first of hs, if any,
+// the only have a client without multi_ack gets an ACK for.
+func firstHash(hs []plumbing.Hash) []plumbing.Hash {
+	if len(hs) == 0 {
+		return nil
+	}
+	return hs[:1]
+}
+
+// uploadPack serves a protocol v0 fetch with go-git's upload-pack,
+// which sends offset deltas even to clients that didn't ask for ofs-delta
+// and refuses shallow fetches, so those are planned like protocol v2 fetches,
+// and the response has a shallow-update section if the client asked to deepen.
+func uploadPack(ctx context.Context, sess transport.UploadPackSession, sto storer.Storer, hidden []string, upr *packp.UploadPackRequest) (*packp.UploadPackResponse, error) {
+	if upr.Capabilities.Supports(capability.OFSDelta) && !isShallowRequest(upr) {
+		// go-git refuses capabilities it doesn't advertise,
+		// these only matter to shallow fetches
+		for _, c := range []capability.Capability{capability.Shallow, capability.DeepenSince, capability.DeepenNot} {
+			upr.Capabilities.Delete(c)
+		}
+		return sess.UploadPack(ctx, upr)
+	}
+	// not upr.Validate, git asks to deepen without
+	// sending the shallow capability it requires,
+	// and deepening wants commits the client has
+	if upr.Depth.IsZero() && upr.IsEmpty() {
+		return nil, transport.ErrEmptyUploadPackRequest
+	}
+	req, err := v0PackRequest(sto, hidden, upr)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := planPack(sto, req)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := packfile.NewEncoder(pw, sto, !upr.Capabilities.Supports(capability.OFSDelta)).Encode(plan.objects, 10)
+		pw.CloseWithError(err)
+	}()
+	res := packp.NewUploadPackResponseWithPackfile(upr, ioutil.NewContextReadCloser(ctx, pr))
+	res.ShallowUpdate = packp.ShallowUpdate{Shallows: plan.shallow, Unshallows: plan.unshallow}
+	return res, nil
+}
+
+// isShallowRequest reports whether a protocol v0 fetch
+// comes from a shallow clone or asks to deepen.
+func isShallowRequest(upr *packp.UploadPackRequest) bool {
+	return len(upr.Shallows) > 0 || !upr.Depth.IsZero()
+}
+
+// v0PackRequest returns the packRequest of a protocol v0 fetch,
+// ignoring shallow commits the repository doesn't have.
+func v0PackRequest(sto storer.Storer, hidden []string, upr *packp.UploadPackRequest) (packRequest, error) {
+	req := packRequest{wants: upr.Wants, common: upr.Haves, filter: noFilter}
+	for _, h := range upr.Shallows {
+		if sto.HasEncodedObject(h) == nil {
+			req.shallows = append(req.shallows, h)
+		}
+	}
+	switch depth := upr.Depth.(type) {
+	case packp.DepthCommits:
+		req.depth = int(depth)
+	case packp.DepthSince:
+		req.since = time.Time(depth)
+	case packp.DepthReference:
+		h, err := resolveDeepenNot(sto, hidden, string(depth))
+		if err != nil {
+			return packRequest{}, err
+		}
+		req.exclude = []plumbing.Hash{h}
+	}
+	return req, nil
+}
+
+// shallowUpdate returns the shallow-update section for a protocol v0 fetch asking to deepen,
+// which streams send before negotiating.
+func shallowUpdate(sto storer.Storer, hidden []string, upr *packp.UploadPackRequest) (*packp.ShallowUpdate, error) {
+	req, err := v0PackRequest(sto, hidden, upr)
+	if err != nil {
+		return nil, err
+	}
+	req.common = nil
+	plan, err := planPack(sto, req)
+	if err != nil {
+		return nil, err
+	}
+	return &packp.ShallowUpdate{Shallows: plan.shallow, Unshallows: plan.unshallow}, nil
+}
+
+// includeTagWants adds the annotated tags pointing at commits being sent
+// to the wants of a protocol v0 fetch asking for include-tag,
+// which go-git's upload-pack doesn't support.
+func includeTagWants(sto storer.Storer, hidden []string, upr *packp.UploadPackRequest) error {
+	if !upr.Capabilities.Supports(capability.IncludeTag) {
+		return nil
+	}
+	upr.Capabilities.Delete(capability.IncludeTag)
+	tags, err := annotatedTags(sto, hidden)
+	if err != nil || len(tags) == 0 {
+		return err
+	}
+	have, err := reachableCommits(sto, upr.Haves, nil)
+	if err != nil {
+		return err
+	}
+	sent, err := reachableCommits(sto, upr.Wants, have)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[plumbing.Hash]bool, len(upr.Wants))
+	for _, h := range upr.Wants {
+		wanted[h] = true
+	}
+	for _, h := range tags {
+		_, target, err := tagChain(sto, h)
+		if err != nil {
+			return err
+		}
+		if sent[target] && !wanted[h] {
+			upr.Wants = append(upr.Wants, h)
+		}
+	}
+	return nil
+}
+
+// reachableCommits returns the commits reachable from tips,
+// not walking past those in stop.
+func reachableCommits(sto storer.EncodedObjectStorer, tips []plumbing.Hash, stop map[plumbing.Hash]bool) (map[plumbing.Hash]bool, error) {
+	reached := make(map[plumbing.Hash]bool)
+	var stack []plumbing.Hash
+	for _, h := range tips {
+		commit, err := peelCommit(sto, h)
+		if err != nil {
+			return nil, err
+		}
+		if commit != nil {
+			stack = append(stack, commit.Hash)
+		}
+	}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if reached[h] || stop[h] {
+			continue
+		}
+		reached[h] = true
+		commit, err := object.GetCommit(sto, h)
+		if err != nil {
+			return nil, fmt.Errorf("get commit %s: %w", h, err)
+		}
+		stack = append(stack, commit.ParentHashes...)
+	}
+	return reached, nil
+}
+
+// tagChain returns the chain of tags starting at h
+// and the object the last of them points at.
+func tagChain(sto storer.EncodedObjectStorer, h plumbing.Hash) ([]plumbing.Hash, plumbing.Hash, error) {
+	var chain []plumbing.Hash
+	for {
+		obj, err := sto.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, plumbing.ZeroHash, fmt.Errorf("get object %s: %w", h, err)
+		}
+		if obj.Type() != plumbing.TagObject {
+			return chain, h, nil
+		}
+		tag, err := object.DecodeTag(sto, obj)
+		if err != nil {
+			return nil, plumbing.ZeroHash, fmt.Errorf("decode tag %s: %w", h, err)
+		}
+		chain = append(chain, h)
+		h = tag.Target
+	}
+}
+
+type objectWalker struct {
+	sto           storer.EncodedObjectStorer
+	filter        objectFilter
+	have          map[plumbing.Hash]bool
+	sent          map[plumbing.Hash]bool
+	clientShallow map[plumbing.Hash]bool
+	objects       []plumbing.Hash
+}
+
+func (w *objectWalker) add(h plumbing.Hash) {
+	w.sent[h] = true
+	w.objects = append(w.objects, h)
+}
+
+// includeTag adds the tag h, and any tags it points at,
+// if the object they tag is being sent and the client doesn't have them.
+func (w *objectWalker) includeTag(h plumbing.Hash) error {
+	if w.have[h] || w.sent[h] {
+		return nil
+	}
+	chain, target, err := tagChain(w.sto, h)
+	if err != nil {
+		return err
+	}
+	if !w.sent[target] {
+		return nil
+	}
+	for _, h := range chain {
+		if !w.have[h] && !w.sent[h] {
+			w.add(h)
+		}
+	}
+	return nil
+}
+
+// markHave records every object reachable from h as held by the client,
+// without walking past the client's shallow commits.
+func (w *objectWalker) markHave(h plumbing.Hash) error {
+	stack := []plumbing.Hash{h}
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if w.have[h] {
+			continue
+		}
+
+		obj, err := w.sto.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return fmt.Errorf("get have %s: %w", h, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			w.have[h] = true
+			commit, err := object.DecodeCommit(w.sto, obj)
+			if err != nil {
+				return fmt.Errorf("decode commit %s: %w", h, err)
+			}
+			if err := w.markTree(commit.TreeHash); err != nil {
+				return err
+			}
+			if !w.clientShallow[h] {
+				stack = append(stack, commit.ParentHashes...)
+			}
+		case plumbing.TagObject:
+			w.have[h] = true
+			tag, err := object.DecodeTag(w.sto, obj)
+			if err != nil {
+				return fmt.Errorf("decode tag %s: %w", h, err)
+			}
+			stack = append(stack, tag.Target)
+		case plumbing.TreeObject:
+			if err := w.markTree(h); err != nil {
+				return err
+			}
+		default:
+			w.have[h] = true
+		}
+	}
+	return nil
+}
+
+func (w *objectWalker) markTree(h plumbing.Hash) error {
+	if w.have[h] {
+		return nil
+	}
+	w.have[h] = true
+	tree, err := object.GetTree(w.sto, h)
+	if err != nil {
+		return fmt.Errorf("get tree %s: %w", h, err)
+	}
+	for _, e := range tree.Entries {
+		switch e.Mode {
+		case filemode.Dir:
+			if err := w.markTree(e.Hash); err != nil {
+				return err
+			}
+		case filemode.Submodule:
+		default:
+			w.have[e.Hash] = true
+		}
+	}
+	return nil
+}
+
+// addTree adds h, a tree depth levels below a root tree,
+// and every object in it that the client doesn't have and the filter allows.
+func (w *objectWalker) addTree(h plumbing.Hash, depth int) error {
+	if w.have[h] || w.sent[h] || w.filter.omitTree(depth) {
+		return nil
+	}
+	w.add(h)
+	tree, err := object.GetTree(w.sto, h)
+	if err != nil {
+		return fmt.Errorf("get tree %s: %w", h, err)
+	}
+	for _, e := range tree.Entries {
+		switch e.Mode {
+		case filemode.Dir:
+			if err := w.addTree(e.Hash, depth+1); err != nil {
+				return err
+			}
+		case filemode.Submodule:
+		default:
+			if w.have[e.Hash] || w.sent[e.Hash] {
+				continue
+			}
+			var size int64
+			if w.filter.needsSize() {
+				size, err = w.sto.EncodedObjectSize(e.Hash)
+				if err != nil {
+					return fmt.Errorf("get blob size %s: %w", e.Hash, err)
+				}
+			}
+			if !w.filter.omitBlob(size, depth+1) {
+				w.add(e.Hash)
+			}
+		}
+	}
+	return nil
+}
+
+// peelWant adds any tags, trees or blobs a want refers to,
+// returning the commit it points to, if any.
+func (w *objectWalker) peelWant(h plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := w.sto.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("get want %s: %w", h, err)
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return h, nil
+		case plumbing.TagObject:
+			if !w.have[h] && !w.sent[h] {
+				w.add(h)
+			}
+			tag, err := object.DecodeTag(w.sto, obj)
+			if err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("decode tag %s: %w", h, err)
+			}
+			h = tag.Target
+		case plumbing.TreeObject:
+			// explicitly wanted, the filter applies below it
+			if !w.have[h] && !w.sent[h] && w.filter.omitTree(0) {
+				w.add(h)
+			}
+			return plumbing.ZeroHash, w.addTree(h, 0)
+		default:
+			if !w.have[h] && !w.sent[h] {
+				w.add(h)
+			}
+			return plumbing.ZeroHash, nil
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package gitreposerver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// uploadPackRequest encodes a protocol v0 upload-pack request body
+// wanting wants and having haves.
+func uploadPackRequest(wants, haves []string) *bytes.Buffer {
+	var b bytes.Buffer
+	e := pktline.NewEncoder(&b)
+	for i, want := range wants {
+		if i == 0 {
+			e.Encodef("want %s ofs-delta\n", want)
+		} else {
+			e.Encodef("want %s\n", want)
+		}
+	}
+	e.Flush()
+	for _, have := range haves {
+		e.Encodef("have %s\n", have)
+	}
+	e.Encodef("done\n")
+	return &b
+}
+
+// fetchRequestV2 encodes a protocol v2 fetch command wanting wants and having haves.
+func fetchRequestV2(wants, haves []string) *bytes.Buffer {
+	var b bytes.Buffer
+	e := pktline.NewEncoder(&b)
+	e.Encodef("command=fetch\n")
+	b.WriteString("0001")
+	for _, want := range wants {
+		e.Encodef("want %s\n", want)
+	}
+	for _, have := range haves {
+		e.Encodef("have %s\n", have)
+	}
+	e.Encodef("done\n")
+	e.Flush()
+	return &b
+}
+
+// postUploadPack posts body to the upload-pack endpoint of the repository at url,
+// with a Git-Protocol header if protocol isn't empty,
+// and returns the status and response body.
+func postUploadPack(t *testing.T, url, protocol string, body io.Reader) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url+"/git-upload-pack", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	if protocol != "" {
+		req.Header.Set("Git-Protocol", protocol)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(b)
+}
+
+// fakeHaves returns n distinct object ids the repository doesn't have.
+func fakeHaves(n int) []string {
+	haves := make([]string, n)
+	for i := range haves {
+		haves[i] = fmt.Sprintf("%040x", i+1)
+	}
+	return haves
+}
+
+func TestMaxHaves(t *testing.T) {
+	dir := newTestRepo(t, 1)
+	srv := newTestServer(t, dir, WithMaxHaves(10))
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+
+	tests := []struct {
+		name  string
+		haves int
+		ok    bool
+	}{
+		{"under", 3, true},
+		{"at", 10, true},
+		{"over", 11, false},
+		{"huge", 100000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			haves := fakeHaves(tt.haves)
+			want := http.StatusOK
+			if !tt.ok {
+				want = http.StatusBadRequest
+			}
+			if code, _ := postUploadPack(t, srv.URL+"/repo.git", "", uploadPackRequest([]string{main}, haves)); code != want {
+				t.Errorf("v0: status %d, want %d", code, want)
+			}
+			// protocol v2 errors are sent in the response
+			code, body := postUploadPack(t, srv.URL+"/repo.git", "version=2", fetchRequestV2([]string{main}, haves))
+			if code != http.StatusOK {
+				t.Errorf("v2: status %d", code)
+			}
+			if refused := strings.Contains(body, "more than 10 haves"); refused == tt.ok {
+				t.Errorf("v2: refused %v, want %v:\n%s", refused, !tt.ok, body)
+			}
+		})
+	}
+}
+
+func TestReadHaves(t *testing.T) {
+	sto := memory.NewStorage()
+	obj := sto.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	common, err := sto.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		haves int
+		max   int
+		err   bool
+	}{
+		{"none", 0, 1, false},
+		{"under", 1, 2, false},
+		{"at", 2, 2, false},
+		{"over", 3, 2, true},
+		{"unlimited", 3, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			e := pktline.NewEncoder(&b)
+			haves := fakeHaves(tt.haves)
+			if len(haves) > 0 {
+				haves[len(haves)-1] = common.String()
+			}
+			for _, have := range haves {
+				e.Encodef("have %s\n", have)
+			}
+			e.Encodef("done\n")
+			// haves after done aren't read
+			e.Encodef("have %s\n", strings.Repeat("f", 40))
+			got, err := readHaves(&b, sto, tt.max)
+			if (err != nil) != tt.err {
+				t.Fatalf("readHaves: %v, want error %v", err, tt.err)
+			}
+			if err != nil {
+				if code, _ := classifyError(err); code != http.StatusBadRequest {
+					t.Errorf("status %d, want 400", code)
+				}
+				return
+			}
+			if !got.done {
+				t.Error("not done")
+			}
+			want := []plumbing.Hash{common}
+			if tt.haves == 0 {
+				want = nil
+			}
+			if !reflect.DeepEqual(got.common, want) {
+				t.Errorf("common %v, want %v", got.common, want)
+			}
+		})
+	}
+}
+
+// packObjects returns the number of objects in the pack in an upload-pack response body
+// without sideband.
+func packObjects(t *testing.T, body string) int {
+	t.Helper()
+	i := strings.Index(body, "PACK")
+	if i < 0 || len(body) < i+12 {
+		t.Fatalf("no pack in %q", body)
+	}
+	return int(binary.BigEndian.Uint32([]byte(body[i+8 : i+12])))
+}
+
+func TestIncrementalFetchV0(t *testing.T) {
+	dir := newTestRepo(t, 3)
+	srv := newTestServer(t, dir)
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+	old := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main~1"))
+
+	_, full := postUploadPack(t, srv.URL+"/repo.git", "", uploadPackRequest([]string{main}, nil))
+	code, incremental := postUploadPack(t, srv.URL+"/repo.git", "", uploadPackRequest([]string{main}, []string{fakeHaves(1)[0], old}))
+	if code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if !strings.HasPrefix(incremental, fmt.Sprintf("0031ACK %s\n", old)) {
+		t.Errorf("response doesn't ACK the common have:\n%q", incremental)
+	}
+	if got, all := packObjects(t, incremental), packObjects(t, full); got >= all {
+		t.Errorf("incremental pack has %d objects, the full pack %d", got, all)
+	}
+
+	// rounds of a stateless client before done get no pack
+	for _, tt := range []struct {
+		have, want string
+	}{
+		{fakeHaves(1)[0], "0008NAK\n"},
+		{old, fmt.Sprintf("0031ACK %s\n", old)},
+	} {
+		var b bytes.Buffer
+		e := pktline.NewEncoder(&b)
+		e.Encodef("want %s ofs-delta\n", main)
+		e.Flush()
+		e.Encodef("have %s\n", tt.have)
+		e.Flush()
+		if _, got := postUploadPack(t, srv.URL+"/repo.git", "", &b); got != tt.want {
+			t.Errorf("round with have %s: got %q, want %q", tt.have, got, tt.want)
+		}
+	}
+}
+
+// cloneV2 clones the repository at url with protocol v2 and args into a new dir
+// and returns it.
+func cloneV2(t *testing.T, url string, args ...string) string {
+	t.Helper()
+	out := filepath.Join(t.TempDir(), "out")
+	runGit(t, t.TempDir(), append(append([]string{"-c", "protocol.version=2", "clone", "-q"}, args...), url, out)...)
+	return out
+}
+
+// commitCount returns the number of commits reachable from rev in the repository at dir.
+func commitCount(t *testing.T, dir, rev string) string {
+	t.Helper()
+	return strings.TrimSpace(runGit(t, dir, "rev-list", "--count", rev))
+}
+
+func TestShallowClone(t *testing.T) {
+	dir := newTestRepo(t, 10)
+	srv := newTestServer(t, dir)
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+	parent := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main~2"))
+
+	out := cloneV2(t, srv.URL+"/repo.git", "--depth=1")
+	if n := commitCount(t, out, "HEAD"); n != "1" {
+		t.Errorf("depth 1 clone has %s commits, want 1", n)
+	}
+	if shallow := strings.TrimSpace(runGit(t, out, "rev-parse", "--shallow-file")); shallow == "" {
+		t.Fatal("no shallow file")
+	}
+	if got := strings.TrimSpace(readTestFile(t, filepath.Join(out, ".git", "shallow"))); got != main {
+		t.Errorf("shallow boundary %q, want %s", got, main)
+	}
+	runGit(t, out, "fsck", "--no-progress")
+
+	runGit(t, out, "-c", "protocol.version=2", "fetch", "-q", "--depth=3")
+	if n := commitCount(t, out, "HEAD"); n != "3" {
+		t.Errorf("deepened clone has %s commits, want 3", n)
+	}
+	if got := strings.TrimSpace(readTestFile(t, filepath.Join(out, ".git", "shallow"))); got != parent {
+		t.Errorf("deepened shallow boundary %q, want %s", got, parent)
+	}
+
+	runGit(t, out, "-c", "protocol.version=2", "fetch", "-q", "--unshallow")
+	if n := commitCount(t, out, "HEAD"); n != "10" {
+		t.Errorf("unshallowed clone has %s commits, want 10", n)
+	}
+	if got := strings.TrimSpace(runGit(t, out, "rev-parse", "--is-shallow-repository")); got != "false" {
+		t.Errorf("unshallowed clone is still shallow")
+	}
+	runGit(t, out, "fsck", "--no-progress")
+
+	v0 := filepath.Join(t.TempDir(), "v0")
+	runGit(t, t.TempDir(), "-c", "protocol.version=0", "clone", "-q", "--depth=1", srv.URL+"/repo.git", v0)
+	if n := commitCount(t, v0, "HEAD"); n != "1" {
+		t.Errorf("protocol v0 depth 1 clone has %s commits, want 1", n)
+	}
+	if got := strings.TrimSpace(readTestFile(t, filepath.Join(v0, ".git", "shallow"))); got != main {
+		t.Errorf("protocol v0 shallow boundary %q, want %s", got, main)
+	}
+	runGit(t, v0, "-c", "protocol.version=0", "fetch", "-q", "--depth=3")
+	if n := commitCount(t, v0, "HEAD"); n != "3" {
+		t.Errorf("protocol v0 deepened clone has %s commits, want 3", n)
+	}
+	runGit(t, v0, "fsck", "--no-progress")
+}
+
+// newDatedRepo is newTestRepo with a commit on main committed at each of dates.
+func newDatedRepo(t *testing.T, dates ...string) string {
+	t.Helper()
+	requireGit(t)
+	work := t.TempDir()
+	runGit(t, work, "init", "-q", "-b", "main")
+	for i, date := range dates {
+		writeTestFile(t, filepath.Join(work, "file.txt"), fmt.Sprintf("version %d\n", i+1))
+		runGit(t, work, "add", "-A")
+		cmd := exec.Command("git", "commit", "-q", "-m", fmt.Sprintf("commit %d", i+1))
+		cmd.Dir = work
+		cmd.Env = append(gitEnv(t.TempDir()), "GIT_AUTHOR_DATE="+date, "GIT_COMMITTER_DATE="+date)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git commit: %v: %s", err, out)
+		}
+	}
+	dir := t.TempDir()
+	runGit(t, dir, "clone", "-q", "--bare", work, "repo.git")
+	return dir
+}
+
+func TestShallowSinceClone(t *testing.T) {
+	dir := newDatedRepo(t, "2020-01-01T00:00:00Z", "2021-01-01T00:00:00Z", "2022-01-01T00:00:00Z", "2023-01-01T00:00:00Z")
+	srv := newTestServer(t, dir)
+
+	out := cloneV2(t, srv.URL+"/repo.git", "--shallow-since=2021-06-01")
+	if n := commitCount(t, out, "HEAD"); n != "2" {
+		t.Errorf("clone since 2021-06-01 has %s commits, want 2", n)
+	}
+	runGit(t, out, "fsck", "--no-progress")
+
+	v0 := filepath.Join(t.TempDir(), "v0")
+	runGit(t, t.TempDir(), "-c", "protocol.version=0", "clone", "-q", "--shallow-since=2020-06-01", srv.URL+"/repo.git", v0)
+	if n := commitCount(t, v0, "HEAD"); n != "3" {
+		t.Errorf("protocol v0 clone since 2020-06-01 has %s commits, want 3", n)
+	}
+	runGit(t, v0, "fsck", "--no-progress")
+}
+
+func TestEmptyRepoClone(t *testing.T) {
+	requireGit(t)
+	dir := t.TempDir()
+	runGit(t, dir, "init", "-q", "--bare", "empty.git")
+	srv := newTestServer(t, dir)
+
+	for _, version := range []string{"0", "2"} {
+		out := filepath.Join(t.TempDir(), "out")
+		cmd := exec.Command("git", "-c", "protocol.version="+version, "clone", srv.URL+"/empty.git", out)
+		cmd.Env = gitEnv(t.TempDir())
+		b, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Errorf("protocol v%s clone of an empty repository: %v: %s", version, err, b)
+			continue
+		}
+		if !strings.Contains(string(b), "You appear to have cloned an empty repository") {
+			t.Errorf("protocol v%s clone of an empty repository printed %q, want the empty repository warning", version, b)
+		}
+		if refs, _ := tryGit(t, out, "show-ref"); refs != "" {
+			t.Errorf("protocol v%s clone of an empty repository has refs %q", version, refs)
+		}
+	}
+}
+
+// TestIncludeTag tags a commit behind main, the tag comes along
+// with main without being wanted.
+func TestIncludeTag(t *testing.T) {
+	dir := newTestRepo(t, 3)
+	gitDir := filepath.Join(dir, "repo.git")
+	runGit(t, gitDir, "tag", "-a", "-m", "v1", "v1", "main~1")
+	main := strings.TrimSpace(runGit(t, gitDir, "rev-parse", "main"))
+	srv := newTestServer(t, dir)
+
+	var b bytes.Buffer
+	e := pktline.NewEncoder(&b)
+	e.Encodef("want %s ofs-delta include-tag\n", main)
+	e.Flush()
+	e.Encodef("done\n")
+	_, withTag := postUploadPack(t, srv.URL+"/repo.git", "", &b)
+	_, withoutTag := postUploadPack(t, srv.URL+"/repo.git", "", uploadPackRequest([]string{main}, nil))
+	if with, without := packObjects(t, withTag), packObjects(t, withoutTag); with != without+1 {
+		t.Errorf("pack has %d objects with include-tag, %d without, want the tag more", with, without)
+	}
+
+	for _, version := range []string{"0", "2"} {
+		out := filepath.Join(t.TempDir(), "out")
+		runGit(t, t.TempDir(), "-c", "protocol.version="+version, "clone", "-q", "--single-branch", srv.URL+"/repo.git", out)
+		if typ, err := tryGit(t, out, "cat-file", "-t", "v1"); err != nil || strings.TrimSpace(typ) != "tag" {
+			t.Errorf("protocol v%s single branch clone: v1 is %q, %v, want the annotated tag", version, typ, err)
+		}
+	}
+}
+
+// TestOFSDelta fetches a file changing a line a commit, with and without ofs-delta.
+// Both packs delta the versions, offset deltas only if the client asked for them,
+// which are smaller than naming the base.
+func TestOFSDelta(t *testing.T) {
+	requireGit(t)
+	work := t.TempDir()
+	runGit(t, work, "init", "-q", "-b", "main")
+	lines := make([]string, 1000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d of a file that changes a line each commit", i)
+	}
+	for i := 0; i < 20; i++ {
+		lines[i*50] = fmt.Sprintf("changed in commit %d", i)
+		writeTestFile(t, filepath.Join(work, "file.txt"), strings.Join(lines, "\n"))
+		runGit(t, work, "add", "-A")
+		runGit(t, work, "commit", "-q", "-m", fmt.Sprintf("commit %d", i))
+	}
+	dir := t.TempDir()
+	runGit(t, dir, "clone", "-q", "--bare", work, "repo.git")
+	main := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main"))
+	srv := newTestServer(t, dir)
+
+	// deltaTypes returns the pack in body and its number of each type of delta.
+	deltaTypes := func(body string) (string, map[plumbing.ObjectType]int) {
+		t.Helper()
+		pack := body[strings.Index(body, "PACK"):]
+		sc := packfile.NewScanner(strings.NewReader(pack))
+		_, n, err := sc.Header()
+		if err != nil {
+			t.Fatal(err)
+		}
+		types := make(map[plumbing.ObjectType]int)
+		for i := uint32(0); i < n; i++ {
+			h, err := sc.NextObjectHeader()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Type.IsDelta() {
+				types[h.Type]++
+			}
+			if _, _, err := sc.NextObject(io.Discard); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return pack, types
+	}
+
+	_, body := postUploadPack(t, srv.URL+"/repo.git", "", uploadPackRequest([]string{main}, nil))
+	ofs, ofsTypes := deltaTypes(body)
+	var b bytes.Buffer
+	e := pktline.NewEncoder(&b)
+	e.Encodef("want %s\n", main)
+	e.Flush()
+	e.Encodef("done\n")
+	_, body = postUploadPack(t, srv.URL+"/repo.git", "", &b)
+	ref, refTypes := deltaTypes(body)
+
+	if ofsTypes[plumbing.OFSDeltaObject] == 0 || ofsTypes[plumbing.REFDeltaObject] != 0 {
+		t.Errorf("pack with ofs-delta has deltas %v, want only offset deltas", ofsTypes)
+	}
+	if refTypes[plumbing.REFDeltaObject] == 0 || refTypes[plumbing.OFSDeltaObject] != 0 {
+		t.Errorf("pack without ofs-delta has deltas %v, want only ref deltas", refTypes)
+	}
+	if len(ofs) >= len(ref) {
+		t.Errorf("pack is %d bytes with ofs-delta, %d without, want it smaller", len(ofs), len(ref))
+	}
+}
+
+func TestAllowAnySHA1InWant(t *testing.T) {
+	dir := newTestRepo(t, 3)
+	old := strings.TrimSpace(runGit(t, filepath.Join(dir, "repo.git"), "rev-parse", "main~1"))
+	tests := []struct {
+		name    string
+		opts    []Option
+		version string
+		ok      bool
+	}{
+		{"v0", nil, "0", false},
+		{"v0 allowed", []Option{WithAllowAnySHA1InWant(true)}, "0", true},
+		{"v2", nil, "2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, dir, tt.opts...)
+			work := t.TempDir()
+			runGit(t, work, "init", "-q")
+			_, err := tryGit(t, work, "-c", "protocol.version="+tt.version, "fetch", "-q", srv.URL+"/repo.git", old)
+			if (err == nil) != tt.ok {
+				t.Fatalf("fetch of a non-tip commit: %v, want success %v", err, tt.ok)
+			}
+			if err == nil {
+				if got := strings.TrimSpace(runGit(t, work, "rev-parse", "FETCH_HEAD")); got != old {
+					t.Errorf("fetched %s, want %s", got, old)
+				}
+			}
+			if tt.version == "0" {
+				want := http.StatusBadRequest
+				if tt.ok {
+					want = http.StatusOK
+				}
+				// git doesn't ask for objects the server didn't say it allows
+				if code, _ := postUploadPack(t, srv.URL+"/repo.git", "", uploadPackRequest([]string{old}, nil)); code != want {
+					t.Errorf("want of a non-tip commit: status %d, want %d", code, want)
+				}
+			}
+		})
+	}
+}